@@ -0,0 +1,330 @@
+package lodm
+
+import (
+	"errors"
+	"math"
+
+	"github.com/flywave/go3d/vec3"
+)
+
+type AttributeError struct {
+	Max float64
+	RMS float64
+
+	sum   float64
+	count int
+}
+
+func (e *AttributeError) add(v float64) {
+	if v > e.Max {
+		e.Max = v
+	}
+	e.sum += v * v
+	e.count++
+}
+
+func (e *AttributeError) finish() {
+	if e.count > 0 {
+		e.RMS = math.Sqrt(e.sum / float64(e.count))
+	}
+}
+
+type CompressionReport struct {
+	Codec            FlagType
+	Setting          CompressSetting
+	Nodes            int
+	RawSize          int64
+	CompressedSize   int64
+	Ratio            float64
+	Position         AttributeError
+	RelativePosition AttributeError
+	Normal           AttributeError
+	Color            AttributeError
+	Texcoord         AttributeError
+}
+
+type QualityTarget struct {
+	Position         float64
+	RelativePosition float64
+	Normal           float64
+	Color            float64
+	Texcoord         float64
+}
+
+type vertexGrid struct {
+	cell  float32
+	min   vec3.T
+	size  [3]int32
+	cells map[[3]int32][]int
+}
+
+func newVertexGrid(verts []vec3.T) *vertexGrid {
+	g := &vertexGrid{cells: make(map[[3]int32][]int)}
+	if len(verts) == 0 {
+		return g
+	}
+	min, max := verts[0], verts[0]
+	for i := range verts {
+		min = vec3.Min(&min, &verts[i])
+		max = vec3.Max(&max, &verts[i])
+	}
+	diag := vec3.Sub(&max, &min)
+	g.min = min
+	g.cell = diag.Length() / float32(math.Cbrt(float64(len(verts))))
+	if g.cell <= 0 {
+		g.cell = 1
+	}
+	for i := range verts {
+		k := g.key(&verts[i])
+		g.cells[k] = append(g.cells[k], i)
+		for j := 0; j < 3; j++ {
+			if k[j]+1 > g.size[j] {
+				g.size[j] = k[j] + 1
+			}
+		}
+	}
+	return g
+}
+
+func (g *vertexGrid) key(v *vec3.T) [3]int32 {
+	var k [3]int32
+	for j := 0; j < 3; j++ {
+		k[j] = int32(math.Floor(float64((v[j] - g.min[j]) / g.cell)))
+	}
+	return k
+}
+
+func (g *vertexGrid) nearest(verts []vec3.T, p *vec3.T, cost func(i int) float64) int {
+	c := g.key(p)
+	best, best_dist := -1, float32(math.Inf(1))
+	var candidates []int
+	var limit int32
+	for j := 0; j < 3; j++ {
+		if l := g.size[j] + absInt32(c[j]); l > limit {
+			limit = l
+		}
+	}
+	for r := int32(0); r <= limit; r++ {
+		for dx := -r; dx <= r; dx++ {
+			for dy := -r; dy <= r; dy++ {
+				for dz := -r; dz <= r; dz++ {
+					if dx != -r && dx != r && dy != -r && dy != r && dz != -r && dz != r {
+						continue
+					}
+					for _, i := range g.cells[[3]int32{c[0] + dx, c[1] + dy, c[2] + dz}] {
+						d := vec3.Distance(p, &verts[i])
+						if d < best_dist {
+							best, best_dist = i, d
+						}
+						candidates = append(candidates, i)
+					}
+				}
+			}
+		}
+		if best >= 0 && best_dist <= float32(r)*g.cell {
+			break
+		}
+	}
+	if best < 0 {
+		return best
+	}
+	eps := best_dist*1e-4 + g.cell*1e-6
+	best_cost := math.Inf(1)
+	for _, i := range candidates {
+		if vec3.Distance(p, &verts[i]) > best_dist+eps {
+			continue
+		}
+		if c := cost(i); c < best_cost {
+			best, best_cost = i, c
+		}
+	}
+	return best
+}
+
+func normalAngle(a, b [3]int16) float64 {
+	u := vec3.T{float32(a[0]), float32(a[1]), float32(a[2])}
+	v := vec3.T{float32(b[0]), float32(b[1]), float32(b[2])}
+	lu, lv := u.Length(), v.Length()
+	if lu == 0 || lv == 0 {
+		if lu == lv {
+			return 0
+		}
+		return 180
+	}
+	d := float64(vec3.Dot(&u, &v) / (lu * lv))
+	return math.Acos(math.Max(-1, math.Min(1, d))) * 180 / math.Pi
+}
+
+func (r *CompressionReport) compare(sig *Signature, node *Node, src, dst *NodeMesh) {
+	normals := sig.Vertex.HasNormals() && src.HasNormal() && dst.HasNormal()
+	colors := sig.Vertex.HasColors() && src.HasColor() && dst.HasColor()
+	texcoords := sig.Vertex.HasTextures() && src.HasTexcoord() && dst.HasTexcoord()
+	grid := newVertexGrid(dst.Verts)
+	for i := range src.Verts {
+		j := grid.nearest(dst.Verts, &src.Verts[i], func(j int) float64 {
+			var c float64
+			if texcoords {
+				d := vec2Distance(src.Texcoords[i], dst.Texcoords[j])
+				c += d * d
+			}
+			if normals {
+				c += normalAngle(src.Normals[i], dst.Normals[j])
+			}
+			if colors {
+				for k := 0; k < 4; k++ {
+					c += math.Abs(float64(src.Colors[i][k]) - float64(dst.Colors[j][k]))
+				}
+			}
+			return c
+		})
+		if j < 0 {
+			continue
+		}
+		d := float64(vec3.Distance(&src.Verts[i], &dst.Verts[j]))
+		r.Position.add(d)
+		if node.Error > 0 {
+			r.RelativePosition.add(d / float64(node.Error))
+		}
+		if normals {
+			r.Normal.add(normalAngle(src.Normals[i], dst.Normals[j]))
+		}
+		if colors {
+			for k := 0; k < 4; k++ {
+				r.Color.add(math.Abs(float64(src.Colors[i][k]) - float64(dst.Colors[j][k])))
+			}
+		}
+		if texcoords {
+			r.Texcoord.add(vec2Distance(src.Texcoords[i], dst.Texcoords[j]))
+		}
+	}
+}
+
+func vec2Distance(a, b [2]float32) float64 {
+	return math.Hypot(float64(a[0]-b[0]), float64(a[1]-b[1]))
+}
+
+func (a *Archive) sampleNodes(samples int) ([]uint32, error) {
+	count := a.sinkNode()
+	if samples <= 0 || samples > int(count) {
+		samples = int(count)
+	}
+	var nodes []uint32
+	for s := 0; s < samples; s++ {
+		n := uint32(s * int(count) / samples)
+		if err := a.LoadNode(n); err != nil {
+			return nil, err
+		}
+		if !a.NodeMeshs[n].Empty() {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("archive has no nodes to analyze")
+	}
+	return nodes, nil
+}
+
+func (a *Archive) analyzeNodes(nodes []uint32, codec FlagType, setting *CompressSetting) (*CompressionReport, error) {
+	c := LookupNodeCodec(codec)
+	r := &CompressionReport{Codec: codec, Setting: *setting, Nodes: len(nodes)}
+	resolved := *setting
+	resolved.CoordQ = coordQ(setting, a.Header.Sphere.Radius())
+	setting = &resolved
+	for _, n := range nodes {
+		mesh := &a.NodeMeshs[n]
+		node := a.Nodes[n]
+		raw, err := rawCodec.Encode(a.Header, &node, mesh, nil, setting)
+		if err != nil {
+			return nil, err
+		}
+		node = a.Nodes[n]
+		first_patch, last_patch := a.getNodePatchRange(n)
+		data, err := c.Encode(a.Header, &node, mesh, a.Patchs[first_patch:last_patch], setting)
+		if err != nil {
+			return nil, err
+		}
+		node = a.Nodes[n]
+		var decoded NodeMesh
+		if err := c.Decode(data, a.Header, &node, &decoded); err != nil {
+			return nil, err
+		}
+		r.RawSize += int64(len(raw))
+		r.CompressedSize += int64(len(data))
+		r.compare(&a.Header.Sign, &a.Nodes[n], mesh, &decoded)
+	}
+	for _, e := range []*AttributeError{&r.Position, &r.RelativePosition, &r.Normal, &r.Color, &r.Texcoord} {
+		e.finish()
+	}
+	if r.CompressedSize > 0 {
+		r.Ratio = float64(r.RawSize) / float64(r.CompressedSize)
+	}
+	return r, nil
+}
+
+func (a *Archive) AnalyzeCompression(codec FlagType, setting *CompressSetting, samples int) (*CompressionReport, error) {
+	if codec == 0 || !isNodeCodecFlag(codec) {
+		return nil, errors.New("codec not registered")
+	}
+	if setting == nil {
+		setting = &DEFAULE_COMPRESS_SETTING
+	}
+	nodes, err := a.sampleNodes(samples)
+	if err != nil {
+		return nil, err
+	}
+	return a.analyzeNodes(nodes, codec, setting)
+}
+
+func (t *QualityTarget) positionMet(r *CompressionReport) bool {
+	return (t.Position <= 0 || r.Position.Max <= t.Position) && (t.RelativePosition <= 0 || r.RelativePosition.Max <= t.RelativePosition)
+}
+
+func (a *Archive) OptimizeCompressSetting(codec FlagType, target QualityTarget, samples int) (*CompressSetting, *CompressionReport, error) {
+	if codec == 0 || !isNodeCodecFlag(codec) {
+		return nil, nil, errors.New("codec not registered")
+	}
+	nodes, err := a.sampleNodes(samples)
+	if err != nil {
+		return nil, nil, err
+	}
+	best := CompressSetting{CoordBits: 24, NormalBits: 16, ColorBits: [4]int{8, 8, 8, 8}, TexStep: DEFAULE_COMPRESS_SETTING.TexStep, UvBits: 24, DeflateLevel: DEFAULE_COMPRESS_SETTING.DeflateLevel}
+	sig := &a.Header.Sign
+	searches := []struct {
+		used  bool
+		min   int
+		max   int
+		apply func(s *CompressSetting, bits int)
+		met   func(r *CompressionReport) bool
+	}{
+		{true, 4, 24, func(s *CompressSetting, bits int) { s.CoordBits = bits }, target.positionMet},
+		{sig.Vertex.HasNormals() && target.Normal > 0, 4, 16, func(s *CompressSetting, bits int) { s.NormalBits = bits }, func(r *CompressionReport) bool { return r.Normal.Max <= target.Normal }},
+		{sig.Vertex.HasColors() && target.Color > 0, 1, 8, func(s *CompressSetting, bits int) { s.ColorBits = [4]int{bits, bits, bits, bits} }, func(r *CompressionReport) bool { return r.Color.Max <= target.Color }},
+		{sig.Vertex.HasTextures() && target.Texcoord > 0, 4, 24, func(s *CompressSetting, bits int) { s.UvBits = bits }, func(r *CompressionReport) bool { return r.Texcoord.Max <= target.Texcoord }},
+	}
+	for _, s := range searches {
+		if !s.used {
+			continue
+		}
+		found := false
+		for bits := s.min; bits <= s.max; bits++ {
+			trial := best
+			s.apply(&trial, bits)
+			r, err := a.analyzeNodes(nodes, codec, &trial)
+			if err != nil {
+				return nil, nil, err
+			}
+			if s.met(r) {
+				best, found = trial, true
+				break
+			}
+		}
+		if !found {
+			return nil, nil, errors.New("quality target not reachable")
+		}
+	}
+	r, err := a.analyzeNodes(nodes, codec, &best)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &best, r, nil
+}
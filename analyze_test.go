@@ -0,0 +1,64 @@
+package lodm
+
+import (
+	"testing"
+)
+
+func newAnalyzeTestArchive() *Archive {
+	sign, mesh := newMeshoptTestMesh()
+	a := newTestArchive()
+	a.Header.Sign = sign
+	a.NodeMeshs[0] = mesh
+	a.NodeMeshs[1] = mesh
+	a.Header.Sphere = pointsSphere(mesh.Verts)
+	return a
+}
+
+func TestAnalyzeCompression(t *testing.T) {
+	a := newAnalyzeTestArchive()
+
+	r, err := a.AnalyzeCompression(MESHOPT, &CompressSetting{}, 0)
+	if err != nil || r.Nodes != 2 || r.Position.Max != 0 || r.Color.Max != 0 || r.Texcoord.Max != 0 || r.Ratio <= 0 {
+		t.FailNow()
+	}
+
+	setting := DEFAULE_COMPRESS_SETTING
+	r, err = a.AnalyzeCompression(MESHOPT, &setting, 1)
+	if err != nil || r.Nodes != 1 || r.Position.Max == 0 || r.Position.Max > 100/float64(int(1)<<14-1) || r.Position.RMS > r.Position.Max {
+		t.FailNow()
+	}
+	if r.RelativePosition.Max != r.Position.Max || r.Color.Max == 0 || r.Normal.Max == 0 || r.Ratio <= 1 {
+		t.FailNow()
+	}
+
+	r, err = a.AnalyzeCompression(DRACO, &setting, 0)
+	if err != nil || r.Position.Max > 0.1 || r.Texcoord.Max > 0.01 {
+		t.FailNow()
+	}
+
+	if _, err := a.AnalyzeCompression(PTJPG, &setting, 0); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestOptimizeCompressSetting(t *testing.T) {
+	a := newAnalyzeTestArchive()
+
+	target := QualityTarget{Position: 0.05, Normal: 1, Color: 10, Texcoord: 0.001}
+	s, r, err := a.OptimizeCompressSetting(MESHOPT, target, 0)
+	if err != nil || r.Position.Max > target.Position || r.Normal.Max > target.Normal || r.Color.Max > target.Color || r.Texcoord.Max > target.Texcoord {
+		t.FailNow()
+	}
+	if s.CoordBits >= 24 || s.ColorBits[0] >= 8 || s.UvBits >= 24 || s.NormalBits >= 16 {
+		t.FailNow()
+	}
+	looser := *s
+	looser.CoordBits--
+	if r, _ := a.AnalyzeCompression(MESHOPT, &looser, 0); r.Position.Max <= target.Position {
+		t.FailNow()
+	}
+
+	if _, _, err := a.OptimizeCompressSetting(CORTO, QualityTarget{RelativePosition: 1e-9}, 0); err == nil {
+		t.FailNow()
+	}
+}
@@ -1,14 +1,15 @@
 package lodm
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"math"
 	"os"
-	"path"
+	"runtime"
+
+	dvec3 "github.com/flywave/go3d/float64/vec3"
+	"github.com/flywave/go3d/vec3"
 )
 
 const (
@@ -19,22 +20,28 @@ const (
 var byteorder = binary.LittleEndian
 
 type Archive struct {
-	Header        Header
-	Nodes         []Node
-	InstanceNodes []Node
-	Instances     []Instance
-	Patchs        []Patch
-	Textures      []Texture
-	Materials     []Material
-	Features      []Feature
-	NodeMeshs     []NodeMesh
-	InstanceMeshs []NodeMesh
-	TextureImages []TextureImage
-	FeatureDatas  []FeatureData
-
-	reader  io.ReadSeekCloser
-	nroots  uint32
-	setting *CompressSetting
+	Header         Header
+	Nodes          []Node
+	InstanceNodes  []Node
+	Instances      []Instance
+	Patchs         []Patch
+	Textures       []Texture
+	Materials      []Material
+	Features       []Feature
+	NodeMeshs      []NodeMesh
+	InstanceMeshs  []NodeMesh
+	TextureImages  []TextureImage
+	FeatureDatas   []FeatureData
+	HorizonPoints  []dvec3.T
+	NodeCodecs     []FlagType
+	InstanceCodecs []FlagType
+
+	reader     io.ReadSeekCloser
+	nroots     uint32
+	setting    *CompressSetting
+	autoCodecs []FlagType
+	autoTarget QualityTarget
+	workers    int
 }
 
 func NewArchive(h Header, setting *CompressSetting) *Archive {
@@ -43,12 +50,58 @@ func NewArchive(h Header, setting *CompressSetting) *Archive {
 	return a
 }
 
+func newDAGArchive(sign Signature, nodes []Node, patchs []Patch, meshes []NodeMesh, setting *CompressSetting) *Archive {
+	h := NewHeader(sign)
+	h.NNodes = uint32(len(nodes) + 1)
+	h.NPatches = uint32(len(patchs))
+
+	var all []vec3.T
+	for i := range meshes {
+		h.NVert += uint64(len(meshes[i].Verts))
+		h.NFace += uint64(len(meshes[i].Faces))
+		all = append(all, meshes[i].Verts...)
+	}
+	h.Sphere = pointsSphere(all)
+
+	a := NewArchive(*h, setting)
+	a.initIndex()
+	copy(a.Nodes, nodes)
+	copy(a.Patchs, patchs)
+	copy(a.NodeMeshs, meshes)
+	for i := range meshes {
+		a.Nodes[i].NVert = uint16(len(meshes[i].Verts))
+		a.Nodes[i].NFace = uint16(len(meshes[i].Faces))
+	}
+	a.Nodes[len(nodes)] = Node{FirstPatch: uint32(len(patchs))}
+	a.countRoots()
+	return a
+}
+
+func newFlatArchive(sign Signature, meshes []NodeMesh, patchs []Patch, setting *CompressSetting) *Archive {
+	sink := uint32(len(meshes))
+	nodes := make([]Node, len(meshes))
+	flat := make([]Patch, len(meshes))
+	for i := range meshes {
+		mesh := &meshes[i]
+		sphere := pointsSphere(mesh.Verts)
+		nodes[i] = Node{Sphere: sphere, TightRadius: sphere.Radius(), FirstPatch: uint32(i)}
+		flat[i] = patchs[i]
+		flat[i].Node = sink
+		if mesh.HasFace() {
+			flat[i].FaceOffset = uint32(len(mesh.Faces))
+		} else {
+			flat[i].FaceOffset = uint32(len(mesh.Verts))
+		}
+	}
+	return newDAGArchive(sign, nodes, flat, meshes, setting)
+}
+
 func (a *Archive) headerSize() int {
 	return HeaderSize
 }
 
 func (a *Archive) indexSize() int {
-	return int(a.Header.NNodes)*binary.Size(Node{}) + int(a.Header.NInstanceNodes)*binary.Size(Node{}) + int(a.Header.NInstances)*binary.Size(Instance{}) + int(a.Header.NPatches)*binary.Size(Patch{}) + int(a.Header.NTextures)*binary.Size(Texture{}) + int(a.Header.NMaterials)*binary.Size(Material{}) + int(a.Header.NFeatures)*binary.Size(Feature{})
+	return int(a.Header.NNodes)*binary.Size(Node{}) + int(a.Header.NInstanceNodes)*binary.Size(Node{}) + int(a.Header.NInstances)*binary.Size(Instance{}) + int(a.Header.NPatches)*binary.Size(Patch{}) + int(a.Header.NTextures)*binary.Size(Texture{}) + int(a.Header.NMaterials)*binary.Size(Material{}) + int(a.Header.NFeatures)*binary.Size(Feature{}) + len(a.HorizonPoints)*binary.Size(dvec3.T{}) + (len(a.NodeCodecs)+len(a.InstanceCodecs))*binary.Size(FlagType(0))
 }
 
 func (a *Archive) initIndex() {
@@ -59,6 +112,17 @@ func (a *Archive) initIndex() {
 	a.Textures = make([]Texture, a.Header.NTextures)
 	a.Materials = make([]Material, a.Header.NMaterials)
 	a.Features = make([]Feature, a.Header.NFeatures)
+	a.NodeMeshs = make([]NodeMesh, a.Header.NNodes)
+	a.InstanceMeshs = make([]NodeMesh, a.Header.NInstanceNodes)
+	a.TextureImages = make([]TextureImage, a.Header.NTextures)
+	a.FeatureDatas = make([]FeatureData, a.Header.NFeatures)
+	if a.Header.Sign.HasHorizonPoints() {
+		a.HorizonPoints = make([]dvec3.T, a.Header.NNodes)
+	}
+	if a.Header.Sign.HasNodeCodecs() {
+		a.NodeCodecs = make([]FlagType, a.Header.NNodes)
+		a.InstanceCodecs = make([]FlagType, a.Header.NInstanceNodes)
+	}
 }
 
 func (a *Archive) countRoots() {
@@ -122,6 +186,22 @@ func (a *Archive) loadIndex() error {
 			return err
 		}
 	}
+	if len(a.HorizonPoints) > 0 {
+		err = binary.Read(a.reader, byteorder, a.HorizonPoints)
+		if err != nil {
+			return err
+		}
+	}
+	if a.Header.Sign.HasNodeCodecs() {
+		err = binary.Read(a.reader, byteorder, a.NodeCodecs)
+		if err != nil {
+			return err
+		}
+		err = binary.Read(a.reader, byteorder, a.InstanceCodecs)
+		if err != nil {
+			return err
+		}
+	}
 	a.countRoots()
 	return nil
 }
@@ -129,13 +209,13 @@ func (a *Archive) loadIndex() error {
 func (a *Archive) getNodePatchRange(n uint32) (uint32, uint32) {
 	node := &a.Nodes[n]
 	nextnode := &a.Nodes[n+1]
-	return node.FirstPatch, nextnode.FirstPatch - 1
+	return node.FirstPatch, nextnode.FirstPatch
 }
 
 func (a *Archive) getNodeMeshRange(n uint32) (int64, int64) {
 	node := &a.Nodes[n]
 	nextnode := &a.Nodes[n+1]
-	return node.address(), node.address() - nextnode.address()
+	return node.address(), nextnode.address() - node.address()
 }
 
 func (a *Archive) readNode(n uint32) ([]byte, error) {
@@ -148,7 +228,7 @@ func (a *Archive) readNode(n uint32) ([]byte, error) {
 		return nil, err
 	}
 	ret := make([]byte, size)
-	_, err = a.reader.Read(ret)
+	_, err = io.ReadFull(a.reader, ret)
 	if err != nil {
 		return nil, err
 	}
@@ -156,41 +236,28 @@ func (a *Archive) readNode(n uint32) ([]byte, error) {
 }
 
 func (a *Archive) setNode(n uint32, buf []byte) error {
-	sign := &a.Header.Sign
 	node := &a.Nodes[n]
 	nextnode := &a.Nodes[n+1]
 
 	offset := node.address()
 
-	d := a.NodeMeshs[n]
+	d := &a.NodeMeshs[n]
 
 	compressedSize := nextnode.address() - offset
 
-	if !sign.IsCompressed() {
-		reader := bytes.NewBuffer(buf)
-		err := d.Read(reader, node, &a.Header)
-		if err != nil {
-			return err
-		}
-	} else {
-		err := decompressNodeMesh(buf[:compressedSize], a.Header, node, &d)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return a.decoderAt(a.NodeCodecs, n).Decode(buf[:compressedSize], a.Header, node, d)
 }
 
 func (a *Archive) getInstanceNodePatchRange(n uint32) (uint32, uint32) {
 	node := &a.InstanceNodes[n]
 	nextnode := &a.InstanceNodes[n+1]
-	return node.FirstPatch, nextnode.FirstPatch - 1
+	return node.FirstPatch, nextnode.FirstPatch
 }
 
 func (a *Archive) getInstanceNodeMeshRange(n uint32) (int64, int64) {
 	node := &a.InstanceNodes[n]
 	nextnode := &a.InstanceNodes[n+1]
-	return node.address(), node.address() - nextnode.address()
+	return node.address(), nextnode.address() - node.address()
 }
 
 func (a *Archive) readInstanceNode(n uint32) ([]byte, error) {
@@ -203,7 +270,7 @@ func (a *Archive) readInstanceNode(n uint32) ([]byte, error) {
 		return nil, err
 	}
 	ret := make([]byte, size)
-	_, err = a.reader.Read(ret)
+	_, err = io.ReadFull(a.reader, ret)
 	if err != nil {
 		return nil, err
 	}
@@ -211,41 +278,28 @@ func (a *Archive) readInstanceNode(n uint32) ([]byte, error) {
 }
 
 func (a *Archive) setInstanceNode(n uint32, buf []byte) error {
-	sign := &a.Header.Sign
 	node := &a.InstanceNodes[n]
 	nextnode := &a.InstanceNodes[n+1]
 
 	offset := node.address()
 
-	d := a.NodeMeshs[n]
+	d := &a.InstanceMeshs[n]
 
 	compressedSize := nextnode.address() - offset
 
-	if !sign.IsCompressed() {
-		reader := bytes.NewBuffer(buf)
-		err := d.Read(reader, node, &a.Header)
-		if err != nil {
-			return err
-		}
-	} else {
-		err := decompressNodeMesh(buf[:compressedSize], a.Header, node, &d)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return a.decoderAt(a.InstanceCodecs, n).Decode(buf[:compressedSize], a.Header, node, d)
 }
 
 func (a *Archive) getPatchTextureRange(p uint32) (int64, int64) {
 	t := a.Patchs[p].TexID
 	tex := &a.Textures[t]
 	nexttex := &a.Textures[t+1]
-	return tex.address(), tex.address() - nexttex.address()
+	return tex.address(), nexttex.address() - tex.address()
 }
 
 func (a *Archive) readPatchTexture(p uint32) ([]byte, error) {
-	if p >= uint32(len(a.Patchs)-1) {
-		return nil, errors.New("patch index error")
+	if a.Patchs[p].TexID >= uint32(len(a.Textures)-1) {
+		return nil, errors.New("texture index error")
 	}
 	offset, size := a.getPatchTextureRange(p)
 	_, err := a.reader.Seek(offset, os.SEEK_SET)
@@ -253,7 +307,7 @@ func (a *Archive) readPatchTexture(p uint32) ([]byte, error) {
 		return nil, err
 	}
 	ret := make([]byte, size)
-	_, err = a.reader.Read(ret)
+	_, err = io.ReadFull(a.reader, ret)
 	if err != nil {
 		return nil, err
 	}
@@ -276,7 +330,7 @@ func (a *Archive) setPatchTexture(p uint32, buf []byte) error {
 func (a *Archive) getFeatureRange(f uint32) (int64, int64) {
 	feat := &a.Features[f]
 	nextfeat := &a.Features[f+1]
-	return feat.address(), feat.address() - nextfeat.address()
+	return feat.address(), nextfeat.address() - feat.address()
 }
 
 func (a *Archive) readFeature(f uint32) ([]byte, error) {
@@ -289,11 +343,11 @@ func (a *Archive) readFeature(f uint32) ([]byte, error) {
 		return nil, err
 	}
 	ret := make([]byte, size)
-	_, err = a.reader.Read(ret)
+	_, err = io.ReadFull(a.reader, ret)
 	if err != nil {
 		return nil, err
 	}
-	return ret, nil
+	return trimFeatureData(ret), nil
 }
 
 func (a *Archive) setFeature(f uint32, buf []byte) error {
@@ -301,79 +355,138 @@ func (a *Archive) setFeature(f uint32, buf []byte) error {
 	return nil
 }
 
-func (a *Archive) saveInstanceNodes(writer io.Writer, offset *int64) error {
-	for n := 0; n < len(a.InstanceNodes); n++ {
-		var nodeData NodeData
-		if a.Header.Sign.IsCompressed() && a.setting != nil {
-			nodeData = CompressNode(a.Header, &a.InstanceNodes[n], &a.InstanceMeshs[n], a.Patchs, a.setting)
-		} else {
-			buf := &bytes.Buffer{}
-			a.InstanceMeshs[n].Write(buf, &a.InstanceNodes[n], &a.Header)
-			nodeData = buf.Bytes()
-			padding := calcPadding(uint32(len(nodeData)), LM_PADDING)
-			if padding != 0 {
-				for i := 0; i < int(padding); i++ {
-					nodeData = append(nodeData, byte(0))
-				}
+func (a *Archive) nodeCodec() NodeCodec {
+	if a.setting == nil {
+		return rawCodec
+	}
+	return a.Header.Sign.NodeCodec()
+}
+
+func (a *Archive) SetSaveWorkers(workers int) {
+	a.workers = workers
+}
+
+func (a *Archive) saveWorkers() int {
+	if a.workers > 0 {
+		return a.workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+func encodeOrdered(count, workers int, encode func(i int) ([]byte, error), write func(i int, data []byte) error) error {
+	if workers > count {
+		workers = count
+	}
+	if workers <= 1 {
+		for i := 0; i < count; i++ {
+			data, err := encode(i)
+			if err != nil {
+				return err
+			}
+			if err := write(i, data); err != nil {
+				return err
 			}
 		}
-		n, err := writer.Write(nodeData)
-		if err != nil {
+		return nil
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan result, count)
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	jobs := make(chan int)
+	window := make(chan struct{}, workers*2)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(jobs)
+		for i := 0; i < count; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				data, err := encode(i)
+				results[i] <- result{data, err}
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		r := <-results[i]
+		<-window
+		if r.err != nil {
+			return r.err
+		}
+		if err := write(i, r.data); err != nil {
 			return err
 		}
-		a.InstanceNodes[n].Offset = uint32(*offset) / LM_PADDING
-		*offset += int64(n)
 	}
 	return nil
 }
 
-func (a *Archive) saveNodes(writer io.Writer, offset *int64) error {
-	for n := 0; n < len(a.Nodes); n++ {
-		var nodeData NodeData
-		if a.Header.Sign.IsCompressed() && a.setting != nil {
-			nodeData = CompressNode(a.Header, &a.Nodes[n], &a.NodeMeshs[n], a.Patchs, a.setting)
-		} else {
-			buf := &bytes.Buffer{}
-			a.NodeMeshs[n].Write(buf, &a.Nodes[n], &a.Header)
-			nodeData = buf.Bytes()
-			padding := calcPadding(uint32(len(nodeData)), LM_PADDING)
-			if padding != 0 {
-				for i := 0; i < int(padding); i++ {
-					nodeData = append(nodeData, byte(0))
-				}
-			}
+func (a *Archive) saveInstanceNodes(writer io.Writer, offset *int64) error {
+	return encodeOrdered(len(a.InstanceNodes), a.saveWorkers(), func(n int) ([]byte, error) {
+		return a.encodeNode(a.InstanceCodecs, a.InstanceNodes, n, &a.InstanceMeshs[n])
+	}, func(n int, nodeData []byte) error {
+		size, err := writer.Write(nodeData)
+		if err != nil {
+			return err
 		}
-		n, err := writer.Write(nodeData)
+		a.InstanceNodes[n].Offset = uint32(*offset) / LM_PADDING
+		*offset += int64(size)
+		return nil
+	})
+}
+
+func (a *Archive) saveNodes(writer io.Writer, offset *int64) error {
+	return encodeOrdered(len(a.Nodes), a.saveWorkers(), func(n int) ([]byte, error) {
+		return a.encodeNode(a.NodeCodecs, a.Nodes, n, &a.NodeMeshs[n])
+	}, func(n int, nodeData []byte) error {
+		size, err := writer.Write(nodeData)
 		if err != nil {
 			return err
 		}
 		a.Nodes[n].Offset = uint32(*offset) / LM_PADDING
-		*offset += int64(n)
-	}
-	return nil
+		*offset += int64(size)
+		return nil
+	})
 }
 
 func (a *Archive) saveTextures(writer io.Writer, offset *int64) error {
-	for i := 0; i < len(a.Textures); i++ {
-		texData := compressTexture(a.Header, a.TextureImages[i])
-		n, err := writer.Write(texData)
+	return encodeOrdered(len(a.Textures), a.saveWorkers(), func(i int) ([]byte, error) {
+		return compressTexture(a.Header, a.TextureImages[i]), nil
+	}, func(i int, texData []byte) error {
+		size, err := writer.Write(texData)
 		if err != nil {
 			return err
 		}
-		a.Textures[n].Offset = uint32(*offset) / LM_PADDING
-		*offset += int64(n)
-	}
-	return nil
+		a.Textures[i].Offset = uint32(*offset) / LM_PADDING
+		*offset += int64(size)
+		return nil
+	})
 }
 
 func (a *Archive) saveFeatures(writer io.Writer, offset *int64) error {
 	for i := 0; i < len(a.Features); i++ {
-		n, err := writer.Write(a.FeatureDatas[i])
+		size, err := writer.Write(padFeatureData(a.FeatureDatas[i]))
 		if err != nil {
 			return err
 		}
-		a.Features[n].Offset = uint32(*offset) / LM_PADDING
-		*offset += int64(n)
+		a.Features[i].Offset = uint32(*offset) / LM_PADDING
+		*offset += int64(size)
 	}
 	return nil
 }
@@ -390,6 +503,12 @@ func (a *Archive) saveIndex(writer io.Writer) error {
 			return err
 		}
 	}
+	for i := range a.InstanceNodes {
+		err = a.InstanceNodes[i].Write(writer)
+		if err != nil {
+			return err
+		}
+	}
 	for i := range a.Instances {
 		err = a.Instances[i].Write(writer)
 		if err != nil {
@@ -420,6 +539,22 @@ func (a *Archive) saveIndex(writer io.Writer) error {
 			return err
 		}
 	}
+	if a.Header.Sign.HasHorizonPoints() {
+		err = binary.Write(writer, byteorder, a.HorizonPoints)
+		if err != nil {
+			return err
+		}
+	}
+	if a.Header.Sign.HasNodeCodecs() {
+		err = binary.Write(writer, byteorder, a.NodeCodecs)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(writer, byteorder, a.InstanceCodecs)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -445,11 +580,12 @@ func (a *Archive) Open(path string) error {
 }
 
 func (a *Archive) Save(path string) error {
-	writer, err := os.Open(path)
-	defer writer.Close()
+	writer, err := os.Create(path)
 	if err != nil {
 		return err
 	}
+	defer writer.Close()
+	a.resolveCompressSetting()
 	err = a.saveHeader(writer)
 	if err != nil {
 		return err
@@ -482,309 +618,19 @@ func (a *Archive) Save(path string) error {
 	if err != nil {
 		return err
 	}
-	writer.Seek(256, os.SEEK_SET)
+	_, err = writer.Seek(int64(a.headerSize()), os.SEEK_SET)
+	if err != nil {
+		return err
+	}
 	err = a.saveIndex(writer)
 	if err != nil {
 		return err
 	}
-	writer.Sync()
-	return nil
+	return writer.Sync()
 }
 
 func (a *Archive) Extract(path_ string) error {
-	for n := uint32(0); n < a.Header.NNodes; n++ {
-		obj := a.genNodeObj(n, false)
-		objname := fmt.Sprintf("node_%v.obj", n)
-
-		f, err := os.Open(path.Join(path_, objname))
-		if err != nil {
-			return err
-		}
-		_, err = f.Write([]byte(obj))
-		if err != nil {
-			return err
-		}
-
-		mtl := a.genNodeMtl(n, false)
-		mtlname := fmt.Sprintf("node_%v.mtl", n)
-
-		f, err = os.Open(path.Join(path_, mtlname))
-		if err != nil {
-			return err
-		}
-		_, err = f.Write([]byte(mtl))
-		if err != nil {
-			return err
-		}
-
-		err = a.extractNodeTexture(path_, n)
-		if err != nil {
-			return err
-		}
-	}
-	for n := uint32(0); n < a.Header.NInstanceNodes; n++ {
-		obj := a.genNodeObj(n, true)
-		objname := fmt.Sprintf("instance_%v.obj", n)
-
-		f, err := os.Open(path.Join(path_, objname))
-		if err != nil {
-			return err
-		}
-		_, err = f.Write([]byte(obj))
-		if err != nil {
-			return err
-		}
-
-		mtl := a.genNodeMtl(n, true)
-		mtlname := fmt.Sprintf("instance_%v.mtl", n)
-
-		f, err = os.Open(path.Join(path_, mtlname))
-		if err != nil {
-			return err
-		}
-		_, err = f.Write([]byte(mtl))
-		if err != nil {
-			return err
-		}
-
-		err = a.extractInstanceNodeTexture(path_, n)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (a *Archive) extractInstanceNodeTexture(path_ string, n uint32) error {
-	first_patch, last_patch := a.getInstanceNodePatchRange(n)
-	t := LM_INVALID_ID
-	for p := first_patch; p < last_patch; p++ {
-		t_ := a.Patchs[p].TexID
-		if t_ == LM_INVALID_ID || t_ == t {
-			continue
-		}
-		t = t_
-		var filename string
-		if (a.Header.Sign.Flags & PTJPG) > 0 {
-			filename = fmt.Sprintf("instance_%v_%v_tex.jpg", n, t)
-		} else if (a.Header.Sign.Flags & PTPNG) > 0 {
-			filename = fmt.Sprintf("instance_%v_%v_tex.png", n, t)
-		}
-		texbuf := a.TextureImages[t]
-		texdata := compressTexture(a.Header, texbuf)
-		f, err := os.Open(path.Join(path_, filename))
-		if err != nil {
-			return err
-		}
-		_, err = f.Write(texdata)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (a *Archive) extractNodeTexture(path_ string, n uint32) error {
-	first_patch, last_patch := a.getNodePatchRange(n)
-	t := LM_INVALID_ID
-	for p := first_patch; p < last_patch; p++ {
-		t_ := a.Patchs[p].TexID
-		if t_ == LM_INVALID_ID || t_ == t {
-			continue
-		}
-		t = t_
-		var filename string
-		if (a.Header.Sign.Flags & PTJPG) > 0 {
-			filename = fmt.Sprintf("node_%v_%v_tex.jpg", n, t)
-		} else if (a.Header.Sign.Flags & PTPNG) > 0 {
-			filename = fmt.Sprintf("node_%v_%v_tex.png", n, t)
-		}
-		texbuf := a.TextureImages[t]
-		texdata := compressTexture(a.Header, texbuf)
-		f, err := os.Open(path.Join(path_, filename))
-		if err != nil {
-			return err
-		}
-		_, err = f.Write(texdata)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (a *Archive) genNodeObj(n uint32, instance bool) string {
-	var buffer bytes.Buffer
-	buffer.WriteString("# Wavefront OBJ file\n")
-	buffer.WriteString("# Converted by flywave\n")
-	if instance {
-		buffer.WriteString(fmt.Sprintf("mtllib instance_%v.mtl\n", n))
-	} else {
-		buffer.WriteString(fmt.Sprintf("mtllib node_%v.mtl\n", n))
-	}
-	sign := &a.Header.Sign
-	var node *Node
-	var first_patch uint32
-	var last_patch uint32
-	var d *NodeMesh
-
-	if instance {
-		node = &a.InstanceNodes[n]
-		d = &a.InstanceMeshs[n]
-		first_patch, last_patch = a.getInstanceNodePatchRange(n)
-	} else {
-		node = &a.Nodes[n]
-		d = &a.NodeMeshs[n]
-		first_patch, last_patch = a.getNodePatchRange(n)
-	}
-
-	buffer.WriteString(fmt.Sprintf("# object %v\n", n))
-	for i := 0; i < int(node.NVert); i++ {
-		buffer.WriteString(fmt.Sprintf("v %f %f %f\n", d.Verts[i][0], d.Verts[i][1], d.Verts[i][2]))
-	}
-	buffer.WriteString(fmt.Sprintf("#  %v vertices\n", node.NVert))
-
-	if sign.Vertex.HasNormals() {
-		for i := 0; i < int(node.NVert); i++ {
-			buffer.WriteString(fmt.Sprintf("vn %d %d %d\n", d.Normals[i][0], d.Normals[i][1], d.Normals[i][2]))
-		}
-		buffer.WriteString(fmt.Sprintf("#  %v normals\n", node.NVert))
-	}
-
-	if sign.Vertex.HasTextures() {
-		for i := 0; i < int(node.NVert); i++ {
-			buffer.WriteString(fmt.Sprintf("vt %f %f \n", d.Texcoords[i][0], d.Texcoords[i][1]))
-		}
-		buffer.WriteString(fmt.Sprintf("#  %v texture vertices\n", node.NVert))
-	}
-
-	if node.NFace > 0 {
-		start := 0
-		for p := first_patch; p < last_patch; p++ {
-			buffer.WriteString(fmt.Sprintf("g patch-%v\n", p))
-
-			patch := &a.Patchs[p]
-			t := a.Patchs[p].TexID
-			m := a.Patchs[p].MtlID
-
-			if t != LM_INVALID_ID || m != LM_INVALID_ID {
-				if instance {
-					buffer.WriteString(fmt.Sprintf("usemtl instance_%v_%v_%v\n", n, t, m))
-				} else {
-					buffer.WriteString(fmt.Sprintf("usemtl node_%v_%v_%v\n", n, t, m))
-				}
-				for k := start; k < int(patch.FaceOffset); k++ {
-					fline := "f "
-					fline += fmt.Sprintf("%d", (d.Faces[k][0] + 1))
-					if sign.Vertex.HasTextures() {
-						fline += fmt.Sprintf("/%d", (d.Faces[k][0] + 1))
-					} else {
-						if sign.Vertex.HasNormals() {
-							fline += "/"
-						}
-					}
-
-					if sign.Vertex.HasNormals() {
-						fline += fmt.Sprintf("/%d", (d.Faces[k][0] + 1))
-					}
-					fline += " "
-
-					fline += fmt.Sprintf("%d", (d.Faces[k][1] + 1))
-					if sign.Vertex.HasTextures() {
-						fline += fmt.Sprintf("/%d", (d.Faces[k][1] + 1))
-					} else {
-						if sign.Vertex.HasNormals() {
-							fline += "/"
-						}
-					}
-
-					if sign.Vertex.HasNormals() {
-						fline += fmt.Sprintf("/%d", (d.Faces[k][1] + 1))
-					}
-					fline += " "
-
-					fline += fmt.Sprintf("%d", (d.Faces[k][2] + 1))
-					if sign.Vertex.HasTextures() {
-						fline += fmt.Sprintf("/%d", (d.Faces[k][2] + 1))
-					} else {
-						if sign.Vertex.HasNormals() {
-							fline += "/"
-						}
-					}
-
-					if sign.Vertex.HasNormals() {
-						fline += fmt.Sprintf("/%d", (d.Faces[k][2] + 1))
-					}
-					fline += "\n"
-
-					buffer.WriteString(fline)
-				}
-				start = int(patch.FaceOffset)
-			}
-		}
-	}
-	return string(buffer.Bytes())
-}
-
-func (a *Archive) genNodeMtl(n uint32, instance bool) string {
-	var buffer bytes.Buffer
-	buffer.WriteString("# Wavefront material file\n")
-	buffer.WriteString("# Converted by flywave\n")
-
-	var first_patch uint32
-	var last_patch uint32
-
-	if instance {
-		first_patch, last_patch = a.getInstanceNodePatchRange(n)
-	} else {
-		first_patch, last_patch = a.getNodePatchRange(n)
-	}
-
-	for p := first_patch; p < last_patch; p++ {
-		t := a.Patchs[p].TexID
-		m := a.Patchs[p].MtlID
-
-		if t == LM_INVALID_ID || m == LM_INVALID_ID {
-			continue
-		}
-		if instance {
-			buffer.WriteString(fmt.Sprintf("newmtl instance_%v_%v_%v\n", n, t, m))
-		} else {
-			buffer.WriteString(fmt.Sprintf("newmtl node_%v_%v_%v\n", n, t, m))
-		}
-		if m != LM_INVALID_ID {
-			mat := a.Materials[m]
-
-			buffer.WriteString(fmt.Sprintf("Kd %v %v %v \n", mat.Color[0]/255, mat.Color[1]/255, mat.Color[2]/255))
-			buffer.WriteString(fmt.Sprintf("d %v \n", mat.Opacity))
-
-			if mat.Type == MTL_LAMBERT || mat.Type == MTL_PHONG {
-				buffer.WriteString(fmt.Sprintf("Ka %v %v %v \n", mat.Ambient[0]/255, mat.Ambient[1]/255, mat.Ambient[2]/255))
-			}
-			if mat.Type == MTL_PHONG {
-				buffer.WriteString(fmt.Sprintf("Ks %v %v %v \n", mat.Specular[0]/255, mat.Specular[1]/255, mat.Specular[2]/255))
-				buffer.WriteString(fmt.Sprintf("Ns %v \n", mat.Shininess))
-			} else {
-				buffer.WriteString("Ks 0.000000 0.000000 0.000000\n")
-				buffer.WriteString("Ns 8.000000\n")
-			}
-			buffer.WriteString("illum 2\n")
-		} else {
-			buffer.WriteString("Ka 0.000000 0.000000 0.000000\n")
-			buffer.WriteString("Kd 1.000000 1.000000 1.000000\n")
-			buffer.WriteString("Ks 0.000000 0.000000 0.000000\n")
-			buffer.WriteString("illum 2\n")
-			buffer.WriteString("Ns 8.000000\n")
-		}
-		if t != LM_INVALID_ID {
-			if instance {
-				buffer.WriteString(fmt.Sprintf("map_Kd instance_%v_%v_tex.jpg \n", n, t))
-			} else {
-				buffer.WriteString(fmt.Sprintf("map_Kd node_%v_%v_tex.jpg \n", n, t))
-			}
-		}
-	}
-	return string(buffer.Bytes())
+	return a.ExtractTo(NewDirSink(path_))
 }
 
 func (a *Archive) Close() error {
@@ -795,16 +641,16 @@ func (a *Archive) Close() error {
 }
 
 func (a *Archive) LoadAll() error {
-	if a.reader != nil {
+	if a.reader == nil {
 		return errors.New("file not open!")
 	}
-	for n := uint32(0); n < a.Header.NNodes; n++ {
+	for n := uint32(0); n < a.sinkNode(); n++ {
 		err := a.LoadNode(n)
 		if err != nil {
 			return err
 		}
 	}
-	for n := uint32(0); n < a.Header.NInstanceNodes; n++ {
+	for n := uint32(0); n+1 < uint32(len(a.InstanceNodes)); n++ {
 		err := a.LoadInstance(n)
 		if err != nil {
 			return err
@@ -814,12 +660,12 @@ func (a *Archive) LoadAll() error {
 }
 
 func (a *Archive) LoadNode(n uint32) error {
-	if a.reader != nil {
-		return errors.New("file not open!")
-	}
 	if !a.NodeMeshs[n].Empty() {
 		return nil
 	}
+	if a.reader == nil {
+		return errors.New("file not open!")
+	}
 	nbuf, err := a.readNode(n)
 	if err != nil {
 		return err
@@ -831,36 +677,16 @@ func (a *Archive) LoadNode(n uint32) error {
 
 	first_patch, last_patch := a.getNodePatchRange(n)
 
-	for p := first_patch; p < last_patch; p++ {
-		tbuf, err := a.readPatchTexture(p)
-		if err != nil {
-			return err
-		}
-		err = a.setPatchTexture(p, tbuf)
-		if err != nil {
-			return err
-		}
-		fid := a.Patchs[p].FeatID
-		fbuf, err := a.readFeature(fid)
-		if err != nil {
-			return err
-		}
-		err = a.setFeature(fid, fbuf)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return a.loadPatchs(first_patch, last_patch)
 }
 
 func (a *Archive) LoadInstance(n uint32) error {
-	if a.reader != nil {
-		return errors.New("file not open!")
-	}
-
 	if !a.InstanceMeshs[n].Empty() {
 		return nil
 	}
+	if a.reader == nil {
+		return errors.New("file not open!")
+	}
 	nbuf, err := a.readInstanceNode(n)
 	if err != nil {
 		return err
@@ -872,56 +698,84 @@ func (a *Archive) LoadInstance(n uint32) error {
 
 	first_patch, last_patch := a.getInstanceNodePatchRange(n)
 
+	return a.loadPatchs(first_patch, last_patch)
+}
+
+func (a *Archive) loadPatchs(first_patch, last_patch uint32) error {
 	for p := first_patch; p < last_patch; p++ {
-		tbuf, err := a.readPatchTexture(p)
-		if err != nil {
-			return err
-		}
-		err = a.setPatchTexture(p, tbuf)
-		if err != nil {
-			return err
+		t := a.Patchs[p].TexID
+		if t != LM_INVALID_ID && a.TextureImages[t] == nil {
+			tbuf, err := a.readPatchTexture(p)
+			if err != nil {
+				return err
+			}
+			err = a.setPatchTexture(p, tbuf)
+			if err != nil {
+				return err
+			}
 		}
 		fid := a.Patchs[p].FeatID
-		fbuf, err := a.readFeature(fid)
-		if err != nil {
-			return err
-		}
-		err = a.setFeature(fid, fbuf)
-		if err != nil {
-			return err
+		if fid != LM_INVALID_ID && len(a.FeatureDatas[fid]) == 0 {
+			fbuf, err := a.readFeature(fid)
+			if err != nil {
+				return err
+			}
+			err = a.setFeature(fid, fbuf)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
 const (
-	CoordStep  float32 = 0.0
-	LumaBits   int     = 6
-	ChromaBits int     = 6
-	AlphaBits  int     = 5
-	NormBits   int     = 10
-	TexStep    float32 = 0.25
+	CoordStep    float32 = 0.0
+	CoordBits    int     = 14
+	LumaBits     int     = 6
+	ChromaBits   int     = 6
+	AlphaBits    int     = 5
+	NormBits     int     = 10
+	TexStep      float32 = 0.25
+	DeflateLevel int     = 6
 )
 
-func (a *Archive) optimizeCompressSetting(s *CompressSetting) {
-	if !a.Header.Sign.IsCompressed() {
-		return
-	}
+func coordQ(s *CompressSetting, radius float32) float32 {
 	coordStep := CoordStep
-	if s != nil {
-		if s.CoordBits > 0 {
-			sphere := &a.Header.Sphere
-			coordStep = sphere.Radius() / float32(math.Pow(2.0, float64(s.CoordBits)))
+	bits := 0
+	if s == nil {
+		bits = CoordBits
+	} else {
+		if q := float64(s.CoordQ); q != 0 && !math.IsInf(q, 0) && !math.IsNaN(q) {
+			coordStep = float32(math.Exp2(q))
 		}
+		bits = s.CoordBits
+	}
+	if bits > 0 && radius > 0 {
+		coordStep = radius / float32(math.Exp2(float64(bits)))
 	}
+	return float32(math.Log2(float64(coordStep)))
+}
 
-	a.setting.CoordQ = float32(math.Log2(float64(coordStep)))
+func (a *Archive) optimizeCompressSetting(s *CompressSetting) {
+	if !a.Header.Sign.IsCompressed() && !a.Header.Sign.HasNodeCodecs() {
+		if s != nil {
+			*a.setting = *s
+		}
+		return
+	}
+	a.setting.CoordQ = coordQ(s, a.Header.Sphere.Radius())
+	if math.IsInf(float64(a.setting.CoordQ), 0) && a.Header.Sign.Flags&(CORTO|NODE_CODECS) != 0 {
+		a.setting.CoordQ = coordQ(nil, a.Header.Sphere.Radius())
+	}
 
 	if s != nil {
+		a.setting.CoordBits = s.CoordBits
 		a.setting.NormalBits = s.NormalBits
 		a.setting.ColorBits = s.ColorBits
 		a.setting.TexStep = s.TexStep
 		a.setting.UvBits = s.UvBits
+		a.setting.DeflateLevel = s.DeflateLevel
 	} else {
 		a.setting.NormalBits = NormBits
 		a.setting.ColorBits[0] = LumaBits
@@ -930,5 +784,31 @@ func (a *Archive) optimizeCompressSetting(s *CompressSetting) {
 		a.setting.ColorBits[3] = AlphaBits
 		a.setting.TexStep = TexStep
 		a.setting.UvBits = int(math.Log2(float64(512 / TexStep)))
+		a.setting.DeflateLevel = DeflateLevel
+	}
+	a.Header.Quantization = a.setting.Quantization()
+}
+
+func (a *Archive) resolveCompressSetting() {
+	if a.setting != nil && a.Header.Quantization != (Quantization{}) {
+		return
+	}
+	var s *CompressSetting
+	if a.setting != nil && *a.setting != (CompressSetting{}) {
+		requested := *a.setting
+		s = &requested
+	} else if q := a.Header.Quantization; q != (Quantization{}) {
+		s = &CompressSetting{NormalBits: int(q.NormalBits), DeflateLevel: DeflateLevel}
+		if q.CoordStep > 0 {
+			s.CoordQ = float32(math.Log2(float64(q.CoordStep)))
+		}
+		if q.UvStep > 0 {
+			s.UvBits = int(math.Round(-math.Log2(float64(q.UvStep))))
+		}
+		for k := 0; k < 4; k++ {
+			s.ColorBits[k] = int(q.ColorBits[k])
+		}
 	}
+	a.setting = &CompressSetting{}
+	a.optimizeCompressSetting(s)
 }
@@ -3,7 +3,14 @@ package lodm
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/flywave/go3d/vec3"
 )
 
 func TestHeader(t *testing.T) {
@@ -45,3 +52,313 @@ func TestPadding(t *testing.T) {
 func TestInstanceNodeId(t *testing.T) {
 
 }
+
+type testReadSeeker struct {
+	*bytes.Reader
+}
+
+func (testReadSeeker) Close() error {
+	return nil
+}
+
+func saveTestArchive(t *testing.T, a *Archive) *Archive {
+	var file bytes.Buffer
+	if a.saveHeader(&file) != nil || a.saveIndex(&file) != nil {
+		t.FailNow()
+	}
+	file.Write(make([]byte, calcPadding(uint32(file.Len()), LM_PADDING)))
+	offset := int64(file.Len())
+	if a.saveNodes(&file, &offset) != nil || a.saveInstanceNodes(&file, &offset) != nil {
+		t.FailNow()
+	}
+	var index bytes.Buffer
+	a.saveIndex(&index)
+	data := file.Bytes()
+	copy(data[HeaderSize:], index.Bytes())
+
+	b := &Archive{reader: testReadSeeker{bytes.NewReader(data)}}
+	if b.loadHeader() != nil || b.loadIndex() != nil {
+		t.FailNow()
+	}
+	return b
+}
+
+func newTestArchive() *Archive {
+	sign := Signature{}
+	sign.Vertex.SetComponent(VERTEX_COORD, Attribute{Type: ATTR_FLOAT, Number: 3})
+	sign.Face.SetComponent(FACE_INDEX, Attribute{Type: ATTR_UNSIGNED_SHORT, Number: 3})
+
+	h := NewHeader(sign)
+	h.NNodes = 3
+	h.NPatches = 2
+	h.Sphere = Sphere{0.5, 0.5, 0.5, 0.87}
+
+	a := NewArchive(*h, nil)
+	a.initIndex()
+	a.Nodes[0] = Node{NVert: uint16(len(testMesh.Verts)), NFace: uint16(len(testMesh.Faces)), Error: 1, Sphere: h.Sphere, FirstPatch: 0}
+	a.Nodes[1] = Node{NVert: uint16(len(testMesh.Verts)), NFace: uint16(len(testMesh.Faces)), Error: 0.1, Sphere: h.Sphere, FirstPatch: 1}
+	a.Nodes[2] = Node{FirstPatch: 2}
+	a.Patchs[0] = Patch{Node: 1, FaceOffset: uint32(len(testMesh.Faces)), TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID}
+	a.Patchs[1] = Patch{Node: 2, FaceOffset: uint32(len(testMesh.Faces)), TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID}
+	a.NodeMeshs[0] = testMesh
+	a.NodeMeshs[1] = testMesh
+	return a
+}
+
+func TestSelectByError(t *testing.T) {
+	a := newTestArchive()
+
+	selected := a.SelectByError(0.5)
+	if !selected[0] || !selected[1] || selected[2] {
+		t.FailNow()
+	}
+
+	selected = a.SelectByError(2)
+	if !selected[0] || selected[1] {
+		t.FailNow()
+	}
+}
+
+func TestExtractAtError(t *testing.T) {
+	a := newTestArchive()
+
+	mesh, patchs, err := a.ExtractAtError(0.5)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if len(mesh.Faces) != len(testMesh.Faces) || len(patchs) != 1 {
+		t.FailNow()
+	}
+
+	if len(mesh.Verts) != len(testMesh.Verts)-1 {
+		t.FailNow()
+	}
+
+	if patchs[0].FaceOffset != uint32(len(mesh.Faces)) || patchs[0].TexID != LM_INVALID_ID {
+		t.FailNow()
+	}
+}
+
+func TestGeomorphs(t *testing.T) {
+	a := newTestArchive()
+
+	if err := a.BuildGeomorphs(); err != nil {
+		t.FailNow()
+	}
+
+	if !a.Header.Sign.Vertex.HasGeomorphs() || len(a.NodeMeshs[1].Morphs) != len(a.NodeMeshs[1].Verts) {
+		t.FailNow()
+	}
+
+	var buf bytes.Buffer
+	node := a.Nodes[1]
+	if err := a.NodeMeshs[1].Write(&buf, &node, &a.Header); err != nil {
+		t.FailNow()
+	}
+
+	var mesh NodeMesh
+	if err := mesh.Read(&buf, &node, &a.Header); err != nil {
+		t.FailNow()
+	}
+
+	for i := range mesh.Morphs {
+		if mesh.Morphs[i] != a.NodeMeshs[1].Morphs[i] {
+			t.FailNow()
+		}
+	}
+	broken := a.NodeMeshs[1]
+	broken.Morphs = broken.Morphs[:2]
+	if broken.Write(&buf, &node, &a.Header) == nil {
+		t.FailNow()
+	}
+
+	if a.SetNodeCodec(1, CORTO) == nil || a.SetNodeCodec(1, DRACO) == nil || a.SetAutoCodecs([]FlagType{MESHOPT, DRACO}, QualityTarget{}) == nil {
+		t.FailNow()
+	}
+	if a.SetNodeCodec(1, MESHOPT) != nil {
+		t.FailNow()
+	}
+	b := saveTestArchive(t, a)
+	if b.LoadNode(1) != nil || len(b.NodeMeshs[1].Morphs) != len(a.NodeMeshs[1].Morphs) || b.Header.Quantization.CoordStep <= 0 {
+		t.FailNow()
+	}
+	if vec3.Distance(&b.NodeMeshs[1].Morphs[2], &a.NodeMeshs[1].Morphs[2]) > float32(math.Sqrt(3)/2)*b.Header.Quantization.CoordStep*1.001 {
+		t.FailNow()
+	}
+
+	c := newTestArchive()
+	if c.SetNodeCodec(0, CORTO) != nil || c.BuildGeomorphs() == nil {
+		t.FailNow()
+	}
+
+	p := closestPointOnTriangle(&vec3.T{0.25, 0.25, 1}, &vec3.T{0, 0, 0}, &vec3.T{1, 0, 0}, &vec3.T{0, 1, 0})
+	if p != (vec3.T{0.25, 0.25, 0}) {
+		t.FailNow()
+	}
+}
+
+func TestNodeCodecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lodm")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	a := newTestArchive()
+	if a.SetNodeCodec(0, CORTO) != nil || a.SetNodeCodec(1, PTJPG) == nil || a.SetNodeCodec(5, 0) == nil {
+		t.FailNow()
+	}
+	step := a.Header.Quantization.CoordStep
+	if step <= 0 || step > 0.001 {
+		t.FailNow()
+	}
+	first := filepath.Join(dir, "first.lodm")
+	if a.Save(first) != nil {
+		t.FailNow()
+	}
+	b := &Archive{}
+	if b.Open(first) != nil || b.LoadAll() != nil {
+		t.FailNow()
+	}
+	if !b.Header.Sign.HasNodeCodecs() || len(b.NodeCodecs) != 3 || b.NodeCodecs[0] != CORTO || b.NodeCodecs[1] != 0 || b.Header.Quantization != a.Header.Quantization {
+		t.FailNow()
+	}
+	second := filepath.Join(dir, "second.lodm")
+	if b.Save(second) != nil {
+		t.FailNow()
+	}
+	c := &Archive{}
+	if c.Open(second) != nil || c.LoadAll() != nil || c.NodeCodecs[0] != CORTO || c.Header.Quantization != a.Header.Quantization {
+		t.FailNow()
+	}
+	tolerance := float32(math.Sqrt(3)/2) * step * 1.001
+	for n := 0; n < 2; n++ {
+		if len(c.NodeMeshs[n].Faces) != len(testMesh.Faces) || !withinTolerance(c.NodeMeshs[n].Verts, testMesh.Verts, tolerance) || !withinTolerance(testMesh.Verts, c.NodeMeshs[n].Verts, tolerance) {
+			t.FailNow()
+		}
+	}
+
+	a = newTestArchive()
+	setting := CompressSetting{CoordQ: -1}
+	d := NewArchive(a.Header, &setting)
+	d.initIndex()
+	copy(d.Nodes, a.Nodes)
+	copy(d.Patchs, a.Patchs)
+	copy(d.NodeMeshs, a.NodeMeshs)
+	d.NodeMeshs[1] = NodeMesh{Verts: make([]vec3.T, len(testMesh.Verts)), Faces: testMesh.Faces}
+	for i, v := range testMesh.Verts {
+		d.NodeMeshs[1].Verts[i] = vec3.T{v[0]*1000 + float32(i)*0.37, v[1] * 1000, v[2]}
+	}
+	if d.SetAutoCodecs([]FlagType{CORTO, MESHOPT}, QualityTarget{}) != nil || d.Header.Quantization.CoordStep != 0.5 {
+		t.FailNow()
+	}
+	b = saveTestArchive(t, d)
+	if b.NodeCodecs[0] == 0 || b.NodeCodecs[1] != 0 {
+		t.FailNow()
+	}
+	for n := uint32(0); n < 2; n++ {
+		if b.LoadNode(n) != nil || !withinTolerance(b.NodeMeshs[n].Verts, d.NodeMeshs[n].Verts, d.Nodes[n].Error) {
+			t.FailNow()
+		}
+	}
+}
+
+func TestAutoCodecAttributes(t *testing.T) {
+	for i, target := range []QualityTarget{{Position: 1}, {Position: 1, Normal: 1e-6}, {Position: 1, Color: 1e-6}, {Position: 1, Texcoord: 1e-9}} {
+		a := newQuantizationTestArchive(0)
+		if a.SetAutoCodecs([]FlagType{MESHOPT}, target) != nil {
+			t.FailNow()
+		}
+		b := saveTestArchive(t, a)
+		if (i == 0) != (b.NodeCodecs[0] == MESHOPT) {
+			t.FailNow()
+		}
+	}
+}
+
+func TestAutoCodecDraco(t *testing.T) {
+	a := newQuantizationTestArchive(0)
+	for d := 1; d < 4; d++ {
+		a.Header.Sign.Vertex.Attributes[int(VERTEX_DATA0)+d] = Attribute{}
+		for n := 0; n < 2; n++ {
+			a.NodeMeshs[n].Data[d] = nil
+		}
+	}
+	if a.SetAutoCodecs([]FlagType{DRACO}, QualityTarget{}) != nil {
+		t.FailNow()
+	}
+	node := a.Nodes[0]
+	data, err := LookupNodeCodec(DRACO).Encode(a.Header, &node, &a.NodeMeshs[0], a.Patchs[:1], a.setting)
+	var decoded NodeMesh
+	if err != nil || LookupNodeCodec(DRACO).Decode(data, a.Header, &node, &decoded) != nil || decoded.Verts[0] == a.NodeMeshs[0].Verts[0] {
+		t.FailNow()
+	}
+	b := saveTestArchive(t, a)
+	if b.NodeCodecs[0] != DRACO || b.NodeCodecs[1] != DRACO {
+		t.FailNow()
+	}
+}
+
+func TestSaveFeatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lodm")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	a := newTestArchive()
+	a.Header.NFeatures = 3
+	a.Features = []Feature{{ID: 1}, {ID: 2}, {}}
+	a.FeatureDatas = []FeatureData{[]byte("roof\x00\x00"), bytes.Repeat([]byte{FEATURE_DATA_END}, int(LM_PADDING)), nil}
+	a.Patchs[0].FeatID, a.Patchs[1].FeatID = 0, 1
+	path := filepath.Join(dir, "features.lodm")
+	if a.Save(path) != nil {
+		t.FailNow()
+	}
+	b := &Archive{}
+	if b.Open(path) != nil || b.LoadAll() != nil {
+		t.FailNow()
+	}
+	defer b.Close()
+	for f := 0; f < 2; f++ {
+		if !bytes.Equal(b.FeatureDatas[f], a.FeatureDatas[f]) {
+			t.FailNow()
+		}
+	}
+}
+
+func TestSaveWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lodm")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	var files [][]byte
+	for _, workers := range []int{1, 4} {
+		a := newTestTexturedArchive()
+		a.SetSaveWorkers(workers)
+		path := filepath.Join(dir, fmt.Sprintf("test_%d.lodm", workers))
+		if a.Save(path) != nil {
+			t.FailNow()
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.FailNow()
+		}
+		files = append(files, data)
+
+		b := &Archive{}
+		if b.Open(path) != nil || b.LoadAll() != nil {
+			t.FailNow()
+		}
+		if len(b.NodeMeshs[1].Faces) != len(testMesh.Faces) || b.NodeMeshs[1].Verts[3] != testMesh.Verts[3] || b.Textures[1].Offset <= b.Textures[0].Offset {
+			t.FailNow()
+		}
+		b.Close()
+	}
+	if !bytes.Equal(files[0], files[1]) {
+		t.FailNow()
+	}
+}
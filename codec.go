@@ -0,0 +1,733 @@
+package lodm
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/flywave/go-corto"
+	"github.com/flywave/go-draco"
+
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+)
+
+type NodeCodec interface {
+	Encode(header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) (NodeData, error)
+	Decode(buf []byte, header Header, node *Node, mesh *NodeMesh) error
+}
+
+type registeredCodec struct {
+	flag  FlagType
+	codec NodeCodec
+}
+
+const reservedFlags = PTJPG | PTPNG | HORIZON | NODE_CODECS
+
+var (
+	nodeCodecs      []registeredCodec
+	nodeCodecsLock  sync.RWMutex
+	compressedFlags FlagType
+	rawCodec        NodeCodec = rawNodeCodec{}
+)
+
+func init() {
+	RegisterNodeCodec(CORTO, cortoNodeCodec{})
+	RegisterNodeCodec(DRACO, dracoNodeCodec{})
+	RegisterNodeCodec(MESHOPT, meshoptNodeCodec{})
+}
+
+func RegisterNodeCodec(flag FlagType, codec NodeCodec) error {
+	if flag == 0 || flag&reservedFlags != 0 {
+		return errors.New("codec flag conflicts with reserved flags")
+	}
+	if codec == nil {
+		return errors.New("codec is nil")
+	}
+	nodeCodecsLock.Lock()
+	defer nodeCodecsLock.Unlock()
+	for i := range nodeCodecs {
+		if nodeCodecs[i].flag == flag {
+			nodeCodecs[i].codec = codec
+			return nil
+		}
+		if nodeCodecs[i].flag&flag != 0 {
+			return errors.New("codec flag overlaps a registered codec")
+		}
+	}
+	nodeCodecs = append(nodeCodecs, registeredCodec{flag: flag, codec: codec})
+	compressedFlags |= flag
+	return nil
+}
+
+func UnregisterNodeCodec(flag FlagType) {
+	nodeCodecsLock.Lock()
+	defer nodeCodecsLock.Unlock()
+	for i := range nodeCodecs {
+		if nodeCodecs[i].flag == flag {
+			nodeCodecs = append(nodeCodecs[:i], nodeCodecs[i+1:]...)
+			compressedFlags &^= flag
+			return
+		}
+	}
+}
+
+func lookupRegisteredCodec(flags FlagType) (registeredCodec, bool) {
+	nodeCodecsLock.RLock()
+	defer nodeCodecsLock.RUnlock()
+	for i := range nodeCodecs {
+		if flags&nodeCodecs[i].flag == nodeCodecs[i].flag {
+			return nodeCodecs[i], true
+		}
+	}
+	return registeredCodec{}, false
+}
+
+func LookupNodeCodec(flags FlagType) NodeCodec {
+	if r, ok := lookupRegisteredCodec(flags); ok {
+		return r.codec
+	}
+	return rawCodec
+}
+
+func compressedFlagMask() FlagType {
+	nodeCodecsLock.RLock()
+	defer nodeCodecsLock.RUnlock()
+	return compressedFlags
+}
+
+func (s *Signature) NodeCodec() NodeCodec {
+	return LookupNodeCodec(s.Flags)
+}
+
+type rawNodeCodec struct{}
+
+func (rawNodeCodec) Encode(header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) (NodeData, error) {
+	buf := &bytes.Buffer{}
+	if err := mesh.Write(buf, node, &header); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (rawNodeCodec) Decode(buf []byte, header Header, node *Node, mesh *NodeMesh) error {
+	return mesh.Read(bytes.NewBuffer(buf), node, &header)
+}
+
+type cortoNodeCodec struct{}
+
+var cortoMinUvStep = float32(math.Exp2(-24))
+
+const cortoNormalBits = 16
+
+func cortoCoordStep(header Header, verts []vec3.T, setting *CompressSetting) float32 {
+	if step := setting.coordStep(verts); step > 0 {
+		return step
+	}
+	if q := float64(coordQ(nil, header.Sphere.Radius())); !math.IsInf(q, 0) {
+		return float32(math.Exp2(q))
+	}
+	return (&CompressSetting{CoordBits: CoordBits}).coordStep(verts)
+}
+
+func (cortoNodeCodec) Encode(header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) (NodeData, error) {
+	if setting == nil {
+		setting = &DEFAULE_COMPRESS_SETTING
+	}
+	sig := header.Sign
+
+	ctx := corto.NewEncoderContext(0)
+	ctx.VertexQ = cortoCoordStep(header, mesh.Verts[:node.NVert], setting)
+	ctx.NormBits = cortoNormalBits
+	ctx.UvBits = setting.uvStep()
+	if ctx.UvBits == 0 {
+		ctx.UvBits = cortoMinUvStep
+	}
+	ctx.ColorBits = [4]int{8, 8, 8, 8}
+
+	geom := &corto.Geom{}
+
+	for p := 0; p < len(patches); p++ {
+		geom.Groups = append(geom.Groups, int(patches[p].FaceOffset))
+	}
+
+	geom.Vertices = make([]vec3.T, len(mesh.Verts))
+	for i := range mesh.Verts {
+		for k := 0; k < 3; k++ {
+			geom.Vertices[i][k] = cortoRound(mesh.Verts[i][k], ctx.VertexQ)
+		}
+	}
+
+	if node.NFace != 0 {
+		geom.Indices16 = make([]corto.Face16, node.NFace)
+		for i := 0; i < int(node.NFace); i++ {
+			geom.Indices16[i] = corto.Face16{mesh.Faces[i][0], mesh.Faces[i][1], mesh.Faces[i][2]}
+		}
+	}
+
+	if sig.Vertex.HasNormals() {
+		geom.Normals16 = make([]corto.Normal16, node.NVert)
+		for i := 0; i < int(node.NVert); i++ {
+			n := quantizeNormal(mesh.Normals[i], setting.normalBits())
+			geom.Normals16[i] = corto.Normal16{n[0], n[1], n[2]}
+		}
+	}
+
+	if sig.Vertex.HasColors() {
+		geom.Colors = make([]corto.Color, node.NVert)
+		for i := 0; i < int(node.NVert); i++ {
+			geom.Colors[i] = quantizeColors(mesh.Colors[i], setting)
+		}
+	}
+
+	if sig.Vertex.HasTextures() {
+		geom.TexCoord = make([]vec2.T, len(mesh.Texcoords))
+		for i := range mesh.Texcoords {
+			for k := 0; k < 2; k++ {
+				geom.TexCoord[i][k] = cortoRound(mesh.Texcoords[i][k], ctx.UvBits)
+			}
+		}
+	}
+
+	return corto.EncodeGeom(ctx, geom), nil
+}
+
+func (cortoNodeCodec) Decode(buf []byte, header Header, node *Node, mesh *NodeMesh) error {
+	ctx := &corto.DecoderContext{}
+	ctx.NFace = uint32(node.NFace)
+	ctx.NVert = uint32(node.NVert)
+	ctx.ColorsComponents = 4
+	ctx.Index16 = true
+	ctx.Normal16 = true
+	geom := corto.DecodeGeom(ctx, buf)
+	mesh.Verts = geom.Vertices[:]
+
+	mesh.Normals = make([][3]int16, len(geom.Normals16))
+	for i := range geom.Normals16 {
+		mesh.Normals[i] = [3]int16(geom.Normals16[i])
+	}
+	if len(geom.TexCoord) > 0 {
+		mesh.Texcoords = geom.TexCoord[:]
+	}
+	if len(geom.Indices16) > 0 {
+		mesh.Faces = make([][3]uint16, len(geom.Indices16))
+		for i := range geom.Indices16 {
+			mesh.Faces[i] = [3]uint16(geom.Indices16[i])
+		}
+	}
+	if len(geom.Colors) > 0 {
+		mesh.Colors = make([][4]byte, len(geom.Colors))
+		for i := range geom.Colors {
+			mesh.Colors[i] = [4]byte(geom.Colors[i])
+		}
+	}
+	return nil
+}
+
+type dracoNodeCodec struct{}
+
+func (dracoNodeCodec) Encode(header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) (NodeData, error) {
+	if setting == nil {
+		setting = &DEFAULE_COMPRESS_SETTING
+	}
+	sig := header.Sign
+
+	enc := draco.NewEncoder()
+
+	verts := mesh.Verts[:node.NVert]
+	if bits := dracoQuantizationBits(maxExtent(vec3Floats(verts, len(verts)), 3), setting.coordStep(verts)); bits > 0 {
+		enc.SetAttributeQuantization(draco.GAT_POSITION, bits)
+	}
+	if sig.Vertex.HasTextures() {
+		uvs := make([]float32, 0, len(verts)*2)
+		for i := range verts {
+			uvs = append(uvs, mesh.Texcoords[i][:]...)
+		}
+		if bits := dracoQuantizationBits(maxExtent(uvs, 2), setting.uvStep()); bits > 0 {
+			enc.SetAttributeQuantization(draco.GAT_TEX_COORD, bits)
+		}
+	}
+
+	var normals [][3]int16
+	if sig.Vertex.HasNormals() {
+		normals = make([][3]int16, len(verts))
+		for i := range normals {
+			normals[i] = quantizeNormal(mesh.Normals[i], setting.normalBits())
+		}
+	}
+	var colors [][4]byte
+	if sig.Vertex.HasColors() {
+		colors = make([][4]byte, len(verts))
+		for i := range colors {
+			colors[i] = quantizeColors(mesh.Colors[i], setting)
+		}
+	}
+
+	if node.NFace == 0 {
+		builder := draco.NewPointCloudBuilder()
+		builder.Start(int(node.NVert))
+
+		builder.SetAttribute(int(node.NVert), mesh.Verts[:], draco.GAT_POSITION)
+
+		if sig.Vertex.HasNormals() {
+			builder.SetAttribute(int(node.NVert), normals, draco.GAT_NORMAL)
+		}
+
+		if sig.Vertex.HasColors() {
+			builder.SetAttribute(int(node.NVert), colors, draco.GAT_COLOR)
+		}
+		pc := builder.GetPointCloud()
+		err, buf := enc.EncodePointCloud(pc)
+		return buf, err
+	} else {
+		builder := draco.NewMeshBuilder()
+		size := int(node.NFace)
+
+		builder.Start(size)
+
+		face_points := make([]vec3.T, size*3)
+
+		var face_normals [][3]int16
+		if sig.Vertex.HasNormals() {
+			face_normals = make([][3]int16, size*3)
+		}
+		var face_colors [][4]byte
+		if sig.Vertex.HasColors() {
+			face_colors = make([][4]byte, size*3)
+		}
+		var face_texcoords []vec2.T
+		if sig.Vertex.HasTextures() {
+			face_texcoords = make([]vec2.T, size*3)
+		}
+
+		for i := range mesh.Faces {
+			face_points[i*3] = mesh.Verts[int(mesh.Faces[i][0])]
+			face_points[i*3+1] = mesh.Verts[int(mesh.Faces[i][1])]
+			face_points[i*3+2] = mesh.Verts[int(mesh.Faces[i][2])]
+			if sig.Vertex.HasNormals() {
+				face_normals[i*3] = normals[int(mesh.Faces[i][0])]
+				face_normals[i*3+1] = normals[int(mesh.Faces[i][1])]
+				face_normals[i*3+2] = normals[int(mesh.Faces[i][2])]
+			}
+			if sig.Vertex.HasColors() {
+				face_colors[i*3] = colors[int(mesh.Faces[i][0])]
+				face_colors[i*3+1] = colors[int(mesh.Faces[i][1])]
+				face_colors[i*3+2] = colors[int(mesh.Faces[i][2])]
+			}
+			if sig.Vertex.HasTextures() {
+				face_texcoords[i*3] = mesh.Texcoords[int(mesh.Faces[i][0])]
+				face_texcoords[i*3+1] = mesh.Texcoords[int(mesh.Faces[i][1])]
+				face_texcoords[i*3+2] = mesh.Texcoords[int(mesh.Faces[i][2])]
+			}
+		}
+
+		builder.SetAttribute(size, face_points[:], draco.GAT_POSITION)
+		if sig.Vertex.HasNormals() {
+			builder.SetAttribute(size, face_normals[:], draco.GAT_NORMAL)
+		}
+		if sig.Vertex.HasColors() {
+			builder.SetAttribute(size, face_colors[:], draco.GAT_COLOR)
+		}
+		if sig.Vertex.HasTextures() {
+			builder.SetAttribute(size, face_texcoords[:], draco.GAT_TEX_COORD)
+		}
+
+		mesh := builder.GetMesh()
+		err, buf := enc.EncodeMesh(mesh)
+		return buf, err
+	}
+}
+
+func cortoRound(v, q float32) float32 {
+	if q <= 0 {
+		return v
+	}
+	return v + float32(math.Copysign(float64(q/2), float64(v)))
+}
+
+func dracoQuantizationBits(extent, step float32) int32 {
+	if extent <= 0 || step <= 0 {
+		return 0
+	}
+	bits := int32(math.Ceil(math.Log2(float64(extent/step) + 1)))
+	if bits < 1 {
+		bits = 1
+	}
+	if bits > 30 {
+		bits = 30
+	}
+	return bits
+}
+
+func quantizeColors(c [4]byte, setting *CompressSetting) [4]byte {
+	for k := 0; k < 4; k++ {
+		c[k] = quantizeColor(c[k], setting.colorBits(k))
+	}
+	return c
+}
+
+func (dracoNodeCodec) Decode(buf []byte, header Header, node *Node, mesh *NodeMesh) error {
+	if node.NFace == 0 {
+		m := draco.NewPointCloud()
+		denc := draco.NewDecoder()
+		err := denc.DecodePointCloud(m, buf)
+		if err != nil {
+			return err
+		}
+		{
+			posid := m.NamedAttributeID(draco.GAT_POSITION)
+
+			mesh.Verts = make([]vec3.T, node.NVert)
+
+			var vertsSlice []float32
+			vertsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&vertsSlice)))
+			vertsHeader.Cap = int(node.NVert * 3)
+			vertsHeader.Len = int(node.NVert * 3)
+			vertsHeader.Data = uintptr(unsafe.Pointer(&mesh.Verts[0]))
+
+			m.AttrData(m.Attr(posid), vertsSlice)
+		}
+
+		if header.Sign.Vertex.HasNormals() {
+			normid := m.NamedAttributeID(draco.GAT_NORMAL)
+
+			mesh.Normals = make([][3]int16, node.NVert)
+
+			var normsSlice []int16
+			normsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&normsSlice)))
+			normsHeader.Cap = int(node.NVert * 3)
+			normsHeader.Len = int(node.NVert * 3)
+			normsHeader.Data = uintptr(unsafe.Pointer(&mesh.Normals[0]))
+
+			m.AttrData(m.Attr(normid), normsSlice)
+		}
+
+		if header.Sign.Vertex.HasColors() {
+			colorid := m.NamedAttributeID(draco.GAT_COLOR)
+
+			mesh.Colors = make([][4]byte, node.NVert)
+
+			var colorsSlice []byte
+			colorsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&colorsSlice)))
+			colorsHeader.Cap = int(node.NVert * 4)
+			colorsHeader.Len = int(node.NVert * 4)
+			colorsHeader.Data = uintptr(unsafe.Pointer(&mesh.Colors[0]))
+
+			m.AttrData(m.Attr(colorid), colorsSlice)
+		}
+
+	} else {
+		m := draco.NewMesh()
+		d := draco.NewDecoder()
+		err := d.DecodeMesh(m, buf)
+		if err != nil {
+			return err
+		}
+		{
+			node.NFace = uint16(m.NumFaces())
+			mesh.Faces = make([][3]uint16, node.NFace)
+
+			faces := make([]uint32, node.NFace*3)
+			faces = m.Faces(faces)
+
+			for i := 0; i < int(node.NFace); i++ {
+				mesh.Faces[i] = [3]uint16{uint16(faces[i*3]), uint16(faces[i*3+1]), uint16(faces[i*3+2])}
+			}
+		}
+
+		{
+			posid := m.NamedAttributeID(draco.GAT_POSITION)
+
+			node.NVert = uint16(m.NumPoints())
+
+			mesh.Verts = make([]vec3.T, node.NVert)
+
+			var vertsSlice []float32
+			vertsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&vertsSlice)))
+			vertsHeader.Cap = int(node.NVert * 3)
+			vertsHeader.Len = int(node.NVert * 3)
+			vertsHeader.Data = uintptr(unsafe.Pointer(&mesh.Verts[0]))
+
+			m.AttrData(m.Attr(posid), vertsSlice)
+		}
+
+		if header.Sign.Vertex.HasNormals() {
+			normid := m.NamedAttributeID(draco.GAT_NORMAL)
+
+			mesh.Normals = make([][3]int16, node.NVert)
+
+			var normsSlice []int16
+			normsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&normsSlice)))
+			normsHeader.Cap = int(node.NVert * 3)
+			normsHeader.Len = int(node.NVert * 3)
+			normsHeader.Data = uintptr(unsafe.Pointer(&mesh.Normals[0]))
+
+			m.AttrData(m.Attr(normid), normsSlice)
+		}
+
+		if header.Sign.Vertex.HasColors() {
+			colorid := m.NamedAttributeID(draco.GAT_COLOR)
+
+			mesh.Colors = make([][4]byte, node.NVert)
+
+			var colorsSlice []byte
+			colorsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&colorsSlice)))
+			colorsHeader.Cap = int(node.NVert * 4)
+			colorsHeader.Len = int(node.NVert * 4)
+			colorsHeader.Data = uintptr(unsafe.Pointer(&mesh.Colors[0]))
+
+			m.AttrData(m.Attr(colorid), colorsSlice)
+		}
+
+		if header.Sign.Vertex.HasTextures() {
+			texcid := m.NamedAttributeID(draco.GAT_TEX_COORD)
+
+			mesh.Texcoords = make([]vec2.T, node.NVert)
+
+			var texsSlice []float32
+			texsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&texsSlice)))
+			texsHeader.Cap = int(node.NVert * 2)
+			texsHeader.Len = int(node.NVert * 2)
+			texsHeader.Data = uintptr(unsafe.Pointer(&mesh.Texcoords[0]))
+
+			m.AttrData(m.Attr(texcid), texsSlice)
+		}
+	}
+	return nil
+}
+
+func isNodeCodecFlag(flag FlagType) bool {
+	if flag == 0 {
+		return true
+	}
+	nodeCodecsLock.RLock()
+	defer nodeCodecsLock.RUnlock()
+	for i := range nodeCodecs {
+		if nodeCodecs[i].flag == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Archive) enableNodeCodecs() {
+	if a.Header.Sign.HasNodeCodecs() && len(a.NodeCodecs) == len(a.Nodes) && len(a.InstanceCodecs) == len(a.InstanceNodes) {
+		return
+	}
+	flag := FlagType(0)
+	if r, ok := lookupRegisteredCodec(a.Header.Sign.Flags); ok {
+		flag = r.flag
+	}
+	a.NodeCodecs = make([]FlagType, len(a.Nodes))
+	a.InstanceCodecs = make([]FlagType, len(a.InstanceNodes))
+	for i := range a.NodeCodecs {
+		a.NodeCodecs[i] = flag
+	}
+	for i := range a.InstanceCodecs {
+		a.InstanceCodecs[i] = flag
+	}
+	a.Header.Sign.SetFlag(NODE_CODECS)
+	a.resolveCompressSetting()
+}
+
+func (a *Archive) hasExtraVertexData() bool {
+	sig := &a.Header.Sign
+	return sig.Vertex.HasGeomorphs() || sig.Vertex.HasData(1) || sig.Vertex.HasData(2) || sig.Vertex.HasData(3)
+}
+
+func (a *Archive) checkNodeCodec(flag FlagType) error {
+	if !isNodeCodecFlag(flag) {
+		return errors.New("codec not registered")
+	}
+	if flag&(CORTO|DRACO) != 0 && a.hasExtraVertexData() {
+		return errors.New("codec drops geomorph and extra vertex data")
+	}
+	return nil
+}
+
+func (a *Archive) usesLossyAttributeCodec() bool {
+	for _, codecs := range [][]FlagType{a.NodeCodecs, a.InstanceCodecs, a.autoCodecs} {
+		for _, flag := range codecs {
+			if flag&(CORTO|DRACO) != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Archive) SetNodeCodec(n uint32, flag FlagType) error {
+	if n >= uint32(len(a.Nodes)) {
+		return errors.New("node index error")
+	}
+	if err := a.checkNodeCodec(flag); err != nil {
+		return err
+	}
+	a.enableNodeCodecs()
+	a.NodeCodecs[n] = flag
+	return nil
+}
+
+func (a *Archive) SetInstanceNodeCodec(n uint32, flag FlagType) error {
+	if n >= uint32(len(a.InstanceNodes)) {
+		return errors.New("node index error")
+	}
+	if err := a.checkNodeCodec(flag); err != nil {
+		return err
+	}
+	a.enableNodeCodecs()
+	a.InstanceCodecs[n] = flag
+	return nil
+}
+
+func (a *Archive) SetAutoCodecs(candidates []FlagType, target QualityTarget) error {
+	for _, flag := range candidates {
+		if err := a.checkNodeCodec(flag); err != nil {
+			return err
+		}
+	}
+	a.autoCodecs = candidates
+	a.autoTarget = target
+	if len(candidates) > 0 {
+		a.enableNodeCodecs()
+	}
+	return nil
+}
+
+func (a *Archive) decoderAt(codecs []FlagType, n uint32) NodeCodec {
+	if a.Header.Sign.HasNodeCodecs() && n < uint32(len(codecs)) {
+		return LookupNodeCodec(codecs[n])
+	}
+	return a.Header.Sign.NodeCodec()
+}
+
+func (a *Archive) encodeNode(codecs []FlagType, nodes []Node, n int, mesh *NodeMesh) (NodeData, error) {
+	if mesh.Empty() || n+1 >= len(nodes) {
+		return nil, nil
+	}
+	node := &nodes[n]
+	patches := a.Patchs[node.FirstPatch:nodes[n+1].FirstPatch]
+	if !a.Header.Sign.HasNodeCodecs() || n >= len(codecs) {
+		return encodeNodeMesh(a.nodeCodec(), a.Header, node, mesh, patches, a.setting)
+	}
+	if len(a.autoCodecs) == 0 {
+		return encodeNodeMesh(LookupNodeCodec(codecs[n]), a.Header, node, mesh, patches, a.setting)
+	}
+	flag, data, err := a.autoEncode(node, mesh, patches)
+	if err != nil {
+		return nil, err
+	}
+	codecs[n] = flag
+	return data, nil
+}
+
+func (a *Archive) autoEncode(node *Node, mesh *NodeMesh, patches []Patch) (FlagType, NodeData, error) {
+	setting := a.setting
+	if setting == nil {
+		setting = &DEFAULE_COMPRESS_SETTING
+	}
+	target := autoQualityTarget(a.autoTarget, node, setting)
+	tolerance := float32(target.Position)
+	best_flag := FlagType(0)
+	best, err := rawCodec.Encode(a.Header, node, mesh, patches, setting)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, flag := range a.autoCodecs {
+		if flag == 0 {
+			continue
+		}
+		codec := LookupNodeCodec(flag)
+		data, err := codec.Encode(a.Header, node, mesh, patches, setting)
+		if err != nil || len(data) >= len(best) {
+			continue
+		}
+		check := *node
+		var decoded NodeMesh
+		if err := codec.Decode(data, a.Header, &check, &decoded); err != nil {
+			continue
+		}
+		if len(decoded.Faces) != len(mesh.Faces) {
+			continue
+		}
+		if !withinTolerance(mesh.Verts, decoded.Verts, tolerance) || !withinTolerance(decoded.Verts, mesh.Verts, tolerance) {
+			continue
+		}
+		r := &CompressionReport{}
+		r.compare(&a.Header.Sign, node, mesh, &decoded)
+		if r.Normal.Max > target.Normal || r.Color.Max > target.Color || r.Texcoord.Max > target.Texcoord {
+			continue
+		}
+		best_flag, best = flag, data
+	}
+	return best_flag, padNodeData(best), nil
+}
+
+func autoQualityTarget(target QualityTarget, node *Node, setting *CompressSetting) QualityTarget {
+	if target.Position <= 0 {
+		relative := target.RelativePosition
+		if relative <= 0 {
+			relative = 1
+		}
+		target.Position = relative * float64(node.Error)
+	}
+	if target.Normal <= 0 {
+		target.Normal = math.Sqrt(3)/2/float64(int(1)<<uint(setting.normalBits()-1)-1)*180/math.Pi*1.01 + 0.01
+	}
+	if target.Color <= 0 {
+		bits := 8
+		for k := 0; k < 4; k++ {
+			if setting.colorBits(k) < bits {
+				bits = setting.colorBits(k)
+			}
+		}
+		target.Color = 255/float64(2*(int(1)<<uint(bits)-1)) + 0.5
+	}
+	if target.Texcoord <= 0 {
+		step := setting.uvStep()
+		if step < cortoMinUvStep {
+			step = cortoMinUvStep
+		}
+		target.Texcoord = math.Sqrt(2) / 2 * float64(step) * 1.001
+	}
+	return target
+}
+
+func withinTolerance(src, dst []vec3.T, tolerance float32) bool {
+	cell := tolerance
+	if cell <= 0 {
+		cell = 1
+	}
+	key := func(v *vec3.T) [3]int32 {
+		return [3]int32{int32(math.Floor(float64(v[0] / cell))), int32(math.Floor(float64(v[1] / cell))), int32(math.Floor(float64(v[2] / cell)))}
+	}
+	grid := make(map[[3]int32][]int)
+	for i := range dst {
+		k := key(&dst[i])
+		grid[k] = append(grid[k], i)
+	}
+	limit := tolerance * tolerance
+	for i := range src {
+		k := key(&src[i])
+		found := false
+		for dx := int32(-1); dx <= 1 && !found; dx++ {
+			for dy := int32(-1); dy <= 1 && !found; dy++ {
+				for dz := int32(-1); dz <= 1 && !found; dz++ {
+					for _, j := range grid[[3]int32{k[0] + dx, k[1] + dy, k[2] + dz}] {
+						if vec3.SquareDistance(&src[i], &dst[j]) <= limit {
+							found = true
+							break
+						}
+					}
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
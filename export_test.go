@@ -0,0 +1,469 @@
+package lodm
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/flywave/go3d/mat3"
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+)
+
+func newTestTexturedArchive() *Archive {
+	a := newTestArchive()
+	a.Header.Sign.Vertex.SetComponent(VERTEX_TEX, Attribute{Type: ATTR_FLOAT, Number: 2})
+	a.Header.Sign.SetFlag(PTPNG)
+	a.Header.NTextures = 2
+	a.Header.NMaterials = 1
+
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	a.Textures = []Texture{{Mat: mat3.T{{2, 0, 0}, {0, 2, 0}, {0.5, 0, 1}}}, {}}
+	a.TextureImages = []TextureImage{img, nil}
+	a.Materials = []Material{{Type: MTL_PBR, Color: [3]byte{255, 255, 255}, Metallic: 0.5, Roughness: 0.5, ClearcoatThickness: 1, Anisotropy: 0.3}}
+
+	for n := 0; n < 2; n++ {
+		mesh := a.NodeMeshs[n]
+		mesh.Texcoords = make([]vec2.T, len(mesh.Verts))
+		for i := range mesh.Verts {
+			mesh.Texcoords[i] = vec2.T{mesh.Verts[i][0], mesh.Verts[i][1]}
+		}
+		a.NodeMeshs[n] = mesh
+		a.Patchs[n].TexID = 0
+		a.Patchs[n].MtlID = 0
+	}
+	return a
+}
+
+func readGLB(t *testing.T, data []byte) map[string]interface{} {
+	var header [5]uint32
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &header); err != nil {
+		t.FailNow()
+	}
+	if header[0] != GLB_MAGIC || header[2] != uint32(len(data)) || header[4] != GLB_CHUNK_JSON {
+		t.FailNow()
+	}
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(data[20:20+header[3]], &doc); err != nil {
+		t.FailNow()
+	}
+	return doc
+}
+
+func TestExportGLB(t *testing.T) {
+	a := newTestTexturedArchive()
+
+	var buf bytes.Buffer
+	if err := a.ExportGLB(&buf); err != nil {
+		t.FailNow()
+	}
+
+	doc := readGLB(t, buf.Bytes())
+	if len(doc["meshes"].([]interface{})) != 1 || len(doc["images"].([]interface{})) != 1 {
+		t.FailNow()
+	}
+
+	used := doc["extensionsUsed"].([]interface{})
+	if len(used) != 3 {
+		t.FailNow()
+	}
+
+	buf.Reset()
+	if err := a.ExportNodeGLB(&buf, 0); err != nil {
+		t.FailNow()
+	}
+	readGLB(t, buf.Bytes())
+}
+
+func TestImportGltf(t *testing.T) {
+	a := newTestTexturedArchive()
+	a.Patchs = append(a.Patchs, Patch{Node: LM_INVALID_ID, FaceOffset: 1, TexID: LM_INVALID_ID, MtlID: 0, FeatID: LM_INVALID_ID})
+	a.InstanceNodes = []Node{{NVert: 3, NFace: 1, FirstPatch: 2}, {FirstPatch: 3}}
+	a.InstanceMeshs = []NodeMesh{{Verts: testMesh.Verts[:3], Faces: testMesh.Faces[:1], Texcoords: make([]vec2.T, 3)}, {}}
+	a.Instances = []Instance{
+		{Node: 0, InstanceID: 5, InstanceMat: mat4.T{{0, 1, 0, 0}, {-1, 0, 0, 0}, {0, 0, 1, 0}, {10, 0, 0, 1}}},
+		{Node: 0, InstanceID: 6, InstanceMat: mat4.T{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 20, 0, 1}}},
+	}
+
+	var buf bytes.Buffer
+	if err := a.ExportGLB(&buf); err != nil {
+		t.FailNow()
+	}
+	b, err := ImportGltf(&buf, nil, nil)
+	if err != nil || len(b.Instances) != 2 || len(b.InstanceNodes) != 2 || b.Header.NInstanceNodes != 2 || b.Header.NPatches != uint32(len(b.Patchs)) {
+		t.FailNow()
+	}
+	if b.Instances[0].InstanceMat != a.Instances[0].InstanceMat || b.Instances[1].InstanceMat != a.Instances[1].InstanceMat {
+		t.FailNow()
+	}
+	mesh := &b.InstanceMeshs[0]
+	if len(mesh.Verts) != 3 || len(mesh.Faces) != 1 || !mesh.HasTexcoord() || b.InstanceNodes[0].NFace != 1 {
+		t.FailNow()
+	}
+	first_patch, last_patch := b.getInstanceNodePatchRange(0)
+	if last_patch-first_patch != 1 || b.Patchs[first_patch].Node != LM_INVALID_ID || b.Patchs[first_patch].MtlID >= b.Header.NMaterials {
+		t.FailNow()
+	}
+	if len(b.Nodes) < 2 || b.Header.NFace == 0 || b.Header.Sphere.Radius() < 10 || len(b.TextureImages) != 2 {
+		t.FailNow()
+	}
+	var index bytes.Buffer
+	if b.saveIndex(&index) != nil || index.Len() != b.indexSize() {
+		t.FailNow()
+	}
+
+	buf.Reset()
+	b.Instances = b.Instances[:1]
+	if err := b.ExportGLB(&buf); err != nil {
+		t.FailNow()
+	}
+	c, err := ImportGltf(&buf, nil, nil)
+	if err != nil || len(c.Instances) != 0 || c.Header.NFace != b.Header.NFace+1 {
+		t.FailNow()
+	}
+}
+
+func TestImportGltfJSON(t *testing.T) {
+	var bin bytes.Buffer
+	binary.Write(&bin, binary.LittleEndian, []float32{0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 1, 1, 0, 1})
+	var png_data bytes.Buffer
+	png.Encode(&png_data, image.NewNRGBA(image.Rect(0, 0, 2, 2)))
+	doc := `{"asset":{"version":"2.0"},"scene":0,"scenes":[{"nodes":[0]}],
+		"nodes":[{"children":[1],"translation":[5,0,0]},{"mesh":0,"scale":[2,2,2]}],
+		"meshes":[{"primitives":[{"attributes":{"POSITION":0,"TEXCOORD_0":1},"material":0}]}],
+		"materials":[{"pbrMetallicRoughness":{"baseColorFactor":[1,0,0,1],"metallicFactor":0,"baseColorTexture":{"index":0}}}],
+		"textures":[{"source":0}],"images":[{"uri":"tex%20a.png"}],
+		"buffers":[{"byteLength":64,"uri":"data:application/octet-stream;base64,` + base64.StdEncoding.EncodeToString(bin.Bytes()) + `"}],
+		"bufferViews":[{"buffer":0,"byteLength":64}],
+		"accessors":[{"bufferView":0,"componentType":5126,"count":3,"type":"VEC3"},{"bufferView":0,"byteOffset":40,"componentType":5126,"count":3,"type":"VEC2"}]}`
+	open := memoryOpener(map[string][]byte{"tex a.png": png_data.Bytes()})
+	a, err := ImportGltf(strings.NewReader(doc), open, nil)
+	if err != nil || len(a.Nodes) != 2 || a.Header.NFace != 1 || len(a.TextureImages) != 2 {
+		t.FailNow()
+	}
+	if a.Header.Matrix[3][0] != 5 || a.NodeMeshs[0].Verts[1] != (vec3.T{2, 0, 0}) || a.NodeMeshs[0].Texcoords[1] != (vec2.T{1, 0}) {
+		t.FailNow()
+	}
+	if a.Materials[0].Color != [3]byte{255, 0, 0} || a.Materials[0].Metallic != 0 || a.Patchs[0].TexID != 0 {
+		t.FailNow()
+	}
+	if _, err := ImportGltf(strings.NewReader(strings.Replace(doc, `"asset":{`, `"extensionsRequired":["EXT_unknown"],"asset":{`, 1)), open, nil); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestTextureTransform(t *testing.T) {
+	m := mat3.T{{2, 0, 0}, {0, 3, 0}, {0.5, 0.25, 1}}
+	tt, ok := textureTransform(m)
+	if !ok {
+		t.FailNow()
+	}
+
+	uv := [2]float32{0.2, 0.7}
+	u := m[0][0]*uv[0] + m[1][0]*uv[1] + m[2][0]
+	v := m[0][1]*uv[0] + m[1][1]*uv[1] + m[2][1]
+
+	offset := tt["offset"].([]float32)
+	scale := tt["scale"].([]float32)
+	gu := uv[0]*scale[0] + offset[0]
+	gv := (1-uv[1])*scale[1] + offset[1]
+
+	if abs32(gu-u) > 1e-5 || abs32(gv-(1-v)) > 1e-5 {
+		t.FailNow()
+	}
+}
+
+func TestExportTileset(t *testing.T) {
+	a := newTestArchive()
+	a.Header.NFeatures = 2
+	a.Features = []Feature{{ID: 7, Type: 1}, {}}
+	a.FeatureDatas = []FeatureData{[]byte("roof"), nil}
+	a.Patchs[1].FeatID = 0
+
+	sink := NewMemorySink()
+	if err := a.ExportTileset(sink); err != nil {
+		t.FailNow()
+	}
+	if len(sink.Files) != 3 {
+		t.FailNow()
+	}
+
+	ts := tileset{}
+	if err := json.Unmarshal(sink.Files[TILESET_FILENAME], &ts); err != nil {
+		t.FailNow()
+	}
+	if ts.Asset.Version != TILESET_VERSION || ts.Root.Content.URI != tileContentName(0) || ts.Root.GeometricError != 1 {
+		t.FailNow()
+	}
+	if len(ts.Root.Children) != 1 || ts.Root.Children[0].Content.URI != tileContentName(1) || len(ts.Root.Children[0].Children) != 0 {
+		t.FailNow()
+	}
+
+	doc := readGLB(t, sink.Files[tileContentName(1)])
+	ext := doc["extensions"].(map[string]interface{})["EXT_structural_metadata"].(map[string]interface{})
+	table := ext["propertyTables"].([]interface{})[0].(map[string]interface{})
+	if table["count"].(float64) != 1 {
+		t.FailNow()
+	}
+	if _, ok := readGLB(t, sink.Files[tileContentName(0)])["extensions"]; ok {
+		t.FailNow()
+	}
+
+	var buf bytes.Buffer
+	if err := a.ExportTilesetArchive(&buf); err != nil {
+		t.FailNow()
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || len(r.File) != 4 {
+		t.FailNow()
+	}
+	index := r.File[3]
+	if index.Name != "@3dtilesIndex1@" || index.UncompressedSize64 != 3*24 {
+		t.FailNow()
+	}
+	offsets := make(map[int64]bool)
+	for _, f := range r.File[:3] {
+		off, err := f.DataOffset()
+		if err != nil {
+			t.FailNow()
+		}
+		offsets[off-30-int64(len(f.Name))] = true
+	}
+	rc, err := index.Open()
+	if err != nil {
+		t.FailNow()
+	}
+	defer rc.Close()
+	for i := 0; i < 3; i++ {
+		var entry struct {
+			Hash   [16]byte
+			Offset uint64
+		}
+		if err := binary.Read(rc, binary.LittleEndian, &entry); err != nil || !offsets[int64(entry.Offset)] {
+			t.FailNow()
+		}
+	}
+}
+
+func memoryOpener(files map[string][]byte) func(name string) (io.ReadCloser, error) {
+	return func(name string) (io.ReadCloser, error) {
+		data, ok := files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func TestImportTileset(t *testing.T) {
+	a := newTestTexturedArchive()
+	a.Header.Matrix = mat4.Ident
+	a.Header.Matrix[3] = [4]float32{100, 200, 300, 1}
+	sink := NewMemorySink()
+	if err := a.ExportTileset(sink); err != nil {
+		t.FailNow()
+	}
+
+	b, err := ImportTileset(memoryOpener(sink.Files), TILESET_FILENAME, nil)
+	if err != nil || len(b.Nodes) != 3 || len(b.Patchs) != 2 {
+		t.FailNow()
+	}
+	if b.Nodes[0].Error != 1 || b.Nodes[1].Error != 0.1 || b.Patchs[0].Node != 1 || b.Patchs[1].Node != 2 {
+		t.FailNow()
+	}
+	if b.Header.Matrix[3] != a.Header.Matrix[3] || b.Header.NTextures != 2 || b.Header.NMaterials != 1 || !b.Header.Sign.Vertex.HasTextures() {
+		t.FailNow()
+	}
+	if b.Materials[0].Metallic != 0.5 || b.Materials[0].ClearcoatThickness != 1 || b.Patchs[1].TexID != 0 {
+		t.FailNow()
+	}
+	mesh := &b.NodeMeshs[1]
+	if len(mesh.Faces) != len(testMesh.Faces) {
+		t.FailNow()
+	}
+	for i, v := range mesh.Verts {
+		found := false
+		for _, w := range testMesh.Verts {
+			found = found || vec3.Distance(&v, &w) < 1e-5
+		}
+		if !found || abs32(mesh.Texcoords[i][0]-(2*v[0]+0.5)) > 1e-5 || abs32(mesh.Texcoords[i][1]-2*v[1]) > 1e-5 {
+			t.FailNow()
+		}
+	}
+	if b.Nodes[0].Sphere.Radius() < b.Nodes[1].Sphere.Radius() || b.Nodes[1].TightRadius == 0 {
+		t.FailNow()
+	}
+
+	var b3dm bytes.Buffer
+	ft := []byte(`{"BATCH_LENGTH":0,"RTC_CENTER":[10,0,0]}    `)
+	glb := sink.Files[tileContentName(1)]
+	binary.Write(&b3dm, binary.LittleEndian, [7]uint32{0, 1, uint32(28 + len(ft) + len(glb)), uint32(len(ft)), 0, 0, 0})
+	b3dm.Write(ft)
+	b3dm.Write(glb)
+	data := b3dm.Bytes()
+	copy(data, "b3dm")
+	files := map[string][]byte{
+		"root.json":        []byte(`{"asset":{"version":"1.0"},"geometricError":4,"root":{"geometricError":4,"boundingVolume":{"sphere":[0,0,0,10]},"children":[{"geometricError":2,"boundingVolume":{"sphere":[0,0,0,10]},"content":{"uri":"sub/tileset.json"}}]}}`),
+		"sub/tileset.json": []byte(`{"asset":{"version":"1.0"},"geometricError":2,"root":{"geometricError":2,"refine":"ADD","boundingVolume":{"sphere":[0,0,0,10]},"content":{"uri":"tiles/a.b3dm"}}}`),
+		"sub/tiles/a.b3dm": data,
+	}
+	c, err := ImportTileset(memoryOpener(files), "root.json", nil)
+	if err != nil || len(c.Nodes) != 2 || c.Nodes[0].Error != 2 || c.Header.Matrix[3][0] != 10 {
+		t.FailNow()
+	}
+	files["sub/tileset.json"] = []byte(`{"asset":{"version":"1.0"},"geometricError":2,"root":{"geometricError":2,"boundingVolume":{"sphere":[0,0,0,10]},"content":{"uri":"../root.json"}}}`)
+	if _, err := ImportTileset(memoryOpener(files), "root.json", nil); err == nil {
+		t.FailNow()
+	}
+}
+
+func readGzipJSON(t *testing.T, data []byte) map[string]interface{} {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.FailNow()
+	}
+	doc := make(map[string]interface{})
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		t.FailNow()
+	}
+	return doc
+}
+
+func TestExportI3S(t *testing.T) {
+	a := newTestTexturedArchive()
+	a.Header.NFeatures = 2
+	a.Features = []Feature{{ID: 7, Type: 1}, {}}
+	a.FeatureDatas = []FeatureData{[]byte("roof"), nil}
+	a.Patchs[1].FeatID = 0
+
+	sink := NewMemorySink()
+	warnings, err := a.ExportI3S(sink, nil)
+	if err != nil || len(warnings) != 0 {
+		t.FailNow()
+	}
+	for _, name := range []string{"metadata.json", "3dSceneLayer.json.gz", "nodepages/0.json.gz", "nodes/0/3dNodeIndexDocument.json.gz", "nodes/1/geometries/0.bin.gz", "nodes/1/textures/0.png", "nodes/1/attributes/f_2/0.bin.gz"} {
+		if _, ok := sink.Files[name]; !ok {
+			t.FailNow()
+		}
+	}
+
+	layer := readGzipJSON(t, sink.Files["3dSceneLayer.json.gz"])
+	if layer["layerType"] != "IntegratedMesh" || len(layer["materialDefinitions"].([]interface{})) != 1 || len(layer["attributeStorageInfo"].([]interface{})) != 3 {
+		t.FailNow()
+	}
+	page := readGzipJSON(t, sink.Files["nodepages/0.json.gz"])["nodes"].([]interface{})
+	root := page[0].(map[string]interface{})
+	if len(page) != 2 || root["lodThreshold"].(float64) <= 0 || root["children"].([]interface{})[0].(float64) != 1 {
+		t.FailNow()
+	}
+	mesh := page[1].(map[string]interface{})["mesh"].(map[string]interface{})["geometry"].(map[string]interface{})
+	if mesh["vertexCount"].(float64) != float64(3*len(testMesh.Faces)) || mesh["featureCount"].(float64) != 1 {
+		t.FailNow()
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(sink.Files["nodes/1/geometries/0.bin.gz"]))
+	if err != nil {
+		t.FailNow()
+	}
+	var header [2]uint32
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil || header[0] != uint32(3*len(testMesh.Faces)) || header[1] != 1 {
+		t.FailNow()
+	}
+	geometry := make([]float32, header[0]*5)
+	if err := binary.Read(r, binary.LittleEndian, geometry); err != nil {
+		t.FailNow()
+	}
+	var feature struct {
+		ID    uint64
+		Range [2]uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &feature); err != nil || feature.ID != 7 || feature.Range[1] != uint32(len(testMesh.Faces)-1) {
+		t.FailNow()
+	}
+
+	var buf bytes.Buffer
+	if _, err := a.ExportSLPK(&buf, nil); err != nil {
+		t.FailNow()
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || len(zr.File) != len(sink.Files)+1 {
+		t.FailNow()
+	}
+	for _, f := range zr.File {
+		if f.Method != zip.Store {
+			t.FailNow()
+		}
+	}
+	if zr.File[len(zr.File)-1].Name != "@specialIndexFileHASH128@" {
+		t.FailNow()
+	}
+}
+
+func abs32(f float32) float32 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+func TestExportTilesetSharedChildren(t *testing.T) {
+	sign := Signature{}
+	sign.Vertex.SetComponent(VERTEX_COORD, Attribute{Type: ATTR_FLOAT, Number: 3})
+	sign.Face.SetComponent(FACE_INDEX, Attribute{Type: ATTR_UNSIGNED_SHORT, Number: 3})
+	faces := uint32(len(testMesh.Faces))
+	nodes := []Node{{Error: 4, FirstPatch: 0}, {Error: 2, FirstPatch: 2}, {Error: 2, FirstPatch: 3}, {Error: 1, FirstPatch: 4}}
+	patchs := []Patch{{Node: 1, FaceOffset: 1}, {Node: 2, FaceOffset: faces}, {Node: 3, FaceOffset: faces}, {Node: 3, FaceOffset: faces}, {Node: 4, FaceOffset: faces}}
+	for i := range patchs {
+		patchs[i].TexID, patchs[i].MtlID, patchs[i].FeatID = LM_INVALID_ID, LM_INVALID_ID, LM_INVALID_ID
+	}
+	a := newDAGArchive(sign, nodes, patchs, []NodeMesh{testMesh, testMesh, testMesh, testMesh}, nil)
+
+	sink := NewMemorySink()
+	if err := a.ExportTileset(sink); err != nil {
+		t.FailNow()
+	}
+	ts := tileset{}
+	if err := json.Unmarshal(sink.Files[TILESET_FILENAME], &ts); err != nil || len(ts.Root.Children) != 2 {
+		t.FailNow()
+	}
+	owner, other := ts.Root.Children[0], ts.Root.Children[1]
+	if owner.Refine != "REPLACE" || len(owner.Children) != 1 || owner.Children[0].Content.URI != tileContentName(3) {
+		t.FailNow()
+	}
+	if other.Refine != "ADD" || len(other.Children) != 0 {
+		t.FailNow()
+	}
+	uris := make(map[string]int)
+	var visit func(*tile)
+	visit = func(c *tile) {
+		if c.Content != nil {
+			uris[c.Content.URI]++
+		}
+		for _, child := range c.Children {
+			visit(child)
+		}
+	}
+	visit(ts.Root)
+	for n := uint32(0); n < 4; n++ {
+		if uris[tileContentName(n)] != 1 {
+			t.FailNow()
+		}
+	}
+}
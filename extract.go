@@ -0,0 +1,188 @@
+package lodm
+
+import (
+	"errors"
+	"math"
+
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+)
+
+type patchKey struct {
+	TexID  uint32
+	MtlID  uint32
+	FeatID uint32
+}
+
+type weldKey struct {
+	Vert     vec3.T
+	Texcoord vec2.T
+}
+
+type meshMerger struct {
+	sign   *Signature
+	mesh   NodeMesh
+	welded map[weldKey]uint32
+	groups []patchKey
+	faces  map[patchKey][][3]uint32
+	points map[patchKey][]uint32
+}
+
+func newMeshMerger(sign *Signature) *meshMerger {
+	return &meshMerger{sign: sign, welded: make(map[weldKey]uint32), faces: make(map[patchKey][][3]uint32), points: make(map[patchKey][]uint32)}
+}
+
+func (m *meshMerger) group(patch *Patch) patchKey {
+	key := patchKey{TexID: patch.TexID, MtlID: patch.MtlID, FeatID: patch.FeatID}
+	if _, ok := m.faces[key]; !ok {
+		m.faces[key] = nil
+		m.groups = append(m.groups, key)
+	}
+	return key
+}
+
+func (m *meshMerger) addVertex(src *NodeMesh, i uint16, weld bool) uint32 {
+	key := weldKey{Vert: src.Verts[i]}
+	if src.HasTexcoord() {
+		key.Texcoord = src.Texcoords[i]
+	}
+	if weld {
+		if idx, ok := m.welded[key]; ok {
+			return idx
+		}
+	}
+	idx := uint32(len(m.mesh.Verts))
+	m.mesh.Verts = append(m.mesh.Verts, src.Verts[i])
+	if m.sign.Vertex.HasNormals() {
+		var n [3]int16
+		if src.HasNormal() {
+			n = src.Normals[i]
+		}
+		m.mesh.Normals = append(m.mesh.Normals, n)
+	}
+	if m.sign.Vertex.HasTextures() {
+		var t vec2.T
+		if src.HasTexcoord() {
+			t = src.Texcoords[i]
+		}
+		m.mesh.Texcoords = append(m.mesh.Texcoords, t)
+	}
+	if m.sign.Vertex.HasColors() {
+		c := [4]byte{255, 255, 255, 255}
+		if src.HasColor() {
+			c = src.Colors[i]
+		}
+		m.mesh.Colors = append(m.mesh.Colors, c)
+	}
+	for d := 1; d < len(m.mesh.Data); d++ {
+		if k := dataNumber(m.sign, d); k > 0 {
+			vals := make([]float32, k)
+			if src.HasData(d) {
+				copy(vals, src.Data[d][int(i)*k:])
+			}
+			m.mesh.Data[d] = append(m.mesh.Data[d], vals...)
+		}
+	}
+	if weld {
+		m.welded[key] = idx
+	}
+	return idx
+}
+
+func dataNumber(sign *Signature, d int) int {
+	if !sign.Vertex.HasData(d) {
+		return 0
+	}
+	return int(sign.Vertex.Attributes[int(VERTEX_DATA0)+d].Number)
+}
+
+func (m *meshMerger) addPatch(src *NodeMesh, patch *Patch, start, end uint32) {
+	key := m.group(patch)
+	if !src.HasFace() {
+		for i := start; i < end && int(i) < len(src.Verts); i++ {
+			m.points[key] = append(m.points[key], m.addVertex(src, uint16(i), false))
+		}
+		return
+	}
+	remap := make(map[uint16]uint32)
+	for f := start; f < end && int(f) < len(src.Faces); f++ {
+		var face [3]uint32
+		for k, v := range src.Faces[f] {
+			idx, ok := remap[v]
+			if !ok {
+				idx = m.addVertex(src, v, true)
+				remap[v] = idx
+			}
+			face[k] = idx
+		}
+		if face[0] == face[1] || face[1] == face[2] || face[2] == face[0] {
+			continue
+		}
+		m.faces[key] = append(m.faces[key], face)
+	}
+}
+
+func (m *meshMerger) result() (*NodeMesh, []Patch, error) {
+	if len(m.mesh.Verts) > math.MaxUint16+1 {
+		return nil, nil, errors.New("merged mesh exceeds 16 bit vertex indices")
+	}
+	var patchs []Patch
+	hasFaces := false
+	for _, faces := range m.faces {
+		hasFaces = hasFaces || len(faces) > 0
+	}
+	if !hasFaces {
+		verts := m.mesh
+		m.mesh = NodeMesh{}
+		for _, key := range m.groups {
+			for _, i := range m.points[key] {
+				m.mesh.Verts = append(m.mesh.Verts, verts.Verts[i])
+				if verts.HasNormal() {
+					m.mesh.Normals = append(m.mesh.Normals, verts.Normals[i])
+				}
+				if verts.HasTexcoord() {
+					m.mesh.Texcoords = append(m.mesh.Texcoords, verts.Texcoords[i])
+				}
+				if verts.HasColor() {
+					m.mesh.Colors = append(m.mesh.Colors, verts.Colors[i])
+				}
+				for d := 1; d < len(verts.Data); d++ {
+					if k := dataNumber(m.sign, d); k > 0 {
+						m.mesh.Data[d] = append(m.mesh.Data[d], verts.Data[d][int(i)*k:int(i+1)*k]...)
+					}
+				}
+			}
+			patchs = append(patchs, Patch{Node: LM_INVALID_ID, FaceOffset: uint32(len(m.mesh.Verts)), TexID: key.TexID, MtlID: key.MtlID, FeatID: key.FeatID})
+		}
+		return &m.mesh, patchs, nil
+	}
+	for _, key := range m.groups {
+		for _, f := range m.faces[key] {
+			m.mesh.Faces = append(m.mesh.Faces, [3]uint16{uint16(f[0]), uint16(f[1]), uint16(f[2])})
+		}
+		if len(m.faces[key]) > 0 {
+			patchs = append(patchs, Patch{Node: LM_INVALID_ID, FaceOffset: uint32(len(m.mesh.Faces)), TexID: key.TexID, MtlID: key.MtlID, FeatID: key.FeatID})
+		}
+	}
+	return &m.mesh, patchs, nil
+}
+
+func (a *Archive) mergeCut(selected []bool) (*NodeMesh, []Patch, error) {
+	for n := range selected {
+		if !selected[n] {
+			continue
+		}
+		if err := a.LoadNode(uint32(n)); err != nil {
+			return nil, nil, err
+		}
+	}
+	m := newMeshMerger(&a.Header.Sign)
+	a.cutPatchs(selected, func(n, p uint32, start, end uint32) {
+		m.addPatch(&a.NodeMeshs[n], &a.Patchs[p], start, end)
+	})
+	return m.result()
+}
+
+func (a *Archive) ExtractAtError(maxError float32) (*NodeMesh, []Patch, error) {
+	return a.mergeCut(a.SelectByError(maxError))
+}
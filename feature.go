@@ -9,6 +9,28 @@ import (
 
 type FeatureData []byte
 
+const FEATURE_DATA_END byte = 0x80
+
+func padFeatureData(data FeatureData) NodeData {
+	if len(data) == 0 {
+		return nil
+	}
+	buf := make(NodeData, len(data), len(data)+int(LM_PADDING))
+	copy(buf, data)
+	return padNodeData(append(buf, FEATURE_DATA_END))
+}
+
+func trimFeatureData(buf []byte) FeatureData {
+	end := len(buf)
+	for end > 0 && buf[end-1] == 0 {
+		end--
+	}
+	if end == 0 || buf[end-1] != FEATURE_DATA_END {
+		return buf
+	}
+	return buf[:end-1]
+}
+
 type Feature struct {
 	Offset uint32
 	Type   uint32
@@ -0,0 +1,151 @@
+package lodm
+
+import (
+	"errors"
+	"math"
+
+	"github.com/flywave/go3d/vec3"
+)
+
+func closestPointOnTriangle(p, a, b, c *vec3.T) vec3.T {
+	ab := vec3.Sub(b, a)
+	ac := vec3.Sub(c, a)
+	ap := vec3.Sub(p, a)
+	d1 := vec3.Dot(&ab, &ap)
+	d2 := vec3.Dot(&ac, &ap)
+	if d1 <= 0 && d2 <= 0 {
+		return *a
+	}
+	bp := vec3.Sub(p, b)
+	d3 := vec3.Dot(&ab, &bp)
+	d4 := vec3.Dot(&ac, &bp)
+	if d3 >= 0 && d4 <= d3 {
+		return *b
+	}
+	vc := d1*d4 - d3*d2
+	if vc <= 0 && d1 >= 0 && d3 <= 0 {
+		v := d1 / (d1 - d3)
+		return vec3.T{a[0] + ab[0]*v, a[1] + ab[1]*v, a[2] + ab[2]*v}
+	}
+	cp := vec3.Sub(p, c)
+	d5 := vec3.Dot(&ab, &cp)
+	d6 := vec3.Dot(&ac, &cp)
+	if d6 >= 0 && d5 <= d6 {
+		return *c
+	}
+	vb := d5*d2 - d1*d6
+	if vb <= 0 && d2 >= 0 && d6 <= 0 {
+		w := d2 / (d2 - d6)
+		return vec3.T{a[0] + ac[0]*w, a[1] + ac[1]*w, a[2] + ac[2]*w}
+	}
+	va := d3*d6 - d5*d4
+	if va <= 0 && (d4-d3) >= 0 && (d5-d6) >= 0 {
+		w := (d4 - d3) / ((d4 - d3) + (d5 - d6))
+		return vec3.T{b[0] + (c[0]-b[0])*w, b[1] + (c[1]-b[1])*w, b[2] + (c[2]-b[2])*w}
+	}
+	denom := 1 / (va + vb + vc)
+	v := vb * denom
+	w := vc * denom
+	return vec3.T{a[0] + ab[0]*v + ac[0]*w, a[1] + ab[1]*v + ac[1]*w, a[2] + ab[2]*v + ac[2]*w}
+}
+
+type parentRegion struct {
+	mesh  *NodeMesh
+	start uint32
+	end   uint32
+}
+
+func (a *Archive) parentRegions() [][]parentRegion {
+	regions := make([][]parentRegion, len(a.Nodes))
+	for n := uint32(0); n+1 < uint32(len(a.Nodes)); n++ {
+		start := uint32(0)
+		first_patch, last_patch := a.getNodePatchRange(n)
+		for p := first_patch; p < last_patch; p++ {
+			patch := &a.Patchs[p]
+			regions[patch.Node] = append(regions[patch.Node], parentRegion{mesh: &a.NodeMeshs[n], start: start, end: patch.FaceOffset})
+			start = patch.FaceOffset
+		}
+	}
+	return regions
+}
+
+func (r *parentRegion) project(p *vec3.T) (vec3.T, float32) {
+	best := *p
+	bestDist := float32(math.MaxFloat32)
+	m := r.mesh
+	if !m.HasFace() {
+		for i := r.start; i < r.end && int(i) < len(m.Verts); i++ {
+			if d := vec3.SquareDistance(p, &m.Verts[i]); d < bestDist {
+				best, bestDist = m.Verts[i], d
+			}
+		}
+		return best, bestDist
+	}
+	for f := r.start; f < r.end && int(f) < len(m.Faces); f++ {
+		face := m.Faces[f]
+		q := closestPointOnTriangle(p, &m.Verts[face[0]], &m.Verts[face[1]], &m.Verts[face[2]])
+		if d := vec3.SquareDistance(p, &q); d < bestDist {
+			best, bestDist = q, d
+		}
+	}
+	return best, bestDist
+}
+
+func (a *Archive) BuildGeomorphs() error {
+	if a.Header.Sign.IsCompressed() {
+		return errors.New("geomorph data requires an uncompressed archive")
+	}
+	if a.Header.Sign.HasNodeCodecs() && a.usesLossyAttributeCodec() {
+		return errors.New("geomorph data requires node codecs that keep extra vertex data")
+	}
+	for n := range a.NodeMeshs {
+		if n+1 < len(a.Nodes) {
+			if err := a.LoadNode(uint32(n)); err != nil {
+				return err
+			}
+		}
+	}
+	regions := a.parentRegions()
+	for n := 0; n+1 < len(a.Nodes); n++ {
+		mesh := &a.NodeMeshs[n]
+		mesh.Morphs = make([]vec3.T, len(mesh.Verts))
+		for i := range mesh.Verts {
+			mesh.Morphs[i] = mesh.Verts[i]
+			bestDist := float32(math.MaxFloat32)
+			for r := range regions[n] {
+				if q, d := regions[n][r].project(&mesh.Verts[i]); d < bestDist {
+					mesh.Morphs[i], bestDist = q, d
+				}
+			}
+		}
+	}
+	a.Header.Sign.Vertex.SetComponent(VERTEX_GEOMORPH, Attribute{Type: ATTR_FLOAT, Number: 3})
+	return nil
+}
+
+func (t *Traversal) computeBlends() {
+	a := t.Archive
+	parentError := make([]float32, len(a.Nodes))
+	for n := range parentError {
+		parentError[n] = float32(math.MaxFloat32)
+	}
+	t.Blends = make([]float32, len(a.Nodes))
+	for n := 0; n+1 < len(a.Nodes); n++ {
+		if !t.Selected[n] {
+			continue
+		}
+		if parentError[n] == float32(math.MaxFloat32) {
+			t.Blends[n] = 1
+		} else {
+			b := (parentError[n] - t.TargetError) / t.TargetError
+			t.Blends[n] = float32(math.Max(0, math.Min(1, float64(b))))
+		}
+		first_patch, last_patch := a.getNodePatchRange(uint32(n))
+		for p := first_patch; p < last_patch; p++ {
+			child := a.Patchs[p].Node
+			if t.errors[n] < parentError[child] {
+				parentError[child] = t.errors[n]
+			}
+		}
+	}
+}
@@ -0,0 +1,1496 @@
+package lodm
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flywave/go-draco"
+	dmat4 "github.com/flywave/go3d/float64/mat4"
+	dquat "github.com/flywave/go3d/float64/quaternion"
+	dvec3 "github.com/flywave/go3d/float64/vec3"
+	"github.com/flywave/go3d/mat3"
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+)
+
+const (
+	GLB_MAGIC      uint32 = 0x46546C67
+	GLB_VERSION    uint32 = 2
+	GLB_CHUNK_JSON uint32 = 0x4E4F534A
+	GLB_CHUNK_BIN  uint32 = 0x004E4942
+)
+
+const (
+	gltfByte          = 5120
+	gltfUnsignedByte  = 5121
+	gltfShort         = 5122
+	gltfUnsignedShort = 5123
+	gltfUnsignedInt   = 5125
+	gltfFloat         = 5126
+
+	gltfArrayBuffer        = 34962
+	gltfElementArrayBuffer = 34963
+
+	gltfPoints    = 0
+	gltfTriangles = 4
+)
+
+type gltfAsset struct {
+	Version   string `json:"version"`
+	Generator string `json:"generator,omitempty"`
+}
+
+type gltfBuffer struct {
+	ByteLength int    `json:"byteLength"`
+	URI        string `json:"uri,omitempty"`
+}
+
+type gltfBufferView struct {
+	Buffer     int  `json:"buffer"`
+	ByteOffset int  `json:"byteOffset"`
+	ByteLength int  `json:"byteLength"`
+	ByteStride int  `json:"byteStride,omitempty"`
+	Target     *int `json:"target,omitempty"`
+}
+
+type gltfAccessor struct {
+	BufferView    *int        `json:"bufferView,omitempty"`
+	ByteOffset    int         `json:"byteOffset,omitempty"`
+	ComponentType int         `json:"componentType"`
+	Normalized    bool        `json:"normalized,omitempty"`
+	Count         int         `json:"count"`
+	Type          string      `json:"type"`
+	Min           []float32   `json:"min,omitempty"`
+	Max           []float32   `json:"max,omitempty"`
+	Sparse        interface{} `json:"sparse,omitempty"`
+}
+
+type gltfPrimitive struct {
+	Attributes map[string]int         `json:"attributes"`
+	Indices    *int                   `json:"indices,omitempty"`
+	Material   *int                   `json:"material,omitempty"`
+	Mode       *int                   `json:"mode,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+type gltfMesh struct {
+	Name       string          `json:"name,omitempty"`
+	Primitives []gltfPrimitive `json:"primitives"`
+}
+
+type gltfNode struct {
+	Name        string      `json:"name,omitempty"`
+	Mesh        *int        `json:"mesh,omitempty"`
+	Children    []int       `json:"children,omitempty"`
+	Matrix      []float64   `json:"matrix,omitempty"`
+	Translation []float64   `json:"translation,omitempty"`
+	Rotation    []float64   `json:"rotation,omitempty"`
+	Scale       []float64   `json:"scale,omitempty"`
+	Extras      interface{} `json:"extras,omitempty"`
+}
+
+type gltfScene struct {
+	Nodes []int `json:"nodes"`
+}
+
+type gltfTextureInfo struct {
+	Index      int                    `json:"index"`
+	TexCoord   int                    `json:"texCoord,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+type gltfPBR struct {
+	BaseColorFactor  []float32        `json:"baseColorFactor,omitempty"`
+	BaseColorTexture *gltfTextureInfo `json:"baseColorTexture,omitempty"`
+	MetallicFactor   *float32         `json:"metallicFactor,omitempty"`
+	RoughnessFactor  *float32         `json:"roughnessFactor,omitempty"`
+}
+
+type gltfMaterial struct {
+	Name                 string                 `json:"name,omitempty"`
+	PbrMetallicRoughness gltfPBR                `json:"pbrMetallicRoughness"`
+	EmissiveFactor       []float32              `json:"emissiveFactor,omitempty"`
+	AlphaMode            string                 `json:"alphaMode,omitempty"`
+	DoubleSided          bool                   `json:"doubleSided,omitempty"`
+	Extensions           map[string]interface{} `json:"extensions,omitempty"`
+}
+
+type gltfImage struct {
+	BufferView *int   `json:"bufferView,omitempty"`
+	MimeType   string `json:"mimeType,omitempty"`
+	URI        string `json:"uri,omitempty"`
+}
+
+type gltfSampler struct {
+	MagFilter int `json:"magFilter,omitempty"`
+	MinFilter int `json:"minFilter,omitempty"`
+	WrapS     int `json:"wrapS,omitempty"`
+	WrapT     int `json:"wrapT,omitempty"`
+}
+
+type gltfTexture struct {
+	Sampler *int `json:"sampler,omitempty"`
+	Source  *int `json:"source,omitempty"`
+}
+
+type gltfDocument struct {
+	Asset              gltfAsset              `json:"asset"`
+	ExtensionsUsed     []string               `json:"extensionsUsed,omitempty"`
+	ExtensionsRequired []string               `json:"extensionsRequired,omitempty"`
+	Scene              int                    `json:"scene"`
+	Scenes             []gltfScene            `json:"scenes"`
+	Nodes              []gltfNode             `json:"nodes,omitempty"`
+	Meshes             []gltfMesh             `json:"meshes,omitempty"`
+	Materials          []gltfMaterial         `json:"materials,omitempty"`
+	Textures           []gltfTexture          `json:"textures,omitempty"`
+	Images             []gltfImage            `json:"images,omitempty"`
+	Samplers           []gltfSampler          `json:"samplers,omitempty"`
+	Accessors          []gltfAccessor         `json:"accessors,omitempty"`
+	BufferViews        []gltfBufferView       `json:"bufferViews,omitempty"`
+	Buffers            []gltfBuffer           `json:"buffers,omitempty"`
+	Extensions         map[string]interface{} `json:"extensions,omitempty"`
+}
+
+type materialKey struct {
+	MtlID uint32
+	TexID uint32
+}
+
+type gltfBuilder struct {
+	archive   *Archive
+	doc       gltfDocument
+	bin       bytes.Buffer
+	materials map[materialKey]int
+	textures  map[uint32]int
+	instances map[uint32]int
+	used      map[string]bool
+	metadata  bool
+	features  map[uint32]int
+	rows      []uint32
+}
+
+func newGltfBuilder(a *Archive) *gltfBuilder {
+	b := &gltfBuilder{archive: a, materials: make(map[materialKey]int), textures: make(map[uint32]int), instances: make(map[uint32]int), used: make(map[string]bool), features: make(map[uint32]int)}
+	b.doc.Asset = gltfAsset{Version: "2.0", Generator: "go-lodm"}
+	b.doc.Scenes = []gltfScene{{}}
+	return b
+}
+
+func (b *gltfBuilder) useExtension(name string) {
+	if !b.used[name] {
+		b.used[name] = true
+		b.doc.ExtensionsUsed = append(b.doc.ExtensionsUsed, name)
+	}
+}
+
+func (b *gltfBuilder) addBufferView(data []byte, target int, stride int) int {
+	for b.bin.Len()%4 != 0 {
+		b.bin.WriteByte(0)
+	}
+	view := gltfBufferView{Buffer: 0, ByteOffset: b.bin.Len(), ByteLength: len(data), ByteStride: stride}
+	if target != 0 {
+		t := target
+		view.Target = &t
+	}
+	b.bin.Write(data)
+	b.doc.BufferViews = append(b.doc.BufferViews, view)
+	return len(b.doc.BufferViews) - 1
+}
+
+func (b *gltfBuilder) addAccessor(data interface{}, componentType int, typ string, count int, target int, normalized bool) (int, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, data); err != nil {
+		return 0, err
+	}
+	view := b.addBufferView(buf.Bytes(), target, 0)
+	b.doc.Accessors = append(b.doc.Accessors, gltfAccessor{BufferView: &view, ComponentType: componentType, Count: count, Type: typ, Normalized: normalized})
+	return len(b.doc.Accessors) - 1, nil
+}
+
+func (b *gltfBuilder) addVertexAttributes(mesh *NodeMesh) (map[string]int, error) {
+	attrs := make(map[string]int)
+
+	pos, err := b.addAccessor(mesh.Verts, gltfFloat, "VEC3", len(mesh.Verts), gltfArrayBuffer, false)
+	if err != nil {
+		return nil, err
+	}
+	min := []float32{math.MaxFloat32, math.MaxFloat32, math.MaxFloat32}
+	max := []float32{-math.MaxFloat32, -math.MaxFloat32, -math.MaxFloat32}
+	for _, v := range mesh.Verts {
+		for i := 0; i < 3; i++ {
+			min[i] = float32(math.Min(float64(min[i]), float64(v[i])))
+			max[i] = float32(math.Max(float64(max[i]), float64(v[i])))
+		}
+	}
+	b.doc.Accessors[pos].Min = min
+	b.doc.Accessors[pos].Max = max
+	attrs["POSITION"] = pos
+
+	if mesh.HasNormal() {
+		if attrs["NORMAL"], err = b.addAccessor(decodeNormals(mesh.Normals), gltfFloat, "VEC3", len(mesh.Normals), gltfArrayBuffer, false); err != nil {
+			return nil, err
+		}
+	}
+	if mesh.HasTexcoord() {
+		uvs := make([][2]float32, len(mesh.Texcoords))
+		for i, t := range mesh.Texcoords {
+			uvs[i] = [2]float32{t[0], 1 - t[1]}
+		}
+		if attrs["TEXCOORD_0"], err = b.addAccessor(uvs, gltfFloat, "VEC2", len(uvs), gltfArrayBuffer, false); err != nil {
+			return nil, err
+		}
+	}
+	if mesh.HasColor() {
+		if attrs["COLOR_0"], err = b.addAccessor(mesh.Colors, gltfUnsignedByte, "VEC4", len(mesh.Colors), gltfArrayBuffer, true); err != nil {
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
+
+func decodeNormals(normals [][3]int16) []vec3.T {
+	ret := make([]vec3.T, len(normals))
+	for i, n := range normals {
+		v := vec3.T{float32(n[0]), float32(n[1]), float32(n[2])}
+		if l := v.Length(); l > 0 {
+			v.Scale(1 / l)
+		}
+		ret[i] = v
+	}
+	return ret
+}
+
+func (b *gltfBuilder) addPrimitive(mesh *NodeMesh, attrs map[string]int, patch *Patch, start, end uint32) (*gltfPrimitive, error) {
+	var indices []uint16
+	mode := gltfTriangles
+	if mesh.HasFace() {
+		for f := start; f < end && int(f) < len(mesh.Faces); f++ {
+			indices = append(indices, mesh.Faces[f][0], mesh.Faces[f][1], mesh.Faces[f][2])
+		}
+	} else {
+		mode = gltfPoints
+		for i := start; i < end && int(i) < len(mesh.Verts); i++ {
+			indices = append(indices, uint16(i))
+		}
+	}
+	if len(indices) == 0 {
+		return nil, nil
+	}
+	idx, err := b.addAccessor(indices, gltfUnsignedShort, "SCALAR", len(indices), gltfElementArrayBuffer, false)
+	if err != nil {
+		return nil, err
+	}
+	prim := &gltfPrimitive{Attributes: attrs, Indices: &idx}
+	if mode != gltfTriangles {
+		prim.Mode = &mode
+	}
+	if mat, ok := b.addMaterial(patch.MtlID, patch.TexID, mesh.HasTexcoord()); ok {
+		prim.Material = &mat
+	}
+	if b.metadata {
+		if err := b.addFeatureIds(prim, patch.FeatID, len(mesh.Verts)); err != nil {
+			return nil, err
+		}
+	}
+	return prim, nil
+}
+
+func (b *gltfBuilder) addMesh(name string, mesh *NodeMesh, first_patch, last_patch uint32, visible func(p uint32) bool) (int, bool, error) {
+	if mesh.Empty() {
+		return 0, false, nil
+	}
+	attrs, err := b.addVertexAttributes(mesh)
+	if err != nil {
+		return 0, false, err
+	}
+	m := gltfMesh{Name: name}
+	start := uint32(0)
+	for p := first_patch; p < last_patch; p++ {
+		patch := &b.archive.Patchs[p]
+		if visible(p) {
+			prim, err := b.addPrimitive(mesh, attrs, patch, start, patch.FaceOffset)
+			if err != nil {
+				return 0, false, err
+			}
+			if prim != nil {
+				m.Primitives = append(m.Primitives, *prim)
+			}
+		}
+		start = patch.FaceOffset
+	}
+	if len(m.Primitives) == 0 {
+		return 0, false, nil
+	}
+	b.doc.Meshes = append(b.doc.Meshes, m)
+	return len(b.doc.Meshes) - 1, true, nil
+}
+
+func (b *gltfBuilder) addTexture(t uint32) (int, bool) {
+	a := b.archive
+	if idx, ok := b.textures[t]; ok {
+		return idx, true
+	}
+	if int(t) >= len(a.TextureImages) || a.TextureImages[t] == nil {
+		return 0, false
+	}
+	data, err := encodeTexture(a.Header, a.TextureImages[t])
+	if err != nil {
+		return 0, false
+	}
+	view := b.addBufferView(data, 0, 0)
+	b.doc.Images = append(b.doc.Images, gltfImage{BufferView: &view, MimeType: textureMimeType(textureExt(a.Header))})
+	if len(b.doc.Samplers) == 0 {
+		b.doc.Samplers = append(b.doc.Samplers, gltfSampler{MagFilter: 9729, MinFilter: 9987, WrapS: 10497, WrapT: 10497})
+	}
+	sampler, source := 0, len(b.doc.Images)-1
+	b.doc.Textures = append(b.doc.Textures, gltfTexture{Sampler: &sampler, Source: &source})
+	b.textures[t] = len(b.doc.Textures) - 1
+	return b.textures[t], true
+}
+
+func textureTransform(m mat3.T) (map[string]interface{}, bool) {
+	if m.IsZero() || m == mat3.Ident {
+		return nil, false
+	}
+	flip := mat3.T{{1, 0, 0}, {0, -1, 0}, {0, 1, 1}}
+	var tmp, t mat3.T
+	tmp.AssignMul(&m, &flip)
+	t.AssignMul(&flip, &tmp)
+
+	sx := float32(math.Hypot(float64(t[0][0]), float64(t[0][1])))
+	sy := float32(math.Hypot(float64(t[1][0]), float64(t[1][1])))
+	if t[0][0]*t[1][1]-t[1][0]*t[0][1] < 0 {
+		sy = -sy
+	}
+	rotation := float32(math.Atan2(float64(-t[0][1]), float64(t[0][0])))
+	return map[string]interface{}{
+		"offset":   []float32{t[2][0], t[2][1]},
+		"rotation": rotation,
+		"scale":    []float32{sx, sy},
+	}, true
+}
+
+func (b *gltfBuilder) addMaterial(mtl, tex uint32, hasUV bool) (int, bool) {
+	a := b.archive
+	if !hasUV {
+		tex = LM_INVALID_ID
+	}
+	if mtl != LM_INVALID_ID && int(mtl) >= len(a.Materials) {
+		mtl = LM_INVALID_ID
+	}
+	key := materialKey{MtlID: mtl, TexID: tex}
+	if idx, ok := b.materials[key]; ok {
+		return idx, true
+	}
+	if mtl == LM_INVALID_ID && tex == LM_INVALID_ID {
+		return 0, false
+	}
+
+	metallic, roughness := float32(0), float32(1)
+	gm := gltfMaterial{PbrMetallicRoughness: gltfPBR{BaseColorFactor: []float32{1, 1, 1, 1}, MetallicFactor: &metallic, RoughnessFactor: &roughness}}
+	if mtl != LM_INVALID_ID {
+		m := &a.Materials[mtl]
+		gm.PbrMetallicRoughness.BaseColorFactor = []float32{float32(m.Color[0]) / 255, float32(m.Color[1]) / 255, float32(m.Color[2]) / 255, 1}
+		if m.Opacity > 0 && m.Opacity < 1 {
+			gm.PbrMetallicRoughness.BaseColorFactor[3] = m.Opacity
+			gm.AlphaMode = "BLEND"
+		}
+		if m.Emissive != [3]byte{} {
+			gm.EmissiveFactor = []float32{float32(m.Emissive[0]) / 255, float32(m.Emissive[1]) / 255, float32(m.Emissive[2]) / 255}
+		}
+		if m.Type == MTL_PBR {
+			metallic, roughness = m.Metallic, m.Roughness
+		} else if m.Type == MTL_PHONG {
+			roughness = float32(math.Sqrt(2 / (float64(m.Shininess) + 2)))
+		}
+		gm.Extensions = make(map[string]interface{})
+		if m.ClearcoatThickness > 0 {
+			b.useExtension("KHR_materials_clearcoat")
+			gm.Extensions["KHR_materials_clearcoat"] = map[string]interface{}{
+				"clearcoatFactor":          m.ClearcoatThickness,
+				"clearcoatRoughnessFactor": m.ClearcoatRoughness,
+			}
+		}
+		if m.Anisotropy != 0 {
+			b.useExtension("KHR_materials_anisotropy")
+			gm.Extensions["KHR_materials_anisotropy"] = map[string]interface{}{
+				"anisotropyStrength": m.Anisotropy,
+				"anisotropyRotation": m.AnisotropyRotation,
+			}
+		}
+		if len(gm.Extensions) == 0 {
+			gm.Extensions = nil
+		}
+	}
+	if tex != LM_INVALID_ID {
+		if idx, ok := b.addTexture(tex); ok {
+			info := &gltfTextureInfo{Index: idx}
+			if int(tex) < len(a.Textures) {
+				if tt, ok := textureTransform(a.Textures[tex].Mat); ok {
+					b.useExtension("KHR_texture_transform")
+					info.Extensions = map[string]interface{}{"KHR_texture_transform": tt}
+				}
+			}
+			gm.PbrMetallicRoughness.BaseColorTexture = info
+		}
+	}
+	b.doc.Materials = append(b.doc.Materials, gm)
+	b.materials[key] = len(b.doc.Materials) - 1
+	return b.materials[key], true
+}
+
+func (b *gltfBuilder) addNode(node gltfNode) int {
+	b.doc.Nodes = append(b.doc.Nodes, node)
+	return len(b.doc.Nodes) - 1
+}
+
+func matrixSlice(m mat4.T) []float64 {
+	if m.IsZero() || m == mat4.Ident {
+		return nil
+	}
+	ret := make([]float64, 0, 16)
+	for c := 0; c < 4; c++ {
+		ret = append(ret, float64(m[c][0]), float64(m[c][1]), float64(m[c][2]), float64(m[c][3]))
+	}
+	return ret
+}
+
+func (b *gltfBuilder) addRoot() int {
+	root := b.addNode(gltfNode{Name: "root", Matrix: matrixSlice(b.archive.Header.Matrix)})
+	b.doc.Scenes[0].Nodes = append(b.doc.Scenes[0].Nodes, root)
+	return root
+}
+
+func (b *gltfBuilder) addArchiveNode(parent int, n uint32, visible func(p uint32) bool) error {
+	a := b.archive
+	if err := a.LoadNode(n); err != nil {
+		return err
+	}
+	first_patch, last_patch := a.getNodePatchRange(n)
+	mesh, ok, err := b.addMesh("", &a.NodeMeshs[n], first_patch, last_patch, visible)
+	if err != nil || !ok {
+		return err
+	}
+	node := b.addNode(gltfNode{Name: nodeName(n), Mesh: &mesh})
+	b.doc.Nodes[parent].Children = append(b.doc.Nodes[parent].Children, node)
+	return nil
+}
+
+func (b *gltfBuilder) addInstances(parent int) error {
+	a := b.archive
+	for i := range a.Instances {
+		inst := &a.Instances[i]
+		if err := a.LoadInstance(inst.Node); err != nil {
+			return err
+		}
+		mesh, ok := b.instances[inst.Node]
+		if !ok {
+			first_patch, last_patch := a.getInstanceNodePatchRange(inst.Node)
+			var err error
+			mesh, ok, err = b.addMesh("", &a.InstanceMeshs[inst.Node], first_patch, last_patch, func(p uint32) bool { return true })
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			b.instances[inst.Node] = mesh
+		}
+		node := b.addNode(gltfNode{Name: instanceName(inst.InstanceID), Mesh: &mesh, Matrix: matrixSlice(inst.InstanceMat)})
+		b.doc.Nodes[parent].Children = append(b.doc.Nodes[parent].Children, node)
+	}
+	return nil
+}
+
+func (b *gltfBuilder) write(w io.Writer) error {
+	if len(b.rows) > 0 {
+		b.addPropertyTable()
+	}
+	for b.bin.Len()%4 != 0 {
+		b.bin.WriteByte(0)
+	}
+	if b.bin.Len() > 0 {
+		b.doc.Buffers = []gltfBuffer{{ByteLength: b.bin.Len()}}
+	}
+	js, err := json.Marshal(&b.doc)
+	if err != nil {
+		return err
+	}
+	for len(js)%4 != 0 {
+		js = append(js, ' ')
+	}
+	length := 12 + 8 + len(js)
+	if b.bin.Len() > 0 {
+		length += 8 + b.bin.Len()
+	}
+	header := []uint32{GLB_MAGIC, GLB_VERSION, uint32(length), uint32(len(js)), GLB_CHUNK_JSON}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if _, err := w.Write(js); err != nil {
+		return err
+	}
+	if b.bin.Len() > 0 {
+		if err := binary.Write(w, binary.LittleEndian, []uint32{uint32(b.bin.Len()), GLB_CHUNK_BIN}); err != nil {
+			return err
+		}
+		if _, err := w.Write(b.bin.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Archive) ExportNodeGLB(w io.Writer, n uint32) error {
+	if n >= a.sinkNode() {
+		return errors.New("node index error")
+	}
+	b := newGltfBuilder(a)
+	root := b.addRoot()
+	if err := b.addArchiveNode(root, n, func(p uint32) bool { return true }); err != nil {
+		return err
+	}
+	return b.write(w)
+}
+
+func (a *Archive) ExportCutGLB(w io.Writer, selected []bool) error {
+	b := newGltfBuilder(a)
+	root := b.addRoot()
+	for n := range selected {
+		if !selected[n] {
+			continue
+		}
+		if err := b.addArchiveNode(root, uint32(n), func(p uint32) bool { return !selected[a.Patchs[p].Node] }); err != nil {
+			return err
+		}
+	}
+	if err := b.addInstances(root); err != nil {
+		return err
+	}
+	return b.write(w)
+}
+
+func (a *Archive) ExportGLB(w io.Writer) error {
+	return a.ExportCutGLB(w, a.SelectByError(0))
+}
+
+func nodeName(n uint32) string {
+	return fmt.Sprintf("node_%v", n)
+}
+
+func instanceName(id uint32) string {
+	return fmt.Sprintf("instance_%v", id)
+}
+
+var (
+	gltfComponentSizes      = map[int]int{gltfByte: 1, gltfUnsignedByte: 1, gltfShort: 2, gltfUnsignedShort: 2, gltfUnsignedInt: 4, gltfFloat: 4}
+	gltfTypeComponents      = map[string]int{"SCALAR": 1, "VEC2": 2, "VEC3": 3, "VEC4": 4, "MAT2": 4, "MAT3": 9, "MAT4": 16}
+	gltfSupportedExtensions = map[string]bool{
+		"KHR_draco_mesh_compression": true,
+		"KHR_mesh_quantization":      true,
+		"KHR_materials_clearcoat":    true,
+		"KHR_materials_anisotropy":   true,
+		"KHR_texture_transform":      true,
+	}
+	yUpToZUp = dmat4.T{{1, 0, 0, 0}, {0, 0, 1, 0}, {0, -1, 0, 0}, {0, 0, 0, 1}}
+)
+
+type gltfReader struct {
+	doc      gltfDocument
+	buffers  [][]byte
+	open     func(name string) (io.ReadCloser, error)
+	textures map[int]uint32
+}
+
+func gltfDataURI(uri string) ([]byte, bool, error) {
+	if !strings.HasPrefix(uri, "data:") {
+		return nil, false, nil
+	}
+	i := strings.Index(uri, ",")
+	if i < 0 {
+		return nil, true, errors.New("gltf: bad data uri")
+	}
+	if strings.HasSuffix(uri[:i], ";base64") {
+		data, err := base64.StdEncoding.DecodeString(uri[i+1:])
+		return data, true, err
+	}
+	data, err := url.PathUnescape(uri[i+1:])
+	return []byte(data), true, err
+}
+
+func (r *gltfReader) resource(uri string) ([]byte, error) {
+	if data, ok, err := gltfDataURI(uri); ok {
+		return data, err
+	}
+	if r.open == nil {
+		return nil, errors.New("gltf: no file opener for " + uri)
+	}
+	name, err := url.PathUnescape(uri)
+	if err != nil {
+		name = uri
+	}
+	f, err := r.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func readGltf(data []byte, open func(name string) (io.ReadCloser, error)) (*gltfReader, error) {
+	r := &gltfReader{open: open, textures: make(map[int]uint32)}
+	js := data
+	var bin []byte
+	if len(data) >= 12 && byteorder.Uint32(data) == GLB_MAGIC {
+		length := int(byteorder.Uint32(data[8:]))
+		if length > len(data) {
+			return nil, errors.New("gltf: truncated glb")
+		}
+		js = nil
+		for off := 12; off+8 <= length; {
+			size := int(byteorder.Uint32(data[off:]))
+			typ := byteorder.Uint32(data[off+4:])
+			if off+8+size > length {
+				return nil, errors.New("gltf: bad glb chunk")
+			}
+			chunk := data[off+8 : off+8+size]
+			if typ == GLB_CHUNK_JSON && js == nil {
+				js = chunk
+			} else if typ == GLB_CHUNK_BIN && bin == nil {
+				bin = chunk
+			}
+			off += 8 + size
+		}
+		if js == nil {
+			return nil, errors.New("gltf: missing json chunk")
+		}
+	}
+	if err := json.Unmarshal(js, &r.doc); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(r.doc.Asset.Version, "2") {
+		return nil, errors.New("gltf: unsupported version " + r.doc.Asset.Version)
+	}
+	for _, ext := range r.doc.ExtensionsRequired {
+		if !gltfSupportedExtensions[ext] {
+			return nil, errors.New("gltf: unsupported extension " + ext)
+		}
+	}
+	r.buffers = make([][]byte, len(r.doc.Buffers))
+	for i, b := range r.doc.Buffers {
+		if b.URI == "" {
+			if bin == nil {
+				return nil, errors.New("gltf: missing binary chunk")
+			}
+			r.buffers[i] = bin
+		} else {
+			buf, err := r.resource(b.URI)
+			if err != nil {
+				return nil, err
+			}
+			r.buffers[i] = buf
+		}
+		if len(r.buffers[i]) < b.ByteLength {
+			return nil, errors.New("gltf: buffer too short")
+		}
+	}
+	return r, nil
+}
+
+func (r *gltfReader) bufferView(i int) ([]byte, int, error) {
+	if i < 0 || i >= len(r.doc.BufferViews) {
+		return nil, 0, errors.New("gltf: buffer view index error")
+	}
+	view := &r.doc.BufferViews[i]
+	if view.Buffer < 0 || view.Buffer >= len(r.buffers) || view.ByteOffset+view.ByteLength > len(r.buffers[view.Buffer]) {
+		return nil, 0, errors.New("gltf: buffer view out of range")
+	}
+	return r.buffers[view.Buffer][view.ByteOffset : view.ByteOffset+view.ByteLength], view.ByteStride, nil
+}
+
+func (r *gltfReader) accessor(i int, fn func(e, c int, b []byte, typ int)) (int, int, error) {
+	if i < 0 || i >= len(r.doc.Accessors) {
+		return 0, 0, errors.New("gltf: accessor index error")
+	}
+	acc := &r.doc.Accessors[i]
+	comps, size := gltfTypeComponents[acc.Type], gltfComponentSizes[acc.ComponentType]
+	if comps == 0 || size == 0 {
+		return 0, 0, errors.New("gltf: bad accessor type")
+	}
+	if acc.Sparse != nil {
+		return 0, 0, errors.New("gltf: sparse accessors are not supported")
+	}
+	if acc.BufferView == nil || acc.Count == 0 {
+		return acc.Count, comps, nil
+	}
+	view, stride, err := r.bufferView(*acc.BufferView)
+	if err != nil {
+		return 0, 0, err
+	}
+	if stride == 0 {
+		stride = comps * size
+	}
+	if acc.ByteOffset+stride*(acc.Count-1)+comps*size > len(view) {
+		return 0, 0, errors.New("gltf: accessor out of range")
+	}
+	for e := 0; e < acc.Count; e++ {
+		for c := 0; c < comps; c++ {
+			off := acc.ByteOffset + e*stride + c*size
+			fn(e, c, view[off:off+size], acc.ComponentType)
+		}
+	}
+	return acc.Count, comps, nil
+}
+
+func gltfComponent(b []byte, typ int, normalized bool) float32 {
+	switch typ {
+	case gltfByte:
+		if normalized {
+			return float32(math.Max(float64(int8(b[0]))/127, -1))
+		}
+		return float32(int8(b[0]))
+	case gltfUnsignedByte:
+		if normalized {
+			return float32(b[0]) / 255
+		}
+		return float32(b[0])
+	case gltfShort:
+		v := int16(byteorder.Uint16(b))
+		if normalized {
+			return float32(math.Max(float64(v)/32767, -1))
+		}
+		return float32(v)
+	case gltfUnsignedShort:
+		if normalized {
+			return float32(byteorder.Uint16(b)) / 65535
+		}
+		return float32(byteorder.Uint16(b))
+	case gltfUnsignedInt:
+		return float32(byteorder.Uint32(b))
+	}
+	return math.Float32frombits(byteorder.Uint32(b))
+}
+
+func (r *gltfReader) floats(i int) ([]float32, int, error) {
+	var ret []float32
+	normalized := i >= 0 && i < len(r.doc.Accessors) && r.doc.Accessors[i].Normalized
+	count, comps, err := r.accessor(i, func(e, c int, b []byte, typ int) {
+		if ret == nil {
+			ret = make([]float32, r.doc.Accessors[i].Count*gltfTypeComponents[r.doc.Accessors[i].Type])
+		}
+		ret[e*gltfTypeComponents[r.doc.Accessors[i].Type]+c] = gltfComponent(b, typ, normalized)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if ret == nil {
+		ret = make([]float32, count*comps)
+	}
+	return ret, comps, nil
+}
+
+func (r *gltfReader) indices(i int) ([]uint32, error) {
+	var ret []uint32
+	_, _, err := r.accessor(i, func(e, c int, b []byte, typ int) {
+		if ret == nil {
+			ret = make([]uint32, r.doc.Accessors[i].Count)
+		}
+		switch typ {
+		case gltfUnsignedByte:
+			ret[e] = uint32(b[0])
+		case gltfUnsignedShort:
+			ret[e] = uint32(byteorder.Uint16(b))
+		default:
+			ret[e] = byteorder.Uint32(b)
+		}
+	})
+	return ret, err
+}
+
+func (r *gltfReader) image(i int) ([]byte, error) {
+	if i < 0 || i >= len(r.doc.Images) {
+		return nil, errors.New("gltf: image index error")
+	}
+	gi := &r.doc.Images[i]
+	if gi.BufferView != nil {
+		data, _, err := r.bufferView(*gi.BufferView)
+		return data, err
+	}
+	return r.resource(gi.URI)
+}
+
+func gltfNodeMatrix(n *gltfNode) dmat4.T {
+	if len(n.Matrix) == 16 {
+		var m dmat4.T
+		for c := 0; c < 4; c++ {
+			for r := 0; r < 4; r++ {
+				m[c][r] = n.Matrix[c*4+r]
+			}
+		}
+		return m
+	}
+	m := dmat4.Ident
+	if len(n.Rotation) == 4 {
+		q := dquat.T{n.Rotation[0], n.Rotation[1], n.Rotation[2], n.Rotation[3]}
+		m.AssignQuaternion(&q)
+	}
+	if len(n.Scale) == 3 {
+		for c := 0; c < 3; c++ {
+			for r := 0; r < 3; r++ {
+				m[c][r] *= n.Scale[c]
+			}
+		}
+	}
+	if len(n.Translation) == 3 {
+		m[3][0], m[3][1], m[3][2] = n.Translation[0], n.Translation[1], n.Translation[2]
+	}
+	return m
+}
+
+func (r *gltfReader) walk(root *dmat4.T, fn func(node int, m *dmat4.T) error) error {
+	var roots []int
+	if r.doc.Scene >= 0 && r.doc.Scene < len(r.doc.Scenes) {
+		roots = r.doc.Scenes[r.doc.Scene].Nodes
+	} else {
+		child := make([]bool, len(r.doc.Nodes))
+		for _, n := range r.doc.Nodes {
+			for _, c := range n.Children {
+				if c >= 0 && c < len(child) {
+					child[c] = true
+				}
+			}
+		}
+		for n := range r.doc.Nodes {
+			if !child[n] {
+				roots = append(roots, n)
+			}
+		}
+	}
+	var visit func(n int, parent *dmat4.T, depth int) error
+	visit = func(n int, parent *dmat4.T, depth int) error {
+		if n < 0 || n >= len(r.doc.Nodes) || depth > len(r.doc.Nodes) {
+			return errors.New("gltf: bad node hierarchy")
+		}
+		local := gltfNodeMatrix(&r.doc.Nodes[n])
+		var m dmat4.T
+		m.AssignMul(parent, &local)
+		if err := fn(n, &m); err != nil {
+			return err
+		}
+		for _, c := range r.doc.Nodes[n].Children {
+			if err := visit(c, &m, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, n := range roots {
+		if err := visit(n, root, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type gltfImporter struct {
+	materials []Material
+	mtlIndex  map[Material]uint32
+	imgIndex  map[[16]byte]uint32
+	images    []TextureImage
+	formats   []string
+	origin    [3]float64
+	hasOrigin bool
+}
+
+type gltfPart struct {
+	mesh  NodeMesh
+	patch Patch
+}
+
+func newGltfImporter() *gltfImporter {
+	return &gltfImporter{mtlIndex: make(map[Material]uint32), imgIndex: make(map[[16]byte]uint32)}
+}
+
+func extFloat(ext map[string]interface{}, key string, def float32) float32 {
+	if v, ok := ext[key].(float64); ok {
+		return float32(v)
+	}
+	return def
+}
+
+func colorFactor(f float32) byte {
+	return byte(math.Round(math.Max(0, math.Min(1, float64(f))) * 255))
+}
+
+func (imp *gltfImporter) texture(r *gltfReader, tex int) (uint32, error) {
+	if tex < 0 || tex >= len(r.doc.Textures) || r.doc.Textures[tex].Source == nil {
+		return LM_INVALID_ID, nil
+	}
+	src := *r.doc.Textures[tex].Source
+	if id, ok := r.textures[src]; ok {
+		return id, nil
+	}
+	data, err := r.image(src)
+	if err != nil {
+		return LM_INVALID_ID, err
+	}
+	hash := md5.Sum(data)
+	id, ok := imp.imgIndex[hash]
+	if !ok {
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return LM_INVALID_ID, err
+		}
+		id = uint32(len(imp.images))
+		imp.images = append(imp.images, img)
+		imp.formats = append(imp.formats, format)
+		imp.imgIndex[hash] = id
+	}
+	r.textures[src] = id
+	return id, nil
+}
+
+func gltfUVMatrix(info *gltfTextureInfo) mat3.T {
+	if info == nil {
+		return mat3.Ident
+	}
+	ext, ok := info.Extensions["KHR_texture_transform"].(map[string]interface{})
+	if !ok {
+		return mat3.Ident
+	}
+	offset, scale := [2]float32{0, 0}, [2]float32{1, 1}
+	for k := 0; k < 2; k++ {
+		if v, ok := ext["offset"].([]interface{}); ok && len(v) == 2 {
+			if f, ok := v[k].(float64); ok {
+				offset[k] = float32(f)
+			}
+		}
+		if v, ok := ext["scale"].([]interface{}); ok && len(v) == 2 {
+			if f, ok := v[k].(float64); ok {
+				scale[k] = float32(f)
+			}
+		}
+	}
+	rot := float64(extFloat(ext, "rotation", 0))
+	c, s := float32(math.Cos(rot)), float32(math.Sin(rot))
+	return mat3.T{{c * scale[0], -s * scale[0], 0}, {s * scale[1], c * scale[1], 0}, {offset[0], offset[1], 1}}
+}
+
+func (imp *gltfImporter) material(r *gltfReader, i *int) (uint32, uint32, error) {
+	if i == nil || *i < 0 || *i >= len(r.doc.Materials) {
+		return LM_INVALID_ID, LM_INVALID_ID, nil
+	}
+	gm := &r.doc.Materials[*i]
+	pbr := &gm.PbrMetallicRoughness
+	m := Material{Type: MTL_PBR, Color: [3]byte{255, 255, 255}, Opacity: 1, Metallic: 1, Roughness: 1}
+	if len(pbr.BaseColorFactor) >= 3 {
+		m.Color = [3]byte{colorFactor(pbr.BaseColorFactor[0]), colorFactor(pbr.BaseColorFactor[1]), colorFactor(pbr.BaseColorFactor[2])}
+		if len(pbr.BaseColorFactor) == 4 && gm.AlphaMode == "BLEND" {
+			m.Opacity = pbr.BaseColorFactor[3]
+		}
+	}
+	if pbr.MetallicFactor != nil {
+		m.Metallic = *pbr.MetallicFactor
+	}
+	if pbr.RoughnessFactor != nil {
+		m.Roughness = *pbr.RoughnessFactor
+	}
+	if len(gm.EmissiveFactor) == 3 {
+		m.Emissive = [3]byte{colorFactor(gm.EmissiveFactor[0]), colorFactor(gm.EmissiveFactor[1]), colorFactor(gm.EmissiveFactor[2])}
+	}
+	if ext, ok := gm.Extensions["KHR_materials_clearcoat"].(map[string]interface{}); ok {
+		m.ClearcoatThickness = extFloat(ext, "clearcoatFactor", 0)
+		m.ClearcoatRoughness = extFloat(ext, "clearcoatRoughnessFactor", 0)
+	}
+	if ext, ok := gm.Extensions["KHR_materials_anisotropy"].(map[string]interface{}); ok {
+		m.Anisotropy = extFloat(ext, "anisotropyStrength", 0)
+		m.AnisotropyRotation = extFloat(ext, "anisotropyRotation", 0)
+	}
+	mtl, ok := imp.mtlIndex[m]
+	if !ok {
+		mtl = uint32(len(imp.materials))
+		imp.materials = append(imp.materials, m)
+		imp.mtlIndex[m] = mtl
+	}
+	tex := LM_INVALID_ID
+	if pbr.BaseColorTexture != nil {
+		var err error
+		if tex, err = imp.texture(r, pbr.BaseColorTexture.Index); err != nil {
+			return LM_INVALID_ID, LM_INVALID_ID, err
+		}
+	}
+	return mtl, tex, nil
+}
+
+func (r *gltfReader) dracoPrimitive(ext map[string]interface{}) (map[string][]float32, map[string]int, []uint32, error) {
+	view, ok := ext["bufferView"].(float64)
+	if !ok {
+		return nil, nil, nil, errors.New("gltf: bad draco extension")
+	}
+	data, _, err := r.bufferView(int(view))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	m := draco.NewMesh()
+	if err := draco.NewDecoder().DecodeMesh(m, data); err != nil {
+		return nil, nil, nil, err
+	}
+	faces := m.Faces(make([]uint32, m.NumFaces()*3))
+	attrs := make(map[string][]float32)
+	comps := make(map[string]int)
+	ids, _ := ext["attributes"].(map[string]interface{})
+	for name, id := range ids {
+		uid, ok := id.(float64)
+		if !ok {
+			continue
+		}
+		attr := m.AttrByUniqueID(uint32(uid))
+		if attr == nil {
+			return nil, nil, nil, errors.New("gltf: missing draco attribute " + name)
+		}
+		vals, _ := m.AttrData(attr, make([]float32, 0))
+		data := vals.([]float32)
+		if attr.Normalized() {
+			scale := float32(1)
+			switch attr.DataType() {
+			case draco.DT_UINT8:
+				scale = 255
+			case draco.DT_INT8:
+				scale = 127
+			case draco.DT_UINT16:
+				scale = 65535
+			case draco.DT_INT16:
+				scale = 32767
+			}
+			for i := range data {
+				data[i] /= scale
+			}
+		}
+		attrs[name] = data
+		comps[name] = int(attr.NumComponents())
+	}
+	return attrs, comps, faces, nil
+}
+
+func (r *gltfReader) primitiveData(prim *gltfPrimitive) (map[string][]float32, map[string]int, []uint32, error) {
+	if ext, ok := prim.Extensions["KHR_draco_mesh_compression"].(map[string]interface{}); ok {
+		return r.dracoPrimitive(ext)
+	}
+	attrs := make(map[string][]float32)
+	comps := make(map[string]int)
+	for _, name := range []string{"POSITION", "NORMAL", "TEXCOORD_0", "COLOR_0"} {
+		idx, ok := prim.Attributes[name]
+		if !ok {
+			continue
+		}
+		data, n, err := r.floats(idx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		attrs[name], comps[name] = data, n
+	}
+	if prim.Indices == nil {
+		return attrs, comps, nil, nil
+	}
+	indices, err := r.indices(*prim.Indices)
+	return attrs, comps, indices, err
+}
+
+func gltfFaces(mode int, indices []uint32, count int) [][3]uint32 {
+	if indices == nil {
+		indices = make([]uint32, count)
+		for i := range indices {
+			indices[i] = uint32(i)
+		}
+	}
+	var faces [][3]uint32
+	switch mode {
+	case gltfTriangles:
+		for i := 0; i+2 < len(indices); i += 3 {
+			faces = append(faces, [3]uint32{indices[i], indices[i+1], indices[i+2]})
+		}
+	case 5:
+		for i := 0; i+2 < len(indices); i++ {
+			if i%2 == 0 {
+				faces = append(faces, [3]uint32{indices[i], indices[i+1], indices[i+2]})
+			} else {
+				faces = append(faces, [3]uint32{indices[i+1], indices[i], indices[i+2]})
+			}
+		}
+	case 6:
+		for i := 1; i+1 < len(indices); i++ {
+			faces = append(faces, [3]uint32{indices[0], indices[i], indices[i+1]})
+		}
+	}
+	return faces
+}
+
+func (imp *gltfImporter) primitive(r *gltfReader, prim *gltfPrimitive, m *dmat4.T, relative bool) ([]gltfPart, error) {
+	mode := gltfTriangles
+	if prim.Mode != nil {
+		mode = *prim.Mode
+	}
+	if mode < gltfTriangles {
+		return nil, nil
+	}
+	attrs, comps, indices, err := r.primitiveData(prim)
+	if err != nil {
+		return nil, err
+	}
+	pos := attrs["POSITION"]
+	if pos == nil || comps["POSITION"] != 3 {
+		return nil, errors.New("gltf: primitive without positions")
+	}
+	count := len(pos) / 3
+	for _, i := range indices {
+		if int(i) >= count {
+			return nil, errors.New("gltf: index out of range")
+		}
+	}
+	faces := gltfFaces(mode, indices, count)
+	if len(faces) == 0 {
+		return nil, nil
+	}
+
+	var origin [3]float64
+	if relative {
+		if !imp.hasOrigin {
+			v := dvec3.T{float64(pos[0]), float64(pos[1]), float64(pos[2])}
+			imp.setOrigin(m.MulVec3(&v))
+		}
+		origin = imp.origin
+	}
+	normalMat := m.Inverted()
+	normalMat.Transpose()
+
+	normals, texcoords, colors := attrs["NORMAL"], attrs["TEXCOORD_0"], attrs["COLOR_0"]
+	if comps["NORMAL"] != 3 || len(normals) < count*3 {
+		normals = nil
+	}
+	if comps["TEXCOORD_0"] != 2 || len(texcoords) < count*2 {
+		texcoords = nil
+	}
+	ncolor := comps["COLOR_0"]
+	if (ncolor != 3 && ncolor != 4) || len(colors) < count*ncolor {
+		colors = nil
+	}
+	mtl, tex, err := imp.material(r, prim.Material)
+	if err != nil {
+		return nil, err
+	}
+	if texcoords == nil {
+		tex = LM_INVALID_ID
+	}
+	uv := mat3.Ident
+	if prim.Material != nil && *prim.Material >= 0 && *prim.Material < len(r.doc.Materials) {
+		uv = gltfUVMatrix(r.doc.Materials[*prim.Material].PbrMetallicRoughness.BaseColorTexture)
+	}
+	copyVertex := func(dst *NodeMesh, i uint32) {
+		v := dvec3.T{float64(pos[i*3]), float64(pos[i*3+1]), float64(pos[i*3+2])}
+		v = m.MulVec3(&v)
+		dst.Verts = append(dst.Verts, vec3.T{float32(v[0] - origin[0]), float32(v[1] - origin[1]), float32(v[2] - origin[2])})
+		if normals != nil {
+			n := dvec3.T{float64(normals[i*3]), float64(normals[i*3+1]), float64(normals[i*3+2])}
+			n = normalMat.MulVec3W(&n, 0)
+			dst.Normals = append(dst.Normals, encodeNormal(vec3.T{float32(n[0]), float32(n[1]), float32(n[2])}))
+		}
+		if texcoords != nil {
+			t := vec2.T{texcoords[i*2], texcoords[i*2+1]}
+			dst.Texcoords = append(dst.Texcoords, vec2.T{uv[0][0]*t[0] + uv[1][0]*t[1] + uv[2][0], 1 - (uv[0][1]*t[0] + uv[1][1]*t[1] + uv[2][1])})
+		}
+		if colors != nil {
+			c := [4]byte{255, 255, 255, 255}
+			for k := 0; k < ncolor; k++ {
+				c[k] = colorFactor(colors[int(i)*ncolor+k])
+			}
+			dst.Colors = append(dst.Colors, c)
+		}
+	}
+	if m.Determinant() < 0 {
+		for i := range faces {
+			faces[i][1], faces[i][2] = faces[i][2], faces[i][1]
+		}
+	}
+
+	var parts []gltfPart
+	for _, mesh := range splitIndexedMesh(count, faces, copyVertex) {
+		parts = append(parts, gltfPart{mesh: mesh, patch: Patch{TexID: tex, MtlID: mtl, FeatID: LM_INVALID_ID}})
+	}
+	return parts, nil
+}
+
+func (imp *gltfImporter) setOrigin(v dvec3.T) {
+	for k := range imp.origin {
+		imp.origin[k] = float64(float32(v[k]))
+	}
+	imp.hasOrigin = true
+}
+
+func (imp *gltfImporter) mesh(r *gltfReader, mesh int, m *dmat4.T, relative bool) ([]gltfPart, error) {
+	if mesh < 0 || mesh >= len(r.doc.Meshes) {
+		return nil, errors.New("gltf: mesh index error")
+	}
+	var parts []gltfPart
+	for i := range r.doc.Meshes[mesh].Primitives {
+		p, err := imp.primitive(r, &r.doc.Meshes[mesh].Primitives[i], m, relative)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p...)
+	}
+	return parts, nil
+}
+
+func (imp *gltfImporter) scene(r *gltfReader, root *dmat4.T) ([]gltfPart, error) {
+	var parts []gltfPart
+	err := r.walk(root, func(n int, m *dmat4.T) error {
+		node := &r.doc.Nodes[n]
+		if node.Mesh == nil {
+			return nil
+		}
+		p, err := imp.mesh(r, *node.Mesh, m, true)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, p...)
+		return nil
+	})
+	return parts, err
+}
+
+func packParts(parts []gltfPart) ([]NodeMesh, [][]Patch) {
+	var meshes []NodeMesh
+	var patchs [][]Patch
+	for _, part := range parts {
+		if len(meshes) == 0 || len(meshes[len(meshes)-1].Verts)+len(part.mesh.Verts) > OBJ_MAX_VERTS {
+			meshes = append(meshes, NodeMesh{})
+			patchs = append(patchs, nil)
+		}
+		mesh := &meshes[len(meshes)-1]
+		appendNodeMesh(mesh, &part.mesh)
+		patch := part.patch
+		patch.FaceOffset = uint32(len(mesh.Faces))
+		patchs[len(patchs)-1] = append(patchs[len(patchs)-1], patch)
+	}
+	return meshes, patchs
+}
+
+func (imp *gltfImporter) signature(meshes []NodeMesh) Signature {
+	sign := Signature{}
+	sign.Vertex.SetComponent(VERTEX_COORD, Attribute{Type: ATTR_FLOAT, Number: 3})
+	sign.Face.SetComponent(FACE_INDEX, Attribute{Type: ATTR_UNSIGNED_SHORT, Number: 3})
+	var hasTex, hasNorm, hasColor bool
+	for i := range meshes {
+		hasTex = hasTex || meshes[i].HasTexcoord()
+		hasNorm = hasNorm || meshes[i].HasNormal()
+		hasColor = hasColor || meshes[i].HasColor()
+	}
+	for i := range meshes {
+		m := &meshes[i]
+		if hasTex && !m.HasTexcoord() {
+			m.Texcoords = make([]vec2.T, len(m.Verts))
+		}
+		if hasNorm && !m.HasNormal() {
+			m.Normals = make([][3]int16, len(m.Verts))
+		}
+		if hasColor && !m.HasColor() {
+			m.Colors = make([][4]byte, len(m.Verts))
+			for j := range m.Colors {
+				m.Colors[j] = [4]byte{255, 255, 255, 255}
+			}
+		}
+	}
+	if hasTex {
+		sign.Vertex.SetComponent(VERTEX_TEX, Attribute{Type: ATTR_FLOAT, Number: 2})
+	}
+	if hasNorm {
+		sign.Vertex.SetComponent(VERTEX_NORM, Attribute{Type: ATTR_SHORT, Number: 3})
+	}
+	if hasColor {
+		sign.Vertex.SetComponent(VERTEX_COLOR, Attribute{Type: ATTR_UNSIGNED_BYTE, Number: 4})
+	}
+	if len(imp.images) > 0 {
+		sign.SetFlag(PTJPG)
+		for _, f := range imp.formats {
+			if f != "jpeg" {
+				sign.UnsetFlag(PTJPG)
+				sign.SetFlag(PTPNG)
+				break
+			}
+		}
+	}
+	return sign
+}
+
+func (imp *gltfImporter) apply(a *Archive) {
+	a.Header.NMaterials = uint32(len(imp.materials))
+	a.Materials = append([]Material(nil), imp.materials...)
+	if len(imp.images) > 0 {
+		a.Header.NTextures = uint32(len(imp.images) + 1)
+		a.Textures = make([]Texture, a.Header.NTextures)
+		a.TextureImages = append(append([]TextureImage(nil), imp.images...), nil)
+	}
+	if imp.hasOrigin && (imp.origin[0] != 0 || imp.origin[1] != 0 || imp.origin[2] != 0) {
+		a.Header.Matrix = mat4.Ident
+		a.Header.Matrix[3] = [4]float32{float32(imp.origin[0]), float32(imp.origin[1]), float32(imp.origin[2]), 1}
+	}
+}
+
+type gltfInstances struct {
+	meshes    []NodeMesh
+	patchs    [][]Patch
+	instances []Instance
+	nodes     map[int]int
+}
+
+func (imp *gltfImporter) instance(r *gltfReader, inst *gltfInstances, n int, m *dmat4.T) (bool, error) {
+	mesh := *r.doc.Nodes[n].Mesh
+	id, ok := inst.nodes[mesh]
+	if !ok {
+		parts, err := imp.mesh(r, mesh, &dmat4.Ident, false)
+		if err != nil {
+			return false, err
+		}
+		meshes, patchs := packParts(parts)
+		id = -1
+		if len(meshes) == 1 {
+			id = len(inst.meshes)
+			inst.meshes = append(inst.meshes, meshes[0])
+			inst.patchs = append(inst.patchs, patchs[0])
+		}
+		inst.nodes[mesh] = id
+	}
+	if id < 0 {
+		return false, nil
+	}
+	if !imp.hasOrigin {
+		imp.setOrigin(dvec3.T{m[3][0], m[3][1], m[3][2]})
+	}
+	var mat mat4.T
+	for c := 0; c < 4; c++ {
+		for k := 0; k < 4; k++ {
+			mat[c][k] = float32(m[c][k])
+		}
+	}
+	for k := 0; k < 3; k++ {
+		mat[3][k] = float32(m[3][k] - imp.origin[k])
+	}
+	inst.instances = append(inst.instances, Instance{Node: uint32(id), InstanceID: uint32(n), InstanceMat: mat})
+	return true, nil
+}
+
+func (imp *gltfImporter) archive(parts []gltfPart, inst *gltfInstances, setting *CompressSetting) *Archive {
+	meshes, patchs := packParts(parts)
+	all := append(append([]NodeMesh(nil), meshes...), inst.meshes...)
+	sign := imp.signature(all)
+	meshes, inst.meshes = all[:len(meshes)], all[len(meshes):]
+
+	sink := uint32(len(meshes))
+	nodes := make([]Node, len(meshes))
+	var flat []Patch
+	for i := range meshes {
+		sphere := pointsSphere(meshes[i].Verts)
+		nodes[i] = Node{Sphere: sphere, TightRadius: sphere.Radius(), FirstPatch: uint32(len(flat))}
+		for _, p := range patchs[i] {
+			p.Node = sink
+			flat = append(flat, p)
+		}
+	}
+	a := newDAGArchive(sign, nodes, flat, meshes, setting)
+	imp.apply(a)
+	if len(inst.instances) == 0 {
+		return a
+	}
+
+	a.InstanceNodes = make([]Node, len(inst.meshes)+1)
+	for i := range inst.meshes {
+		mesh := &inst.meshes[i]
+		sphere := pointsSphere(mesh.Verts)
+		a.InstanceNodes[i] = Node{NVert: uint16(len(mesh.Verts)), NFace: uint16(len(mesh.Faces)), Sphere: sphere, TightRadius: sphere.Radius(), FirstPatch: uint32(len(a.Patchs))}
+		for _, p := range inst.patchs[i] {
+			p.Node = LM_INVALID_ID
+			a.Patchs = append(a.Patchs, p)
+		}
+	}
+	a.InstanceNodes[len(inst.meshes)] = Node{FirstPatch: uint32(len(a.Patchs))}
+	a.InstanceMeshs = append(inst.meshes, NodeMesh{})
+	a.Instances = inst.instances
+	for i := range a.Instances {
+		s := transformSphere(&a.Instances[i].InstanceMat, a.InstanceNodes[a.Instances[i].Node].Sphere)
+		a.Header.Sphere = unionSphere(a.Header.Sphere, s)
+	}
+	a.Header.NPatches = uint32(len(a.Patchs))
+	a.Header.NInstanceNodes = uint32(len(a.InstanceNodes))
+	a.Header.NInstances = uint32(len(a.Instances))
+	return a
+}
+
+func ImportGltf(reader io.Reader, open func(name string) (io.ReadCloser, error), setting *CompressSetting) (*Archive, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	r, err := readGltf(data, open)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[int]int)
+	r.walk(&dmat4.Ident, func(n int, m *dmat4.T) error {
+		if r.doc.Nodes[n].Mesh != nil {
+			refs[*r.doc.Nodes[n].Mesh]++
+		}
+		return nil
+	})
+
+	imp := newGltfImporter()
+	inst := &gltfInstances{nodes: make(map[int]int)}
+	var parts []gltfPart
+	err = r.walk(&dmat4.Ident, func(n int, m *dmat4.T) error {
+		node := &r.doc.Nodes[n]
+		if node.Mesh == nil {
+			return nil
+		}
+		if refs[*node.Mesh] > 1 {
+			if ok, err := imp.instance(r, inst, n, m); ok || err != nil {
+				return err
+			}
+		}
+		p, err := imp.mesh(r, *node.Mesh, m, true)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, p...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 && len(inst.instances) == 0 {
+		return nil, errors.New("gltf: no geometry")
+	}
+	return imp.archive(parts, inst, setting), nil
+}
+
+func ImportGltfFile(path string, setting *CompressSetting) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ImportGltf(f, NewObjDirReader(filepath.Dir(path)).Open, setting)
+}
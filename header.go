@@ -63,6 +63,8 @@ const (
 	VERTEX_COLOR ComponentType = 2
 	VERTEX_TEX   ComponentType = 3
 	VERTEX_DATA0 ComponentType = 4
+
+	VERTEX_GEOMORPH = VERTEX_DATA0
 )
 
 type VertexElement struct {
@@ -85,6 +87,10 @@ func (e *VertexElement) HasData(i int) bool {
 	return e.Attributes[int(VERTEX_DATA0)+i].Valid()
 }
 
+func (e *VertexElement) HasGeomorphs() bool {
+	return e.Attributes[VERTEX_GEOMORPH].Valid()
+}
+
 const (
 	FACE_INDEX ComponentType = 0
 	FACE_NORM  ComponentType = 1
@@ -120,11 +126,14 @@ func (e *FaceElement) HasData(i int) bool {
 type FlagType uint32
 
 const (
-	PTJPG FlagType = 0x1
-	PTPNG FlagType = 0x2
-	CORTO FlagType = 0x4
-	DRACO FlagType = 0x8
-	TILE  FlagType = 0x16
+	PTJPG       FlagType = 0x1
+	PTPNG       FlagType = 0x2
+	CORTO       FlagType = 0x4
+	DRACO       FlagType = 0x8
+	TILE        FlagType = 0x16
+	HORIZON     FlagType = 0x20
+	MESHOPT     FlagType = 0x40
+	NODE_CODECS FlagType = 0x80
 )
 
 type Signature struct {
@@ -145,7 +154,15 @@ func (s *Signature) HasPTextures() bool {
 }
 
 func (s *Signature) IsCompressed() bool {
-	return (s.Flags & (CORTO | DRACO)) > 0
+	return (s.Flags & compressedFlagMask()) > 0
+}
+
+func (s *Signature) HasHorizonPoints() bool {
+	return (s.Flags & HORIZON) > 0
+}
+
+func (s *Signature) HasNodeCodecs() bool {
+	return (s.Flags & NODE_CODECS) > 0
 }
 
 func (s *Signature) IsTile() bool {
@@ -178,7 +195,16 @@ type Header struct {
 	Sphere         Sphere
 	Matrix         mat4.T
 	Tile           [3]uint32
-	Padding        [76]byte
+	Quantization   Quantization
+	Padding        [60]byte
+}
+
+type Quantization struct {
+	CoordStep  float32
+	UvStep     float32
+	NormalBits uint8
+	ColorBits  [4]uint8
+	Reserved   [3]byte
 }
 
 func NewHeader(sign Signature) *Header {
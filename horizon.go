@@ -0,0 +1,140 @@
+package lodm
+
+import (
+	"math"
+
+	dvec3 "github.com/flywave/go3d/float64/vec3"
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec3"
+)
+
+const (
+	WGS84_RADIUS_X float64 = 6378137.0
+	WGS84_RADIUS_Y float64 = 6378137.0
+	WGS84_RADIUS_Z float64 = 6356752.3142451793
+)
+
+var (
+	wgs84Radii = dvec3.T{WGS84_RADIUS_X, WGS84_RADIUS_Y, WGS84_RADIUS_Z}
+)
+
+func toScaledSpace(p dvec3.T) dvec3.T {
+	return dvec3.T{p[0] / wgs84Radii[0], p[1] / wgs84Radii[1], p[2] / wgs84Radii[2]}
+}
+
+func toECEF(m *mat4.T, p *vec3.T) dvec3.T {
+	x, y, z := float64(p[0]), float64(p[1]), float64(p[2])
+	return dvec3.T{
+		float64(m[0][0])*x + float64(m[1][0])*y + float64(m[2][0])*z + float64(m[3][0]),
+		float64(m[0][1])*x + float64(m[1][1])*y + float64(m[2][1])*z + float64(m[3][1]),
+		float64(m[0][2])*x + float64(m[1][2])*y + float64(m[2][2])*z + float64(m[3][2]),
+	}
+}
+
+func horizonMagnitude(position dvec3.T, scaledDirection *dvec3.T) float64 {
+	scaled := toScaledSpace(position)
+	magnitudeSquared := scaled.LengthSqr()
+	magnitude := math.Sqrt(magnitudeSquared)
+	if magnitude == 0 {
+		return 0
+	}
+	direction := scaled.Scaled(1 / magnitude)
+
+	magnitudeSquared = math.Max(1, magnitudeSquared)
+	magnitude = math.Max(1, magnitude)
+
+	cosAlpha := dvec3.Dot(&direction, scaledDirection)
+	cross := dvec3.Cross(&direction, scaledDirection)
+	sinAlpha := cross.Length()
+	cosBeta := 1 / magnitude
+	sinBeta := math.Sqrt(magnitudeSquared-1) * cosBeta
+
+	return 1 / (cosAlpha*cosBeta - sinAlpha*sinBeta)
+}
+
+func computeHorizonPoint(direction dvec3.T, positions []dvec3.T) (dvec3.T, bool) {
+	scaledDirection := toScaledSpace(direction)
+	if scaledDirection.IsZero() {
+		return dvec3.T{}, false
+	}
+	scaledDirection.Normalize()
+	result := float64(0)
+	for i := range positions {
+		m := horizonMagnitude(positions[i], &scaledDirection)
+		if m < 0 || math.IsInf(m, 0) || math.IsNaN(m) {
+			return dvec3.T{}, false
+		}
+		result = math.Max(result, m)
+	}
+	return scaledDirection.Scaled(result), true
+}
+
+func isScaledSpacePointVisible(occludee, camera *dvec3.T) bool {
+	vhMagnitudeSquared := camera.LengthSqr() - 1
+	vt := dvec3.Sub(occludee, camera)
+	vtDotVc := -dvec3.Dot(&vt, camera)
+	var occluded bool
+	if vhMagnitudeSquared < 0 {
+		occluded = vtDotVc > 0
+	} else {
+		occluded = vtDotVc > vhMagnitudeSquared && vtDotVc*vtDotVc/vt.LengthSqr() > vhMagnitudeSquared
+	}
+	return !occluded
+}
+
+func (a *Archive) BuildHorizonPoints() error {
+	model := a.modelMatrix()
+	scale := float64(transformSphere(&model, Sphere{0, 0, 0, 1}).Radius())
+	sink := a.sinkNode()
+	bounds := make([]Sphere, len(a.Nodes))
+	points := make([]dvec3.T, len(a.Nodes))
+	for n := int(sink) - 1; n >= 0; n-- {
+		bounds[n] = a.Nodes[n].Sphere
+		first_patch, last_patch := a.getNodePatchRange(uint32(n))
+		for p := first_patch; p < last_patch; p++ {
+			if child := a.Patchs[p].Node; child > uint32(n) && child < sink {
+				bounds[n] = unionSphere(bounds[n], bounds[child])
+			}
+		}
+		if bounds[n].IsEmpty() {
+			continue
+		}
+		center := bounds[n].Center()
+		direction := toECEF(&model, &center)
+		radius := float64(bounds[n].Radius()) * scale
+		positions := make([]dvec3.T, 8)
+		for i := range positions {
+			positions[i] = direction
+			for k := 0; k < 3; k++ {
+				if i&(1<<uint(k)) != 0 {
+					positions[i][k] += radius
+				} else {
+					positions[i][k] -= radius
+				}
+			}
+		}
+		if p, ok := computeHorizonPoint(direction, positions); ok {
+			points[n] = p
+		}
+	}
+	a.HorizonPoints = points
+	a.Header.Sign.SetFlag(HORIZON)
+	return nil
+}
+
+func (t *Traversal) isAboveHorizon(n uint32) bool {
+	a := t.Archive
+	if !t.HorizonCulling || len(a.HorizonPoints) <= int(n) {
+		return true
+	}
+	p := a.HorizonPoints[n]
+	if p.IsZero() {
+		return true
+	}
+	eye := t.Camera.EyeECEF
+	if eye.IsZero() {
+		eye = dvec3.T{float64(t.Camera.Eye[0]), float64(t.Camera.Eye[1]), float64(t.Camera.Eye[2])}
+	}
+	camera := toScaledSpace(eye)
+	return isScaledSpacePointVisible(&p, &camera)
+}
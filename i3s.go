@@ -0,0 +1,643 @@
+package lodm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec3"
+)
+
+const (
+	I3S_VERSION        = "1.8"
+	I3S_NODES_PER_PAGE = 64
+)
+
+type I3SSetting struct {
+	Name string
+	WKID int
+}
+
+var (
+	DEFAULT_I3S_SETTING = I3SSetting{Name: "lodm", WKID: 3857}
+)
+
+type i3sOBB struct {
+	Center     [3]float64 `json:"center"`
+	HalfSize   [3]float32 `json:"halfSize"`
+	Quaternion [4]float32 `json:"quaternion"`
+}
+
+type i3sResource struct {
+	Definition   *int `json:"definition,omitempty"`
+	Resource     int  `json:"resource"`
+	VertexCount  *int `json:"vertexCount,omitempty"`
+	FeatureCount *int `json:"featureCount,omitempty"`
+}
+
+type i3sNodeMesh struct {
+	Geometry  *i3sResource `json:"geometry,omitempty"`
+	Material  *i3sResource `json:"material,omitempty"`
+	Attribute *i3sResource `json:"attribute,omitempty"`
+}
+
+type i3sPageNode struct {
+	Index        int          `json:"index"`
+	LodThreshold float64      `json:"lodThreshold"`
+	OBB          i3sOBB       `json:"obb"`
+	Children     []int        `json:"children,omitempty"`
+	ParentIndex  *int         `json:"parentIndex,omitempty"`
+	Mesh         *i3sNodeMesh `json:"mesh,omitempty"`
+}
+
+type i3sNode struct {
+	node     uint32
+	parent   int
+	level    int
+	children []int
+	mbs      [4]float64
+	page     i3sPageNode
+}
+
+type i3sExporter struct {
+	archive   *Archive
+	sink      ExportSink
+	setting   I3SSetting
+	model     mat4.T
+	normalMat mat4.T
+	nodes     []*i3sNode
+	materials map[materialKey]int
+	matDefs   []interface{}
+	features  bool
+	warnings  []string
+}
+
+type i3sFaceGroup struct {
+	feature uint32
+	faces   [][3]uint16
+	texture []uint32
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (e *i3sExporter) writeJSON(name string, v interface{}, compress bool) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if compress {
+		return writeSinkFile(e.sink, name+".gz", gzipBytes(js))
+	}
+	return writeSinkFile(e.sink, name, js)
+}
+
+func (e *i3sExporter) transform(v vec3.T) [3]float64 {
+	m := &e.model
+	var ret [3]float64
+	for k := 0; k < 3; k++ {
+		ret[k] = float64(m[0][k])*float64(v[0]) + float64(m[1][k])*float64(v[1]) + float64(m[2][k])*float64(v[2]) + float64(m[3][k])
+	}
+	return ret
+}
+
+func (e *i3sExporter) sphere(s Sphere) [4]float64 {
+	c := e.transform(s.Center())
+	r := transformSphere(&e.model, Sphere{0, 0, 0, s.Radius()}).Radius()
+	return [4]float64{c[0], c[1], c[2], float64(r)}
+}
+
+func (e *i3sExporter) buildNodes() {
+	a := e.archive
+	sink_node := a.sinkNode()
+	parent := a.firstParents()
+	children := make([][]uint32, sink_node)
+	var roots []uint32
+	for n := uint32(0); n < sink_node; n++ {
+		if parent[n] == LM_INVALID_ID {
+			roots = append(roots, n)
+		} else {
+			children[parent[n]] = append(children[parent[n]], n)
+		}
+	}
+
+	queue := []*i3sNode{}
+	if len(roots) == 1 {
+		queue = append(queue, &i3sNode{node: roots[0], parent: -1})
+	} else {
+		root := &i3sNode{node: LM_INVALID_ID, parent: -1, mbs: e.sphere(a.Header.Sphere)}
+		queue = append(queue, root)
+	}
+	for i := 0; i < len(queue); i++ {
+		cur := queue[i]
+		var kids []uint32
+		if cur.node == LM_INVALID_ID {
+			kids = roots
+		} else {
+			kids = children[cur.node]
+			cur.mbs = e.sphere(a.Nodes[cur.node].Sphere)
+		}
+		for _, c := range kids {
+			cur.children = append(cur.children, len(queue))
+			queue = append(queue, &i3sNode{node: c, parent: i, level: cur.level + 1})
+		}
+	}
+	e.nodes = queue
+}
+
+func i3sLodThreshold(node *Node) float64 {
+	if node.Error <= 0 {
+		return 0
+	}
+	d := 2 * float64(node.Sphere.Radius()) / float64(node.Error)
+	return math.Pi / 4 * d * d
+}
+
+func (e *i3sExporter) material(mtl uint32, textured bool) int {
+	a := e.archive
+	if mtl != LM_INVALID_ID && int(mtl) >= len(a.Materials) {
+		mtl = LM_INVALID_ID
+	}
+	key := materialKey{MtlID: mtl, TexID: LM_INVALID_ID}
+	if textured {
+		key.TexID = 0
+	}
+	if idx, ok := e.materials[key]; ok {
+		return idx
+	}
+	pbr := map[string]interface{}{"baseColorFactor": []float32{1, 1, 1, 1}, "metallicFactor": 0, "roughnessFactor": 1}
+	def := map[string]interface{}{"doubleSided": true, "pbrMetallicRoughness": pbr}
+	if mtl != LM_INVALID_ID {
+		m := &a.Materials[mtl]
+		color := []float32{float32(m.Color[0]) / 255, float32(m.Color[1]) / 255, float32(m.Color[2]) / 255, 1}
+		if m.Opacity > 0 && m.Opacity < 1 {
+			color[3] = m.Opacity
+			def["alphaMode"] = "blend"
+		}
+		pbr["baseColorFactor"] = color
+		if m.Type == MTL_PBR {
+			pbr["metallicFactor"], pbr["roughnessFactor"] = m.Metallic, m.Roughness
+		}
+		if m.Emissive != [3]byte{} {
+			def["emissiveFactor"] = []float32{float32(m.Emissive[0]) / 255, float32(m.Emissive[1]) / 255, float32(m.Emissive[2]) / 255}
+		}
+	}
+	if textured {
+		pbr["baseColorTexture"] = map[string]interface{}{"textureSetDefinitionId": 0}
+	}
+	e.matDefs = append(e.matDefs, def)
+	e.materials[key] = len(e.matDefs) - 1
+	return e.materials[key]
+}
+
+func (e *i3sExporter) faceGroups(n uint32) ([]*i3sFaceGroup, uint32, uint32) {
+	a := e.archive
+	mesh := &a.NodeMeshs[n]
+	tex, mtl := LM_INVALID_ID, LM_INVALID_ID
+	textures, materials := map[uint32]bool{}, map[uint32]bool{}
+	var groups []*i3sFaceGroup
+	var none *i3sFaceGroup
+	index := make(map[uint32]*i3sFaceGroup)
+
+	start := uint32(0)
+	first_patch, last_patch := a.getNodePatchRange(n)
+	for p := first_patch; p < last_patch; p++ {
+		patch := &a.Patchs[p]
+		if patch.TexID != LM_INVALID_ID && mesh.HasTexcoord() {
+			textures[patch.TexID] = true
+			if tex == LM_INVALID_ID {
+				tex = patch.TexID
+			}
+		}
+		if patch.MtlID != LM_INVALID_ID {
+			materials[patch.MtlID] = true
+			if mtl == LM_INVALID_ID {
+				mtl = patch.MtlID
+			}
+		}
+		fid := patch.FeatID
+		if int(fid)+1 >= len(a.Features) {
+			fid = LM_INVALID_ID
+		}
+		g := index[fid]
+		if g == nil {
+			g = &i3sFaceGroup{feature: fid}
+			index[fid] = g
+			if fid == LM_INVALID_ID {
+				none = g
+			} else {
+				groups = append(groups, g)
+			}
+		}
+		for f := start; f < patch.FaceOffset && int(f) < len(mesh.Faces); f++ {
+			g.faces = append(g.faces, mesh.Faces[f])
+			g.texture = append(g.texture, patch.TexID)
+		}
+		start = patch.FaceOffset
+	}
+	if len(textures) > 1 {
+		e.warnings = append(e.warnings, fmt.Sprintf("node %v: kept texture %v of %v", n, tex, len(textures)))
+	}
+	if len(materials) > 1 {
+		e.warnings = append(e.warnings, fmt.Sprintf("node %v: kept material %v of %v", n, mtl, len(materials)))
+	}
+	if none != nil {
+		groups = append(groups, none)
+	}
+	return groups, tex, mtl
+}
+
+func (e *i3sExporter) geometryBuffer(n uint32, node *i3sNode, groups []*i3sFaceGroup) ([]byte, int, int) {
+	a := e.archive
+	sig := &a.Header.Sign
+	mesh := &a.NodeMeshs[n]
+	var nverts, nfeatures int
+	for _, g := range groups {
+		nverts += len(g.faces) * 3
+		if g.feature != LM_INVALID_ID {
+			nfeatures++
+		}
+	}
+
+	var positions, normals, uvs bytes.Buffer
+	var colors []byte
+	var normal []vec3.T
+	if mesh.HasNormal() {
+		normal = decodeNormals(mesh.Normals)
+	}
+	var featureIds []uint64
+	var faceRanges []uint32
+	face := uint32(0)
+	for _, g := range groups {
+		if g.feature != LM_INVALID_ID {
+			featureIds = append(featureIds, uint64(a.Features[g.feature].ID))
+			faceRanges = append(faceRanges, face, face+uint32(len(g.faces))-1)
+		}
+		face += uint32(len(g.faces))
+		for f, tri := range g.faces {
+			for _, i := range tri {
+				p := e.transform(mesh.Verts[i])
+				binary.Write(&positions, byteorder, [3]float32{float32(p[0] - node.mbs[0]), float32(p[1] - node.mbs[1]), float32(p[2] - node.mbs[2])})
+				if sig.Vertex.HasNormals() {
+					var nm vec3.T
+					if normal != nil {
+						nm = e.normalMat.MulVec3W(&normal[i], 0)
+						if l := nm.Length(); l > 0 {
+							nm.Scale(1 / l)
+						}
+					}
+					binary.Write(&normals, byteorder, nm)
+				}
+				if sig.Vertex.HasTextures() {
+					var uv vec3.T
+					if mesh.HasTexcoord() {
+						uv = vec3.T{mesh.Texcoords[i][0], mesh.Texcoords[i][1], 1}
+						if t := g.texture[f]; t != LM_INVALID_ID && int(t) < len(a.Textures) && !a.Textures[t].Mat.IsZero() {
+							uv = a.Textures[t].Mat.MulVec3(&uv)
+						}
+					}
+					binary.Write(&uvs, byteorder, [2]float32{uv[0], 1 - uv[1]})
+				}
+				if sig.Vertex.HasColors() {
+					c := [4]byte{255, 255, 255, 255}
+					if mesh.HasColor() {
+						c = mesh.Colors[i]
+					}
+					colors = append(colors, c[:]...)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, byteorder, [2]uint32{uint32(nverts), uint32(nfeatures)})
+	buf.Write(positions.Bytes())
+	buf.Write(normals.Bytes())
+	buf.Write(uvs.Bytes())
+	buf.Write(colors)
+	binary.Write(&buf, byteorder, featureIds)
+	binary.Write(&buf, byteorder, faceRanges)
+	return buf.Bytes(), nverts, nfeatures
+}
+
+func (e *i3sExporter) writeAttributes(dir string, groups []*i3sFaceGroup) error {
+	a := e.archive
+	var ids, types []uint32
+	var counts []uint32
+	var values []byte
+	for _, g := range groups {
+		if g.feature == LM_INVALID_ID {
+			continue
+		}
+		ids = append(ids, a.Features[g.feature].ID)
+		types = append(types, a.Features[g.feature].Type)
+		var data []byte
+		if int(g.feature) < len(a.FeatureDatas) {
+			data = a.FeatureDatas[g.feature]
+		}
+		values = append(values, data...)
+		values = append(values, 0)
+		counts = append(counts, uint32(len(data)+1))
+	}
+	for k, vals := range [][]uint32{ids, types} {
+		var buf bytes.Buffer
+		binary.Write(&buf, byteorder, uint32(len(vals)))
+		binary.Write(&buf, byteorder, vals)
+		if err := writeSinkFile(e.sink, fmt.Sprintf("%s/attributes/f_%d/0.bin.gz", dir, k), gzipBytes(buf.Bytes())); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, byteorder, [2]uint32{uint32(len(counts)), uint32(len(values))})
+	binary.Write(&buf, byteorder, counts)
+	buf.Write(values)
+	return writeSinkFile(e.sink, fmt.Sprintf("%s/attributes/f_2/0.bin.gz", dir), gzipBytes(buf.Bytes()))
+}
+
+func i3sHref(i int) string {
+	return fmt.Sprintf("../%d", i)
+}
+
+func (e *i3sExporter) writeNode(i int) error {
+	a := e.archive
+	node := e.nodes[i]
+	dir := fmt.Sprintf("nodes/%d", i)
+	r := float32(node.mbs[3])
+	node.page = i3sPageNode{Index: i, Children: node.children, OBB: i3sOBB{Center: [3]float64{node.mbs[0], node.mbs[1], node.mbs[2]}, HalfSize: [3]float32{r, r, r}, Quaternion: [4]float32{0, 0, 0, 1}}}
+	if node.parent >= 0 {
+		parent := node.parent
+		node.page.ParentIndex = &parent
+	}
+
+	doc := map[string]interface{}{
+		"id":    fmt.Sprint(i),
+		"level": node.level,
+		"mbs":   node.mbs,
+		"obb":   node.page.OBB,
+	}
+	if node.parent >= 0 {
+		p := e.nodes[node.parent]
+		doc["parentNode"] = map[string]interface{}{"id": fmt.Sprint(node.parent), "href": i3sHref(node.parent), "mbs": p.mbs}
+	}
+	var kids []interface{}
+	for _, c := range node.children {
+		kids = append(kids, map[string]interface{}{"id": fmt.Sprint(c), "href": i3sHref(c), "mbs": e.nodes[c].mbs})
+	}
+	if kids != nil {
+		doc["children"] = kids
+	}
+
+	if node.node != LM_INVALID_ID {
+		n := node.node
+		if len(node.children) > 0 {
+			node.page.LodThreshold = i3sLodThreshold(&a.Nodes[n])
+			doc["lodSelection"] = []interface{}{
+				map[string]interface{}{"metricType": "maxScreenThresholdSQ", "maxError": node.page.LodThreshold},
+				map[string]interface{}{"metricType": "maxScreenThreshold", "maxError": math.Sqrt(node.page.LodThreshold * 4 / math.Pi)},
+			}
+		}
+		if err := a.LoadNode(n); err != nil {
+			return err
+		}
+		groups, tex, mtl := e.faceGroups(n)
+		data, nverts, nfeatures := e.geometryBuffer(n, node, groups)
+		if nverts > 0 {
+			def := 0
+			node.page.Mesh = &i3sNodeMesh{Geometry: &i3sResource{Definition: &def, Resource: i, VertexCount: &nverts, FeatureCount: &nfeatures}}
+			if err := writeSinkFile(e.sink, dir+"/geometries/0.bin.gz", gzipBytes(data)); err != nil {
+				return err
+			}
+			doc["geometryData"] = []interface{}{map[string]interface{}{"href": "./geometries/0"}}
+
+			textured := false
+			if tex != LM_INVALID_ID && int(tex) < len(a.TextureImages) && a.TextureImages[tex] != nil {
+				img, err := encodeTexture(a.Header, a.TextureImages[tex])
+				if err != nil {
+					return err
+				}
+				if err := writeSinkFile(e.sink, fmt.Sprintf("%s/textures/0.%s", dir, textureExt(a.Header)), img); err != nil {
+					return err
+				}
+				doc["textureData"] = []interface{}{map[string]interface{}{"href": "./textures/0"}}
+				textured = true
+			}
+			mdef := e.material(mtl, textured)
+			node.page.Mesh.Material = &i3sResource{Definition: &mdef, Resource: i}
+
+			if e.features {
+				if err := e.writeAttributes(dir, groups); err != nil {
+					return err
+				}
+				node.page.Mesh.Attribute = &i3sResource{Resource: i}
+				doc["attributeData"] = []interface{}{
+					map[string]interface{}{"href": "./attributes/f_0/0"},
+					map[string]interface{}{"href": "./attributes/f_1/0"},
+					map[string]interface{}{"href": "./attributes/f_2/0"},
+				}
+			}
+		}
+	}
+	return e.writeJSON(dir+"/3dNodeIndexDocument.json", doc, true)
+}
+
+func (e *i3sExporter) geometryDefinition() map[string]interface{} {
+	sig := &e.archive.Header.Sign
+	def := map[string]interface{}{
+		"offset":   8,
+		"position": map[string]interface{}{"type": "Float32", "component": 3},
+	}
+	if sig.Vertex.HasNormals() {
+		def["normal"] = map[string]interface{}{"type": "Float32", "component": 3}
+	}
+	if sig.Vertex.HasTextures() {
+		def["uv0"] = map[string]interface{}{"type": "Float32", "component": 2}
+	}
+	if sig.Vertex.HasColors() {
+		def["color"] = map[string]interface{}{"type": "UInt8", "component": 4}
+	}
+	def["featureId"] = map[string]interface{}{"type": "UInt64", "component": 1, "binding": "per-feature"}
+	def["faceRange"] = map[string]interface{}{"type": "UInt32", "component": 2, "binding": "per-feature"}
+	return map[string]interface{}{"geometryBuffers": []interface{}{def}}
+}
+
+func i3sLayerVersion(name string, h *Header) string {
+	hash := md5.Sum([]byte(fmt.Sprint(name, *h)))
+	return fmt.Sprintf("%X-%X-%X-%X-%X", hash[0:4], hash[4:6], hash[6:8], hash[8:10], hash[10:16])
+}
+
+func (e *i3sExporter) writeLayer() error {
+	a := e.archive
+	root := e.nodes[0].mbs
+	extent := []float64{root[0] - root[3], root[1] - root[3], root[0] + root[3], root[1] + root[3]}
+	sr := map[string]interface{}{"wkid": e.setting.WKID, "latestWkid": e.setting.WKID}
+
+	ext := textureExt(a.Header)
+	var textureFormats []string
+	if len(a.Textures) > 1 {
+		textureFormats = []string{textureMimeType(ext)}
+	}
+	geometry := e.geometryDefinition()
+	layer := map[string]interface{}{
+		"id":               0,
+		"version":          i3sLayerVersion(e.setting.Name, &a.Header),
+		"name":             e.setting.Name,
+		"layerType":        "IntegratedMesh",
+		"spatialReference": sr,
+		"store": map[string]interface{}{
+			"profile":               "meshpyramids",
+			"version":               I3S_VERSION,
+			"resourcePattern":       []string{"3dNodeIndexDocument", "Attributes", "SharedResource", "Geometry"},
+			"rootNode":              "./nodes/0",
+			"extent":                extent,
+			"indexCRS":              fmt.Sprintf("http://www.opengis.net/def/crs/EPSG/0/%d", e.setting.WKID),
+			"vertexCRS":             fmt.Sprintf("http://www.opengis.net/def/crs/EPSG/0/%d", e.setting.WKID),
+			"normalReferenceFrame":  "vertex-reference-frame",
+			"nidEncoding":           "application/vnd.esri.i3s.json+gzip; version=1.6",
+			"geometryEncoding":      "application/octet-stream; version=1.6",
+			"attributeEncoding":     "application/octet-stream; version=1.6",
+			"textureEncoding":       textureFormats,
+			"lodType":               "MeshPyramid",
+			"lodModel":              "node-switching",
+			"defaultGeometrySchema": e.defaultGeometrySchema(),
+		},
+		"nodePages":           map[string]interface{}{"nodesPerPage": I3S_NODES_PER_PAGE, "lodSelectionMetricType": "maxScreenThresholdSQ"},
+		"materialDefinitions": e.matDefs,
+		"geometryDefinitions": []interface{}{geometry},
+	}
+	if len(a.Textures) > 1 {
+		layer["textureSetDefinitions"] = []interface{}{
+			map[string]interface{}{"formats": []interface{}{map[string]interface{}{"name": "0", "format": ext}}},
+		}
+	}
+	if e.features {
+		layer["fields"] = []interface{}{
+			map[string]interface{}{"name": "id", "type": "esriFieldTypeInteger", "alias": "id"},
+			map[string]interface{}{"name": "type", "type": "esriFieldTypeInteger", "alias": "type"},
+			map[string]interface{}{"name": "data", "type": "esriFieldTypeString", "alias": "data"},
+		}
+		count := map[string]interface{}{"property": "count", "valueType": "UInt32"}
+		layer["attributeStorageInfo"] = []interface{}{
+			map[string]interface{}{"key": "f_0", "name": "id", "header": []interface{}{count}, "ordering": []string{"attributeValues"}, "attributeValues": map[string]interface{}{"valueType": "UInt32", "valuesPerElement": 1}},
+			map[string]interface{}{"key": "f_1", "name": "type", "header": []interface{}{count}, "ordering": []string{"attributeValues"}, "attributeValues": map[string]interface{}{"valueType": "UInt32", "valuesPerElement": 1}},
+			map[string]interface{}{"key": "f_2", "name": "data",
+				"header":              []interface{}{count, map[string]interface{}{"property": "attributeValuesByteCount", "valueType": "UInt32"}},
+				"ordering":            []string{"attributeByteCounts", "attributeValues"},
+				"attributeByteCounts": map[string]interface{}{"valueType": "UInt32", "valuesPerElement": 1},
+				"attributeValues":     map[string]interface{}{"valueType": "String", "encoding": "UTF-8", "valuesPerElement": 1},
+			},
+		}
+	}
+	return e.writeJSON("3dSceneLayer.json", layer, true)
+}
+
+func (e *i3sExporter) defaultGeometrySchema() map[string]interface{} {
+	sig := &e.archive.Header.Sign
+	header := []interface{}{
+		map[string]interface{}{"property": "vertexCount", "type": "UInt32"},
+		map[string]interface{}{"property": "featureCount", "type": "UInt32"},
+	}
+	ordering := []string{"position"}
+	vertexAttributes := map[string]interface{}{"position": map[string]interface{}{"valueType": "Float32", "valuesPerElement": 3}}
+	if sig.Vertex.HasNormals() {
+		ordering = append(ordering, "normal")
+		vertexAttributes["normal"] = map[string]interface{}{"valueType": "Float32", "valuesPerElement": 3}
+	}
+	if sig.Vertex.HasTextures() {
+		ordering = append(ordering, "uv0")
+		vertexAttributes["uv0"] = map[string]interface{}{"valueType": "Float32", "valuesPerElement": 2}
+	}
+	if sig.Vertex.HasColors() {
+		ordering = append(ordering, "color")
+		vertexAttributes["color"] = map[string]interface{}{"valueType": "UInt8", "valuesPerElement": 4}
+	}
+	return map[string]interface{}{
+		"geometryType":          "triangles",
+		"topology":              "PerAttributeArray",
+		"header":                header,
+		"ordering":              ordering,
+		"vertexAttributes":      vertexAttributes,
+		"featureAttributeOrder": []string{"id", "faceRange"},
+		"featureAttributes": map[string]interface{}{
+			"id":        map[string]interface{}{"valueType": "UInt64", "valuesPerElement": 1},
+			"faceRange": map[string]interface{}{"valueType": "UInt32", "valuesPerElement": 2},
+		},
+	}
+}
+
+func (a *Archive) ExportI3S(sink ExportSink, setting *I3SSetting) ([]string, error) {
+	if len(a.Nodes) < 2 {
+		return nil, errors.New("archive has no nodes")
+	}
+	if !a.Header.Sign.Face.HasIndex() {
+		return nil, errors.New("i3s: point clouds are not supported")
+	}
+	e := &i3sExporter{archive: a, sink: sink, setting: DEFAULT_I3S_SETTING, model: a.modelMatrix(), materials: make(map[materialKey]int)}
+	if setting != nil {
+		e.setting = *setting
+	}
+	e.normalMat = e.model.Inverted()
+	e.normalMat.Transpose()
+	e.features = len(a.Features) > 1
+	if len(a.Instances) > 0 {
+		e.warnings = append(e.warnings, fmt.Sprintf("dropped %v instances of %v instance nodes", len(a.Instances), len(a.InstanceNodes)))
+	}
+
+	e.buildNodes()
+	for i := range e.nodes {
+		if err := e.writeNode(i); err != nil {
+			return nil, err
+		}
+	}
+	for p := 0; p*I3S_NODES_PER_PAGE < len(e.nodes); p++ {
+		var page []i3sPageNode
+		for i := p * I3S_NODES_PER_PAGE; i < len(e.nodes) && i < (p+1)*I3S_NODES_PER_PAGE; i++ {
+			page = append(page, e.nodes[i].page)
+		}
+		if err := e.writeJSON(fmt.Sprintf("nodepages/%d.json", p), map[string]interface{}{"nodes": page}, true); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.writeLayer(); err != nil {
+		return nil, err
+	}
+	metadata := map[string]interface{}{"folderPattern": "BASIC", "ArchiveCompressionType": "STORE", "ResourceCompressionType": "GZIP", "I3SVersion": I3S_VERSION, "nodeCount": len(e.nodes)}
+	if err := e.writeJSON("metadata.json", metadata, false); err != nil {
+		return nil, err
+	}
+	return e.warnings, nil
+}
+
+func (a *Archive) ExportSLPK(w io.Writer, setting *I3SSetting) ([]string, error) {
+	sink := NewSLPKSink(w)
+	warnings, err := a.ExportI3S(sink, setting)
+	if err != nil {
+		return nil, err
+	}
+	return warnings, sink.Close()
+}
+
+func (a *Archive) ExportSLPKFile(path string, setting *I3SSetting) ([]string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return a.ExportSLPK(f, setting)
+}
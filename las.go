@@ -0,0 +1,314 @@
+package lodm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec3"
+)
+
+const (
+	LAS_HEADER_SIZE         = 375
+	LAS_LEGACY_HEADER_SIZE  = 227
+	LAS_POINT_FORMAT        = 7
+	LAS_POINT_RECORD_LENGTH = 36
+	LAS_DEFAULT_SCALE       = 0.001
+
+	LAS_INTENSITY_DATA      = 1
+	LAS_CLASSIFICATION_DATA = 2
+)
+
+var (
+	lasMinRecordLength = []int{20, 28, 26, 34, 57, 63, 30, 36, 38, 59, 67}
+)
+
+type lasHeader struct {
+	Signature            [4]byte
+	FileSourceID         uint16
+	GlobalEncoding       uint16
+	GUID                 [16]byte
+	VersionMajor         uint8
+	VersionMinor         uint8
+	SystemIdentifier     [32]byte
+	GeneratingSoftware   [32]byte
+	CreationDay          uint16
+	CreationYear         uint16
+	HeaderSize           uint16
+	PointDataOffset      uint32
+	NumberOfVLRs         uint32
+	PointFormat          uint8
+	PointRecordLength    uint16
+	LegacyPointCount     uint32
+	LegacyPointsByReturn [5]uint32
+	Scale                [3]float64
+	Offset               [3]float64
+	MaxX                 float64
+	MinX                 float64
+	MaxY                 float64
+	MinY                 float64
+	MaxZ                 float64
+	MinZ                 float64
+	WaveformOffset       uint64
+	EVLROffset           uint64
+	NumberOfEVLRs        uint32
+	PointCount           uint64
+	PointsByReturn       [15]uint64
+}
+
+func (h *lasHeader) pointCount() uint64 {
+	if h.VersionMinor >= 4 && h.PointCount != 0 {
+		return h.PointCount
+	}
+	return uint64(h.LegacyPointCount)
+}
+
+func (h *lasHeader) rgbOffset() int {
+	switch h.PointFormat {
+	case 2:
+		return 20
+	case 3, 5:
+		return 28
+	case 7, 8, 10:
+		return 30
+	}
+	return -1
+}
+
+func (h *lasHeader) classificationOffset() int {
+	if h.PointFormat >= 6 {
+		return 16
+	}
+	return 15
+}
+
+func readLasHeader(reader io.Reader) (*lasHeader, error) {
+	buf := make([]byte, LAS_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, buf[:LAS_LEGACY_HEADER_SIZE]); err != nil {
+		return nil, err
+	}
+	if string(buf[:4]) != "LASF" {
+		return nil, errors.New("las: bad signature")
+	}
+	size := int(byteorder.Uint16(buf[94:]))
+	if size < LAS_LEGACY_HEADER_SIZE {
+		return nil, errors.New("las: bad header size")
+	}
+	if size > LAS_HEADER_SIZE {
+		size = LAS_HEADER_SIZE
+	}
+	if _, err := io.ReadFull(reader, buf[LAS_LEGACY_HEADER_SIZE:size]); err != nil {
+		return nil, err
+	}
+	h := &lasHeader{}
+	if err := binary.Read(bytes.NewReader(buf), byteorder, h); err != nil {
+		return nil, err
+	}
+	if h.PointFormat&0x80 != 0 {
+		return nil, errors.New("las: compressed point data is not supported")
+	}
+	if int(h.PointFormat) >= len(lasMinRecordLength) || int(h.PointRecordLength) < lasMinRecordLength[h.PointFormat] {
+		return nil, errors.New("las: unsupported point format")
+	}
+	if h.PointDataOffset < uint32(size) {
+		return nil, errors.New("las: bad point data offset")
+	}
+	return h, nil
+}
+
+func lasSignature(hasColor bool) Signature {
+	sign := Signature{}
+	sign.Vertex.SetComponent(VERTEX_COORD, Attribute{Type: ATTR_FLOAT, Number: 3})
+	if hasColor {
+		sign.Vertex.SetComponent(VERTEX_COLOR, Attribute{Type: ATTR_UNSIGNED_BYTE, Number: 4})
+	}
+	sign.Vertex.SetComponent(VERTEX_DATA0+LAS_INTENSITY_DATA, Attribute{Type: ATTR_UNSIGNED_SHORT, Number: 1})
+	sign.Vertex.SetComponent(VERTEX_DATA0+LAS_CLASSIFICATION_DATA, Attribute{Type: ATTR_UNSIGNED_BYTE, Number: 1})
+	return sign
+}
+
+func ImportLas(reader io.Reader, setting *CompressSetting) (*Archive, error) {
+	br := bufio.NewReader(reader)
+	h, err := readLasHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	skip := int(h.PointDataOffset) - int(h.HeaderSize)
+	if h.HeaderSize > LAS_HEADER_SIZE {
+		skip = int(h.PointDataOffset) - LAS_HEADER_SIZE
+	}
+	if _, err := br.Discard(skip); err != nil {
+		return nil, err
+	}
+
+	var origin [3]float64
+	for i := range origin {
+		origin[i] = float64(float32(h.Offset[i]))
+	}
+	rgb := h.rgbOffset()
+	class := h.classificationOffset()
+	count := h.pointCount()
+
+	var meshes []NodeMesh
+	var rgbs [][3]uint16
+	wide := false
+	record := make([]byte, h.PointRecordLength)
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(br, record); err != nil {
+			return nil, err
+		}
+		if i%uint64(OBJ_MAX_VERTS) == 0 {
+			meshes = append(meshes, NodeMesh{})
+		}
+		mesh := &meshes[len(meshes)-1]
+		var v vec3.T
+		for k := range v {
+			x := float64(int32(byteorder.Uint32(record[k*4:])))
+			v[k] = float32(x*h.Scale[k] + h.Offset[k] - origin[k])
+		}
+		mesh.Verts = append(mesh.Verts, v)
+		mesh.Data[LAS_INTENSITY_DATA] = append(mesh.Data[LAS_INTENSITY_DATA], float32(byteorder.Uint16(record[12:])))
+		c := record[class]
+		if h.PointFormat < 6 {
+			c &= 0x1f
+		}
+		mesh.Data[LAS_CLASSIFICATION_DATA] = append(mesh.Data[LAS_CLASSIFICATION_DATA], float32(c))
+		if rgb >= 0 {
+			col := [3]uint16{byteorder.Uint16(record[rgb:]), byteorder.Uint16(record[rgb+2:]), byteorder.Uint16(record[rgb+4:])}
+			wide = wide || col[0] > 255 || col[1] > 255 || col[2] > 255
+			rgbs = append(rgbs, col)
+		}
+	}
+
+	if rgb >= 0 {
+		i := 0
+		for m := range meshes {
+			meshes[m].Colors = make([][4]byte, len(meshes[m].Verts))
+			for v := range meshes[m].Colors {
+				col := rgbs[i]
+				if wide {
+					col[0], col[1], col[2] = col[0]>>8, col[1]>>8, col[2]>>8
+				}
+				meshes[m].Colors[v] = [4]byte{byte(col[0]), byte(col[1]), byte(col[2]), 255}
+				i++
+			}
+		}
+	}
+
+	patchs := make([]Patch, len(meshes))
+	for i := range patchs {
+		patchs[i] = Patch{TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID}
+	}
+	a := newFlatArchive(lasSignature(rgb >= 0), meshes, patchs, setting)
+	a.Header.Matrix = mat4.Ident
+	a.Header.Matrix[3] = [4]float32{float32(origin[0]), float32(origin[1]), float32(origin[2]), 1}
+	return a, nil
+}
+
+func ImportLasFile(path string, setting *CompressSetting) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ImportLas(f, setting)
+}
+
+func (a *Archive) ExportCutLas(writer io.Writer, selected []bool) error {
+	if a.Header.NFace != 0 || a.Header.Sign.Face.HasIndex() {
+		return errors.New("las: archive is not a point cloud")
+	}
+	for n := range selected {
+		if !selected[n] {
+			continue
+		}
+		if err := a.LoadNode(uint32(n)); err != nil {
+			return err
+		}
+	}
+
+	m := a.modelMatrix()
+	h := &lasHeader{
+		GlobalEncoding:    0x10,
+		VersionMajor:      1,
+		VersionMinor:      4,
+		HeaderSize:        LAS_HEADER_SIZE,
+		PointDataOffset:   LAS_HEADER_SIZE,
+		PointFormat:       LAS_POINT_FORMAT,
+		PointRecordLength: LAS_POINT_RECORD_LENGTH,
+		Scale:             [3]float64{LAS_DEFAULT_SCALE, LAS_DEFAULT_SCALE, LAS_DEFAULT_SCALE},
+		Offset:            [3]float64{float64(m[3][0]), float64(m[3][1]), float64(m[3][2])},
+	}
+	copy(h.Signature[:], "LASF")
+	copy(h.GeneratingSoftware[:], "go-lodm")
+
+	var records bytes.Buffer
+	var min, max [3]int32
+	a.cutPatchs(selected, func(n, p uint32, start, end uint32) {
+		mesh := &a.NodeMeshs[n]
+		for i := start; i < end && int(i) < len(mesh.Verts); i++ {
+			var record [LAS_POINT_RECORD_LENGTH]byte
+			v := mesh.Verts[i]
+			for k := 0; k < 3; k++ {
+				x := float64(m[0][k])*float64(v[0]) + float64(m[1][k])*float64(v[1]) + float64(m[2][k])*float64(v[2])
+				q := int32(math.Round(x / h.Scale[k]))
+				if h.PointCount == 0 || q < min[k] {
+					min[k] = q
+				}
+				if h.PointCount == 0 || q > max[k] {
+					max[k] = q
+				}
+				byteorder.PutUint32(record[k*4:], uint32(q))
+			}
+			if mesh.HasData(LAS_INTENSITY_DATA) {
+				byteorder.PutUint16(record[12:], uint16(mesh.Data[LAS_INTENSITY_DATA][i]))
+			}
+			record[14] = 0x11
+			if mesh.HasData(LAS_CLASSIFICATION_DATA) {
+				record[16] = byte(mesh.Data[LAS_CLASSIFICATION_DATA][i])
+			}
+			if mesh.HasColor() {
+				c := mesh.Colors[i]
+				byteorder.PutUint16(record[30:], uint16(c[0])*257)
+				byteorder.PutUint16(record[32:], uint16(c[1])*257)
+				byteorder.PutUint16(record[34:], uint16(c[2])*257)
+			}
+			records.Write(record[:])
+			h.PointCount++
+		}
+	})
+	h.PointsByReturn[0] = h.PointCount
+	h.MinX, h.MaxX = float64(min[0])*h.Scale[0]+h.Offset[0], float64(max[0])*h.Scale[0]+h.Offset[0]
+	h.MinY, h.MaxY = float64(min[1])*h.Scale[1]+h.Offset[1], float64(max[1])*h.Scale[1]+h.Offset[1]
+	h.MinZ, h.MaxZ = float64(min[2])*h.Scale[2]+h.Offset[2], float64(max[2])*h.Scale[2]+h.Offset[2]
+
+	if err := binary.Write(writer, byteorder, h); err != nil {
+		return err
+	}
+	_, err := writer.Write(records.Bytes())
+	return err
+}
+
+func (a *Archive) ExportLasAtError(writer io.Writer, maxError float32) error {
+	return a.ExportCutLas(writer, a.SelectByError(maxError))
+}
+
+func (a *Archive) ExportLas(writer io.Writer) error {
+	return a.ExportCutLas(writer, a.selectCut(func(n uint32) (bool, bool) {
+		return true, true
+	}))
+}
+
+func (a *Archive) ExportLasFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return a.ExportLas(f)
+}
@@ -0,0 +1,61 @@
+package lodm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec3"
+)
+
+func TestLas(t *testing.T) {
+	mesh := NodeMesh{
+		Verts:  []vec3.T{{0, 0, 0}, {1.5, 2.25, 3}, {-4, 5.125, 0.001}},
+		Colors: [][4]byte{{255, 0, 0, 255}, {0, 128, 0, 255}, {0, 0, 7, 255}},
+	}
+	mesh.Data[LAS_INTENSITY_DATA] = []float32{100, 2000, 65535}
+	mesh.Data[LAS_CLASSIFICATION_DATA] = []float32{2, 6, 9}
+	a := newFlatArchive(lasSignature(true), []NodeMesh{mesh}, []Patch{{TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID}}, nil)
+	a.Header.Matrix = mat4.Ident
+	a.Header.Matrix[3] = [4]float32{500000, 4000000, 100, 1}
+
+	var buf bytes.Buffer
+	if err := a.ExportLas(&buf); err != nil {
+		t.FailNow()
+	}
+	if buf.Len() != LAS_HEADER_SIZE+3*LAS_POINT_RECORD_LENGTH || binary.Size(lasHeader{}) != LAS_HEADER_SIZE {
+		t.FailNow()
+	}
+	h, err := readLasHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil || h.pointCount() != 3 || h.MinX != 499996 || h.MaxZ != 103 {
+		t.FailNow()
+	}
+
+	b, err := ImportLas(&buf, nil)
+	if err != nil || b.Header.Matrix[3][0] != 500000 || len(b.NodeMeshs) != 2 {
+		t.FailNow()
+	}
+	got := &b.NodeMeshs[0]
+	for i := range mesh.Verts {
+		for k := 0; k < 3; k++ {
+			if abs32(got.Verts[i][k]-mesh.Verts[i][k]) > 0.0005 {
+				t.FailNow()
+			}
+		}
+		if got.Colors[i] != mesh.Colors[i] {
+			t.FailNow()
+		}
+		if got.Data[LAS_INTENSITY_DATA][i] != mesh.Data[LAS_INTENSITY_DATA][i] || got.Data[LAS_CLASSIFICATION_DATA][i] != mesh.Data[LAS_CLASSIFICATION_DATA][i] {
+			t.FailNow()
+		}
+	}
+
+	buf.Reset()
+	if err := a.ExportLasAtError(&buf, 1); err != nil || buf.Len() != LAS_HEADER_SIZE+3*LAS_POINT_RECORD_LENGTH {
+		t.FailNow()
+	}
+	if err := newTestArchive().ExportLas(&buf); err == nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,416 @@
+package lodm
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+)
+
+const (
+	MESHOPT_DEFLATE byte = 0x1
+
+	MESHOPT_GROUP_SIZE = 16
+)
+
+var errMeshoptTruncated = errors.New("meshopt: truncated stream")
+
+func zigzag8(d byte) byte {
+	return (d << 1) ^ byte(int8(d)>>7)
+}
+
+func unzigzag8(v byte) byte {
+	return (v >> 1) ^ -(v & 1)
+}
+
+func meshoptGroupBits(deltas []byte) int {
+	var max byte
+	for _, d := range deltas {
+		if d > max {
+			max = d
+		}
+	}
+	switch {
+	case max == 0:
+		return 0
+	case max < 4:
+		return 2
+	case max < 16:
+		return 4
+	}
+	return 8
+}
+
+func encodeVertexStream(w *bytes.Buffer, data []byte, count, stride int) {
+	groups := (count + MESHOPT_GROUP_SIZE - 1) / MESHOPT_GROUP_SIZE
+	deltas := make([]byte, groups*MESHOPT_GROUP_SIZE)
+	header := make([]byte, (groups+3)/4)
+	for k := 0; k < stride; k++ {
+		var prev byte
+		for i := 0; i < count; i++ {
+			v := data[i*stride+k]
+			deltas[i] = zigzag8(v - prev)
+			prev = v
+		}
+		for i := range header {
+			header[i] = 0
+		}
+		var body []byte
+		for g := 0; g < groups; g++ {
+			group := deltas[g*MESHOPT_GROUP_SIZE : (g+1)*MESHOPT_GROUP_SIZE]
+			bits := meshoptGroupBits(group)
+			header[g/4] |= byte(bits/2-bits/8) << uint((g%4)*2)
+			if bits == 0 {
+				continue
+			}
+			var acc uint
+			var used uint
+			for _, d := range group {
+				acc |= uint(d) << used
+				used += uint(bits)
+				if used == 8 {
+					body = append(body, byte(acc))
+					acc, used = 0, 0
+				}
+			}
+		}
+		w.Write(header)
+		w.Write(body)
+	}
+}
+
+func decodeVertexStream(r *bytes.Reader, count, stride int) ([]byte, error) {
+	groups := (count + MESHOPT_GROUP_SIZE - 1) / MESHOPT_GROUP_SIZE
+	data := make([]byte, count*stride)
+	header := make([]byte, (groups+3)/4)
+	group := make([]byte, MESHOPT_GROUP_SIZE)
+	for k := 0; k < stride; k++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, errMeshoptTruncated
+		}
+		var prev byte
+		for g := 0; g < groups; g++ {
+			bits := [4]uint{0, 2, 4, 8}[(header[g/4]>>uint((g%4)*2))&3]
+			for i := range group {
+				group[i] = 0
+			}
+			if bits > 0 {
+				packed := make([]byte, MESHOPT_GROUP_SIZE*bits/8)
+				if _, err := io.ReadFull(r, packed); err != nil {
+					return nil, errMeshoptTruncated
+				}
+				mask := byte(1<<bits - 1)
+				for i := range group {
+					bit := uint(i) * bits
+					group[i] = (packed[bit/8] >> (bit % 8)) & mask
+				}
+			}
+			for i := 0; i < MESHOPT_GROUP_SIZE && g*MESHOPT_GROUP_SIZE+i < count; i++ {
+				prev += unzigzag8(group[i])
+				data[(g*MESHOPT_GROUP_SIZE+i)*stride+k] = prev
+			}
+		}
+	}
+	return data, nil
+}
+
+func encodeIndexSequence(w *bytes.Buffer, faces [][3]uint16) {
+	var last [2]int32
+	var tmp [binary.MaxVarintLen64]byte
+	for _, f := range faces {
+		for _, i := range f {
+			index := int32(i)
+			d0, d1 := index-last[0], index-last[1]
+			cur, d := 0, d0
+			if absInt32(d1) < absInt32(d0) {
+				cur, d = 1, d1
+			}
+			v := uint64(uint32((d<<1)^(d>>31)))<<1 | uint64(cur)
+			last[cur] = index
+			w.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+		}
+	}
+}
+
+func decodeIndexSequence(r *bytes.Reader, count int) ([][3]uint16, error) {
+	var last [2]int32
+	faces := make([][3]uint16, count)
+	for f := range faces {
+		for k := 0; k < 3; k++ {
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, errMeshoptTruncated
+			}
+			cur := v & 1
+			z := uint32(v >> 1)
+			index := last[cur] + (int32(z>>1) ^ -int32(z&1))
+			last[cur] = index
+			faces[f][k] = uint16(index)
+		}
+	}
+	return faces, nil
+}
+
+func absInt32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func encodeFloats(w *bytes.Buffer, vals []float32, dims int, step float32) {
+	count := len(vals) / dims
+	min := make([]float32, dims)
+	for k := 0; k < dims; k++ {
+		min[k] = float32(math.Inf(1))
+	}
+	for i, v := range vals {
+		if v < min[i%dims] {
+			min[i%dims] = v
+		}
+	}
+	if step > 0 && maxExtent(vals, dims)/step >= float32(math.MaxUint32) {
+		step = 0
+	}
+	data := make([]byte, len(vals)*4)
+	if step > 0 && count > 0 {
+		w.WriteByte(1)
+		binary.Write(w, byteorder, min)
+		binary.Write(w, byteorder, step)
+		for i, v := range vals {
+			byteorder.PutUint32(data[i*4:], uint32(math.Round(float64((v-min[i%dims])/step))))
+		}
+	} else {
+		w.WriteByte(0)
+		for i, v := range vals {
+			byteorder.PutUint32(data[i*4:], math.Float32bits(v))
+		}
+	}
+	encodeVertexStream(w, data, count, dims*4)
+}
+
+func decodeFloats(r *bytes.Reader, count, dims int) ([]float32, error) {
+	mode, err := r.ReadByte()
+	if err != nil {
+		return nil, errMeshoptTruncated
+	}
+	min := make([]float32, dims)
+	var step float32
+	if mode == 1 {
+		if binary.Read(r, byteorder, min) != nil || binary.Read(r, byteorder, &step) != nil {
+			return nil, errMeshoptTruncated
+		}
+	}
+	data, err := decodeVertexStream(r, count, dims*4)
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]float32, count*dims)
+	for i := range vals {
+		u := byteorder.Uint32(data[i*4:])
+		if mode == 1 {
+			vals[i] = min[i%dims] + float32(u)*step
+		} else {
+			vals[i] = math.Float32frombits(u)
+		}
+	}
+	return vals, nil
+}
+
+func vec3Floats(v []vec3.T, n int) []float32 {
+	vals := make([]float32, n*3)
+	for i := 0; i < n && i < len(v); i++ {
+		copy(vals[i*3:], v[i][:])
+	}
+	return vals
+}
+
+func floatsVec3(vals []float32) []vec3.T {
+	v := make([]vec3.T, len(vals)/3)
+	for i := range v {
+		copy(v[i][:], vals[i*3:])
+	}
+	return v
+}
+
+type meshoptNodeCodec struct{}
+
+func (meshoptNodeCodec) Encode(header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) (NodeData, error) {
+	if setting == nil {
+		setting = &DEFAULE_COMPRESS_SETTING
+	}
+	sig := header.Sign
+	nvert := int(node.NVert)
+	nface := int(node.NFace)
+	if nvert > len(mesh.Verts) || nface > len(mesh.Faces) {
+		return nil, errors.New("meshopt: node counts exceed mesh size")
+	}
+	body := &bytes.Buffer{}
+	coord_step := setting.coordStep(mesh.Verts[:nvert])
+	encodeFloats(body, vec3Floats(mesh.Verts, nvert), 3, coord_step)
+	if sig.Face.HasIndex() {
+		encodeIndexSequence(body, mesh.Faces[:nface])
+	}
+	if sig.Vertex.HasNormals() {
+		bits := setting.normalBits()
+		body.WriteByte(byte(bits))
+		data := make([]byte, nvert*6)
+		for i := 0; i < nvert && i < len(mesh.Normals); i++ {
+			n := quantizeNormal(mesh.Normals[i], bits)
+			for k := 0; k < 3; k++ {
+				byteorder.PutUint16(data[i*6+k*2:], uint16(n[k]))
+			}
+		}
+		encodeVertexStream(body, data, nvert, 6)
+	}
+	if sig.Vertex.HasTextures() {
+		vals := make([]float32, nvert*2)
+		for i := 0; i < nvert && i < len(mesh.Texcoords); i++ {
+			copy(vals[i*2:], mesh.Texcoords[i][:])
+		}
+		encodeFloats(body, vals, 2, setting.uvStep())
+	}
+	if sig.Vertex.HasColors() {
+		var bits [4]byte
+		data := make([]byte, nvert*4)
+		for k := 0; k < 4; k++ {
+			bits[k] = byte(setting.colorBits(k))
+		}
+		body.Write(bits[:])
+		for i := 0; i < nvert && i < len(mesh.Colors); i++ {
+			for k := 0; k < 4; k++ {
+				c := mesh.Colors[i][k]
+				if bits[k] < 8 {
+					levels := float64(int(1)<<bits[k] - 1)
+					c = byte(math.Round(float64(c) * levels / 255))
+				}
+				data[i*4+k] = c
+			}
+		}
+		encodeVertexStream(body, data, nvert, 4)
+	}
+	if sig.Vertex.HasGeomorphs() {
+		encodeFloats(body, vec3Floats(mesh.Morphs, nvert), 3, coord_step)
+	}
+	for d := 1; d < len(mesh.Data); d++ {
+		if !sig.Vertex.HasData(d) {
+			continue
+		}
+		dims := int(sig.Vertex.Attributes[int(VERTEX_DATA0)+d].Number)
+		vals := make([]float32, nvert*dims)
+		copy(vals, mesh.Data[d])
+		encodeFloats(body, vals, dims, 0)
+	}
+
+	if setting.DeflateLevel == 0 {
+		return append([]byte{0}, body.Bytes()...), nil
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteByte(MESHOPT_DEFLATE)
+	fw, err := flate.NewWriter(buf, setting.DeflateLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(body.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (meshoptNodeCodec) Decode(buf []byte, header Header, node *Node, mesh *NodeMesh) error {
+	if len(buf) == 0 {
+		return errMeshoptTruncated
+	}
+	body := buf[1:]
+	if buf[0]&MESHOPT_DEFLATE != 0 {
+		var err error
+		if body, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(body))); err != nil {
+			return err
+		}
+	}
+	r := bytes.NewReader(body)
+	sig := header.Sign
+	nvert := int(node.NVert)
+
+	vals, err := decodeFloats(r, nvert, 3)
+	if err != nil {
+		return err
+	}
+	mesh.Verts = floatsVec3(vals)
+	if sig.Face.HasIndex() {
+		if mesh.Faces, err = decodeIndexSequence(r, int(node.NFace)); err != nil {
+			return err
+		}
+	}
+	if sig.Vertex.HasNormals() {
+		if _, err := r.ReadByte(); err != nil {
+			return errMeshoptTruncated
+		}
+		data, err := decodeVertexStream(r, nvert, 6)
+		if err != nil {
+			return err
+		}
+		mesh.Normals = make([][3]int16, nvert)
+		for i := range mesh.Normals {
+			for k := 0; k < 3; k++ {
+				mesh.Normals[i][k] = int16(byteorder.Uint16(data[i*6+k*2:]))
+			}
+		}
+	}
+	if sig.Vertex.HasTextures() {
+		vals, err := decodeFloats(r, nvert, 2)
+		if err != nil {
+			return err
+		}
+		mesh.Texcoords = make([]vec2.T, nvert)
+		for i := range mesh.Texcoords {
+			mesh.Texcoords[i] = vec2.T{vals[i*2], vals[i*2+1]}
+		}
+	}
+	if sig.Vertex.HasColors() {
+		var bits [4]byte
+		if _, err := io.ReadFull(r, bits[:]); err != nil {
+			return errMeshoptTruncated
+		}
+		data, err := decodeVertexStream(r, nvert, 4)
+		if err != nil {
+			return err
+		}
+		mesh.Colors = make([][4]byte, nvert)
+		for i := range mesh.Colors {
+			for k := 0; k < 4; k++ {
+				c := data[i*4+k]
+				if bits[k] > 0 && bits[k] < 8 {
+					levels := float64(int(1)<<bits[k] - 1)
+					c = byte(math.Round(float64(c) * 255 / levels))
+				}
+				mesh.Colors[i][k] = c
+			}
+		}
+	}
+	if sig.Vertex.HasGeomorphs() {
+		vals, err := decodeFloats(r, nvert, 3)
+		if err != nil {
+			return err
+		}
+		mesh.Morphs = floatsVec3(vals)
+	}
+	for d := 1; d < len(mesh.Data); d++ {
+		if !sig.Vertex.HasData(d) {
+			continue
+		}
+		if mesh.Data[d], err = decodeFloats(r, nvert, int(sig.Vertex.Attributes[int(VERTEX_DATA0)+d].Number)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package lodm
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+)
+
+func newMeshoptTestMesh() (Signature, NodeMesh) {
+	sign := Signature{}
+	sign.Vertex.SetComponent(VERTEX_COORD, Attribute{Type: ATTR_FLOAT, Number: 3})
+	sign.Vertex.SetComponent(VERTEX_NORM, Attribute{Type: ATTR_SHORT, Number: 3})
+	sign.Vertex.SetComponent(VERTEX_COLOR, Attribute{Type: ATTR_UNSIGNED_BYTE, Number: 4})
+	sign.Vertex.SetComponent(VERTEX_TEX, Attribute{Type: ATTR_FLOAT, Number: 2})
+	sign.Vertex.SetComponent(VERTEX_DATA0+1, Attribute{Type: ATTR_FLOAT, Number: 1})
+	sign.Vertex.SetComponent(VERTEX_DATA0+2, Attribute{Type: ATTR_FLOAT, Number: 2})
+	sign.Face.SetComponent(FACE_INDEX, Attribute{Type: ATTR_UNSIGNED_SHORT, Number: 3})
+	sign.SetFlag(MESHOPT)
+
+	mesh := NodeMesh{Faces: testMesh.Faces}
+	for i, v := range testMesh.Verts {
+		mesh.Verts = append(mesh.Verts, vec3.T{v[0]*100 + 0.123, v[1] * 50, v[2]*10 - 3})
+		mesh.Normals = append(mesh.Normals, [3]int16{int16(v[0]*2000 - 1000), 500, int16(v[2] * 3000)})
+		mesh.Colors = append(mesh.Colors, [4]byte{byte(i * 31), 200, byte(255 - i*17), 255})
+		mesh.Texcoords = append(mesh.Texcoords, vec2.T{v[0]*0.7 + 0.1, v[1] * 0.3})
+		mesh.Data[1] = append(mesh.Data[1], float32(i)*1.5)
+		mesh.Data[2] = append(mesh.Data[2], float32(i)*0.25, -float32(i)*3)
+	}
+	return sign, mesh
+}
+
+func TestMeshoptLossless(t *testing.T) {
+	sign, mesh := newMeshoptTestMesh()
+	h := NewHeader(sign)
+	node := &Node{NVert: uint16(len(mesh.Verts)), NFace: uint16(len(mesh.Faces))}
+
+	raw := &bytes.Buffer{}
+	if err := mesh.Write(raw, node, h); err != nil {
+		t.FailNow()
+	}
+	var expect NodeMesh
+	if err := expect.Read(raw, node, h); err != nil {
+		t.FailNow()
+	}
+
+	data, err := CompressNode(*h, node, &mesh, nil, &CompressSetting{})
+	if err != nil {
+		t.FailNow()
+	}
+	var got NodeMesh
+	if err := decompressNodeMesh(data, *h, node, &got); err != nil {
+		t.FailNow()
+	}
+	for i := range expect.Verts {
+		if got.Verts[i] != expect.Verts[i] || got.Normals[i] != expect.Normals[i] || got.Colors[i] != expect.Colors[i] || got.Texcoords[i] != expect.Texcoords[i] || got.Data[1][i] != expect.Data[1][i] || got.Data[2][2*i+1] != expect.Data[2][2*i+1] {
+			t.FailNow()
+		}
+	}
+	for i := range expect.Faces {
+		if got.Faces[i] != expect.Faces[i] {
+			t.FailNow()
+		}
+	}
+}
+
+func TestMeshoptQuantized(t *testing.T) {
+	sign, mesh := newMeshoptTestMesh()
+	h := NewHeader(sign)
+	node := &Node{NVert: uint16(len(mesh.Verts)), NFace: uint16(len(mesh.Faces))}
+	setting := DEFAULE_COMPRESS_SETTING
+
+	data, err := CompressNode(*h, node, &mesh, nil, &setting)
+	if err != nil {
+		t.FailNow()
+	}
+	if data[0]&MESHOPT_DEFLATE == 0 || int64(len(data)) >= mesh.CalcSize() {
+		t.FailNow()
+	}
+	var got NodeMesh
+	if err := decompressNodeMesh(data, *h, node, &got); err != nil || len(got.Faces) != len(mesh.Faces) {
+		t.FailNow()
+	}
+	for i := range mesh.Faces {
+		if got.Faces[i] != mesh.Faces[i] {
+			t.FailNow()
+		}
+	}
+	coord := 100 / math.Exp2(float64(setting.CoordBits))
+	uv := math.Exp2(-float64(setting.UvBits))
+	normals := decodeNormals(mesh.Normals)
+	got_normals := decodeNormals(got.Normals)
+	for i := range mesh.Verts {
+		for k := 0; k < 3; k++ {
+			if math.Abs(float64(got.Verts[i][k]-mesh.Verts[i][k])) > coord/2+1e-4 {
+				t.FailNow()
+			}
+			if math.Abs(float64(got_normals[i][k]-normals[i][k])) > 2/float64(int(1)<<uint(setting.NormalBits-1)-1) {
+				t.FailNow()
+			}
+		}
+		for k := 0; k < 2; k++ {
+			if math.Abs(float64(got.Texcoords[i][k]-mesh.Texcoords[i][k])) > uv/2+1e-6 {
+				t.FailNow()
+			}
+		}
+		for k := 0; k < 4; k++ {
+			if math.Abs(float64(got.Colors[i][k])-float64(mesh.Colors[i][k])) > 255/float64(int(1)<<uint(setting.ColorBits[k])-1)/2+1 {
+				t.FailNow()
+			}
+		}
+		if got.Data[1][i] != mesh.Data[1][i] || got.Data[2][2*i] != mesh.Data[2][2*i] || got.Data[2][2*i+1] != mesh.Data[2][2*i+1] {
+			t.FailNow()
+		}
+	}
+
+	if err := decompressNodeMesh(data[:len(data)/2], *h, node, &got); err == nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,430 @@
+package lodm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	"github.com/flywave/go3d/mat3"
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+)
+
+const (
+	NEXUS_MAGIC   uint32 = 0x4E787320
+	NEXUS_PADDING uint32 = 256
+)
+
+const (
+	NEXUS_PTEXTURE uint32 = 0x1
+	NEXUS_MECO     uint32 = 0x2
+	NEXUS_CTM1     uint32 = 0x4
+	NEXUS_CTM2     uint32 = 0x8
+	NEXUS_CORTO    uint32 = 0x10
+)
+
+type nexusSignature struct {
+	Vertex VertexElement
+	Face   FaceElement
+	Flags  uint32
+}
+
+type nexusHeader struct {
+	Magic     uint32
+	Version   uint32
+	NVert     uint64
+	NFace     uint64
+	Sign      nexusSignature
+	NNodes    uint32
+	NPatches  uint32
+	NTextures uint32
+	Sphere    Sphere
+}
+
+type nexusPatch struct {
+	Node           uint32
+	TriangleOffset uint32
+	Texture        uint32
+}
+
+type nexusTexture struct {
+	Offset uint32
+	Matrix [16]float32
+}
+
+func (m *nexusTexture) address() int64 {
+	return int64(m.Offset) * int64(NEXUS_PADDING)
+}
+
+func (m *nexusTexture) mat() mat3.T {
+	x := &m.Matrix
+	return mat3.T{{x[0], x[1], x[3]}, {x[4], x[5], x[7]}, {x[12], x[13], x[15]}}
+}
+
+func (m *nexusTexture) setMat(mat mat3.T) {
+	if mat.IsZero() {
+		mat = mat3.Ident
+	}
+	m.Matrix = [16]float32{mat[0][0], mat[0][1], 0, mat[0][2], mat[1][0], mat[1][1], 0, mat[1][2], 0, 0, 1, 0, mat[2][0], mat[2][1], 0, mat[2][2]}
+}
+
+func nexusToSignature(ns nexusSignature) (Signature, error) {
+	var sig Signature
+	if ns.Flags&(NEXUS_MECO|NEXUS_CTM1|NEXUS_CTM2) != 0 {
+		return sig, errors.New("nexus compression not supported")
+	}
+	for i := int(VERTEX_DATA0); i < 8; i++ {
+		if ns.Vertex.Attributes[i].Valid() || ns.Face.Attributes[i].Valid() {
+			return sig, errors.New("nexus data attributes not supported")
+		}
+	}
+	if ns.Face.HasNormals() || ns.Face.HasColors() || ns.Face.HasTextures() {
+		return sig, errors.New("nexus face attributes not supported")
+	}
+	sig.Vertex = ns.Vertex
+	sig.Face = ns.Face
+	if ns.Flags&NEXUS_PTEXTURE != 0 {
+		sig.SetFlag(PTJPG)
+	}
+	if ns.Flags&NEXUS_CORTO != 0 {
+		sig.SetFlag(CORTO)
+	}
+	return sig, nil
+}
+
+func readNexusMesh(buf []byte, node *Node, sig *nexusSignature) (NodeMesh, error) {
+	var mesh NodeMesh
+	reader := bytes.NewReader(buf)
+	mesh.Verts = make([]vec3.T, node.NVert)
+	if err := binary.Read(reader, byteorder, mesh.Verts); err != nil {
+		return mesh, err
+	}
+	if sig.Vertex.HasTextures() {
+		mesh.Texcoords = make([]vec2.T, node.NVert)
+		if err := binary.Read(reader, byteorder, mesh.Texcoords); err != nil {
+			return mesh, err
+		}
+	}
+	if sig.Vertex.HasNormals() {
+		mesh.Normals = make([][3]int16, node.NVert)
+		if err := binary.Read(reader, byteorder, mesh.Normals); err != nil {
+			return mesh, err
+		}
+	}
+	if sig.Vertex.HasColors() {
+		mesh.Colors = make([][4]byte, node.NVert)
+		if err := binary.Read(reader, byteorder, mesh.Colors); err != nil {
+			return mesh, err
+		}
+	}
+	if node.NFace > 0 {
+		mesh.Faces = make([][3]uint16, node.NFace)
+		if err := binary.Read(reader, byteorder, mesh.Faces); err != nil {
+			return mesh, err
+		}
+	}
+	return mesh, nil
+}
+
+func readNexusBlob(reader io.ReadSeeker, offset, size int64) ([]byte, error) {
+	if size < 0 {
+		return nil, errors.New("nexus blob size error")
+	}
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func ImportNexus(reader io.ReadSeeker, setting *CompressSetting) (*Archive, error) {
+	var nh nexusHeader
+	if err := binary.Read(reader, byteorder, &nh); err != nil {
+		return nil, err
+	}
+	if nh.Magic != NEXUS_MAGIC {
+		return nil, errors.New("not a nexus file")
+	}
+	if nh.NNodes < 1 {
+		return nil, errors.New("nexus file has no nodes")
+	}
+	sig, err := nexusToSignature(nh.Sign)
+	if err != nil {
+		return nil, err
+	}
+
+	h := NewHeader(sig)
+	h.NVert = nh.NVert
+	h.NFace = nh.NFace
+	h.NNodes = nh.NNodes
+	h.NPatches = nh.NPatches
+	h.NTextures = nh.NTextures
+	h.Sphere = nh.Sphere
+
+	a := NewArchive(*h, setting)
+	a.initIndex()
+
+	if err := binary.Read(reader, byteorder, a.Nodes); err != nil {
+		return nil, err
+	}
+	patchs := make([]nexusPatch, nh.NPatches)
+	if err := binary.Read(reader, byteorder, patchs); err != nil {
+		return nil, err
+	}
+	for i, p := range patchs {
+		a.Patchs[i] = Patch{Node: p.Node, FaceOffset: p.TriangleOffset, TexID: p.Texture, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID}
+	}
+	textures := make([]nexusTexture, nh.NTextures)
+	if err := binary.Read(reader, byteorder, textures); err != nil {
+		return nil, err
+	}
+	a.countRoots()
+
+	for n := 0; n+1 < len(a.Nodes); n++ {
+		node := &a.Nodes[n]
+		offset := int64(node.Offset) * int64(NEXUS_PADDING)
+		buf, err := readNexusBlob(reader, offset, int64(a.Nodes[n+1].Offset)*int64(NEXUS_PADDING)-offset)
+		if err != nil {
+			return nil, err
+		}
+		if sig.IsCompressed() {
+			err = decompressNodeMesh(buf, a.Header, node, &a.NodeMeshs[n])
+		} else {
+			a.NodeMeshs[n], err = readNexusMesh(buf, node, &nh.Sign)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	has_png := false
+	for t := 0; t+1 < len(textures); t++ {
+		offset := textures[t].address()
+		buf, err := readNexusBlob(reader, offset, textures[t+1].address()-offset)
+		if err != nil {
+			return nil, err
+		}
+		img, format, err := image.Decode(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		if format == "png" {
+			has_png = true
+		}
+		a.TextureImages[t] = img
+		a.Textures[t].Mat = textures[t].mat()
+	}
+	if has_png {
+		a.Header.Sign.Flags = a.Header.Sign.Flags&^PTJPG | PTPNG
+	}
+	return a, nil
+}
+
+func ImportNexusFile(path string, setting *CompressSetting) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ImportNexus(f, setting)
+}
+
+func signatureToNexus(sig Signature) nexusSignature {
+	ns := nexusSignature{Vertex: sig.Vertex, Face: sig.Face}
+	for i := int(VERTEX_DATA0); i < 8; i++ {
+		ns.Vertex.Attributes[i] = Attribute{}
+		ns.Face.Attributes[i] = Attribute{}
+	}
+	if sig.HasPTextures() {
+		ns.Flags |= NEXUS_PTEXTURE
+	}
+	if sig.IsCompressed() {
+		ns.Flags |= NEXUS_CORTO
+	}
+	return ns
+}
+
+func writeNexusMesh(mesh *NodeMesh, sig *nexusSignature) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, byteorder, mesh.Verts)
+	if sig.Vertex.HasTextures() {
+		binary.Write(buf, byteorder, mesh.Texcoords)
+	}
+	if sig.Vertex.HasNormals() {
+		binary.Write(buf, byteorder, mesh.Normals)
+	}
+	if sig.Vertex.HasColors() {
+		binary.Write(buf, byteorder, mesh.Colors)
+	}
+	binary.Write(buf, byteorder, mesh.Faces)
+	return buf.Bytes()
+}
+
+func padNexusBlob(buf []byte) []byte {
+	return append(buf, make([]byte, calcPadding(uint32(len(buf)), NEXUS_PADDING))...)
+}
+
+func (a *Archive) nexusWarnings() []string {
+	var warnings []string
+	if len(a.Materials) > 0 {
+		warnings = append(warnings, fmt.Sprintf("dropped %v materials", len(a.Materials)))
+	}
+	if len(a.Features) > 1 {
+		warnings = append(warnings, fmt.Sprintf("dropped %v features", len(a.Features)-1))
+	}
+	if len(a.Instances) > 0 {
+		warnings = append(warnings, fmt.Sprintf("dropped %v instances of %v instance nodes", len(a.Instances), len(a.InstanceNodes)))
+	}
+	if !a.Header.Matrix.IsZero() && a.Header.Matrix != mat4.Ident {
+		warnings = append(warnings, "dropped model matrix")
+	}
+	if a.Header.Sign.Vertex.HasGeomorphs() {
+		warnings = append(warnings, "dropped geomorph targets")
+	}
+	for i := 1; i < 4; i++ {
+		if a.Header.Sign.Vertex.HasData(i) {
+			warnings = append(warnings, fmt.Sprintf("dropped vertex data %v", i))
+		}
+	}
+	if a.Header.Sign.HasHorizonPoints() {
+		warnings = append(warnings, "dropped horizon points")
+	}
+	if a.Header.Sign.Flags&DRACO != 0 {
+		warnings = append(warnings, "draco nodes re-encoded with corto")
+	}
+	if a.Header.Sign.Flags&MESHOPT != 0 {
+		warnings = append(warnings, "meshopt nodes re-encoded with corto")
+	}
+	if a.Header.Sign.Flags&PTPNG != 0 && len(a.Textures) > 1 {
+		warnings = append(warnings, "png textures re-encoded as jpeg")
+	}
+	return warnings
+}
+
+func (a *Archive) nexusNodeBlob(n uint32, ns *nexusSignature) ([]byte, error) {
+	if a.Header.Sign.Flags&CORTO != 0 && !a.Header.Sign.HasNodeCodecs() && a.reader != nil {
+		return a.readNode(n)
+	}
+	if err := a.LoadNode(n); err != nil {
+		return nil, err
+	}
+	mesh := &a.NodeMeshs[n]
+	if ns.Flags&NEXUS_CORTO != 0 {
+		h := a.Header
+		h.Sign.Flags = CORTO
+		h.Sign.Vertex = ns.Vertex
+		first_patch, last_patch := a.getNodePatchRange(n)
+		buf, err := compressNodeMesh(h, &a.Nodes[n], mesh, a.Patchs[first_patch:last_patch], a.setting)
+		if err != nil {
+			return nil, err
+		}
+		return padNexusBlob(buf), nil
+	}
+	return padNexusBlob(writeNexusMesh(mesh, ns)), nil
+}
+
+func (a *Archive) nexusTextureBlob(t uint32) ([]byte, error) {
+	if a.Header.Sign.Flags&PTJPG != 0 && a.reader != nil {
+		offset := a.Textures[t].address()
+		size := a.Textures[t+1].address() - offset
+		if _, err := a.reader.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(a.reader, buf); err != nil {
+			return nil, err
+		}
+		return padNexusBlob(buf), nil
+	}
+	if a.TextureImages[t] == nil {
+		return nil, errors.New("texture not loaded")
+	}
+	h := a.Header
+	h.Sign.Flags = PTJPG
+	return padNexusBlob(compressTexture(h, a.TextureImages[t])), nil
+}
+
+func (a *Archive) ExportNexus(writer io.Writer) ([]string, error) {
+	if len(a.Nodes) < 2 {
+		return nil, errors.New("archive has no nodes")
+	}
+	ns := signatureToNexus(a.Header.Sign)
+	nh := nexusHeader{Magic: NEXUS_MAGIC, Version: 2, NVert: a.Header.NVert, NFace: a.Header.NFace, Sign: ns, NNodes: uint32(len(a.Nodes)), NPatches: uint32(len(a.Patchs)), NTextures: uint32(len(a.Textures)), Sphere: a.Header.Sphere}
+	if nh.NTextures == 0 {
+		nh.NTextures = 1
+	}
+
+	sink_node := a.sinkNode()
+	nodes := make([]Node, len(a.Nodes))
+	copy(nodes, a.Nodes)
+	textures := make([]nexusTexture, nh.NTextures)
+	for i := range textures {
+		if i < len(a.Textures) {
+			textures[i].setMat(a.Textures[i].Mat)
+		} else {
+			textures[i].setMat(mat3.Ident)
+		}
+	}
+
+	indexSize := uint32(binary.Size(nh) + len(nodes)*binary.Size(Node{}) + len(a.Patchs)*binary.Size(nexusPatch{}) + len(textures)*binary.Size(nexusTexture{}))
+	offset := indexSize + calcPadding(indexSize, NEXUS_PADDING)
+
+	var blobs [][]byte
+	for n := uint32(0); n < sink_node; n++ {
+		buf, err := a.nexusNodeBlob(n, &ns)
+		if err != nil {
+			return nil, err
+		}
+		nodes[n].Offset = offset / NEXUS_PADDING
+		offset += uint32(len(buf))
+		blobs = append(blobs, buf)
+	}
+	nodes[sink_node].Offset = offset / NEXUS_PADDING
+	for t := 0; t+1 < len(textures); t++ {
+		buf, err := a.nexusTextureBlob(uint32(t))
+		if err != nil {
+			return nil, err
+		}
+		textures[t].Offset = offset / NEXUS_PADDING
+		offset += uint32(len(buf))
+		blobs = append(blobs, buf)
+	}
+	textures[len(textures)-1].Offset = offset / NEXUS_PADDING
+
+	patchs := make([]nexusPatch, len(a.Patchs))
+	for i, p := range a.Patchs {
+		patchs[i] = nexusPatch{Node: p.Node, TriangleOffset: p.FaceOffset, Texture: p.TexID}
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, byteorder, nh)
+	binary.Write(buf, byteorder, nodes)
+	binary.Write(buf, byteorder, patchs)
+	binary.Write(buf, byteorder, textures)
+	buf.Write(make([]byte, calcPadding(uint32(buf.Len()), NEXUS_PADDING)))
+	if _, err := writer.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	for _, b := range blobs {
+		if _, err := writer.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	return a.nexusWarnings(), nil
+}
+
+func (a *Archive) ExportNexusFile(path string) ([]string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return a.ExportNexus(f)
+}
@@ -0,0 +1,151 @@
+package lodm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func newTestNexus(a *Archive) []byte {
+	nh := nexusHeader{Magic: NEXUS_MAGIC, Version: 2, NVert: a.Header.NVert, NFace: a.Header.NFace, NNodes: uint32(len(a.Nodes)), NPatches: uint32(len(a.Patchs)), NTextures: 1, Sphere: a.Header.Sphere}
+	nh.Sign.Vertex = a.Header.Sign.Vertex
+	nh.Sign.Face = a.Header.Sign.Face
+
+	var data bytes.Buffer
+	nodes := make([]Node, len(a.Nodes))
+	copy(nodes, a.Nodes)
+	start := calcPadding(uint32(binary.Size(nh)+len(nodes)*binary.Size(Node{})+len(a.Patchs)*binary.Size(nexusPatch{})+binary.Size(nexusTexture{})), NEXUS_PADDING)
+	start += uint32(binary.Size(nh) + len(nodes)*binary.Size(Node{}) + len(a.Patchs)*binary.Size(nexusPatch{}) + binary.Size(nexusTexture{}))
+	for n := range nodes {
+		nodes[n].Offset = (start + uint32(data.Len())) / NEXUS_PADDING
+		if n+1 == len(nodes) {
+			break
+		}
+		mesh := &a.NodeMeshs[n]
+		binary.Write(&data, binary.LittleEndian, mesh.Verts)
+		binary.Write(&data, binary.LittleEndian, mesh.Normals)
+		binary.Write(&data, binary.LittleEndian, mesh.Faces)
+		data.Write(make([]byte, calcPadding(uint32(data.Len()), NEXUS_PADDING)))
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, nh)
+	binary.Write(&buf, binary.LittleEndian, nodes)
+	for _, p := range a.Patchs {
+		binary.Write(&buf, binary.LittleEndian, nexusPatch{Node: p.Node, TriangleOffset: p.FaceOffset, Texture: p.TexID})
+	}
+	binary.Write(&buf, binary.LittleEndian, nexusTexture{Offset: nodes[len(nodes)-1].Offset})
+	buf.Write(make([]byte, calcPadding(uint32(buf.Len()), NEXUS_PADDING)))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+func TestImportNexus(t *testing.T) {
+	if binary.Size(nexusHeader{}) != 88 || binary.Size(nexusPatch{}) != 12 || binary.Size(nexusTexture{}) != 68 {
+		t.FailNow()
+	}
+
+	a := newTestArchive()
+	a.Header.Sign.Vertex.SetComponent(VERTEX_NORM, Attribute{Type: ATTR_SHORT, Number: 3})
+	for n := 0; n < 2; n++ {
+		mesh := a.NodeMeshs[n]
+		mesh.Normals = make([][3]int16, len(mesh.Verts))
+		for i := range mesh.Normals {
+			mesh.Normals[i] = [3]int16{0, 0, int16(i)}
+		}
+		a.NodeMeshs[n] = mesh
+	}
+
+	b, err := ImportNexus(bytes.NewReader(newTestNexus(a)), nil)
+	if err != nil {
+		t.FailNow()
+	}
+	if len(b.Nodes) != 3 || len(b.Patchs) != 2 || b.Patchs[0].Node != 1 || b.Patchs[1].MtlID != LM_INVALID_ID {
+		t.FailNow()
+	}
+	if !b.Header.Sign.Vertex.HasNormals() || b.Header.Sign.IsCompressed() || b.Header.Magic != MAGIC_BYTE {
+		t.FailNow()
+	}
+	for n := 0; n < 2; n++ {
+		mesh := &b.NodeMeshs[n]
+		if len(mesh.Verts) != len(testMesh.Verts) || len(mesh.Faces) != len(testMesh.Faces) {
+			t.FailNow()
+		}
+		if mesh.Verts[3] != testMesh.Verts[3] || mesh.Faces[2] != testMesh.Faces[2] || mesh.Normals[5][2] != 5 {
+			t.FailNow()
+		}
+	}
+
+	if _, err := ImportNexus(bytes.NewReader(make([]byte, 128)), nil); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestExportNexus(t *testing.T) {
+	a := newTestTexturedArchive()
+
+	var buf bytes.Buffer
+	warnings, err := a.ExportNexus(&buf)
+	if err != nil || len(warnings) != 2 {
+		t.FailNow()
+	}
+	if buf.Len()%int(NEXUS_PADDING) != 0 {
+		t.FailNow()
+	}
+
+	b, err := ImportNexus(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.FailNow()
+	}
+	if b.Header.Sign.Flags&PTJPG == 0 || len(b.Textures) != 2 || b.TextureImages[0] == nil || b.Patchs[0].TexID != 0 {
+		t.FailNow()
+	}
+	if !b.TextureImages[0].Bounds().Eq(a.TextureImages[0].Bounds()) || b.Textures[0].Mat != a.Textures[0].Mat {
+		t.FailNow()
+	}
+	for n := 0; n < 2; n++ {
+		if len(b.NodeMeshs[n].Verts) != len(a.NodeMeshs[n].Verts) || b.NodeMeshs[n].Texcoords[4] != a.NodeMeshs[n].Texcoords[4] || b.NodeMeshs[n].Faces[1] != a.NodeMeshs[n].Faces[1] {
+			t.FailNow()
+		}
+	}
+
+	data := buf.Bytes()
+	textures := make([]nexusTexture, 2)
+	index := binary.Size(nexusHeader{}) + len(a.Nodes)*binary.Size(Node{}) + len(a.Patchs)*binary.Size(nexusPatch{})
+	if err := binary.Read(bytes.NewReader(data[index:]), binary.LittleEndian, textures); err != nil {
+		t.FailNow()
+	}
+	png_blob := padNexusBlob(compressTexture(a.Header, a.TextureImages[0]))
+	data = append(data[:textures[0].address()], png_blob...)
+	textures[1].Offset = uint32(len(data)) / NEXUS_PADDING
+	var index_buf bytes.Buffer
+	binary.Write(&index_buf, binary.LittleEndian, textures)
+	copy(data[index:], index_buf.Bytes())
+
+	b, err = ImportNexus(bytes.NewReader(data), nil)
+	if err != nil || b.Header.Sign.Flags&PTPNG == 0 || b.Header.Sign.Flags&PTJPG != 0 {
+		t.FailNow()
+	}
+	r0, g0, b0, _ := a.TextureImages[0].At(3, 5).RGBA()
+	r1, g1, b1, _ := b.TextureImages[0].At(3, 5).RGBA()
+	if r0 != r1 || g0 != g1 || b0 != b1 || b.Textures[0].Mat != a.Textures[0].Mat {
+		t.FailNow()
+	}
+
+	a = newTestArchive()
+	a.Header.Sign.SetFlag(CORTO)
+	setting := DEFAULE_COMPRESS_SETTING
+	a.setting = &setting
+
+	buf.Reset()
+	if _, err := a.ExportNexus(&buf); err != nil {
+		t.FailNow()
+	}
+	b, err = ImportNexus(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil || !b.Header.Sign.IsCompressed() {
+		t.FailNow()
+	}
+	if len(b.NodeMeshs[1].Faces) != len(testMesh.Faces) {
+		t.FailNow()
+	}
+}
@@ -2,6 +2,7 @@ package lodm
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 	"reflect"
 	"unsafe"
@@ -18,6 +19,8 @@ type NodeMesh struct {
 	Normals   [][3]int16
 	Texcoords []vec2.T
 	Colors    [][4]byte
+	Morphs    []vec3.T
+	Data      [4][]float32
 }
 
 func (m *NodeMesh) Empty() bool {
@@ -25,7 +28,7 @@ func (m *NodeMesh) Empty() bool {
 }
 
 func (m *NodeMesh) CalcSize() int64 {
-	return int64((len(m.Verts) * 3 * 4) + (len(m.Faces) * 3 * 2) + (len(m.Texcoords) * 2 * 4) + (len(m.Normals) * 3 * 2) + (len(m.Colors) * 4))
+	return int64((len(m.Verts) * 3 * 4) + (len(m.Faces) * 3 * 2) + (len(m.Texcoords) * 2 * 4) + (len(m.Normals) * 3 * 2) + (len(m.Colors) * 4) + (len(m.Morphs) * 3 * 4) + (len(m.Data[1])+len(m.Data[2])+len(m.Data[3]))*4)
 }
 
 func (m *NodeMesh) Read(reader io.Reader, node *Node, header *Header) error {
@@ -99,6 +102,30 @@ func (m *NodeMesh) Read(reader io.Reader, node *Node, header *Header) error {
 		}
 	}
 
+	if sig.Vertex.HasGeomorphs() {
+		m.Morphs = make([]vec3.T, node.NVert)
+
+		var morphsSlice []float32
+		morphsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&morphsSlice)))
+		morphsHeader.Cap = int(node.NVert * 3)
+		morphsHeader.Len = int(node.NVert * 3)
+		morphsHeader.Data = uintptr(unsafe.Pointer(&m.Morphs[0]))
+
+		if err := binary.Read(reader, byteorder, morphsSlice); err != nil {
+			return err
+		}
+	}
+
+	for i := 1; i < 4; i++ {
+		if sig.Vertex.HasData(i) {
+			data, err := readVertexData(reader, sig.Vertex.Attributes[int(VERTEX_DATA0)+i], int(node.NVert))
+			if err != nil {
+				return err
+			}
+			m.Data[i] = data
+		}
+	}
+
 	return nil
 }
 
@@ -166,6 +193,33 @@ func (m *NodeMesh) Write(writer io.Writer, node *Node, header *Header) error {
 			return err
 		}
 	}
+
+	if sig.Vertex.HasGeomorphs() {
+		if len(m.Morphs) != len(m.Verts) {
+			return errors.New("geomorph count does not match vertex count")
+		}
+		var morphsSlice []float32
+		morphsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&morphsSlice)))
+		morphsHeader.Cap = int(node.NVert * 3)
+		morphsHeader.Len = int(node.NVert * 3)
+		morphsHeader.Data = uintptr(unsafe.Pointer(&m.Morphs[0]))
+
+		if err := binary.Write(writer, byteorder, morphsSlice); err != nil {
+			return err
+		}
+	}
+
+	for i := 1; i < 4; i++ {
+		if sig.Vertex.HasData(i) {
+			attr := sig.Vertex.Attributes[int(VERTEX_DATA0)+i]
+			if len(m.Data[i]) != len(m.Verts)*int(attr.Number) {
+				return errors.New("vertex data size does not match vertex count")
+			}
+			if err := writeVertexData(writer, attr, m.Data[i]); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -185,6 +239,103 @@ func (m *NodeMesh) HasColor() bool {
 	return len(m.Colors) > 0
 }
 
+func (m *NodeMesh) HasMorph() bool {
+	return len(m.Morphs) > 0
+}
+
+func (m *NodeMesh) HasData(i int) bool {
+	return i < len(m.Data) && len(m.Data[i]) > 0
+}
+
+func (m *NodeMesh) Morphed(blend float32) []vec3.T {
+	if !m.HasMorph() || blend >= 1 {
+		return m.Verts
+	}
+	verts := make([]vec3.T, len(m.Verts))
+	for i := range m.Verts {
+		verts[i] = vec3.Interpolate(&m.Morphs[i], &m.Verts[i], blend)
+	}
+	return verts
+}
+
+func readVertexData(reader io.Reader, attr Attribute, nvert int) ([]float32, error) {
+	count := nvert * int(attr.Number)
+	ret := make([]float32, count)
+	switch attr.Type {
+	case ATTR_BYTE:
+		buf := make([]int8, count)
+		if err := binary.Read(reader, byteorder, buf); err != nil {
+			return nil, err
+		}
+		for i := range buf {
+			ret[i] = float32(buf[i])
+		}
+	case ATTR_UNSIGNED_BYTE:
+		buf := make([]uint8, count)
+		if err := binary.Read(reader, byteorder, buf); err != nil {
+			return nil, err
+		}
+		for i := range buf {
+			ret[i] = float32(buf[i])
+		}
+	case ATTR_SHORT:
+		buf := make([]int16, count)
+		if err := binary.Read(reader, byteorder, buf); err != nil {
+			return nil, err
+		}
+		for i := range buf {
+			ret[i] = float32(buf[i])
+		}
+	case ATTR_UNSIGNED_SHORT:
+		buf := make([]uint16, count)
+		if err := binary.Read(reader, byteorder, buf); err != nil {
+			return nil, err
+		}
+		for i := range buf {
+			ret[i] = float32(buf[i])
+		}
+	case ATTR_FLOAT:
+		if err := binary.Read(reader, byteorder, ret); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported vertex data type")
+	}
+	return ret, nil
+}
+
+func writeVertexData(writer io.Writer, attr Attribute, data []float32) error {
+	switch attr.Type {
+	case ATTR_BYTE:
+		buf := make([]int8, len(data))
+		for i := range data {
+			buf[i] = int8(data[i])
+		}
+		return binary.Write(writer, byteorder, buf)
+	case ATTR_UNSIGNED_BYTE:
+		buf := make([]uint8, len(data))
+		for i := range data {
+			buf[i] = uint8(data[i])
+		}
+		return binary.Write(writer, byteorder, buf)
+	case ATTR_SHORT:
+		buf := make([]int16, len(data))
+		for i := range data {
+			buf[i] = int16(data[i])
+		}
+		return binary.Write(writer, byteorder, buf)
+	case ATTR_UNSIGNED_SHORT:
+		buf := make([]uint16, len(data))
+		for i := range data {
+			buf[i] = uint16(data[i])
+		}
+		return binary.Write(writer, byteorder, buf)
+	case ATTR_FLOAT:
+		return binary.Write(writer, byteorder, data)
+	}
+	return errors.New("unsupported vertex data type")
+}
+
 type Node struct {
 	Offset      uint32
 	NVert       uint16
@@ -0,0 +1,868 @@
+package lodm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+)
+
+const (
+	OBJ_MAX_VERTS int = 65535
+)
+
+type ObjMesh struct {
+	Name  string
+	MtlID uint32
+	TexID uint32
+	Mesh  NodeMesh
+}
+
+type objVertex struct {
+	v, vt, vn int
+}
+
+type ObjReader struct {
+	Materials       []Material
+	MaterialNames   []string
+	MaterialTexture []uint32
+	TextureImages   []TextureImage
+	TextureFormats  []string
+	Warnings        []string
+
+	Open func(name string) (io.ReadCloser, error)
+
+	verts     []vec3.T
+	colors    [][4]byte
+	texcoords []vec2.T
+	normals   []vec3.T
+
+	materials map[string]uint32
+	textures  map[string]uint32
+
+	name     string
+	mtl      uint32
+	current  NodeMesh
+	remap    map[objVertex]uint16
+	hasTex   bool
+	hasNorm  bool
+	hasColor bool
+	emit     func(*ObjMesh) error
+}
+
+func NewObjReader(open func(name string) (io.ReadCloser, error)) *ObjReader {
+	return &ObjReader{Open: open, materials: make(map[string]uint32), textures: make(map[string]uint32), mtl: LM_INVALID_ID}
+}
+
+func NewObjDirReader(dir string) *ObjReader {
+	return NewObjReader(func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	})
+}
+
+func parseFloats(fields []string, n int) ([]float32, error) {
+	if len(fields) < n {
+		return nil, errors.New("obj: missing values")
+	}
+	ret := make([]float32, n)
+	for i := 0; i < n; i++ {
+		f, err := strconv.ParseFloat(fields[i], 32)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = float32(f)
+	}
+	return ret, nil
+}
+
+func colorByte(f float32) byte {
+	return byte(math.Round(math.Max(0, math.Min(1, float64(f))) * 255))
+}
+
+func colorBytes(f []float32) [3]byte {
+	return [3]byte{colorByte(f[0]), colorByte(f[1]), colorByte(f[2])}
+}
+
+func (r *ObjReader) loadTexture(name string) (uint32, error) {
+	if t, ok := r.textures[name]; ok {
+		return t, nil
+	}
+	f, err := r.openFile(name)
+	if f == nil || err != nil {
+		return LM_INVALID_ID, err
+	}
+	defer f.Close()
+	img, format, err := image.Decode(f)
+	if err != nil {
+		return LM_INVALID_ID, err
+	}
+	t := uint32(len(r.TextureImages))
+	r.TextureImages = append(r.TextureImages, img)
+	r.TextureFormats = append(r.TextureFormats, format)
+	r.textures[name] = t
+	return t, nil
+}
+
+func (r *ObjReader) ReadMtl(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var m *Material
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "newmtl" {
+			if len(fields) < 2 {
+				return errors.New("mtl: newmtl without name")
+			}
+			name := strings.Join(fields[1:], " ")
+			r.materials[name] = uint32(len(r.Materials))
+			r.Materials = append(r.Materials, Material{Type: MTL_LAMBERT, Mode: COLOR, Color: [3]byte{255, 255, 255}, Opacity: 1, Roughness: 1})
+			r.MaterialNames = append(r.MaterialNames, name)
+			r.MaterialTexture = append(r.MaterialTexture, LM_INVALID_ID)
+			m = &r.Materials[len(r.Materials)-1]
+			continue
+		}
+		if m == nil {
+			continue
+		}
+		args := fields[1:]
+		switch fields[0] {
+		case "Kd", "Ka", "Ks", "Ke":
+			f, err := parseFloats(args, 3)
+			if err != nil {
+				return err
+			}
+			switch fields[0] {
+			case "Kd":
+				m.Color = colorBytes(f)
+			case "Ka":
+				m.Ambient = colorBytes(f)
+			case "Ks":
+				m.Specular = colorBytes(f)
+				if m.Type == MTL_LAMBERT {
+					m.Type = MTL_PHONG
+				}
+			case "Ke":
+				m.Emissive = colorBytes(f)
+			}
+		case "Ns", "d", "Tr", "Pr", "Pm", "Pc", "Pcr", "aniso", "anisor":
+			f, err := parseFloats(args, 1)
+			if err != nil {
+				return err
+			}
+			switch fields[0] {
+			case "Ns":
+				m.Shininess = f[0]
+				if m.Type == MTL_LAMBERT {
+					m.Type = MTL_PHONG
+				}
+			case "d":
+				m.Opacity = f[0]
+			case "Tr":
+				m.Opacity = 1 - f[0]
+			case "Pr":
+				m.Roughness = f[0]
+				m.Type = MTL_PBR
+			case "Pm":
+				m.Metallic = f[0]
+				m.Type = MTL_PBR
+			case "Pc":
+				m.ClearcoatThickness = f[0]
+			case "Pcr":
+				m.ClearcoatRoughness = f[0]
+			case "aniso":
+				m.Anisotropy = f[0]
+			case "anisor":
+				m.AnisotropyRotation = f[0]
+			}
+		case "map_Kd":
+			if len(args) == 0 {
+				return errors.New("mtl: map_Kd without file")
+			}
+			t, err := r.loadTexture(args[len(args)-1])
+			if err != nil {
+				return err
+			}
+			if t == LM_INVALID_ID {
+				continue
+			}
+			r.MaterialTexture[len(r.MaterialTexture)-1] = t
+			m.Mode |= TEXTURE
+		case "bump", "map_Bump":
+			m.Mode |= BUMP
+		}
+	}
+	return scanner.Err()
+}
+
+func (r *ObjReader) loadMtl(name string) error {
+	f, err := r.openFile(name)
+	if f == nil || err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.ReadMtl(f)
+}
+
+func (r *ObjReader) openFile(name string) (io.ReadCloser, error) {
+	if r.Open == nil {
+		r.Warnings = append(r.Warnings, fmt.Sprintf("missing file %v: no file opener", name))
+		return nil, nil
+	}
+	f, err := r.Open(name)
+	if os.IsNotExist(err) {
+		r.Warnings = append(r.Warnings, fmt.Sprintf("missing file %v", name))
+		return nil, nil
+	}
+	return f, err
+}
+
+func objIndex(s string, n int) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return -1, err
+	}
+	if i < 0 {
+		i += n
+	} else {
+		i--
+	}
+	if i < 0 || i >= n {
+		return -1, fmt.Errorf("obj: index %v out of range", s)
+	}
+	return i, nil
+}
+
+func (r *ObjReader) parseVertex(s string) (objVertex, error) {
+	parts := strings.Split(s, "/")
+	var ov objVertex
+	var err error
+	if ov.v, err = objIndex(parts[0], len(r.verts)); err != nil {
+		return ov, err
+	}
+	if ov.v < 0 {
+		return ov, errors.New("obj: face without vertex index")
+	}
+	ov.vt, ov.vn = -1, -1
+	if len(parts) > 1 {
+		if ov.vt, err = objIndex(parts[1], len(r.texcoords)); err != nil {
+			return ov, err
+		}
+	}
+	if len(parts) > 2 {
+		if ov.vn, err = objIndex(parts[2], len(r.normals)); err != nil {
+			return ov, err
+		}
+	}
+	return ov, nil
+}
+
+func (r *ObjReader) addVertex(ov objVertex) uint16 {
+	if i, ok := r.remap[ov]; ok {
+		return i
+	}
+	m := &r.current
+	i := uint16(len(m.Verts))
+	m.Verts = append(m.Verts, r.verts[ov.v])
+	m.Colors = append(m.Colors, r.colors[ov.v])
+	var t vec2.T
+	if ov.vt >= 0 {
+		t = r.texcoords[ov.vt]
+		r.hasTex = true
+	}
+	m.Texcoords = append(m.Texcoords, t)
+	var n [3]int16
+	if ov.vn >= 0 {
+		n = encodeNormal(r.normals[ov.vn])
+		r.hasNorm = true
+	}
+	m.Normals = append(m.Normals, n)
+	r.remap[ov] = i
+	return i
+}
+
+func (r *ObjReader) flush() error {
+	m := r.current
+	if len(m.Faces) > 0 {
+		if !r.hasTex {
+			m.Texcoords = nil
+		}
+		if !r.hasNorm {
+			m.Normals = nil
+		}
+		if !r.hasColor {
+			m.Colors = nil
+		}
+		tex := LM_INVALID_ID
+		if r.mtl != LM_INVALID_ID && r.hasTex {
+			tex = r.MaterialTexture[r.mtl]
+		}
+		if err := r.emit(&ObjMesh{Name: r.name, MtlID: r.mtl, TexID: tex, Mesh: m}); err != nil {
+			return err
+		}
+	}
+	r.current = NodeMesh{}
+	r.remap = make(map[objVertex]uint16)
+	r.hasTex, r.hasNorm = false, false
+	return nil
+}
+
+func (r *ObjReader) addFace(fields []string) error {
+	if len(fields) < 3 {
+		return errors.New("obj: face with less than 3 vertices")
+	}
+	poly := make([]objVertex, len(fields))
+	for i, f := range fields {
+		ov, err := r.parseVertex(f)
+		if err != nil {
+			return err
+		}
+		poly[i] = ov
+	}
+	if len(r.current.Verts)+len(poly) > OBJ_MAX_VERTS {
+		if err := r.flush(); err != nil {
+			return err
+		}
+		if len(poly) > OBJ_MAX_VERTS {
+			return errors.New("obj: polygon too large")
+		}
+	}
+	first := r.addVertex(poly[0])
+	prev := r.addVertex(poly[1])
+	for i := 2; i < len(poly); i++ {
+		cur := r.addVertex(poly[i])
+		r.current.Faces = append(r.current.Faces, [3]uint16{first, prev, cur})
+		prev = cur
+	}
+	return nil
+}
+
+func (r *ObjReader) Read(reader io.Reader, emit func(*ObjMesh) error) error {
+	r.emit = emit
+	r.remap = make(map[objVertex]uint16)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		args := fields[1:]
+		switch fields[0] {
+		case "v":
+			f, err := parseFloats(args, 3)
+			if err != nil {
+				return err
+			}
+			r.verts = append(r.verts, vec3.T{f[0], f[1], f[2]})
+			c := [4]byte{255, 255, 255, 255}
+			if len(args) >= 6 {
+				rgb, err := parseFloats(args[3:], 3)
+				if err != nil {
+					return err
+				}
+				c = [4]byte{colorByte(rgb[0]), colorByte(rgb[1]), colorByte(rgb[2]), 255}
+				r.hasColor = true
+			}
+			r.colors = append(r.colors, c)
+		case "vt":
+			f, err := parseFloats(args, 2)
+			if err != nil {
+				return err
+			}
+			r.texcoords = append(r.texcoords, vec2.T{f[0], f[1]})
+		case "vn":
+			f, err := parseFloats(args, 3)
+			if err != nil {
+				return err
+			}
+			r.normals = append(r.normals, vec3.T{f[0], f[1], f[2]})
+		case "f":
+			if err := r.addFace(args); err != nil {
+				return err
+			}
+		case "usemtl":
+			mtl := LM_INVALID_ID
+			if len(args) > 0 {
+				name := strings.Join(args, " ")
+				if m, ok := r.materials[name]; ok {
+					mtl = m
+				} else {
+					r.Warnings = append(r.Warnings, fmt.Sprintf("unknown material %v", name))
+				}
+			}
+			if mtl != r.mtl {
+				if err := r.flush(); err != nil {
+					return err
+				}
+				r.mtl = mtl
+			}
+		case "mtllib":
+			for _, name := range args {
+				if err := r.loadMtl(name); err != nil {
+					return err
+				}
+			}
+		case "o", "g":
+			if len(args) > 0 {
+				r.name = strings.Join(args, " ")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return r.flush()
+}
+
+func (r *ObjReader) Archive(meshes []ObjMesh, setting *CompressSetting) *Archive {
+	sign := Signature{}
+	sign.Vertex.SetComponent(VERTEX_COORD, Attribute{Type: ATTR_FLOAT, Number: 3})
+	sign.Face.SetComponent(FACE_INDEX, Attribute{Type: ATTR_UNSIGNED_SHORT, Number: 3})
+
+	var hasTex, hasNorm, hasColor bool
+	for i := range meshes {
+		hasTex = hasTex || meshes[i].Mesh.HasTexcoord()
+		hasNorm = hasNorm || meshes[i].Mesh.HasNormal()
+		hasColor = hasColor || meshes[i].Mesh.HasColor()
+	}
+	nodes := make([]NodeMesh, len(meshes))
+	patchs := make([]Patch, len(meshes))
+	for i := range meshes {
+		m := meshes[i].Mesh
+		if hasTex && !m.HasTexcoord() {
+			m.Texcoords = make([]vec2.T, len(m.Verts))
+		}
+		if hasNorm && !m.HasNormal() {
+			m.Normals = make([][3]int16, len(m.Verts))
+		}
+		if hasColor && !m.HasColor() {
+			m.Colors = make([][4]byte, len(m.Verts))
+			for j := range m.Colors {
+				m.Colors[j] = [4]byte{255, 255, 255, 255}
+			}
+		}
+		nodes[i] = m
+		patchs[i] = Patch{TexID: meshes[i].TexID, MtlID: meshes[i].MtlID, FeatID: LM_INVALID_ID}
+	}
+	if hasTex {
+		sign.Vertex.SetComponent(VERTEX_TEX, Attribute{Type: ATTR_FLOAT, Number: 2})
+	}
+	if hasNorm {
+		sign.Vertex.SetComponent(VERTEX_NORM, Attribute{Type: ATTR_SHORT, Number: 3})
+	}
+	if hasColor {
+		sign.Vertex.SetComponent(VERTEX_COLOR, Attribute{Type: ATTR_UNSIGNED_BYTE, Number: 4})
+	}
+	if len(r.TextureImages) > 0 {
+		sign.SetFlag(PTJPG)
+		for _, f := range r.TextureFormats {
+			if f != "jpeg" {
+				sign.UnsetFlag(PTJPG)
+				sign.SetFlag(PTPNG)
+				break
+			}
+		}
+	}
+
+	a := newFlatArchive(sign, nodes, patchs, setting)
+	a.Header.NMaterials = uint32(len(r.Materials))
+	a.Materials = append([]Material(nil), r.Materials...)
+	if len(r.TextureImages) > 0 {
+		a.Header.NTextures = uint32(len(r.TextureImages) + 1)
+		a.Textures = make([]Texture, a.Header.NTextures)
+		a.TextureImages = append(append([]TextureImage(nil), r.TextureImages...), nil)
+	}
+	return a
+}
+
+func ImportObj(reader io.Reader, open func(name string) (io.ReadCloser, error), setting *CompressSetting) (*Archive, error) {
+	r := NewObjReader(open)
+	var meshes []ObjMesh
+	err := r.Read(reader, func(m *ObjMesh) error {
+		meshes = append(meshes, *m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(meshes) == 0 {
+		return nil, errors.New("obj: no faces")
+	}
+	return r.Archive(meshes, setting), nil
+}
+
+func ImportObjFile(path string, setting *CompressSetting) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ImportObj(f, NewObjDirReader(filepath.Dir(path)).Open, setting)
+}
+
+type objExporter struct {
+	archive  *Archive
+	sink     ExportSink
+	textures map[uint32]string
+}
+
+type objWriter struct {
+	exporter  *objExporter
+	name      string
+	file      io.WriteCloser
+	w         *bufio.Writer
+	mtl       bytes.Buffer
+	materials map[materialKey]string
+	nv        int
+	nvt       int
+	nvn       int
+}
+
+func newObjExporter(a *Archive, sink ExportSink) *objExporter {
+	return &objExporter{archive: a, sink: sink, textures: make(map[uint32]string)}
+}
+
+func (e *objExporter) create(name string) (*objWriter, error) {
+	f, err := e.sink.Create(name + ".obj")
+	if err != nil {
+		return nil, err
+	}
+	w := &objWriter{exporter: e, name: name, file: f, w: bufio.NewWriter(f), materials: make(map[materialKey]string)}
+	fmt.Fprintf(w.w, "# Wavefront OBJ file\nmtllib %v.mtl\n", name)
+	w.mtl.WriteString("# Wavefront material file\n")
+	return w, nil
+}
+
+func (e *objExporter) texture(t uint32) (string, error) {
+	if name, ok := e.textures[t]; ok {
+		return name, nil
+	}
+	a := e.archive
+	if int(t) >= len(a.TextureImages) || a.TextureImages[t] == nil {
+		return "", errors.New("texture not loaded")
+	}
+	data, err := encodeTexture(a.Header, a.TextureImages[t])
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("texture_%v.%v", t, textureExt(a.Header))
+	if err := writeSinkFile(e.sink, name, data); err != nil {
+		return "", err
+	}
+	e.textures[t] = name
+	return name, nil
+}
+
+func objColor(c [3]byte) string {
+	return fmt.Sprintf("%g %g %g", float32(c[0])/255, float32(c[1])/255, float32(c[2])/255)
+}
+
+func (w *objWriter) material(mtl, tex uint32) (string, error) {
+	a := w.exporter.archive
+	if mtl != LM_INVALID_ID && int(mtl) >= len(a.Materials) {
+		mtl = LM_INVALID_ID
+	}
+	key := materialKey{MtlID: mtl, TexID: tex}
+	if name, ok := w.materials[key]; ok {
+		return name, nil
+	}
+	name := "default"
+	if mtl != LM_INVALID_ID || tex != LM_INVALID_ID {
+		name = fmt.Sprintf("material_%v_%v", int32(mtl), int32(tex))
+	}
+	fmt.Fprintf(&w.mtl, "newmtl %v\n", name)
+	if mtl != LM_INVALID_ID {
+		m := &a.Materials[mtl]
+		fmt.Fprintf(&w.mtl, "Ka %v\nKd %v\nKs %v\n", objColor(m.Ambient), objColor(m.Color), objColor(m.Specular))
+		if m.Emissive != [3]byte{} {
+			fmt.Fprintf(&w.mtl, "Ke %v\n", objColor(m.Emissive))
+		}
+		if m.Type == MTL_PHONG {
+			fmt.Fprintf(&w.mtl, "Ns %g\n", m.Shininess)
+		}
+		if m.Opacity > 0 && m.Opacity < 1 {
+			fmt.Fprintf(&w.mtl, "d %g\n", m.Opacity)
+		}
+		if m.Type == MTL_PBR {
+			fmt.Fprintf(&w.mtl, "Pr %g\nPm %g\n", m.Roughness, m.Metallic)
+		}
+		if m.ClearcoatThickness > 0 {
+			fmt.Fprintf(&w.mtl, "Pc %g\nPcr %g\n", m.ClearcoatThickness, m.ClearcoatRoughness)
+		}
+		if m.Anisotropy != 0 {
+			fmt.Fprintf(&w.mtl, "aniso %g\nanisor %g\n", m.Anisotropy, m.AnisotropyRotation)
+		}
+	} else {
+		w.mtl.WriteString("Ka 0 0 0\nKd 1 1 1\nKs 0 0 0\n")
+	}
+	w.mtl.WriteString("illum 2\n")
+	if tex != LM_INVALID_ID {
+		file, err := w.exporter.texture(tex)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&w.mtl, "map_Kd %v\n", file)
+	}
+	w.materials[key] = name
+	return name, nil
+}
+
+func (w *objWriter) writeMesh(group string, mesh *NodeMesh, m *mat4.T, first_patch, last_patch uint32, visible func(p uint32) bool) error {
+	a := w.exporter.archive
+	if mesh.Empty() {
+		return nil
+	}
+	remap := make([]int, len(mesh.Verts))
+	for i := range remap {
+		remap[i] = -1
+	}
+	texture := make([]uint32, len(mesh.Verts))
+	var used []int
+	use := func(i int, t uint32) {
+		if remap[i] < 0 {
+			remap[i] = len(used)
+			texture[i] = t
+			used = append(used, i)
+		}
+	}
+	start := uint32(0)
+	for p := first_patch; p < last_patch; p++ {
+		patch := &a.Patchs[p]
+		if visible(p) {
+			if mesh.HasFace() {
+				for f := start; f < patch.FaceOffset && int(f) < len(mesh.Faces); f++ {
+					for _, i := range mesh.Faces[f] {
+						use(int(i), patch.TexID)
+					}
+				}
+			} else {
+				for i := start; i < patch.FaceOffset && int(i) < len(mesh.Verts); i++ {
+					use(int(i), patch.TexID)
+				}
+			}
+		}
+		start = patch.FaceOffset
+	}
+	if len(used) == 0 {
+		return nil
+	}
+
+	var normalMat mat4.T
+	if m != nil {
+		normalMat = m.Inverted()
+		normalMat.Transpose()
+	}
+	hasTex, hasNorm := mesh.HasTexcoord(), mesh.HasNormal()
+
+	fmt.Fprintf(w.w, "o %v\n", group)
+	for _, i := range used {
+		v := mesh.Verts[i]
+		if m != nil {
+			v = m.MulVec3(&v)
+		}
+		if mesh.HasColor() {
+			c := mesh.Colors[i]
+			fmt.Fprintf(w.w, "v %g %g %g %g %g %g\n", v[0], v[1], v[2], float32(c[0])/255, float32(c[1])/255, float32(c[2])/255)
+		} else {
+			fmt.Fprintf(w.w, "v %g %g %g\n", v[0], v[1], v[2])
+		}
+	}
+	if hasTex {
+		for _, i := range used {
+			uv := vec3.T{mesh.Texcoords[i][0], mesh.Texcoords[i][1], 1}
+			if t := texture[i]; t != LM_INVALID_ID && int(t) < len(a.Textures) && !a.Textures[t].Mat.IsZero() {
+				uv = a.Textures[t].Mat.MulVec3(&uv)
+			}
+			fmt.Fprintf(w.w, "vt %g %g\n", uv[0], uv[1])
+		}
+	}
+	if hasNorm {
+		for _, i := range used {
+			n := decodeNormals(mesh.Normals[i : i+1])[0]
+			if m != nil {
+				n = normalMat.MulVec3W(&n, 0)
+				if l := n.Length(); l > 0 {
+					n.Scale(1 / l)
+				}
+			}
+			fmt.Fprintf(w.w, "vn %g %g %g\n", n[0], n[1], n[2])
+		}
+	}
+
+	ref := func(i uint16) string {
+		idx := remap[i]
+		s := strconv.Itoa(w.nv + idx + 1)
+		if hasTex && hasNorm {
+			return fmt.Sprintf("%v/%v/%v", s, w.nvt+idx+1, w.nvn+idx+1)
+		} else if hasTex {
+			return fmt.Sprintf("%v/%v", s, w.nvt+idx+1)
+		} else if hasNorm {
+			return fmt.Sprintf("%v//%v", s, w.nvn+idx+1)
+		}
+		return s
+	}
+	start = 0
+	for p := first_patch; p < last_patch; p++ {
+		patch := &a.Patchs[p]
+		if visible(p) {
+			tex := patch.TexID
+			if !hasTex {
+				tex = LM_INVALID_ID
+			}
+			name, err := w.material(patch.MtlID, tex)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w.w, "g %v_patch_%v\nusemtl %v\n", group, p, name)
+			if mesh.HasFace() {
+				for f := start; f < patch.FaceOffset && int(f) < len(mesh.Faces); f++ {
+					face := mesh.Faces[f]
+					fmt.Fprintf(w.w, "f %v %v %v\n", ref(face[0]), ref(face[1]), ref(face[2]))
+				}
+			} else {
+				for i := start; i < patch.FaceOffset && int(i) < len(mesh.Verts); i++ {
+					fmt.Fprintf(w.w, "p %v\n", w.nv+remap[i]+1)
+				}
+			}
+		}
+		start = patch.FaceOffset
+	}
+
+	w.nv += len(used)
+	if hasTex {
+		w.nvt += len(used)
+	}
+	if hasNorm {
+		w.nvn += len(used)
+	}
+	return nil
+}
+
+func (w *objWriter) close() error {
+	if err := w.w.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return writeSinkFile(w.exporter.sink, w.name+".mtl", w.mtl.Bytes())
+}
+
+func (e *objExporter) writeNode(w *objWriter, n uint32, visible func(p uint32) bool) error {
+	a := e.archive
+	if err := a.LoadNode(n); err != nil {
+		return err
+	}
+	first_patch, last_patch := a.getNodePatchRange(n)
+	return w.writeMesh(nodeName(n), &a.NodeMeshs[n], nil, first_patch, last_patch, visible)
+}
+
+func (e *objExporter) writeInstanceNode(w *objWriter, n uint32, name string, m *mat4.T) error {
+	a := e.archive
+	if err := a.LoadInstance(n); err != nil {
+		return err
+	}
+	first_patch, last_patch := a.getInstanceNodePatchRange(n)
+	return w.writeMesh(name, &a.InstanceMeshs[n], m, first_patch, last_patch, func(p uint32) bool { return true })
+}
+
+func (a *Archive) ExtractTo(sink ExportSink) error {
+	e := newObjExporter(a, sink)
+	for n := uint32(0); n < a.sinkNode(); n++ {
+		w, err := e.create(nodeName(n))
+		if err != nil {
+			return err
+		}
+		if err := e.writeNode(w, n, func(p uint32) bool { return true }); err != nil {
+			w.close()
+			return err
+		}
+		if err := w.close(); err != nil {
+			return err
+		}
+	}
+	for n := 0; n+1 < len(a.InstanceNodes); n++ {
+		name := fmt.Sprintf("instance_node_%v", n)
+		w, err := e.create(name)
+		if err != nil {
+			return err
+		}
+		if err := e.writeInstanceNode(w, uint32(n), name, nil); err != nil {
+			w.close()
+			return err
+		}
+		if err := w.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Archive) ExportNodeObj(sink ExportSink, n uint32) error {
+	if n >= a.sinkNode() {
+		return errors.New("node index error")
+	}
+	e := newObjExporter(a, sink)
+	w, err := e.create(nodeName(n))
+	if err != nil {
+		return err
+	}
+	if err := e.writeNode(w, n, func(p uint32) bool { return true }); err != nil {
+		w.close()
+		return err
+	}
+	return w.close()
+}
+
+func (a *Archive) ExportCutObj(sink ExportSink, name string, selected []bool) error {
+	e := newObjExporter(a, sink)
+	w, err := e.create(name)
+	if err != nil {
+		return err
+	}
+	for n := range selected {
+		if !selected[n] || uint32(n) >= a.sinkNode() {
+			continue
+		}
+		if err := e.writeNode(w, uint32(n), func(p uint32) bool { return !selected[a.Patchs[p].Node] }); err != nil {
+			w.close()
+			return err
+		}
+	}
+	for i := range a.Instances {
+		inst := &a.Instances[i]
+		var m *mat4.T
+		if !inst.InstanceMat.IsZero() {
+			m = &inst.InstanceMat
+		}
+		if err := e.writeInstanceNode(w, inst.Node, instanceName(inst.InstanceID), m); err != nil {
+			w.close()
+			return err
+		}
+	}
+	return w.close()
+}
+
+func (a *Archive) ExportObjAtError(sink ExportSink, name string, maxError float32) error {
+	return a.ExportCutObj(sink, name, a.SelectByError(maxError))
+}
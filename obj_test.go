@@ -0,0 +1,201 @@
+package lodm
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec2"
+)
+
+const testObj = `# quad with seams
+mtllib test.mtl
+v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0 1 0 1 0 0
+vt 0 0
+vt 1 0
+vt 1 1
+vt 0 1
+vt 0.5 0.5
+vn 0 0 2
+usemtl red
+f 1/1/1 2/2/1 3/3/1 4/4/1
+usemtl shiny
+f -4/5/-1 -2/5/-1 -1/5/-1
+`
+
+const testMtl = `newmtl red
+Kd 1 0 0
+d 0.5
+map_Kd tex.png
+newmtl shiny
+Kd 0.5 0.5 0.5
+Pr 0.25
+Pm 1
+`
+
+func testObjOpener(t *testing.T) func(name string) (io.ReadCloser, error) {
+	var tex bytes.Buffer
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.NRGBA{255, 0, 0, 255})
+	if err := png.Encode(&tex, img); err != nil {
+		t.FailNow()
+	}
+	files := map[string][]byte{"test.mtl": []byte(testMtl), "tex.png": tex.Bytes()}
+	return func(name string) (io.ReadCloser, error) {
+		data, ok := files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func TestObjReader(t *testing.T) {
+	r := NewObjReader(testObjOpener(t))
+	var meshes []ObjMesh
+	err := r.Read(strings.NewReader(testObj), func(m *ObjMesh) error {
+		meshes = append(meshes, *m)
+		return nil
+	})
+	if err != nil || len(meshes) != 2 || len(r.Materials) != 2 || len(r.TextureImages) != 1 {
+		t.FailNow()
+	}
+
+	red := meshes[0]
+	if red.MtlID != 0 || red.TexID != 0 || len(red.Mesh.Verts) != 4 || len(red.Mesh.Faces) != 2 {
+		t.FailNow()
+	}
+	if red.Mesh.Normals[0] != [3]int16{0, 0, 32767} || red.Mesh.Colors[3] != [4]byte{255, 0, 0, 255} {
+		t.FailNow()
+	}
+
+	shiny := meshes[1]
+	if shiny.MtlID != 1 || shiny.TexID != LM_INVALID_ID || len(shiny.Mesh.Verts) != 3 || shiny.Mesh.Texcoords[0][0] != 0.5 {
+		t.FailNow()
+	}
+
+	m := r.Materials[0]
+	if m.Color != [3]byte{255, 0, 0} || m.Opacity != 0.5 || m.Mode&TEXTURE == 0 {
+		t.FailNow()
+	}
+	m = r.Materials[1]
+	if m.Type != MTL_PBR || m.Roughness != 0.25 || m.Metallic != 1 || m.Color != [3]byte{128, 128, 128} {
+		t.FailNow()
+	}
+
+	a := r.Archive(meshes, nil)
+	if len(a.Nodes) != 3 || a.nroots != 2 || a.Header.NFace != 3 || a.Header.Sign.Flags&PTPNG == 0 {
+		t.FailNow()
+	}
+	if len(a.Textures) != 2 || a.Patchs[0].TexID != 0 || a.Patchs[1].MtlID != 1 || a.Patchs[1].Node != 2 {
+		t.FailNow()
+	}
+}
+
+func TestObjReaderMissingFiles(t *testing.T) {
+	files := map[string][]byte{"test.mtl": []byte(testMtl)}
+	r := NewObjReader(func(name string) (io.ReadCloser, error) {
+		data, ok := files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	var meshes []ObjMesh
+	err := r.Read(strings.NewReader(testObj+"usemtl missing\nf 1 2 3\n"), func(m *ObjMesh) error {
+		meshes = append(meshes, *m)
+		return nil
+	})
+	if err != nil || len(meshes) != 3 || len(r.Warnings) != 2 || len(r.TextureImages) != 0 {
+		t.FailNow()
+	}
+	if meshes[0].MtlID != 0 || meshes[0].TexID != LM_INVALID_ID || meshes[2].MtlID != LM_INVALID_ID {
+		t.FailNow()
+	}
+
+	r = NewObjReader(nil)
+	if err := r.Read(strings.NewReader(testObj), func(m *ObjMesh) error { return nil }); err != nil || len(r.Warnings) != 3 {
+		t.FailNow()
+	}
+}
+
+func TestObjReaderSplit(t *testing.T) {
+	var obj strings.Builder
+	for i := 0; i < 70000; i++ {
+		obj.WriteString("v 0 0 0\n")
+	}
+	for i := 1; i+2 <= 70000; i += 3 {
+		obj.WriteString("f " + fmt.Sprintf("%v %v %v", i, i+1, i+2) + "\n")
+	}
+	a, err := ImportObj(strings.NewReader(obj.String()), nil, nil)
+	if err != nil || len(a.Nodes) != 3 || a.Header.NVert != 69999 {
+		t.FailNow()
+	}
+}
+
+func TestExportObj(t *testing.T) {
+	a := newTestTexturedArchive()
+	a.Header.Sign.Vertex.SetComponent(VERTEX_NORM, Attribute{Type: ATTR_SHORT, Number: 3})
+	for n := 0; n < 2; n++ {
+		mesh := a.NodeMeshs[n]
+		mesh.Normals = make([][3]int16, len(mesh.Verts))
+		for i := range mesh.Normals {
+			mesh.Normals[i] = [3]int16{0, 0, 1000}
+		}
+		a.NodeMeshs[n] = mesh
+	}
+	a.Patchs = append(a.Patchs, Patch{Node: LM_INVALID_ID, FaceOffset: 1, TexID: LM_INVALID_ID, MtlID: 0, FeatID: LM_INVALID_ID})
+	a.InstanceNodes = []Node{{NVert: 3, NFace: 1, FirstPatch: 2}, {FirstPatch: 3}}
+	a.InstanceMeshs = []NodeMesh{{Verts: testMesh.Verts[:3], Faces: testMesh.Faces[:1], Normals: [][3]int16{{0, 0, 1}, {0, 0, 1}, {0, 0, 1}}, Texcoords: make([]vec2.T, 3)}, {}}
+	a.Instances = []Instance{{Node: 0, InstanceID: 5, InstanceMat: mat4.T{{0, 1, 0, 0}, {-1, 0, 0, 0}, {0, 0, 1, 0}, {10, 0, 0, 1}}}}
+
+	sink := NewMemorySink()
+	if err := a.ExportObjAtError(sink, "cut", 0); err != nil {
+		t.FailNow()
+	}
+	if len(sink.Files) != 3 || sink.Files["texture_0.png"] == nil {
+		t.FailNow()
+	}
+	obj := string(sink.Files["cut.obj"])
+	if !strings.Contains(obj, "f 1/1/1 2/2/2 3/3/3") || !strings.Contains(obj, "vn 0 0 1\n") || !strings.Contains(obj, "v 10 0 0\n") {
+		t.FailNow()
+	}
+
+	open := func(name string) (io.ReadCloser, error) {
+		data, ok := sink.Files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	b, err := ImportObj(strings.NewReader(obj), open, nil)
+	if err != nil || len(b.Materials) != 2 || len(b.TextureImages) != 2 {
+		t.FailNow()
+	}
+	faces := 0
+	for n := 0; n+1 < len(b.Nodes); n++ {
+		faces += len(b.NodeMeshs[n].Faces)
+	}
+	if faces != len(testMesh.Faces)+1 || b.Materials[0].Type != MTL_PBR || b.Materials[0].Metallic != 0.5 {
+		t.FailNow()
+	}
+
+	sink = NewMemorySink()
+	if err := a.ExtractTo(sink); err != nil {
+		t.FailNow()
+	}
+	if sink.Files["node_0.obj"] == nil || sink.Files["node_1.mtl"] == nil || sink.Files["instance_node_0.obj"] == nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,229 @@
+package lodm
+
+import (
+	"math"
+
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec3"
+	"github.com/flywave/go3d/vec4"
+)
+
+const (
+	OCCLUSION_BUFFER_SIZE int = 128
+)
+
+type depthLevel struct {
+	width  int
+	height int
+	depth  []float32
+}
+
+type hiZBuffer struct {
+	levels []depthLevel
+	view   mat4.T
+	proj   mat4.T
+	near   float32
+}
+
+func newHiZBuffer(width, height int, view, proj mat4.T, near float32) *hiZBuffer {
+	b := &hiZBuffer{view: view, proj: proj, near: near}
+	level := depthLevel{width: width, height: height, depth: make([]float32, width*height)}
+	for i := range level.depth {
+		level.depth[i] = math.MaxFloat32
+	}
+	b.levels = append(b.levels, level)
+	return b
+}
+
+func (b *hiZBuffer) project(v vec3.T) (float32, float32) {
+	p := b.proj.MulVec4(&vec4.T{v[0], v[1], v[2], 1})
+	base := &b.levels[0]
+	x := (p[0]/p[3]*0.5 + 0.5) * float32(base.width)
+	y := (0.5 - p[1]/p[3]*0.5) * float32(base.height)
+	return x, y
+}
+
+func (b *hiZBuffer) drawTriangle(v0, v1, v2 vec3.T) {
+	in := []vec3.T{v0, v1, v2}
+	var poly []vec3.T
+	for i := range in {
+		a, c := in[i], in[(i+1)%len(in)]
+		da, dc := -a[2]-b.near, -c[2]-b.near
+		if da >= 0 {
+			poly = append(poly, a)
+		}
+		if (da >= 0) != (dc >= 0) {
+			poly = append(poly, vec3.Interpolate(&a, &c, da/(da-dc)))
+		}
+	}
+	for i := 1; i+1 < len(poly); i++ {
+		b.fillTriangle(poly[0], poly[i], poly[i+1])
+	}
+}
+
+func (b *hiZBuffer) fillTriangle(v0, v1, v2 vec3.T) {
+	base := &b.levels[0]
+	x0, y0 := b.project(v0)
+	x1, y1 := b.project(v1)
+	x2, y2 := b.project(v2)
+	area := (x1-x0)*(y2-y0) - (x2-x0)*(y1-y0)
+	if area == 0 {
+		return
+	}
+	iz0, iz1, iz2 := -1/v0[2], -1/v1[2], -1/v2[2]
+
+	minx := int(math.Max(0, math.Floor(float64(min3(x0, x1, x2)))))
+	maxx := int(math.Min(float64(base.width-1), math.Ceil(float64(max3(x0, x1, x2)))))
+	miny := int(math.Max(0, math.Floor(float64(min3(y0, y1, y2)))))
+	maxy := int(math.Min(float64(base.height-1), math.Ceil(float64(max3(y0, y1, y2)))))
+
+	for y := miny; y <= maxy; y++ {
+		py := float32(y) + 0.5
+		for x := minx; x <= maxx; x++ {
+			px := float32(x) + 0.5
+			b0 := ((x1-px)*(y2-py) - (x2-px)*(y1-py)) / area
+			b1 := ((x2-px)*(y0-py) - (x0-px)*(y2-py)) / area
+			b2 := 1 - b0 - b1
+			if b0 < 0 || b1 < 0 || b2 < 0 {
+				continue
+			}
+			z := 1 / (b0*iz0 + b1*iz1 + b2*iz2)
+			idx := y*base.width + x
+			if z < base.depth[idx] {
+				base.depth[idx] = z
+			}
+		}
+	}
+}
+
+func (b *hiZBuffer) drawMesh(mesh *NodeMesh, modelView *mat4.T) {
+	if !mesh.HasFace() {
+		return
+	}
+	verts := make([]vec3.T, len(mesh.Verts))
+	for i := range mesh.Verts {
+		verts[i] = modelView.MulVec3(&mesh.Verts[i])
+	}
+	for _, f := range mesh.Faces {
+		b.drawTriangle(verts[f[0]], verts[f[1]], verts[f[2]])
+	}
+}
+
+func (b *hiZBuffer) buildPyramid() {
+	for {
+		prev := &b.levels[len(b.levels)-1]
+		if prev.width <= 1 && prev.height <= 1 {
+			return
+		}
+		level := depthLevel{width: (prev.width + 1) / 2, height: (prev.height + 1) / 2}
+		level.depth = make([]float32, level.width*level.height)
+		for y := 0; y < level.height; y++ {
+			for x := 0; x < level.width; x++ {
+				d := float32(0)
+				for dy := 0; dy < 2; dy++ {
+					for dx := 0; dx < 2; dx++ {
+						sx, sy := x*2+dx, y*2+dy
+						if sx >= prev.width {
+							sx = prev.width - 1
+						}
+						if sy >= prev.height {
+							sy = prev.height - 1
+						}
+						if v := prev.depth[sy*prev.width+sx]; v > d {
+							d = v
+						}
+					}
+				}
+				level.depth[y*level.width+x] = d
+			}
+		}
+		b.levels = append(b.levels, level)
+	}
+}
+
+func (b *hiZBuffer) isOccluded(s Sphere) bool {
+	center := s.Center()
+	c := b.view.MulVec3(&center)
+	r := s.Radius()
+	nearest := -c[2] - r
+	if nearest <= b.near {
+		return false
+	}
+	minx, miny := float32(math.MaxFloat32), float32(math.MaxFloat32)
+	maxx, maxy := -float32(math.MaxFloat32), -float32(math.MaxFloat32)
+	for i := 0; i < 8; i++ {
+		corner := vec3.T{c[0] - r, c[1] - r, c[2] - r}
+		if i&1 != 0 {
+			corner[0] += 2 * r
+		}
+		if i&2 != 0 {
+			corner[1] += 2 * r
+		}
+		if i&4 != 0 {
+			corner[2] += 2 * r
+		}
+		x, y := b.project(corner)
+		minx, maxx = float32(math.Min(float64(minx), float64(x))), float32(math.Max(float64(maxx), float64(x)))
+		miny, maxy = float32(math.Min(float64(miny), float64(y))), float32(math.Max(float64(maxy), float64(y)))
+	}
+	base := &b.levels[0]
+	if maxx < 0 || maxy < 0 || minx >= float32(base.width) || miny >= float32(base.height) {
+		return false
+	}
+	minx, miny = float32(math.Max(0, float64(minx))), float32(math.Max(0, float64(miny)))
+	maxx, maxy = float32(math.Min(float64(base.width-1), float64(maxx))), float32(math.Min(float64(base.height-1), float64(maxy)))
+
+	extent := math.Max(float64(maxx-minx), float64(maxy-miny))
+	lod := 0
+	if extent > 1 {
+		lod = int(math.Ceil(math.Log2(extent)))
+	}
+	if lod >= len(b.levels) {
+		lod = len(b.levels) - 1
+	}
+	level := &b.levels[lod]
+	x0, x1 := int(minx)>>uint(lod), int(maxx)>>uint(lod)
+	y0, y1 := int(miny)>>uint(lod), int(maxy)>>uint(lod)
+	for y := y0; y <= y1 && y < level.height; y++ {
+		for x := x0; x <= x1 && x < level.width; x++ {
+			if level.depth[y*level.width+x] >= nearest {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (t *Traversal) buildOcclusionBuffer() {
+	a := t.Archive
+	width, height := OCCLUSION_BUFFER_SIZE, OCCLUSION_BUFFER_SIZE
+	if t.Width > t.Height {
+		height = int(math.Max(1, float64(OCCLUSION_BUFFER_SIZE*t.Height/t.Width)))
+	} else {
+		width = int(math.Max(1, float64(OCCLUSION_BUFFER_SIZE*t.Width/t.Height)))
+	}
+	view := t.Camera.ViewMatrix()
+	proj := t.Camera.ProjectionMatrix(float32(t.Width) / float32(t.Height))
+	t.occlusion = newHiZBuffer(width, height, view, proj, t.Camera.Near)
+
+	var modelView mat4.T
+	modelView.AssignMul(&view, &t.model)
+	for n := 0; n+1 < len(a.Nodes); n++ {
+		if a.NodeMeshs[n].Empty() {
+			continue
+		}
+		s := transformSphere(&t.model, a.Nodes[n].Sphere)
+		if !t.isVisible(s) {
+			continue
+		}
+		t.occlusion.drawMesh(&a.NodeMeshs[n], &modelView)
+	}
+	t.occlusion.buildPyramid()
+}
+
+func (t *Traversal) isOccluded(n uint32, s Sphere) bool {
+	if t.occlusion == nil || !t.Archive.NodeMeshs[n].Empty() {
+		return false
+	}
+	return t.occlusion.isOccluded(s)
+}
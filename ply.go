@@ -0,0 +1,699 @@
+package lodm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+)
+
+type PlyFormat uint8
+
+const (
+	PLY_ASCII     PlyFormat = 0
+	PLY_BINARY_LE PlyFormat = 1
+	PLY_BINARY_BE PlyFormat = 2
+)
+
+var (
+	plyFormatNames = []string{"ascii", "binary_little_endian", "binary_big_endian"}
+	plyTypes       = map[string]AttributeType{
+		"char": ATTR_BYTE, "int8": ATTR_BYTE,
+		"uchar": ATTR_UNSIGNED_BYTE, "uint8": ATTR_UNSIGNED_BYTE,
+		"short": ATTR_SHORT, "int16": ATTR_SHORT,
+		"ushort": ATTR_UNSIGNED_SHORT, "uint16": ATTR_UNSIGNED_SHORT,
+		"int": ATTR_INT, "int32": ATTR_INT,
+		"uint": ATTR_UNSIGNED_INT, "uint32": ATTR_UNSIGNED_INT,
+		"float": ATTR_FLOAT, "float32": ATTR_FLOAT,
+		"double": ATTR_DOUBLE, "float64": ATTR_DOUBLE,
+	}
+	plyTypeNames = []string{"", "char", "uchar", "short", "ushort", "int", "uint", "float", "double"}
+)
+
+type PlyMesh struct {
+	Sign      Signature
+	DataNames [4]string
+	Verts     []vec3.T
+	Normals   [][3]int16
+	Texcoords []vec2.T
+	Colors    [][4]byte
+	Data      [4][]float32
+	Faces     [][3]uint32
+}
+
+type plyProperty struct {
+	name      string
+	typ       AttributeType
+	list      bool
+	countType AttributeType
+}
+
+type plyElement struct {
+	name  string
+	count int
+	props []plyProperty
+}
+
+type plyReader struct {
+	format  PlyFormat
+	order   binary.ByteOrder
+	reader  *bufio.Reader
+	scanner *bufio.Scanner
+	buf     [8]byte
+}
+
+func (r *plyReader) value(t AttributeType) (float64, error) {
+	if r.format == PLY_ASCII {
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+		return strconv.ParseFloat(r.scanner.Text(), 64)
+	}
+	b := r.buf[:typeSize[t]]
+	if _, err := io.ReadFull(r.reader, b); err != nil {
+		return 0, err
+	}
+	switch t {
+	case ATTR_BYTE:
+		return float64(int8(b[0])), nil
+	case ATTR_UNSIGNED_BYTE:
+		return float64(b[0]), nil
+	case ATTR_SHORT:
+		return float64(int16(r.order.Uint16(b))), nil
+	case ATTR_UNSIGNED_SHORT:
+		return float64(r.order.Uint16(b)), nil
+	case ATTR_INT:
+		return float64(int32(r.order.Uint32(b))), nil
+	case ATTR_UNSIGNED_INT:
+		return float64(r.order.Uint32(b)), nil
+	case ATTR_FLOAT:
+		return float64(math.Float32frombits(r.order.Uint32(b))), nil
+	default:
+		return math.Float64frombits(r.order.Uint64(b)), nil
+	}
+}
+
+func readPlyHeader(reader *bufio.Reader) (PlyFormat, []*plyElement, error) {
+	var format PlyFormat
+	var elements []*plyElement
+	line, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "ply" {
+		return format, nil, errors.New("ply: bad magic")
+	}
+	hasFormat := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return format, nil, errors.New("ply: unexpected end of header")
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "format":
+			if len(fields) < 2 {
+				return format, nil, errors.New("ply: bad format line")
+			}
+			found := false
+			for i, name := range plyFormatNames {
+				if fields[1] == name {
+					format = PlyFormat(i)
+					found = true
+				}
+			}
+			if !found {
+				return format, nil, errors.New("ply: unknown format " + fields[1])
+			}
+			hasFormat = true
+		case "element":
+			if len(fields) < 3 {
+				return format, nil, errors.New("ply: bad element line")
+			}
+			count, err := strconv.Atoi(fields[2])
+			if err != nil || count < 0 {
+				return format, nil, errors.New("ply: bad element count")
+			}
+			elements = append(elements, &plyElement{name: fields[1], count: count})
+		case "property":
+			if len(elements) == 0 {
+				return format, nil, errors.New("ply: property before element")
+			}
+			var prop plyProperty
+			var ok bool
+			if len(fields) == 5 && fields[1] == "list" {
+				prop.list = true
+				prop.countType, ok = plyTypes[fields[2]]
+				if !ok {
+					return format, nil, errors.New("ply: unknown type " + fields[2])
+				}
+				prop.typ, ok = plyTypes[fields[3]]
+				prop.name = fields[4]
+			} else if len(fields) == 3 {
+				prop.typ, ok = plyTypes[fields[1]]
+				prop.name = fields[2]
+			}
+			if !ok {
+				return format, nil, errors.New("ply: bad property line")
+			}
+			e := elements[len(elements)-1]
+			e.props = append(e.props, prop)
+		case "end_header":
+			if !hasFormat {
+				return format, nil, errors.New("ply: missing format")
+			}
+			return format, elements, nil
+		}
+	}
+}
+
+func plyVertexSlot(name string) (ComponentType, int) {
+	switch name {
+	case "x":
+		return VERTEX_COORD, 0
+	case "y":
+		return VERTEX_COORD, 1
+	case "z":
+		return VERTEX_COORD, 2
+	case "nx":
+		return VERTEX_NORM, 0
+	case "ny":
+		return VERTEX_NORM, 1
+	case "nz":
+		return VERTEX_NORM, 2
+	case "red":
+		return VERTEX_COLOR, 0
+	case "green":
+		return VERTEX_COLOR, 1
+	case "blue":
+		return VERTEX_COLOR, 2
+	case "alpha":
+		return VERTEX_COLOR, 3
+	case "s", "u", "texture_u", "texture_s":
+		return VERTEX_TEX, 0
+	case "t", "v", "texture_v", "texture_t":
+		return VERTEX_TEX, 1
+	}
+	return VERTEX_DATA0, 0
+}
+
+func (m *PlyMesh) readVertices(r *plyReader, e *plyElement) error {
+	slots := make([]ComponentType, len(e.props))
+	comps := make([]int, len(e.props))
+	nextData := 1
+	for i, prop := range e.props {
+		if prop.list {
+			continue
+		}
+		slots[i], comps[i] = plyVertexSlot(prop.name)
+		switch slots[i] {
+		case VERTEX_DATA0:
+			if nextData >= len(m.Data) {
+				return errors.New("ply: too many extra vertex properties")
+			}
+			if prop.typ == ATTR_INT || prop.typ == ATTR_UNSIGNED_INT || prop.typ == ATTR_DOUBLE {
+				return errors.New("ply: unsupported extra vertex property type")
+			}
+			comps[i] = nextData
+			m.DataNames[nextData] = prop.name
+			m.Sign.Vertex.SetComponent(VERTEX_DATA0+ComponentType(nextData), Attribute{Type: prop.typ, Number: 1})
+			m.Data[nextData] = make([]float32, e.count)
+			nextData++
+		case VERTEX_NORM:
+			m.Sign.Vertex.SetComponent(VERTEX_NORM, Attribute{Type: ATTR_SHORT, Number: 3})
+		case VERTEX_COLOR:
+			m.Sign.Vertex.SetComponent(VERTEX_COLOR, Attribute{Type: ATTR_UNSIGNED_BYTE, Number: 4})
+		case VERTEX_TEX:
+			m.Sign.Vertex.SetComponent(VERTEX_TEX, Attribute{Type: ATTR_FLOAT, Number: 2})
+		}
+	}
+	m.Sign.Vertex.SetComponent(VERTEX_COORD, Attribute{Type: ATTR_FLOAT, Number: 3})
+
+	m.Verts = make([]vec3.T, e.count)
+	if m.Sign.Vertex.HasNormals() {
+		m.Normals = make([][3]int16, e.count)
+	}
+	if m.Sign.Vertex.HasTextures() {
+		m.Texcoords = make([]vec2.T, e.count)
+	}
+	if m.Sign.Vertex.HasColors() {
+		m.Colors = make([][4]byte, e.count)
+	}
+	for v := 0; v < e.count; v++ {
+		var normal vec3.T
+		color := [4]byte{255, 255, 255, 255}
+		for i, prop := range e.props {
+			if prop.list {
+				if err := r.skipList(prop); err != nil {
+					return err
+				}
+				continue
+			}
+			val, err := r.value(prop.typ)
+			if err != nil {
+				return err
+			}
+			switch slots[i] {
+			case VERTEX_COORD:
+				m.Verts[v][comps[i]] = float32(val)
+			case VERTEX_NORM:
+				normal[comps[i]] = float32(val)
+			case VERTEX_COLOR:
+				if prop.typ == ATTR_FLOAT || prop.typ == ATTR_DOUBLE {
+					val *= 255
+				}
+				color[comps[i]] = byte(math.Max(0, math.Min(255, math.Round(val))))
+			case VERTEX_TEX:
+				m.Texcoords[v][comps[i]] = float32(val)
+			case VERTEX_DATA0:
+				m.Data[comps[i]][v] = float32(val)
+			}
+		}
+		if m.Normals != nil {
+			m.Normals[v] = encodeNormal(normal)
+		}
+		if m.Colors != nil {
+			m.Colors[v] = color
+		}
+	}
+	return nil
+}
+
+func (r *plyReader) skipList(prop plyProperty) error {
+	count, err := r.value(prop.countType)
+	if err != nil {
+		return err
+	}
+	for k := 0; k < int(count); k++ {
+		if _, err := r.value(prop.typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *PlyMesh) readFaces(r *plyReader, e *plyElement, nvert int) error {
+	for f := 0; f < e.count; f++ {
+		for _, prop := range e.props {
+			if !prop.list || (prop.name != "vertex_indices" && prop.name != "vertex_index") {
+				var err error
+				if prop.list {
+					err = r.skipList(prop)
+				} else {
+					_, err = r.value(prop.typ)
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			count, err := r.value(prop.countType)
+			if err != nil {
+				return err
+			}
+			poly := make([]uint32, int(count))
+			for k := range poly {
+				val, err := r.value(prop.typ)
+				if err != nil {
+					return err
+				}
+				if val < 0 || int(val) >= nvert {
+					return errors.New("ply: face index out of range")
+				}
+				poly[k] = uint32(val)
+			}
+			for k := 2; k < len(poly); k++ {
+				m.Faces = append(m.Faces, [3]uint32{poly[0], poly[k-1], poly[k]})
+			}
+		}
+	}
+	return nil
+}
+
+func ReadPly(reader io.Reader) (*PlyMesh, error) {
+	br := bufio.NewReader(reader)
+	format, elements, err := readPlyHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	r := &plyReader{format: format, reader: br, order: binary.LittleEndian}
+	if format == PLY_BINARY_BE {
+		r.order = binary.BigEndian
+	}
+	if format == PLY_ASCII {
+		r.scanner = bufio.NewScanner(br)
+		r.scanner.Split(bufio.ScanWords)
+	}
+
+	m := &PlyMesh{}
+	hasVertex := false
+	for _, e := range elements {
+		switch {
+		case e.name == "vertex" && !hasVertex:
+			if err := m.readVertices(r, e); err != nil {
+				return nil, err
+			}
+			hasVertex = true
+		case e.name == "face" && hasVertex:
+			if err := m.readFaces(r, e, len(m.Verts)); err != nil {
+				return nil, err
+			}
+		default:
+			for i := 0; i < e.count; i++ {
+				for _, prop := range e.props {
+					if prop.list {
+						err = r.skipList(prop)
+					} else {
+						_, err = r.value(prop.typ)
+					}
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	if !hasVertex {
+		return nil, errors.New("ply: no vertex element")
+	}
+	if len(m.Faces) > 0 {
+		m.Sign.Face.SetComponent(FACE_INDEX, Attribute{Type: ATTR_UNSIGNED_SHORT, Number: 3})
+	}
+	return m, nil
+}
+
+func ReadPlyFile(path string) (*PlyMesh, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPly(f)
+}
+
+func (m *PlyMesh) dataNumber(d int) int {
+	return dataNumber(&m.Sign, d)
+}
+
+func (m *PlyMesh) copyVertex(dst *NodeMesh, i uint32) {
+	dst.Verts = append(dst.Verts, m.Verts[i])
+	if len(m.Normals) > 0 {
+		dst.Normals = append(dst.Normals, m.Normals[i])
+	}
+	if len(m.Texcoords) > 0 {
+		dst.Texcoords = append(dst.Texcoords, m.Texcoords[i])
+	}
+	if len(m.Colors) > 0 {
+		dst.Colors = append(dst.Colors, m.Colors[i])
+	}
+	for d := 1; d < len(m.Data); d++ {
+		if k := m.dataNumber(d); k > 0 {
+			dst.Data[d] = append(dst.Data[d], m.Data[d][int(i)*k:int(i+1)*k]...)
+		}
+	}
+}
+
+func (m *PlyMesh) Meshes() []NodeMesh {
+	return splitIndexedMesh(len(m.Verts), m.Faces, m.copyVertex)
+}
+
+type plyWriter struct {
+	w      *bufio.Writer
+	format PlyFormat
+	order  binary.ByteOrder
+	first  bool
+	buf    [8]byte
+}
+
+func (w *plyWriter) value(t AttributeType, v float64) {
+	if w.format == PLY_ASCII {
+		if !w.first {
+			w.w.WriteByte(' ')
+		}
+		w.first = false
+		w.w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		return
+	}
+	b := w.buf[:typeSize[t]]
+	switch t {
+	case ATTR_BYTE:
+		b[0] = byte(int8(v))
+	case ATTR_UNSIGNED_BYTE:
+		b[0] = byte(v)
+	case ATTR_SHORT:
+		w.order.PutUint16(b, uint16(int16(v)))
+	case ATTR_UNSIGNED_SHORT:
+		w.order.PutUint16(b, uint16(v))
+	case ATTR_INT:
+		w.order.PutUint32(b, uint32(int32(v)))
+	case ATTR_UNSIGNED_INT:
+		w.order.PutUint32(b, uint32(v))
+	case ATTR_FLOAT:
+		w.order.PutUint32(b, math.Float32bits(float32(v)))
+	default:
+		w.order.PutUint64(b, math.Float64bits(v))
+	}
+	w.w.Write(b)
+}
+
+func (w *plyWriter) end() {
+	if w.format == PLY_ASCII {
+		w.w.WriteByte('\n')
+	}
+	w.first = true
+}
+
+func (m *PlyMesh) dataName(d, k int) string {
+	name := m.DataNames[d]
+	if name == "" {
+		name = fmt.Sprintf("data%d", d)
+	}
+	if m.dataNumber(d) > 1 {
+		name = fmt.Sprintf("%s_%d", name, k)
+	}
+	return name
+}
+
+func WritePly(writer io.Writer, m *PlyMesh, format PlyFormat) error {
+	if int(format) >= len(plyFormatNames) {
+		return errors.New("ply: unknown format")
+	}
+	w := &plyWriter{w: bufio.NewWriter(writer), format: format, order: binary.LittleEndian, first: true}
+	if format == PLY_BINARY_BE {
+		w.order = binary.BigEndian
+	}
+	hasNormal := len(m.Normals) == len(m.Verts) && len(m.Normals) > 0
+	hasTex := len(m.Texcoords) == len(m.Verts) && len(m.Texcoords) > 0
+	hasColor := len(m.Colors) == len(m.Verts) && len(m.Colors) > 0
+
+	fmt.Fprintf(w.w, "ply\nformat %s 1.0\ncomment generated by go-lodm\n", plyFormatNames[format])
+	fmt.Fprintf(w.w, "element vertex %d\nproperty float x\nproperty float y\nproperty float z\n", len(m.Verts))
+	if hasNormal {
+		w.w.WriteString("property float nx\nproperty float ny\nproperty float nz\n")
+	}
+	if hasColor {
+		w.w.WriteString("property uchar red\nproperty uchar green\nproperty uchar blue\nproperty uchar alpha\n")
+	}
+	if hasTex {
+		w.w.WriteString("property float s\nproperty float t\n")
+	}
+	for d := 1; d < len(m.Data); d++ {
+		for k := 0; k < m.dataNumber(d); k++ {
+			fmt.Fprintf(w.w, "property %s %s\n", plyTypeNames[m.Sign.Vertex.Attributes[int(VERTEX_DATA0)+d].Type], m.dataName(d, k))
+		}
+	}
+	if len(m.Faces) > 0 {
+		fmt.Fprintf(w.w, "element face %d\nproperty list uchar uint vertex_indices\n", len(m.Faces))
+	}
+	w.w.WriteString("end_header\n")
+
+	var normals []vec3.T
+	if hasNormal {
+		normals = decodeNormals(m.Normals)
+	}
+	for i := range m.Verts {
+		for _, c := range m.Verts[i] {
+			w.value(ATTR_FLOAT, float64(c))
+		}
+		if hasNormal {
+			for _, c := range normals[i] {
+				w.value(ATTR_FLOAT, float64(c))
+			}
+		}
+		if hasColor {
+			for _, c := range m.Colors[i] {
+				w.value(ATTR_UNSIGNED_BYTE, float64(c))
+			}
+		}
+		if hasTex {
+			w.value(ATTR_FLOAT, float64(m.Texcoords[i][0]))
+			w.value(ATTR_FLOAT, float64(m.Texcoords[i][1]))
+		}
+		for d := 1; d < len(m.Data); d++ {
+			k := m.dataNumber(d)
+			for j := 0; j < k; j++ {
+				w.value(m.Sign.Vertex.Attributes[int(VERTEX_DATA0)+d].Type, float64(m.Data[d][i*k+j]))
+			}
+		}
+		w.end()
+	}
+	for _, f := range m.Faces {
+		w.value(ATTR_UNSIGNED_BYTE, 3)
+		for _, v := range f {
+			w.value(ATTR_UNSIGNED_INT, float64(v))
+		}
+		w.end()
+	}
+	return w.w.Flush()
+}
+
+func WritePlyFile(path string, m *PlyMesh, format PlyFormat) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return WritePly(f, m, format)
+}
+
+func ImportPly(reader io.Reader, setting *CompressSetting) (*Archive, error) {
+	m, err := ReadPly(reader)
+	if err != nil {
+		return nil, err
+	}
+	meshes := m.Meshes()
+	patchs := make([]Patch, len(meshes))
+	for i := range patchs {
+		patchs[i] = Patch{TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID}
+	}
+	return newFlatArchive(m.Sign, meshes, patchs, setting), nil
+}
+
+func ImportPlyFile(path string, setting *CompressSetting) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ImportPly(f, setting)
+}
+
+func (a *Archive) cutPlyMesh(selected []bool) (*PlyMesh, error) {
+	for n := range selected {
+		if !selected[n] {
+			continue
+		}
+		if err := a.LoadNode(uint32(n)); err != nil {
+			return nil, err
+		}
+	}
+	m := &PlyMesh{Sign: a.Header.Sign}
+	m.Sign.Vertex.Attributes[VERTEX_GEOMORPH] = Attribute{}
+	hasTex := m.Sign.Vertex.HasTextures()
+	remaps := make(map[uint32]map[uint16]uint32)
+	add := func(n uint32, tex uint32, i uint16) uint32 {
+		remap := remaps[n]
+		if remap == nil {
+			remap = make(map[uint16]uint32)
+			remaps[n] = remap
+		}
+		if idx, ok := remap[i]; ok {
+			return idx
+		}
+		src := &a.NodeMeshs[n]
+		idx := uint32(len(m.Verts))
+		remap[i] = idx
+		m.Verts = append(m.Verts, src.Verts[i])
+		if m.Sign.Vertex.HasNormals() {
+			var nm [3]int16
+			if src.HasNormal() {
+				nm = src.Normals[i]
+			}
+			m.Normals = append(m.Normals, nm)
+		}
+		if m.Sign.Vertex.HasColors() {
+			c := [4]byte{255, 255, 255, 255}
+			if src.HasColor() {
+				c = src.Colors[i]
+			}
+			m.Colors = append(m.Colors, c)
+		}
+		if hasTex {
+			var uv vec3.T
+			if src.HasTexcoord() {
+				uv = vec3.T{src.Texcoords[i][0], src.Texcoords[i][1], 1}
+			}
+			if tex != LM_INVALID_ID && int(tex) < len(a.Textures) && !a.Textures[tex].Mat.IsZero() {
+				uv = a.Textures[tex].Mat.MulVec3(&uv)
+			}
+			m.Texcoords = append(m.Texcoords, vec2.T{uv[0], uv[1]})
+		}
+		for d := 1; d < len(m.Data); d++ {
+			if k := m.dataNumber(d); k > 0 {
+				vals := make([]float32, k)
+				if src.HasData(d) {
+					copy(vals, src.Data[d][int(i)*k:])
+				}
+				m.Data[d] = append(m.Data[d], vals...)
+			}
+		}
+		return idx
+	}
+	a.cutPatchs(selected, func(n, p uint32, start, end uint32) {
+		src := &a.NodeMeshs[n]
+		tex := a.Patchs[p].TexID
+		if !src.HasFace() {
+			for i := start; i < end && int(i) < len(src.Verts); i++ {
+				add(n, tex, uint16(i))
+			}
+			return
+		}
+		for f := start; f < end && int(f) < len(src.Faces); f++ {
+			var face [3]uint32
+			for k, v := range src.Faces[f] {
+				face[k] = add(n, tex, v)
+			}
+			m.Faces = append(m.Faces, face)
+		}
+	})
+	if len(m.Faces) == 0 {
+		m.Sign.Face = FaceElement{}
+	}
+	return m, nil
+}
+
+func (a *Archive) ExportNodePly(writer io.Writer, n uint32, format PlyFormat) error {
+	if n >= a.sinkNode() {
+		return errors.New("node index error")
+	}
+	selected := make([]bool, len(a.Nodes))
+	selected[n] = true
+	m, err := a.cutPlyMesh(selected)
+	if err != nil {
+		return err
+	}
+	return WritePly(writer, m, format)
+}
+
+func (a *Archive) ExportCutPly(writer io.Writer, selected []bool, format PlyFormat) error {
+	m, err := a.cutPlyMesh(selected)
+	if err != nil {
+		return err
+	}
+	return WritePly(writer, m, format)
+}
+
+func (a *Archive) ExportPlyAtError(writer io.Writer, maxError float32, format PlyFormat) error {
+	return a.ExportCutPly(writer, a.SelectByError(maxError), format)
+}
@@ -0,0 +1,136 @@
+package lodm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testPly = `ply
+format ascii 1.0
+comment quad with an extra property
+element vertex 4
+property float x
+property float y
+property float z
+property float nx
+property float ny
+property float nz
+property uchar red
+property uchar green
+property uchar blue
+property float s
+property float t
+property ushort intensity
+element material 1
+property list uchar int ids
+element face 1
+property list uchar int vertex_indices
+end_header
+0 0 0 0 0 1 255 0 0 0 0 10
+1 0 0 0 0 1 0 255 0 1 0 20
+1 1 0 0 0 1 0 0 255 1 1 30
+0 1 0 0 0 1 255 255 255 0 1 40
+2 7 8
+4 0 1 2 3
+`
+
+func checkTestPly(t *testing.T, m *PlyMesh) {
+	if len(m.Verts) != 4 || len(m.Faces) != 2 || m.Faces[1] != [3]uint32{0, 2, 3} {
+		t.FailNow()
+	}
+	if m.Verts[2][0] != 1 || m.Verts[2][1] != 1 || m.Texcoords[1][0] != 1 {
+		t.FailNow()
+	}
+	if m.Colors[1] != [4]byte{0, 255, 0, 255} || m.Normals[0][2] != 32767 {
+		t.FailNow()
+	}
+	if m.Sign.Vertex.Attributes[VERTEX_DATA0+1].Type != ATTR_UNSIGNED_SHORT || m.Data[1][3] != 40 {
+		t.FailNow()
+	}
+}
+
+func TestPly(t *testing.T) {
+	m, err := ReadPly(strings.NewReader(testPly))
+	if err != nil {
+		t.FailNow()
+	}
+	checkTestPly(t, m)
+	if m.DataNames[1] != "intensity" {
+		t.FailNow()
+	}
+
+	for _, format := range []PlyFormat{PLY_ASCII, PLY_BINARY_LE, PLY_BINARY_BE} {
+		var buf bytes.Buffer
+		if err := WritePly(&buf, m, format); err != nil {
+			t.FailNow()
+		}
+		rm, err := ReadPly(&buf)
+		if err != nil {
+			t.FailNow()
+		}
+		checkTestPly(t, rm)
+		if rm.DataNames[1] != "intensity" {
+			t.FailNow()
+		}
+	}
+
+	tooMany := strings.Replace(testPly, "property ushort intensity", "property float a\nproperty float b\nproperty float c\nproperty float d", 1)
+	if _, err := ReadPly(strings.NewReader(tooMany)); err == nil {
+		t.FailNow()
+	}
+	wide := strings.Replace(testPly, "property ushort intensity", "property uint intensity", 1)
+	if _, err := ReadPly(strings.NewReader(wide)); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestPlyArchive(t *testing.T) {
+	a, err := ImportPly(strings.NewReader(testPly), nil)
+	if err != nil || len(a.Nodes) != 2 || !a.Header.Sign.Vertex.HasData(1) {
+		t.FailNow()
+	}
+
+	var buf bytes.Buffer
+	node := a.Nodes[0]
+	if err := a.NodeMeshs[0].Write(&buf, &node, &a.Header); err != nil {
+		t.FailNow()
+	}
+	var mesh NodeMesh
+	if err := mesh.Read(&buf, &node, &a.Header); err != nil || len(mesh.Data[1]) != 4 || mesh.Data[1][2] != 30 {
+		t.FailNow()
+	}
+	wide := a.Header
+	wide.Sign.Vertex.SetComponent(VERTEX_DATA0+1, Attribute{Type: ATTR_DOUBLE, Number: 1})
+	if err := a.NodeMeshs[0].Write(&buf, &node, &wide); err == nil {
+		t.FailNow()
+	}
+	if err := mesh.Read(bytes.NewReader(make([]byte, 1024)), &node, &wide); err == nil {
+		t.FailNow()
+	}
+	short := a.NodeMeshs[0]
+	short.Data[1] = short.Data[1][:3]
+	if err := short.Write(&buf, &node, &a.Header); err == nil {
+		t.FailNow()
+	}
+
+	buf.Reset()
+	if err := a.ExportNodePly(&buf, 0, PLY_BINARY_LE); err != nil {
+		t.FailNow()
+	}
+	m, err := ReadPly(&buf)
+	if err != nil {
+		t.FailNow()
+	}
+	checkTestPly(t, m)
+
+	buf.Reset()
+	ta := newTestArchive()
+	if err := ta.ExportPlyAtError(&buf, 0.5, PLY_ASCII); err != nil {
+		t.FailNow()
+	}
+	m, err = ReadPly(&buf)
+	if err != nil || len(m.Faces) != len(testMesh.Faces) {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,379 @@
+package lodm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/flywave/go3d/mat4"
+)
+
+const (
+	POTREE_VERSION       = "2.0"
+	POTREE_MAX_DEPTH     = 20
+	POTREE_NODE_SIZE     = 22
+	POTREE_SPACING_RATIO = 128
+
+	POTREE_NODE_NORMAL = 0
+	POTREE_NODE_LEAF   = 1
+)
+
+var (
+	potreeTypeNames = []string{"", "int8", "uint8", "int16", "uint16", "int32", "uint32", "float", "double"}
+)
+
+type potreeAttribute struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Size        int       `json:"size"`
+	NumElements int       `json:"numElements"`
+	ElementSize int       `json:"elementSize"`
+	Type        string    `json:"type"`
+	Min         []float64 `json:"min"`
+	Max         []float64 `json:"max"`
+}
+
+type potreeHierarchy struct {
+	FirstChunkSize int `json:"firstChunkSize"`
+	StepSize       int `json:"stepSize"`
+	Depth          int `json:"depth"`
+}
+
+type potreeBoundingBox struct {
+	Min [3]float64 `json:"min"`
+	Max [3]float64 `json:"max"`
+}
+
+type potreeMetadata struct {
+	Version     string            `json:"version"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Points      uint64            `json:"points"`
+	Projection  string            `json:"projection"`
+	Hierarchy   potreeHierarchy   `json:"hierarchy"`
+	Offset      [3]float64        `json:"offset"`
+	Scale       [3]float64        `json:"scale"`
+	Spacing     float64           `json:"spacing"`
+	BoundingBox potreeBoundingBox `json:"boundingBox"`
+	Encoding    string            `json:"encoding"`
+	Attributes  []potreeAttribute `json:"attributes"`
+}
+
+type potreeNode struct {
+	children [8]*potreeNode
+	points   uint32
+	data     bytes.Buffer
+}
+
+type potreeExporter struct {
+	archive *Archive
+	model   mat4.T
+	min     [3]float64
+	size    float64
+	scale   float64
+	spacing float64
+	attrs   []potreeAttribute
+	data    []int
+	root    *potreeNode
+	depth   int
+}
+
+func putAttributeValue(b []byte, t AttributeType, v float64) {
+	switch t {
+	case ATTR_BYTE:
+		b[0] = byte(int8(v))
+	case ATTR_UNSIGNED_BYTE:
+		b[0] = byte(v)
+	case ATTR_SHORT:
+		byteorder.PutUint16(b, uint16(int16(v)))
+	case ATTR_UNSIGNED_SHORT:
+		byteorder.PutUint16(b, uint16(v))
+	case ATTR_INT:
+		byteorder.PutUint32(b, uint32(int32(v)))
+	case ATTR_UNSIGNED_INT:
+		byteorder.PutUint32(b, uint32(v))
+	case ATTR_FLOAT:
+		byteorder.PutUint32(b, math.Float32bits(float32(v)))
+	default:
+		byteorder.PutUint64(b, math.Float64bits(v))
+	}
+}
+
+func potreeDataName(d int) string {
+	switch d {
+	case LAS_INTENSITY_DATA:
+		return "intensity"
+	case LAS_CLASSIFICATION_DATA:
+		return "classification"
+	}
+	return fmt.Sprintf("data%d", d)
+}
+
+func newPotreeAttribute(name string, t AttributeType, n int) potreeAttribute {
+	attr := potreeAttribute{Name: name, NumElements: n, ElementSize: typeSize[t], Size: n * typeSize[t], Type: potreeTypeNames[t]}
+	attr.Min = make([]float64, n)
+	attr.Max = make([]float64, n)
+	for k := range attr.Min {
+		attr.Min[k], attr.Max[k] = math.Inf(1), math.Inf(-1)
+	}
+	return attr
+}
+
+func (attr *potreeAttribute) update(k int, v float64) {
+	attr.Min[k] = math.Min(attr.Min[k], v)
+	attr.Max[k] = math.Max(attr.Max[k], v)
+}
+
+func (e *potreeExporter) world(n uint32, i int) [3]float64 {
+	v := e.archive.NodeMeshs[n].Verts[i]
+	m := &e.model
+	var p [3]float64
+	for k := 0; k < 3; k++ {
+		p[k] = float64(m[0][k])*float64(v[0]) + float64(m[1][k])*float64(v[1]) + float64(m[2][k])*float64(v[2]) + float64(m[3][k])
+	}
+	return p
+}
+
+func (e *potreeExporter) nodePoints(n uint32) int {
+	first_patch, last_patch := e.archive.getNodePatchRange(n)
+	if first_patch == last_patch {
+		return 0
+	}
+	end := int(e.archive.Patchs[last_patch-1].FaceOffset)
+	if end > len(e.archive.NodeMeshs[n].Verts) {
+		end = len(e.archive.NodeMeshs[n].Verts)
+	}
+	return end
+}
+
+func (e *potreeExporter) levels() []int {
+	a := e.archive
+	sink_node := a.sinkNode()
+	parent := a.firstParents()
+	levels := make([]int, sink_node)
+	for n := uint32(0); n < sink_node; n++ {
+		err := float64(a.Nodes[n].Error)
+		if err > 0 {
+			levels[n] = int(math.Round(math.Log2(e.spacing / err)))
+		} else if parent[n] != LM_INVALID_ID {
+			levels[n] = levels[parent[n]] + 1
+		}
+		if parent[n] != LM_INVALID_ID && levels[n] < levels[parent[n]] {
+			levels[n] = levels[parent[n]]
+		}
+		if levels[n] > POTREE_MAX_DEPTH {
+			levels[n] = POTREE_MAX_DEPTH
+		}
+	}
+	return levels
+}
+
+func (e *potreeExporter) bounds() {
+	a := e.archive
+	min := [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+	max := [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for n := uint32(0); n < a.sinkNode(); n++ {
+		for i := 0; i < e.nodePoints(n); i++ {
+			p := e.world(n, i)
+			for k := 0; k < 3; k++ {
+				min[k] = math.Min(min[k], p[k])
+				max[k] = math.Max(max[k], p[k])
+			}
+		}
+	}
+	e.min = min
+	for k := 0; k < 3; k++ {
+		e.size = math.Max(e.size, max[k]-min[k])
+	}
+	if e.size == 0 {
+		e.size = 1
+	}
+	e.scale = LAS_DEFAULT_SCALE
+	for e.size/e.scale > math.MaxInt32 {
+		e.scale *= 10
+	}
+}
+
+func (e *potreeExporter) cell(level int, p [3]float64) *potreeNode {
+	cells := float64(uint32(1) << uint(level))
+	var idx [3]uint32
+	for k := 0; k < 3; k++ {
+		c := math.Floor((p[k] - e.min[k]) / e.size * cells)
+		idx[k] = uint32(math.Max(0, math.Min(cells-1, c)))
+	}
+	node := e.root
+	for l := level - 1; l >= 0; l-- {
+		child := (idx[0]>>uint(l)&1)<<2 | (idx[1]>>uint(l)&1)<<1 | idx[2]>>uint(l)&1
+		if node.children[child] == nil {
+			node.children[child] = &potreeNode{}
+		}
+		node = node.children[child]
+	}
+	if level > e.depth {
+		e.depth = level
+	}
+	return node
+}
+
+func (e *potreeExporter) addPoints(n uint32, level int) {
+	a := e.archive
+	mesh := &a.NodeMeshs[n]
+	size := 0
+	for _, attr := range e.attrs {
+		size += attr.Size
+	}
+	record := make([]byte, size)
+	for i := 0; i < e.nodePoints(n); i++ {
+		p := e.world(n, i)
+		off := 0
+		for k := 0; k < 3; k++ {
+			q := int32(math.Round((p[k] - e.min[k]) / e.scale))
+			byteorder.PutUint32(record[off:], uint32(q))
+			e.attrs[0].update(k, float64(q)*e.scale+e.min[k])
+			off += 4
+		}
+		a_idx := 1
+		if a.Header.Sign.Vertex.HasColors() {
+			for k := 0; k < 3; k++ {
+				c := 0.0
+				if mesh.HasColor() {
+					c = float64(mesh.Colors[i][k]) * 257
+				}
+				byteorder.PutUint16(record[off:], uint16(c))
+				e.attrs[a_idx].update(k, c)
+				off += 2
+			}
+			a_idx++
+		}
+		for _, d := range e.data {
+			attr := &e.attrs[a_idx]
+			t := a.Header.Sign.Vertex.Attributes[int(VERTEX_DATA0)+d].Type
+			for k := 0; k < attr.NumElements; k++ {
+				v := 0.0
+				if j := i*attr.NumElements + k; j < len(mesh.Data[d]) {
+					v = float64(mesh.Data[d][j])
+				}
+				putAttributeValue(record[off:], t, v)
+				attr.update(k, v)
+				off += attr.ElementSize
+			}
+			a_idx++
+		}
+		node := e.cell(level, p)
+		node.data.Write(record)
+		node.points++
+	}
+}
+
+func (e *potreeExporter) write(sink ExportSink, name string) error {
+	var hierarchy, octree bytes.Buffer
+	var points uint64
+	entry := make([]byte, POTREE_NODE_SIZE)
+	queue := []*potreeNode{e.root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		mask := byte(0)
+		for i, c := range node.children {
+			if c != nil {
+				mask |= 1 << uint(i)
+				queue = append(queue, c)
+			}
+		}
+		entry[0] = POTREE_NODE_NORMAL
+		if mask == 0 {
+			entry[0] = POTREE_NODE_LEAF
+		}
+		entry[1] = mask
+		byteorder.PutUint32(entry[2:], node.points)
+		byteorder.PutUint64(entry[6:], uint64(octree.Len()))
+		byteorder.PutUint64(entry[14:], uint64(node.data.Len()))
+		hierarchy.Write(entry)
+		octree.Write(node.data.Bytes())
+		points += uint64(node.points)
+	}
+
+	if points == 0 {
+		for i := range e.attrs {
+			for k := range e.attrs[i].Min {
+				e.attrs[i].Min[k], e.attrs[i].Max[k] = 0, 0
+			}
+		}
+	}
+	meta := potreeMetadata{
+		Version:     POTREE_VERSION,
+		Name:        name,
+		Points:      points,
+		Hierarchy:   potreeHierarchy{FirstChunkSize: hierarchy.Len(), StepSize: e.depth + 1, Depth: e.depth},
+		Offset:      e.min,
+		Scale:       [3]float64{e.scale, e.scale, e.scale},
+		Spacing:     e.spacing,
+		BoundingBox: potreeBoundingBox{Min: e.min, Max: [3]float64{e.min[0] + e.size, e.min[1] + e.size, e.min[2] + e.size}},
+		Encoding:    "DEFAULT",
+		Attributes:  e.attrs,
+	}
+	js, err := json.MarshalIndent(&meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeSinkFile(sink, "octree.bin", octree.Bytes()); err != nil {
+		return err
+	}
+	if err := writeSinkFile(sink, "hierarchy.bin", hierarchy.Bytes()); err != nil {
+		return err
+	}
+	return writeSinkFile(sink, "metadata.json", js)
+}
+
+func (a *Archive) ExportPotree(sink ExportSink, name string) ([]string, error) {
+	if len(a.Nodes) < 2 {
+		return nil, errors.New("archive has no nodes")
+	}
+	if a.Header.NFace != 0 || a.Header.Sign.Face.HasIndex() {
+		return nil, errors.New("potree: archive is not a point cloud")
+	}
+	sink_node := a.sinkNode()
+	for n := uint32(0); n < sink_node; n++ {
+		if err := a.LoadNode(n); err != nil {
+			return nil, err
+		}
+	}
+
+	var warnings []string
+	e := &potreeExporter{archive: a, model: a.modelMatrix(), root: &potreeNode{}}
+	e.attrs = append(e.attrs, newPotreeAttribute("position", ATTR_INT, 3))
+	if a.Header.Sign.Vertex.HasColors() {
+		e.attrs = append(e.attrs, newPotreeAttribute("rgb", ATTR_UNSIGNED_SHORT, 3))
+	}
+	for d := 1; d < 4; d++ {
+		if n := dataNumber(&a.Header.Sign, d); n > 0 {
+			e.data = append(e.data, d)
+			e.attrs = append(e.attrs, newPotreeAttribute(potreeDataName(d), a.Header.Sign.Vertex.Attributes[int(VERTEX_DATA0)+d].Type, n))
+		}
+	}
+	if a.Header.Sign.Vertex.HasNormals() {
+		warnings = append(warnings, "dropped normals")
+	}
+	if len(a.Instances) > 0 {
+		warnings = append(warnings, fmt.Sprintf("dropped %v instances of %v instance nodes", len(a.Instances), len(a.InstanceNodes)))
+	}
+
+	e.bounds()
+	for n := uint32(0); n < sink_node; n++ {
+		e.spacing = math.Max(e.spacing, float64(a.Nodes[n].Error))
+	}
+	levels := e.levels()
+	if e.spacing == 0 {
+		e.spacing = e.size / POTREE_SPACING_RATIO
+	}
+	for n := uint32(0); n < sink_node; n++ {
+		e.addPoints(n, levels[n])
+	}
+	return warnings, e.write(sink, name)
+}
+
+func (a *Archive) ExportPotreeDir(dir string, name string) ([]string, error) {
+	return a.ExportPotree(NewDirSink(dir), name)
+}
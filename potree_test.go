@@ -0,0 +1,57 @@
+package lodm
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/flywave/go3d/vec3"
+)
+
+func TestExportPotree(t *testing.T) {
+	coarse := NodeMesh{Verts: []vec3.T{{0, 0, 0}, {4, 4, 4}}, Colors: [][4]byte{{255, 0, 0, 255}, {0, 255, 0, 255}}}
+	fine := NodeMesh{Verts: []vec3.T{{0, 0, 0}, {1, 1, 1}, {4, 4, 4}}, Colors: make([][4]byte, 3)}
+	for _, m := range []*NodeMesh{&coarse, &fine} {
+		m.Data[LAS_INTENSITY_DATA] = make([]float32, len(m.Verts))
+		m.Data[LAS_CLASSIFICATION_DATA] = make([]float32, len(m.Verts))
+	}
+	fine.Data[LAS_INTENSITY_DATA][2] = 300
+	nodes := []Node{{Error: 1, Sphere: pointsSphere(coarse.Verts), FirstPatch: 0}, {Error: 0.5, Sphere: pointsSphere(fine.Verts), FirstPatch: 1}}
+	patchs := []Patch{
+		{Node: 1, FaceOffset: 2, TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID},
+		{Node: 2, FaceOffset: 3, TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID},
+	}
+	a := newDAGArchive(lasSignature(true), nodes, patchs, []NodeMesh{coarse, fine}, nil)
+
+	sink := NewMemorySink()
+	warnings, err := a.ExportPotree(sink, "cloud")
+	if err != nil || len(warnings) != 0 || len(sink.Files) != 3 {
+		t.FailNow()
+	}
+	var meta potreeMetadata
+	if err := json.Unmarshal(sink.Files["metadata.json"], &meta); err != nil {
+		t.FailNow()
+	}
+	if meta.Points != 5 || meta.Spacing != 1 || meta.Hierarchy.Depth != 1 || len(meta.Attributes) != 4 {
+		t.FailNow()
+	}
+	if meta.Attributes[1].Name != "rgb" || meta.Attributes[2].Name != "intensity" || meta.Attributes[2].Max[0] != 300 || meta.BoundingBox.Max[0] != 4 {
+		t.FailNow()
+	}
+
+	record := 12 + 6 + 2 + 1
+	hierarchy := sink.Files["hierarchy.bin"]
+	if len(sink.Files["octree.bin"]) != 5*record || len(hierarchy) != meta.Hierarchy.FirstChunkSize || len(hierarchy) != 3*POTREE_NODE_SIZE {
+		t.FailNow()
+	}
+	if hierarchy[0] != POTREE_NODE_NORMAL || hierarchy[1] != 0x81 || byteorder.Uint32(hierarchy[2:]) != 2 {
+		t.FailNow()
+	}
+	child := hierarchy[POTREE_NODE_SIZE:]
+	if child[0] != POTREE_NODE_LEAF || byteorder.Uint32(child[2:]) != 2 || byteorder.Uint64(child[6:]) != uint64(2*record) {
+		t.FailNow()
+	}
+
+	if _, err := newTestArchive().ExportPotree(sink, "mesh"); err == nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,347 @@
+package lodm
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/flywave/go3d/vec3"
+)
+
+const (
+	STL_HEADER_SIZE = 80
+	STL_FACE_SIZE   = 50
+
+	MF3_MODEL_PATH = "3D/3dmodel.model"
+)
+
+type PrintSetting struct {
+	UnitScale float32
+	Unit      string
+}
+
+var (
+	DEFAULT_PRINT_SETTING = PrintSetting{UnitScale: 1, Unit: "millimeter"}
+
+	MF3_UNITS = []string{"micron", "millimeter", "centimeter", "inch", "foot", "meter"}
+)
+
+type printMesh struct {
+	verts    []vec3.T
+	faces    [][3]uint32
+	mtls     []uint32
+	colors   [][4]byte
+	corners  [][3]uint32
+	index    map[vec3.T]uint32
+	palette  map[[4]byte]uint32
+	warnings []string
+}
+
+type edgeKey [2]uint32
+
+func (p *printMesh) addVertex(v vec3.T) uint32 {
+	idx, ok := p.index[v]
+	if !ok {
+		idx = uint32(len(p.verts))
+		p.index[v] = idx
+		p.verts = append(p.verts, v)
+	}
+	return idx
+}
+
+func (p *printMesh) addColor(c [4]byte) uint32 {
+	idx, ok := p.palette[c]
+	if !ok {
+		idx = uint32(len(p.colors))
+		p.palette[c] = idx
+		p.colors = append(p.colors, c)
+	}
+	return idx
+}
+
+func (a *Archive) extractPrintMesh(maxError float32, setting *PrintSetting) (*printMesh, error) {
+	if !a.Header.Sign.Face.HasIndex() {
+		return nil, errors.New("print: point clouds are not supported")
+	}
+	if setting == nil {
+		setting = &DEFAULT_PRINT_SETTING
+	}
+	unitScale := setting.UnitScale
+	if unitScale == 0 {
+		unitScale = 1
+	}
+	selected := a.SelectByError(maxError)
+	for n := range selected {
+		if !selected[n] {
+			continue
+		}
+		if err := a.LoadNode(uint32(n)); err != nil {
+			return nil, err
+		}
+	}
+	m := a.modelMatrix()
+	flip := m.Determinant3x3()*unitScale < 0
+	colors := a.Header.Sign.Vertex.HasColors()
+	p := &printMesh{index: make(map[vec3.T]uint32), palette: make(map[[4]byte]uint32)}
+	degenerate := 0
+	a.cutPatchs(selected, func(n, patch uint32, start, end uint32) {
+		mesh := &a.NodeMeshs[n]
+		for f := start; f < end && int(f) < len(mesh.Faces); f++ {
+			var face, corner [3]uint32
+			for k, i := range mesh.Faces[f] {
+				v := mesh.Verts[i]
+				var w vec3.T
+				for j := 0; j < 3; j++ {
+					w[j] = float32((float64(m[0][j])*float64(v[0]) + float64(m[1][j])*float64(v[1]) + float64(m[2][j])*float64(v[2]) + float64(m[3][j])) * float64(unitScale))
+				}
+				face[k] = p.addVertex(w)
+				if colors {
+					c := [4]byte{255, 255, 255, 255}
+					if mesh.HasColor() {
+						c = mesh.Colors[i]
+					}
+					corner[k] = p.addColor(c)
+				}
+			}
+			if face[0] == face[1] || face[1] == face[2] || face[2] == face[0] {
+				degenerate++
+				continue
+			}
+			if flip {
+				face[1], face[2] = face[2], face[1]
+				corner[1], corner[2] = corner[2], corner[1]
+			}
+			p.faces = append(p.faces, face)
+			p.mtls = append(p.mtls, a.Patchs[patch].MtlID)
+			if colors {
+				p.corners = append(p.corners, corner)
+			}
+		}
+	})
+	if a.Header.Sign.Vertex.HasTextures() {
+		p.warnings = append(p.warnings, "dropped textures")
+	}
+	if len(a.Instances) > 0 {
+		p.warnings = append(p.warnings, fmt.Sprintf("dropped %v instances of %v instance nodes", len(a.Instances), len(a.InstanceNodes)))
+	}
+	if degenerate > 0 {
+		p.warnings = append(p.warnings, fmt.Sprintf("dropped %v degenerate faces", degenerate))
+	}
+	p.checkEdges()
+	return p, nil
+}
+
+func (p *printMesh) checkEdges() {
+	edges := make(map[edgeKey]int)
+	directed := make(map[edgeKey]int)
+	for _, w := range p.faces {
+		for k := 0; k < 3; k++ {
+			a, b := w[k], w[(k+1)%3]
+			directed[edgeKey{a, b}]++
+			if a > b {
+				a, b = b, a
+			}
+			edges[edgeKey{a, b}]++
+		}
+	}
+	var boundary, shared, flipped int
+	for e, n := range edges {
+		switch {
+		case n == 1:
+			boundary++
+		case n > 2:
+			shared++
+		case directed[e] != 1:
+			flipped++
+		}
+	}
+	if boundary > 0 {
+		p.warnings = append(p.warnings, fmt.Sprintf("%v non-manifold boundary edges", boundary))
+	}
+	if shared > 0 {
+		p.warnings = append(p.warnings, fmt.Sprintf("%v non-manifold edges shared by more than two faces", shared))
+	}
+	if flipped > 0 {
+		p.warnings = append(p.warnings, fmt.Sprintf("%v non-manifold edges with inconsistent orientation", flipped))
+	}
+}
+
+func (p *printMesh) faceNormal(f [3]uint32) vec3.T {
+	e1 := vec3.Sub(&p.verts[f[1]], &p.verts[f[0]])
+	e2 := vec3.Sub(&p.verts[f[2]], &p.verts[f[0]])
+	n := vec3.Cross(&e1, &e2)
+	if n.Length() > 0 {
+		n.Normalize()
+	}
+	return n
+}
+
+func (p *printMesh) writeStl(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	var header [STL_HEADER_SIZE]byte
+	copy(header[:], "binary stl exported by go-lodm")
+	w.Write(header[:])
+	binary.Write(w, byteorder, uint32(len(p.faces)))
+	var rec [STL_FACE_SIZE]byte
+	for _, f := range p.faces {
+		n := p.faceNormal(f)
+		for k := 0; k < 3; k++ {
+			byteorder.PutUint32(rec[k*4:], math.Float32bits(n[k]))
+			for j := 0; j < 3; j++ {
+				byteorder.PutUint32(rec[12+j*12+k*4:], math.Float32bits(p.verts[f[j]][k]))
+			}
+		}
+		if _, err := w.Write(rec[:]); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (a *Archive) ExportStlAtError(writer io.Writer, maxError float32, setting *PrintSetting) ([]string, error) {
+	p, err := a.extractPrintMesh(maxError, setting)
+	if err != nil {
+		return nil, err
+	}
+	return p.warnings, p.writeStl(writer)
+}
+
+func (a *Archive) ExportStlFile(path string, maxError float32, setting *PrintSetting) ([]string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return a.ExportStlAtError(f, maxError, setting)
+}
+
+func hexColor(c [3]byte, alpha byte) string {
+	return fmt.Sprintf("#%02X%02X%02X%02X", c[0], c[1], c[2], alpha)
+}
+
+func (p *printMesh) write3MFModel(writer io.Writer, materials []Material, unit string) error {
+	w := bufio.NewWriter(writer)
+	w.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(w, `<model unit="%s" xml:lang="en-US" xmlns="http://schemas.microsoft.com/3dmanufacturing/core/2015/02" xmlns:m="http://schemas.microsoft.com/3dmanufacturing/material/2015/02">`+"\n", unit)
+	w.WriteString(" <resources>\n")
+
+	colors := len(p.corners) > 0
+	bases := make(map[uint32]int)
+	face_base := make([]int, len(p.faces))
+	w.WriteString(`  <basematerials id="1">` + "\n")
+	for i, mtl := range p.mtls {
+		if int(mtl) >= len(materials) {
+			mtl = LM_INVALID_ID
+		}
+		if colors && mtl == LM_INVALID_ID {
+			face_base[i] = -1
+			continue
+		}
+		idx, ok := bases[mtl]
+		if !ok {
+			idx = len(bases)
+			bases[mtl] = idx
+			name, color, alpha := "default", [3]byte{255, 255, 255}, byte(255)
+			if mtl != LM_INVALID_ID {
+				m := &materials[mtl]
+				name, color = fmt.Sprintf("material_%d", mtl), m.Color
+				if m.Opacity > 0 && m.Opacity < 1 {
+					alpha = byte(math.Round(float64(m.Opacity) * 255))
+				}
+			}
+			fmt.Fprintf(w, "   <base name=\"%s\" displaycolor=\"%s\"/>\n", name, hexColor(color, alpha))
+		}
+		face_base[i] = idx
+	}
+	if len(bases) == 0 {
+		w.WriteString(`   <base name="default" displaycolor="#FFFFFFFF"/>` + "\n")
+	}
+	w.WriteString("  </basematerials>\n")
+
+	if colors {
+		w.WriteString(`  <m:colorgroup id="2">` + "\n")
+		for _, c := range p.colors {
+			fmt.Fprintf(w, "   <m:color color=\"%s\"/>\n", hexColor([3]byte{c[0], c[1], c[2]}, c[3]))
+		}
+		w.WriteString("  </m:colorgroup>\n")
+	}
+
+	w.WriteString(`  <object id="3" type="model" pid="1" pindex="0">` + "\n   <mesh>\n    <vertices>\n")
+	for _, v := range p.verts {
+		fmt.Fprintf(w, "     <vertex x=\"%g\" y=\"%g\" z=\"%g\"/>\n", v[0], v[1], v[2])
+	}
+	w.WriteString("    </vertices>\n    <triangles>\n")
+	for i, t := range p.faces {
+		if face_base[i] < 0 {
+			c := p.corners[i]
+			fmt.Fprintf(w, "     <triangle v1=\"%d\" v2=\"%d\" v3=\"%d\" pid=\"2\" p1=\"%d\" p2=\"%d\" p3=\"%d\"/>\n", t[0], t[1], t[2], c[0], c[1], c[2])
+		} else {
+			fmt.Fprintf(w, "     <triangle v1=\"%d\" v2=\"%d\" v3=\"%d\" pid=\"1\" p1=\"%d\"/>\n", t[0], t[1], t[2], face_base[i])
+		}
+	}
+	w.WriteString("    </triangles>\n   </mesh>\n  </object>\n </resources>\n")
+	w.WriteString(" <build>\n  <item objectid=\"3\"/>\n </build>\n</model>\n")
+	return w.Flush()
+}
+
+func (a *Archive) Export3MFAtError(writer io.Writer, maxError float32, setting *PrintSetting) ([]string, error) {
+	if setting == nil {
+		setting = &DEFAULT_PRINT_SETTING
+	}
+	unit := setting.Unit
+	if unit == "" {
+		unit = DEFAULT_PRINT_SETTING.Unit
+	}
+	valid := false
+	for _, u := range MF3_UNITS {
+		valid = valid || u == unit
+	}
+	if !valid {
+		return nil, fmt.Errorf("print: unsupported 3mf unit %v", unit)
+	}
+	p, err := a.extractPrintMesh(maxError, setting)
+	if err != nil {
+		return nil, err
+	}
+	zw := zip.NewWriter(writer)
+	files := []struct {
+		name string
+		data string
+	}{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="model" ContentType="application/vnd.ms-package.3dmanufacturing-3dmodel+xml"/></Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Target="/` + MF3_MODEL_PATH + `" Id="rel0" Type="http://schemas.microsoft.com/3dmanufacturing/2013/01/3dmodel"/></Relationships>`},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, file.data); err != nil {
+			return nil, err
+		}
+	}
+	f, err := zw.Create(MF3_MODEL_PATH)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.write3MFModel(f, a.Materials, unit); err != nil {
+		return nil, err
+	}
+	return p.warnings, zw.Close()
+}
+
+func (a *Archive) Export3MFFile(path string, maxError float32, setting *PrintSetting) ([]string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return a.Export3MFAtError(f, maxError, setting)
+}
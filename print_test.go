@@ -0,0 +1,116 @@
+package lodm
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec3"
+)
+
+func TestExportStl(t *testing.T) {
+	a := newTestArchive()
+	a.Header.Matrix = mat4.Ident
+	a.Header.Matrix[3] = [4]float32{10, 0, 0, 1}
+
+	var buf bytes.Buffer
+	warnings, err := a.ExportStlAtError(&buf, 0.5, &PrintSetting{UnitScale: 1000})
+	if err != nil || len(warnings) != 0 {
+		t.FailNow()
+	}
+	data := buf.Bytes()
+	if len(data) != STL_HEADER_SIZE+4+len(testMesh.Faces)*STL_FACE_SIZE || byteorder.Uint32(data[STL_HEADER_SIZE:]) != uint32(len(testMesh.Faces)) {
+		t.FailNow()
+	}
+	x := math.Float32frombits(byteorder.Uint32(data[STL_HEADER_SIZE+4+12:]))
+	if x != 10000 && x != 11000 {
+		t.FailNow()
+	}
+
+	a.NodeMeshs[1].Faces = a.NodeMeshs[1].Faces[1:]
+	warnings, err = a.ExportStlAtError(&buf, 0.5, nil)
+	if err != nil || len(warnings) != 1 || !strings.Contains(warnings[0], "3 non-manifold boundary edges") {
+		t.FailNow()
+	}
+}
+
+func TestExport3MF(t *testing.T) {
+	a := newTestTexturedArchive()
+	a.Header.Sign.Vertex.SetComponent(VERTEX_COLOR, Attribute{Type: ATTR_UNSIGNED_BYTE, Number: 4})
+
+	var buf bytes.Buffer
+	if _, err := a.Export3MFAtError(&buf, 0.5, &PrintSetting{Unit: "parsec"}); err == nil {
+		t.FailNow()
+	}
+	warnings, err := a.Export3MFAtError(&buf, 0.5, &PrintSetting{UnitScale: 1, Unit: "meter"})
+	if err != nil || len(warnings) != 1 || warnings[0] != "dropped textures" {
+		t.FailNow()
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || len(r.File) != 3 || r.File[2].Name != MF3_MODEL_PATH {
+		t.FailNow()
+	}
+	f, err := r.File[2].Open()
+	if err != nil {
+		t.FailNow()
+	}
+	data, _ := ioutil.ReadAll(f)
+	model := string(data)
+	if strings.Count(model, "<triangle ") != len(testMesh.Faces) || !strings.Contains(model, `<base name="material_0" displaycolor="#FFFFFFFF"/>`) {
+		t.FailNow()
+	}
+	if !strings.Contains(model, `<m:colorgroup id="2">`) || strings.Contains(model, `pid="2" p1=`) || !strings.Contains(model, `pid="1" p1="0"/>`) {
+		t.FailNow()
+	}
+	if !strings.Contains(model, `<model unit="meter"`) || strings.Count(model, "<vertex ") != len(testMesh.Verts)-1 {
+		t.FailNow()
+	}
+
+	b := newFlatArchive(a.Header.Sign, []NodeMesh{testMesh, testMesh}, []Patch{{MtlID: 0}, {MtlID: LM_INVALID_ID}}, nil)
+	b.Materials = a.Materials
+	buf.Reset()
+	if _, err := b.Export3MFAtError(&buf, 0, nil); err != nil {
+		t.FailNow()
+	}
+	r, err = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.FailNow()
+	}
+	f, err = r.File[2].Open()
+	if err != nil {
+		t.FailNow()
+	}
+	data, _ = ioutil.ReadAll(f)
+	model = string(data)
+	if !strings.Contains(model, `<model unit="millimeter"`) || strings.Count(model, `pid="1" p1="0"/>`) != len(testMesh.Faces) || strings.Count(model, `pid="2" p1=`) != len(testMesh.Faces) {
+		t.FailNow()
+	}
+}
+
+func TestExportStlLargeCut(t *testing.T) {
+	sign := Signature{}
+	sign.Vertex.SetComponent(VERTEX_COORD, Attribute{Type: ATTR_FLOAT, Number: 3})
+	sign.Face.SetComponent(FACE_INDEX, Attribute{Type: ATTR_UNSIGNED_SHORT, Number: 3})
+	meshes := make([]NodeMesh, 2)
+	for n := range meshes {
+		for i := 0; i < 40000; i++ {
+			meshes[n].Verts = append(meshes[n].Verts, vec3.T{float32(i % 200), float32(i / 200), float32(n)})
+		}
+		for i := 0; i+2 < 40000; i += 3 {
+			meshes[n].Faces = append(meshes[n].Faces, [3]uint16{uint16(i), uint16(i + 1), uint16(i + 2)})
+		}
+	}
+	patchs := []Patch{{TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID}, {TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID}}
+	a := newFlatArchive(sign, meshes, patchs, nil)
+	if _, _, err := a.ExtractAtError(0); err == nil {
+		t.FailNow()
+	}
+	var buf bytes.Buffer
+	if _, err := a.ExportStlAtError(&buf, 0, nil); err != nil || byteorder.Uint32(buf.Bytes()[STL_HEADER_SIZE:]) != 2*13333 {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,408 @@
+package lodm
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/flywave/go3d/mat3"
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+	"github.com/flywave/go3d/vec4"
+)
+
+type RenderOptions struct {
+	Background  color.NRGBA
+	LightDir    vec3.T
+	Ambient     float32
+	TargetError float32
+	PointSize   int
+}
+
+var (
+	DEFAULT_RENDER_OPTIONS = RenderOptions{Background: color.NRGBA{0, 0, 0, 0}, LightDir: vec3.T{-0.3, -0.5, -1}, Ambient: 0.25, TargetError: DEFAULT_TARGET_ERROR, PointSize: 1}
+)
+
+func CameraForSphere(s Sphere, dir vec3.T, fovy float32) Camera {
+	dir.Normalize()
+	dist := s.Radius() / float32(math.Sin(float64(fovy)/2))
+	center := s.Center()
+	eye := dir.Scaled(-dist)
+	eye.Add(&center)
+	up := vec3.T{0, 1, 0}
+	if math.Abs(float64(vec3.Dot(&up, &dir))) > 0.99 {
+		up = vec3.T{0, 0, 1}
+	}
+	return Camera{Eye: eye, Center: center, Up: up, Fovy: fovy, Near: dist * 0.01, Far: dist + s.Radius()*2}
+}
+
+func TurntableCameras(s Sphere, frames int, elevation float32, fovy float32) []Camera {
+	cams := make([]Camera, frames)
+	for i := 0; i < frames; i++ {
+		angle := 2 * math.Pi * float64(i) / float64(frames)
+		dir := vec3.T{
+			float32(-math.Sin(angle) * math.Cos(float64(elevation))),
+			float32(-math.Sin(float64(elevation))),
+			float32(-math.Cos(angle) * math.Cos(float64(elevation))),
+		}
+		cams[i] = CameraForSphere(s, dir, fovy)
+	}
+	return cams
+}
+
+type rasterVertex struct {
+	pos    vec4.T
+	color  vec4.T
+	uv     vec2.T
+	normal vec3.T
+}
+
+type rasterizer struct {
+	width   int
+	height  int
+	img     *image.NRGBA
+	depth   []float32
+	opt     *RenderOptions
+	light   vec3.T
+	texture TextureImage
+	texMat  mat3.T
+	base    vec4.T
+	hasUV   bool
+}
+
+func newRasterizer(width, height int, opt *RenderOptions) *rasterizer {
+	r := &rasterizer{width: width, height: height, opt: opt}
+	r.img = image.NewNRGBA(image.Rect(0, 0, width, height))
+	r.depth = make([]float32, width*height)
+	for i := range r.depth {
+		r.depth[i] = math.MaxFloat32
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r.img.SetNRGBA(x, y, opt.Background)
+		}
+	}
+	r.light = opt.LightDir.Scaled(-1)
+	r.light.Normalize()
+	return r
+}
+
+func (r *rasterizer) toScreen(v *rasterVertex) (float32, float32, float32, float32) {
+	iw := 1 / v.pos[3]
+	x := (v.pos[0]*iw*0.5 + 0.5) * float32(r.width)
+	y := (0.5 - v.pos[1]*iw*0.5) * float32(r.height)
+	z := v.pos[2] * iw
+	return x, y, z, iw
+}
+
+func lerpVertex(a, b *rasterVertex, t float32) rasterVertex {
+	var v rasterVertex
+	for i := 0; i < 4; i++ {
+		v.pos[i] = a.pos[i] + (b.pos[i]-a.pos[i])*t
+		v.color[i] = a.color[i] + (b.color[i]-a.color[i])*t
+	}
+	for i := 0; i < 3; i++ {
+		v.normal[i] = a.normal[i] + (b.normal[i]-a.normal[i])*t
+	}
+	for i := 0; i < 2; i++ {
+		v.uv[i] = a.uv[i] + (b.uv[i]-a.uv[i])*t
+	}
+	return v
+}
+
+func (r *rasterizer) drawTriangle(tri [3]rasterVertex) {
+	const eps = 1e-5
+	var poly []rasterVertex
+	for i := 0; i < 3; i++ {
+		a, b := &tri[i], &tri[(i+1)%3]
+		da, db := a.pos[3]+a.pos[2], b.pos[3]+b.pos[2]
+		if da >= eps {
+			poly = append(poly, *a)
+		}
+		if (da >= eps) != (db >= eps) {
+			poly = append(poly, lerpVertex(a, b, (eps-da)/(db-da)))
+		}
+	}
+	for i := 1; i+1 < len(poly); i++ {
+		r.fillTriangle(&poly[0], &poly[i], &poly[i+1])
+	}
+}
+
+func (r *rasterizer) fillTriangle(v0, v1, v2 *rasterVertex) {
+	x0, y0, z0, w0 := r.toScreen(v0)
+	x1, y1, z1, w1 := r.toScreen(v1)
+	x2, y2, z2, w2 := r.toScreen(v2)
+
+	area := (x1-x0)*(y2-y0) - (x2-x0)*(y1-y0)
+	if area == 0 {
+		return
+	}
+	minx := int(math.Max(0, math.Floor(float64(min3(x0, x1, x2)))))
+	maxx := int(math.Min(float64(r.width-1), math.Ceil(float64(max3(x0, x1, x2)))))
+	miny := int(math.Max(0, math.Floor(float64(min3(y0, y1, y2)))))
+	maxy := int(math.Min(float64(r.height-1), math.Ceil(float64(max3(y0, y1, y2)))))
+
+	for y := miny; y <= maxy; y++ {
+		py := float32(y) + 0.5
+		for x := minx; x <= maxx; x++ {
+			px := float32(x) + 0.5
+			b0 := ((x1-px)*(y2-py) - (x2-px)*(y1-py)) / area
+			b1 := ((x2-px)*(y0-py) - (x0-px)*(y2-py)) / area
+			b2 := 1 - b0 - b1
+			if b0 < 0 || b1 < 0 || b2 < 0 {
+				continue
+			}
+			z := b0*z0 + b1*z1 + b2*z2
+			if z < -1 || z > 1 {
+				continue
+			}
+			idx := y*r.width + x
+			if z >= r.depth[idx] {
+				continue
+			}
+			p0, p1, p2 := b0*w0, b1*w1, b2*w2
+			iw := 1 / (p0 + p1 + p2)
+			p0, p1, p2 = p0*iw, p1*iw, p2*iw
+
+			var c vec4.T
+			for i := 0; i < 4; i++ {
+				c[i] = p0*v0.color[i] + p1*v1.color[i] + p2*v2.color[i]
+			}
+			n := vec3.T{
+				p0*v0.normal[0] + p1*v1.normal[0] + p2*v2.normal[0],
+				p0*v0.normal[1] + p1*v1.normal[1] + p2*v2.normal[1],
+				p0*v0.normal[2] + p1*v1.normal[2] + p2*v2.normal[2],
+			}
+			if r.texture != nil && r.hasUV {
+				uv := vec2.T{
+					p0*v0.uv[0] + p1*v1.uv[0] + p2*v2.uv[0],
+					p0*v0.uv[1] + p1*v1.uv[1] + p2*v2.uv[1],
+				}
+				t := r.sample(uv)
+				c = mulVec4(&c, &t)
+			}
+			r.depth[idx] = z
+			r.img.SetNRGBA(x, y, r.shade(c, n))
+		}
+	}
+}
+
+func (r *rasterizer) drawPoint(v *rasterVertex) {
+	if v.pos[3] <= 0 {
+		return
+	}
+	x, y, z, _ := r.toScreen(v)
+	if z < -1 || z > 1 {
+		return
+	}
+	half := r.opt.PointSize / 2
+	for dy := -half; dy < r.opt.PointSize-half; dy++ {
+		for dx := -half; dx < r.opt.PointSize-half; dx++ {
+			px, py := int(x)+dx, int(y)+dy
+			if px < 0 || py < 0 || px >= r.width || py >= r.height {
+				continue
+			}
+			idx := py*r.width + px
+			if z >= r.depth[idx] {
+				continue
+			}
+			r.depth[idx] = z
+			r.img.SetNRGBA(px, py, r.shade(v.color, v.normal))
+		}
+	}
+}
+
+func (r *rasterizer) shade(c vec4.T, n vec3.T) color.NRGBA {
+	intensity := float32(1)
+	if l := n.Length(); l > 0 {
+		n.Scale(1 / l)
+		d := float32(math.Abs(float64(vec3.Dot(&n, &r.light))))
+		intensity = r.opt.Ambient + (1-r.opt.Ambient)*d
+	}
+	return color.NRGBA{
+		clampByte(c[0] * intensity),
+		clampByte(c[1] * intensity),
+		clampByte(c[2] * intensity),
+		clampByte(c[3]),
+	}
+}
+
+func (r *rasterizer) sample(uv vec2.T) vec4.T {
+	t := vec3.T{uv[0], uv[1], 1}
+	t = r.texMat.MulVec3(&t)
+	b := r.texture.Bounds()
+	u := t[0] - float32(math.Floor(float64(t[0])))
+	v := t[1] - float32(math.Floor(float64(t[1])))
+	x := b.Min.X + int(u*float32(b.Dx()))
+	y := b.Min.Y + int((1-v)*float32(b.Dy()))
+	if x >= b.Max.X {
+		x = b.Max.X - 1
+	}
+	if y >= b.Max.Y {
+		y = b.Max.Y - 1
+	}
+	c := color.NRGBAModel.Convert(r.texture.At(x, y)).(color.NRGBA)
+	return vec4.T{float32(c.R) / 255, float32(c.G) / 255, float32(c.B) / 255, float32(c.A) / 255}
+}
+
+func (r *rasterizer) drawMesh(a *Archive, mesh *NodeMesh, positions []vec3.T, mvp, model *mat4.T, first_patch, last_patch uint32, visible func(p uint32) bool) {
+	if mesh.Empty() {
+		return
+	}
+	verts := make([]rasterVertex, len(positions))
+	for i := range positions {
+		v := vec4.FromVec3(&positions[i])
+		verts[i].pos = mvp.MulVec4(&v)
+		verts[i].color = vec4.T{1, 1, 1, 1}
+		if mesh.HasColor() {
+			c := mesh.Colors[i]
+			verts[i].color = vec4.T{float32(c[0]) / 255, float32(c[1]) / 255, float32(c[2]) / 255, float32(c[3]) / 255}
+		}
+		if mesh.HasNormal() {
+			n := vec3.T{float32(mesh.Normals[i][0]), float32(mesh.Normals[i][1]), float32(mesh.Normals[i][2])}
+			verts[i].normal = model.MulVec3W(&n, 0)
+		}
+		if mesh.HasTexcoord() {
+			verts[i].uv = mesh.Texcoords[i]
+		}
+	}
+
+	start := uint32(0)
+	for p := first_patch; p < last_patch; p++ {
+		patch := &a.Patchs[p]
+		end := patch.FaceOffset
+		if visible(p) {
+			r.setPatch(a, patch)
+			if mesh.HasFace() {
+				r.drawFaces(mesh, positions, verts, model, start, end)
+			} else {
+				for i := start; i < end && int(i) < len(verts); i++ {
+					v := verts[i]
+					v.color = mulVec4(&v.color, &r.base)
+					r.drawPoint(&v)
+				}
+			}
+		}
+		start = end
+	}
+}
+
+func (r *rasterizer) drawFaces(mesh *NodeMesh, positions []vec3.T, verts []rasterVertex, model *mat4.T, start, end uint32) {
+	r.hasUV = mesh.HasTexcoord()
+	for f := start; f < end && int(f) < len(mesh.Faces); f++ {
+		face := mesh.Faces[f]
+		tri := [3]rasterVertex{verts[face[0]], verts[face[1]], verts[face[2]]}
+		if !mesh.HasNormal() {
+			p0 := model.MulVec3(&positions[face[0]])
+			p1 := model.MulVec3(&positions[face[1]])
+			p2 := model.MulVec3(&positions[face[2]])
+			e1 := vec3.Sub(&p1, &p0)
+			e2 := vec3.Sub(&p2, &p0)
+			n := vec3.Cross(&e1, &e2)
+			tri[0].normal, tri[1].normal, tri[2].normal = n, n, n
+		}
+		for i := range tri {
+			tri[i].color = mulVec4(&tri[i].color, &r.base)
+		}
+		r.drawTriangle(tri)
+	}
+}
+
+func (r *rasterizer) setPatch(a *Archive, patch *Patch) {
+	r.base = vec4.T{1, 1, 1, 1}
+	if patch.MtlID != LM_INVALID_ID && int(patch.MtlID) < len(a.Materials) {
+		m := &a.Materials[patch.MtlID]
+		r.base = vec4.T{float32(m.Color[0]) / 255, float32(m.Color[1]) / 255, float32(m.Color[2]) / 255, 1}
+		if m.Opacity > 0 {
+			r.base[3] = m.Opacity
+		}
+	}
+	r.texture = nil
+	if patch.TexID != LM_INVALID_ID && int(patch.TexID) < len(a.TextureImages) {
+		r.texture = a.TextureImages[patch.TexID]
+		r.texMat = mat3.Ident
+		if int(patch.TexID) < len(a.Textures) && !a.Textures[patch.TexID].Mat.IsZero() {
+			r.texMat = a.Textures[patch.TexID].Mat
+		}
+	}
+}
+
+func Render(a *Archive, cam Camera, width, height int, opt *RenderOptions) (image.Image, error) {
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("invalid image size")
+	}
+	if opt == nil {
+		opt = &DEFAULT_RENDER_OPTIONS
+	}
+	t := NewTraversal(a, cam, width, height)
+	if opt.TargetError > 0 {
+		t.TargetError = opt.TargetError
+	}
+	if err := t.Traverse(); err != nil {
+		return nil, err
+	}
+
+	r := newRasterizer(width, height, opt)
+	model := a.modelMatrix()
+	view := cam.ViewMatrix()
+	proj := cam.ProjectionMatrix(float32(width) / float32(height))
+	var viewProj, mvp mat4.T
+	viewProj.AssignMul(&proj, &view)
+	mvp.AssignMul(&viewProj, &model)
+
+	for n := range t.Selected {
+		if !t.Selected[n] {
+			continue
+		}
+		first_patch, last_patch := a.getNodePatchRange(uint32(n))
+		mesh := &a.NodeMeshs[n]
+		r.drawMesh(a, mesh, mesh.Morphed(t.Blends[n]), &mvp, &model, first_patch, last_patch, func(p uint32) bool {
+			return !t.Selected[a.Patchs[p].Node]
+		})
+	}
+
+	for i := range a.Instances {
+		inst := &a.Instances[i]
+		if err := a.LoadInstance(inst.Node); err != nil {
+			return nil, err
+		}
+		var instModel, instMvp mat4.T
+		instMat := inst.InstanceMat
+		if instMat.IsZero() {
+			instMat = mat4.Ident
+		}
+		instModel.AssignMul(&model, &instMat)
+		instMvp.AssignMul(&viewProj, &instModel)
+		first_patch, last_patch := a.getInstanceNodePatchRange(inst.Node)
+		mesh := &a.InstanceMeshs[inst.Node]
+		r.drawMesh(a, mesh, mesh.Verts, &instMvp, &instModel, first_patch, last_patch, func(p uint32) bool {
+			return true
+		})
+	}
+	return r.img, nil
+}
+
+func clampByte(f float32) uint8 {
+	v := f*255 + 0.5
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+func min3(a, b, c float32) float32 {
+	return float32(math.Min(float64(a), math.Min(float64(b), float64(c))))
+}
+
+func max3(a, b, c float32) float32 {
+	return float32(math.Max(float64(a), math.Max(float64(b), float64(c))))
+}
+
+func mulVec4(a, b *vec4.T) vec4.T {
+	return vec4.T{a[0] * b[0], a[1] * b[1], a[2] * b[2], a[3] * b[3]}
+}
@@ -0,0 +1,31 @@
+package lodm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/flywave/go3d/vec3"
+)
+
+func TestRender(t *testing.T) {
+	a := newTestArchive()
+
+	cam := CameraForSphere(a.BoundingSpere(), vec3.T{-1, -1, -1}, math.Pi/4)
+
+	img, err := Render(a, cam, 64, 64, nil)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if _, _, _, alpha := img.At(32, 32).RGBA(); alpha == 0 {
+		t.FailNow()
+	}
+	if _, _, _, alpha := img.At(0, 0).RGBA(); alpha != 0 {
+		t.FailNow()
+	}
+
+	cams := TurntableCameras(a.BoundingSpere(), 4, 0.3, math.Pi/4)
+	if len(cams) != 4 {
+		t.FailNow()
+	}
+}
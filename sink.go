@@ -0,0 +1,191 @@
+package lodm
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type ExportSink interface {
+	Create(name string) (io.WriteCloser, error)
+}
+
+type DirSink struct {
+	Dir string
+}
+
+func NewDirSink(dir string) *DirSink {
+	return &DirSink{Dir: dir}
+}
+
+func (s *DirSink) Create(name string) (io.WriteCloser, error) {
+	p := filepath.Join(s.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+type MemorySink struct {
+	Files map[string][]byte
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{Files: make(map[string][]byte)}
+}
+
+type memoryFile struct {
+	bytes.Buffer
+	name string
+	sink *MemorySink
+}
+
+func (f *memoryFile) Close() error {
+	f.sink.Files[f.name] = f.Bytes()
+	return nil
+}
+
+func (s *MemorySink) Create(name string) (io.WriteCloser, error) {
+	return &memoryFile{name: name, sink: s}, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type zipEntry struct {
+	hash   [16]byte
+	offset uint64
+}
+
+type ZipSink struct {
+	Method uint16
+
+	writer  *zip.Writer
+	counter *countingWriter
+	entries []zipEntry
+	index   string
+}
+
+func NewZipSink(w io.Writer) *ZipSink {
+	c := &countingWriter{w: w}
+	return &ZipSink{Method: zip.Deflate, writer: zip.NewWriter(c), counter: c}
+}
+
+func NewTilesArchiveSink(w io.Writer) *ZipSink {
+	s := NewZipSink(w)
+	s.index = "@3dtilesIndex1@"
+	return s
+}
+
+func NewSLPKSink(w io.Writer) *ZipSink {
+	s := NewZipSink(w)
+	s.Method = zip.Store
+	s.index = "@specialIndexFileHASH128@"
+	return s
+}
+
+type zipFile struct {
+	bytes.Buffer
+	name string
+	sink *ZipSink
+}
+
+func (f *zipFile) Close() error {
+	return f.sink.writeEntry(f.name, f.Bytes())
+}
+
+func (s *ZipSink) Create(name string) (io.WriteCloser, error) {
+	return &zipFile{name: name, sink: s}, nil
+}
+
+func (s *ZipSink) writeRaw(name string, method uint16, data []byte) (uint64, error) {
+	fh := &zip.FileHeader{Name: name, Method: method, CRC32: crc32.ChecksumIEEE(data), UncompressedSize64: uint64(len(data))}
+	body := data
+	switch method {
+	case zip.Store:
+	case zip.Deflate:
+		var buf bytes.Buffer
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return 0, err
+		}
+		if err := fw.Close(); err != nil {
+			return 0, err
+		}
+		body = buf.Bytes()
+	default:
+		return 0, errors.New("unsupported zip method")
+	}
+	fh.CompressedSize64 = uint64(len(body))
+	if err := s.writer.Flush(); err != nil {
+		return 0, err
+	}
+	offset := uint64(s.counter.n)
+	w, err := s.writer.CreateRaw(fh)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+func (s *ZipSink) writeEntry(name string, data []byte) error {
+	offset, err := s.writeRaw(name, s.Method, data)
+	if err != nil {
+		return err
+	}
+	s.entries = append(s.entries, zipEntry{hash: md5.Sum([]byte(name)), offset: offset})
+	return nil
+}
+
+func (s *ZipSink) Close() error {
+	if s.index != "" {
+		sort.Slice(s.entries, func(i, j int) bool {
+			return bytes.Compare(s.entries[i].hash[:], s.entries[j].hash[:]) < 0
+		})
+		var buf bytes.Buffer
+		for _, e := range s.entries {
+			buf.Write(e.hash[:])
+			if err := binary.Write(&buf, binary.LittleEndian, e.offset); err != nil {
+				return err
+			}
+		}
+		if _, err := s.writeRaw(s.index, zip.Store, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return s.writer.Close()
+}
+
+func writeSinkFile(sink ExportSink, name string, data []byte) error {
+	f, err := sink.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
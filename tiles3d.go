@@ -0,0 +1,561 @@
+package lodm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	dmat4 "github.com/flywave/go3d/float64/mat4"
+	"github.com/flywave/go3d/vec3"
+)
+
+const (
+	TILESET_VERSION  = "1.1"
+	TILESET_FILENAME = "tileset.json"
+)
+
+var (
+	yUpMatrix = []float64{1, 0, 0, 0, 0, 0, -1, 0, 0, 1, 0, 0, 0, 0, 0, 1}
+)
+
+type tilesetAsset struct {
+	Version   string `json:"version"`
+	Generator string `json:"generator,omitempty"`
+}
+
+type tileBoundingVolume struct {
+	Sphere []float32 `json:"sphere"`
+}
+
+type tileContent struct {
+	URI string `json:"uri"`
+}
+
+type tile struct {
+	Transform      []float64          `json:"transform,omitempty"`
+	BoundingVolume tileBoundingVolume `json:"boundingVolume"`
+	GeometricError float32            `json:"geometricError"`
+	Refine         string             `json:"refine,omitempty"`
+	Content        *tileContent       `json:"content,omitempty"`
+	Contents       []tileContent      `json:"contents,omitempty"`
+	Children       []*tile            `json:"children,omitempty"`
+}
+
+type tileset struct {
+	Asset          tilesetAsset `json:"asset"`
+	GeometricError float32      `json:"geometricError"`
+	Root           *tile        `json:"root"`
+}
+
+func (b *gltfBuilder) addFeatureIds(prim *gltfPrimitive, fid uint32, count int) error {
+	if fid == LM_INVALID_ID || int(fid)+1 >= len(b.archive.Features) || count == 0 {
+		return nil
+	}
+	row, ok := b.features[fid]
+	if !ok {
+		row = len(b.rows)
+		b.features[fid] = row
+		b.rows = append(b.rows, fid)
+	}
+	ids := make([]uint16, count)
+	for i := range ids {
+		ids[i] = uint16(row)
+	}
+	attrs := make(map[string]int, len(prim.Attributes)+1)
+	for k, v := range prim.Attributes {
+		attrs[k] = v
+	}
+	id, err := b.addAccessor(ids, gltfUnsignedShort, "SCALAR", count, gltfArrayBuffer, false)
+	if err != nil {
+		return err
+	}
+	attrs["_FEATURE_ID_0"] = id
+	prim.Attributes = attrs
+
+	b.useExtension("EXT_mesh_features")
+	if prim.Extensions == nil {
+		prim.Extensions = make(map[string]interface{})
+	}
+	prim.Extensions["EXT_mesh_features"] = map[string]interface{}{
+		"featureIds": []interface{}{
+			map[string]interface{}{"featureCount": 1, "attribute": 0, "propertyTable": 0},
+		},
+	}
+	return nil
+}
+
+func (b *gltfBuilder) addPropertyTable() {
+	a := b.archive
+	ids := make([]uint32, len(b.rows))
+	types := make([]uint32, len(b.rows))
+	offsets := make([]uint32, 0, len(b.rows)+1)
+	var data []byte
+	for i, fid := range b.rows {
+		ids[i] = a.Features[fid].ID
+		types[i] = a.Features[fid].Type
+		offsets = append(offsets, uint32(len(data)))
+		if int(fid) < len(a.FeatureDatas) {
+			data = append(data, a.FeatureDatas[fid]...)
+		}
+	}
+	offsets = append(offsets, uint32(len(data)))
+
+	view := func(v interface{}) int {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, v)
+		return b.addBufferView(buf.Bytes(), 0, 0)
+	}
+
+	b.useExtension("EXT_structural_metadata")
+	if b.doc.Extensions == nil {
+		b.doc.Extensions = make(map[string]interface{})
+	}
+	b.doc.Extensions["EXT_structural_metadata"] = map[string]interface{}{
+		"schema": map[string]interface{}{
+			"id": "lodm",
+			"classes": map[string]interface{}{
+				"feature": map[string]interface{}{
+					"properties": map[string]interface{}{
+						"id":   map[string]interface{}{"type": "SCALAR", "componentType": "UINT32"},
+						"type": map[string]interface{}{"type": "SCALAR", "componentType": "UINT32"},
+						"data": map[string]interface{}{"type": "SCALAR", "componentType": "UINT8", "array": true},
+					},
+				},
+			},
+		},
+		"propertyTables": []interface{}{
+			map[string]interface{}{
+				"class": "feature",
+				"count": len(b.rows),
+				"properties": map[string]interface{}{
+					"id":   map[string]interface{}{"values": view(ids)},
+					"type": map[string]interface{}{"values": view(types)},
+					"data": map[string]interface{}{"values": view(data), "arrayOffsets": view(offsets), "arrayOffsetType": "UINT32"},
+				},
+			},
+		},
+	}
+}
+
+func tileContentName(n uint32) string {
+	return fmt.Sprintf("tiles/%v.glb", n)
+}
+
+func sphereVolume(s Sphere) tileBoundingVolume {
+	c := s.Center()
+	return tileBoundingVolume{Sphere: []float32{c[0], c[1], c[2], s.Radius()}}
+}
+
+func (a *Archive) writeTileContent(sink ExportSink, n uint32) (bool, error) {
+	if err := a.LoadNode(n); err != nil {
+		return false, err
+	}
+	b := newGltfBuilder(a)
+	b.metadata = true
+	root := b.addNode(gltfNode{Name: "root", Matrix: yUpMatrix})
+	b.doc.Scenes[0].Nodes = append(b.doc.Scenes[0].Nodes, root)
+	if err := b.addArchiveNode(root, n, func(p uint32) bool { return true }); err != nil {
+		return false, err
+	}
+	if len(b.doc.Meshes) == 0 {
+		return false, nil
+	}
+	var buf bytes.Buffer
+	if err := b.write(&buf); err != nil {
+		return false, err
+	}
+	return true, writeSinkFile(sink, tileContentName(n), buf.Bytes())
+}
+
+func (a *Archive) firstParents() []uint32 {
+	sink_node := a.sinkNode()
+	parent := make([]uint32, sink_node)
+	for n := range parent {
+		parent[n] = LM_INVALID_ID
+	}
+	for n := uint32(0); n < sink_node; n++ {
+		first_patch, last_patch := a.getNodePatchRange(n)
+		for p := first_patch; p < last_patch; p++ {
+			child := a.Patchs[p].Node
+			if child < sink_node && child > n && parent[child] == LM_INVALID_ID {
+				parent[child] = n
+			}
+		}
+	}
+	return parent
+}
+
+func (a *Archive) buildTiles(sink ExportSink) ([]*tile, error) {
+	sink_node := a.sinkNode()
+	tiles := make([]*tile, sink_node)
+	parent := a.firstParents()
+	for n := uint32(0); n < sink_node; n++ {
+		node := &a.Nodes[n]
+		t := &tile{BoundingVolume: sphereVolume(node.Sphere), GeometricError: node.Error, Refine: "REPLACE"}
+		ok, err := a.writeTileContent(sink, n)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			t.Content = &tileContent{URI: tileContentName(n)}
+		}
+		tiles[n] = t
+	}
+	for n := uint32(0); n < sink_node; n++ {
+		added := make(map[uint32]bool)
+		first_patch, last_patch := a.getNodePatchRange(n)
+		for p := first_patch; p < last_patch; p++ {
+			child := a.Patchs[p].Node
+			if child >= sink_node || child <= n || added[child] {
+				continue
+			}
+			added[child] = true
+			if parent[child] == n {
+				tiles[n].Children = append(tiles[n].Children, tiles[child])
+			} else {
+				tiles[n].Refine = "ADD"
+			}
+		}
+	}
+	var roots []*tile
+	for n := uint32(0); n < sink_node; n++ {
+		if parent[n] == LM_INVALID_ID {
+			roots = append(roots, tiles[n])
+		}
+	}
+	return roots, nil
+}
+
+func (a *Archive) ExportTileset(sink ExportSink) error {
+	if len(a.Nodes) < 2 {
+		return errors.New("archive has no nodes")
+	}
+	roots, err := a.buildTiles(sink)
+	if err != nil {
+		return err
+	}
+	root := roots[0]
+	if len(roots) > 1 {
+		root = &tile{BoundingVolume: sphereVolume(a.Header.Sphere), Refine: "ADD", Children: roots}
+		for _, t := range roots {
+			if t.GeometricError > root.GeometricError {
+				root.GeometricError = t.GeometricError
+			}
+		}
+	}
+	root.Transform = matrixSlice(a.Header.Matrix)
+
+	ts := tileset{Asset: tilesetAsset{Version: TILESET_VERSION, Generator: "go-lodm"}, GeometricError: root.GeometricError, Root: root}
+	js, err := json.Marshal(&ts)
+	if err != nil {
+		return err
+	}
+	return writeSinkFile(sink, TILESET_FILENAME, js)
+}
+
+func (a *Archive) ExportTilesetDir(dir string) error {
+	return a.ExportTileset(NewDirSink(dir))
+}
+
+func (a *Archive) ExportTilesetArchive(w io.Writer) error {
+	sink := NewTilesArchiveSink(w)
+	if err := a.ExportTileset(sink); err != nil {
+		return err
+	}
+	return sink.Close()
+}
+
+func (a *Archive) ExportTilesetArchiveFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return a.ExportTilesetArchive(f)
+}
+
+type importedTile struct {
+	first    int
+	count    int
+	refine   string
+	children []int
+}
+
+type tilesetImporter struct {
+	open     func(name string) (io.ReadCloser, error)
+	gltf     *gltfImporter
+	tiles    []importedTile
+	meshes   []NodeMesh
+	patchs   [][]Patch
+	errors   []float32
+	visiting map[string]bool
+}
+
+func (imp *tilesetImporter) read(name string) ([]byte, error) {
+	f, err := imp.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func (imp *tilesetImporter) relativeOpen(dir string) func(name string) (io.ReadCloser, error) {
+	return func(name string) (io.ReadCloser, error) {
+		return imp.open(path.Join(dir, name))
+	}
+}
+
+func (imp *tilesetImporter) glb(data []byte, dir string, m *dmat4.T) ([]gltfPart, error) {
+	r, err := readGltf(data, imp.relativeOpen(dir))
+	if err != nil {
+		return nil, err
+	}
+	var root dmat4.T
+	root.AssignMul(m, &yUpToZUp)
+	return imp.gltf.scene(r, &root)
+}
+
+func (imp *tilesetImporter) b3dm(data []byte, dir string, m *dmat4.T) ([]gltfPart, error) {
+	if len(data) < 28 {
+		return nil, errors.New("b3dm: truncated header")
+	}
+	ft_json := int(byteorder.Uint32(data[12:]))
+	ft_bin := int(byteorder.Uint32(data[16:]))
+	bt_json := int(byteorder.Uint32(data[20:]))
+	bt_bin := int(byteorder.Uint32(data[24:]))
+	start := 28 + ft_json + ft_bin + bt_json + bt_bin
+	if start > len(data) {
+		return nil, errors.New("b3dm: bad header")
+	}
+	local := *m
+	if ft_json > 0 {
+		var ft struct {
+			RTCCenter json.RawMessage `json:"RTC_CENTER"`
+		}
+		if err := json.Unmarshal(data[28:28+ft_json], &ft); err != nil {
+			return nil, err
+		}
+		var center []float64
+		var ref struct {
+			ByteOffset int `json:"byteOffset"`
+		}
+		if len(ft.RTCCenter) > 0 && json.Unmarshal(ft.RTCCenter, &center) != nil && json.Unmarshal(ft.RTCCenter, &ref) == nil {
+			bin := data[28+ft_json : 28+ft_json+ft_bin]
+			if ref.ByteOffset+12 > len(bin) {
+				return nil, errors.New("b3dm: bad RTC_CENTER")
+			}
+			for k := 0; k < 3; k++ {
+				center = append(center, float64(math.Float32frombits(byteorder.Uint32(bin[ref.ByteOffset+k*4:]))))
+			}
+		}
+		if len(center) == 3 {
+			rtc := dmat4.Ident
+			rtc[3][0], rtc[3][1], rtc[3][2] = center[0], center[1], center[2]
+			local.AssignMul(m, &rtc)
+		}
+	}
+	return imp.glb(data[start:], dir, &local)
+}
+
+func (imp *tilesetImporter) cmpt(data []byte, dir string, m *dmat4.T) ([]gltfPart, error) {
+	if len(data) < 16 {
+		return nil, errors.New("cmpt: truncated header")
+	}
+	var parts []gltfPart
+	count := int(byteorder.Uint32(data[12:]))
+	off := 16
+	for i := 0; i < count; i++ {
+		if off+12 > len(data) {
+			return nil, errors.New("cmpt: truncated tile")
+		}
+		size := int(byteorder.Uint32(data[off+8:]))
+		if size < 12 || off+size > len(data) {
+			return nil, errors.New("cmpt: bad tile length")
+		}
+		p, err := imp.content(data[off:off+size], dir, m)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p...)
+		off += size
+	}
+	return parts, nil
+}
+
+func (imp *tilesetImporter) content(data []byte, dir string, m *dmat4.T) ([]gltfPart, error) {
+	if len(data) < 4 {
+		return nil, errors.New("tileset: empty content")
+	}
+	switch string(data[:4]) {
+	case "b3dm":
+		return imp.b3dm(data, dir, m)
+	case "cmpt":
+		return imp.cmpt(data, dir, m)
+	case "i3dm", "pnts":
+		return nil, errors.New("tileset: unsupported content " + string(data[:4]))
+	}
+	return imp.glb(data, dir, m)
+}
+
+func (imp *tilesetImporter) tileset(name string, parent *dmat4.T, refine string, parentTile int) error {
+	if imp.visiting[name] {
+		return errors.New("tileset: recursive reference " + name)
+	}
+	imp.visiting[name] = true
+	defer delete(imp.visiting, name)
+
+	data, err := imp.read(name)
+	if err != nil {
+		return err
+	}
+	var ts tileset
+	if err := json.Unmarshal(data, &ts); err != nil {
+		return err
+	}
+	if ts.Root == nil {
+		return errors.New("tileset: missing root in " + name)
+	}
+	return imp.tile(ts.Root, path.Dir(name), parent, refine, parentTile)
+}
+
+func (imp *tilesetImporter) tile(t *tile, dir string, parent *dmat4.T, refine string, parentTile int) error {
+	m := *parent
+	if len(t.Transform) == 16 {
+		local := gltfNodeMatrix(&gltfNode{Matrix: t.Transform})
+		m.AssignMul(parent, &local)
+	}
+	if t.Refine != "" {
+		refine = strings.ToUpper(t.Refine)
+	}
+
+	contents := t.Contents
+	if t.Content != nil {
+		contents = append([]tileContent{*t.Content}, contents...)
+	}
+	var parts []gltfPart
+	var externals []string
+	for _, c := range contents {
+		name, err := url.PathUnescape(c.URI)
+		if err != nil {
+			name = c.URI
+		}
+		name = path.Join(dir, name)
+		if strings.EqualFold(path.Ext(name), ".json") {
+			externals = append(externals, name)
+			continue
+		}
+		data, err := imp.read(name)
+		if err != nil {
+			return err
+		}
+		p, err := imp.content(data, path.Dir(name), &m)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, p...)
+	}
+
+	current := parentTile
+	if len(parts) > 0 {
+		meshes, patchs := packParts(parts)
+		current = len(imp.tiles)
+		imp.tiles = append(imp.tiles, importedTile{first: len(imp.meshes), count: len(meshes), refine: refine})
+		for range meshes {
+			imp.errors = append(imp.errors, t.GeometricError)
+		}
+		imp.meshes = append(imp.meshes, meshes...)
+		imp.patchs = append(imp.patchs, patchs...)
+		if parentTile >= 0 {
+			imp.tiles[parentTile].children = append(imp.tiles[parentTile].children, current)
+		}
+	}
+	for _, name := range externals {
+		if err := imp.tileset(name, &m, refine, current); err != nil {
+			return err
+		}
+	}
+	for _, c := range t.Children {
+		if err := imp.tile(c, dir, &m, refine, current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (imp *tilesetImporter) archive(setting *CompressSetting) *Archive {
+	sink := uint32(len(imp.meshes))
+	nodes := make([]Node, len(imp.meshes))
+	links := make([][]uint32, len(imp.meshes))
+	var patchs []Patch
+	for _, t := range imp.tiles {
+		var children []uint32
+		for _, c := range t.children {
+			for i := 0; i < imp.tiles[c].count; i++ {
+				children = append(children, uint32(imp.tiles[c].first+i))
+			}
+		}
+		target := sink
+		if t.refine != "ADD" && len(children) > 0 {
+			target = children[0]
+		}
+		for i := t.first; i < t.first+t.count; i++ {
+			nodes[i] = Node{Error: imp.errors[i], FirstPatch: uint32(len(patchs))}
+			links[i] = children
+			for _, p := range imp.patchs[i] {
+				p.Node = target
+				patchs = append(patchs, p)
+			}
+			for _, c := range children {
+				if c != target {
+					patchs = append(patchs, Patch{Node: c, FaceOffset: uint32(len(imp.meshes[i].Faces)), TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID})
+				}
+			}
+		}
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		sphere := pointsSphere(imp.meshes[i].Verts)
+		for _, c := range links[i] {
+			sphere = unionSphere(sphere, nodes[c].Sphere)
+		}
+		center := sphere.Center()
+		for _, v := range imp.meshes[i].Verts {
+			if d := vec3.Distance(&v, &center); d > nodes[i].TightRadius {
+				nodes[i].TightRadius = d
+			}
+		}
+		nodes[i].Sphere = sphere
+	}
+
+	a := newDAGArchive(imp.gltf.signature(imp.meshes), nodes, patchs, imp.meshes, setting)
+	imp.gltf.apply(a)
+	return a
+}
+
+func ImportTileset(open func(name string) (io.ReadCloser, error), name string, setting *CompressSetting) (*Archive, error) {
+	imp := &tilesetImporter{open: open, gltf: newGltfImporter(), visiting: make(map[string]bool)}
+	if err := imp.tileset(path.Clean(name), &dmat4.Ident, "REPLACE", -1); err != nil {
+		return nil, err
+	}
+	if len(imp.meshes) == 0 {
+		return nil, errors.New("tileset: no geometry")
+	}
+	return imp.archive(setting), nil
+}
+
+func ImportTilesetFile(path string, setting *CompressSetting) (*Archive, error) {
+	return ImportTileset(NewObjDirReader(filepath.Dir(path)).Open, filepath.Base(path), setting)
+}
@@ -0,0 +1,253 @@
+package lodm
+
+import (
+	"math"
+
+	dvec3 "github.com/flywave/go3d/float64/vec3"
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec3"
+	"github.com/flywave/go3d/vec4"
+)
+
+const (
+	DEFAULT_TARGET_ERROR float32 = 1.0
+)
+
+type Camera struct {
+	Eye     vec3.T
+	Center  vec3.T
+	Up      vec3.T
+	Fovy    float32
+	Near    float32
+	Far     float32
+	EyeECEF dvec3.T
+}
+
+func (c *Camera) ViewMatrix() mat4.T {
+	f := vec3.Sub(&c.Center, &c.Eye)
+	f.Normalize()
+	s := vec3.Cross(&f, &c.Up)
+	s.Normalize()
+	u := vec3.Cross(&s, &f)
+	return mat4.T{
+		vec4.T{s[0], u[0], -f[0], 0},
+		vec4.T{s[1], u[1], -f[1], 0},
+		vec4.T{s[2], u[2], -f[2], 0},
+		vec4.T{-vec3.Dot(&s, &c.Eye), -vec3.Dot(&u, &c.Eye), vec3.Dot(&f, &c.Eye), 1},
+	}
+}
+
+func (c *Camera) ProjectionMatrix(aspect float32) mat4.T {
+	f := float32(1 / math.Tan(float64(c.Fovy)/2))
+	return mat4.T{
+		vec4.T{f / aspect, 0, 0, 0},
+		vec4.T{0, f, 0, 0},
+		vec4.T{0, 0, (c.Far + c.Near) / (c.Near - c.Far), -1},
+		vec4.T{0, 0, 2 * c.Far * c.Near / (c.Near - c.Far), 0},
+	}
+}
+
+func (a *Archive) modelMatrix() mat4.T {
+	if a.Header.Matrix.IsZero() {
+		return mat4.Ident
+	}
+	return a.Header.Matrix
+}
+
+func transformSphere(m *mat4.T, s Sphere) Sphere {
+	c := s.Center()
+	c = m.MulVec3(&c)
+	scale := float32(0)
+	for i := 0; i < 3; i++ {
+		axis := vec3.T{m[i][0], m[i][1], m[i][2]}
+		if l := axis.Length(); l > scale {
+			scale = l
+		}
+	}
+	return Sphere{c[0], c[1], c[2], s.Radius() * scale}
+}
+
+func (a *Archive) sinkNode() uint32 {
+	return uint32(len(a.Nodes) - 1)
+}
+
+func (a *Archive) selectCut(visit func(n uint32) (bool, bool)) []bool {
+	selected := make([]bool, len(a.Nodes))
+	if len(a.Nodes) == 0 {
+		return selected
+	}
+	sink := a.sinkNode()
+	blocked := make([]bool, len(a.Nodes))
+	for n := uint32(0); n < sink; n++ {
+		refine := false
+		if !blocked[n] {
+			selected[n], refine = visit(n)
+		}
+		if refine {
+			continue
+		}
+		first_patch, last_patch := a.getNodePatchRange(n)
+		for p := first_patch; p < last_patch; p++ {
+			blocked[a.Patchs[p].Node] = true
+		}
+	}
+	return selected
+}
+
+func (a *Archive) SelectByError(maxError float32) []bool {
+	return a.selectCut(func(n uint32) (bool, bool) {
+		return true, a.Nodes[n].Error >= maxError
+	})
+}
+
+func (a *Archive) cutPatchs(selected []bool, fn func(n, p uint32, start, end uint32)) {
+	for n := range selected {
+		if !selected[n] {
+			continue
+		}
+		start := uint32(0)
+		first_patch, last_patch := a.getNodePatchRange(uint32(n))
+		for p := first_patch; p < last_patch; p++ {
+			patch := &a.Patchs[p]
+			if !selected[patch.Node] {
+				fn(uint32(n), p, start, patch.FaceOffset)
+			}
+			start = patch.FaceOffset
+		}
+	}
+}
+
+type TraversalStats struct {
+	Visited  int
+	Selected int
+	Culled   int
+	Horizon  int
+	Occluded int
+	Loaded   int
+}
+
+type Traversal struct {
+	Archive          *Archive
+	Camera           Camera
+	Width            int
+	Height           int
+	TargetError      float32
+	HorizonCulling   bool
+	OcclusionCulling bool
+	Selected         []bool
+	Blends           []float32
+	Stats            TraversalStats
+
+	model      mat4.T
+	viewProj   mat4.T
+	planes     [6]vec4.T
+	resolution float32
+	scale      float32
+	errors     []float32
+	occlusion  *hiZBuffer
+}
+
+func NewTraversal(a *Archive, cam Camera, width, height int) *Traversal {
+	return &Traversal{Archive: a, Camera: cam, Width: width, Height: height, TargetError: DEFAULT_TARGET_ERROR, HorizonCulling: true}
+}
+
+func (t *Traversal) setup() {
+	t.model = t.Archive.modelMatrix()
+	view := t.Camera.ViewMatrix()
+	proj := t.Camera.ProjectionMatrix(float32(t.Width) / float32(t.Height))
+	t.viewProj.AssignMul(&proj, &view)
+	t.resolution = float32(t.Height) / float32(2*math.Tan(float64(t.Camera.Fovy)/2))
+	t.scale = transformSphere(&t.model, Sphere{0, 0, 0, 1}).Radius()
+
+	m := &t.viewProj
+	row := func(r int) vec4.T { return vec4.T{m[0][r], m[1][r], m[2][r], m[3][r]} }
+	r0, r1, r2, r3 := row(0), row(1), row(2), row(3)
+	for i := 0; i < 4; i++ {
+		t.planes[0][i] = r3[i] + r0[i]
+		t.planes[1][i] = r3[i] - r0[i]
+		t.planes[2][i] = r3[i] + r1[i]
+		t.planes[3][i] = r3[i] - r1[i]
+		t.planes[4][i] = r3[i] + r2[i]
+		t.planes[5][i] = r3[i] - r2[i]
+	}
+	for i := range t.planes {
+		l := float32(math.Sqrt(float64(t.planes[i][0]*t.planes[i][0] + t.planes[i][1]*t.planes[i][1] + t.planes[i][2]*t.planes[i][2])))
+		if l > 0 {
+			for j := range t.planes[i] {
+				t.planes[i][j] /= l
+			}
+		}
+	}
+}
+
+func (t *Traversal) isVisible(s Sphere) bool {
+	for i := range t.planes {
+		p := &t.planes[i]
+		if p[0]*s[0]+p[1]*s[1]+p[2]*s[2]+p[3] < -s[3] {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Traversal) screenError(n uint32, s Sphere) float32 {
+	c := s.Center()
+	dist := vec3.Distance(&c, &t.Camera.Eye) - s.Radius()
+	if dist < t.Camera.Near {
+		dist = t.Camera.Near
+	}
+	return t.Archive.Nodes[n].Error * t.scale * t.resolution / dist
+}
+
+func (t *Traversal) Traverse() error {
+	a := t.Archive
+	t.setup()
+	t.Stats = TraversalStats{}
+	t.errors = make([]float32, len(a.Nodes))
+	t.occlusion = nil
+	if t.OcclusionCulling {
+		t.buildOcclusionBuffer()
+	}
+	t.Selected = a.selectCut(func(n uint32) (bool, bool) {
+		t.Stats.Visited++
+		s := transformSphere(&t.model, a.Nodes[n].Sphere)
+		if !t.isVisible(s) {
+			t.Stats.Culled++
+			return false, false
+		}
+		if !t.isAboveHorizon(n) {
+			t.Stats.Horizon++
+			return false, false
+		}
+		if t.isOccluded(n, s) {
+			t.Stats.Occluded++
+			return false, false
+		}
+		t.errors[n] = t.screenError(n, s)
+		return true, t.errors[n] > t.TargetError
+	})
+	t.computeBlends()
+	for n := range t.Selected {
+		if !t.Selected[n] {
+			continue
+		}
+		t.Stats.Selected++
+		if a.NodeMeshs[n].Empty() {
+			if err := a.LoadNode(uint32(n)); err != nil {
+				return err
+			}
+			t.Stats.Loaded++
+		}
+	}
+	return nil
+}
+
+func (t *Traversal) SelectedNodes() []uint32 {
+	var ret []uint32
+	for n := range t.Selected {
+		if t.Selected[n] {
+			ret = append(ret, uint32(n))
+		}
+	}
+	return ret
+}
@@ -0,0 +1,98 @@
+package lodm
+
+import (
+	"math"
+	"testing"
+
+	dvec3 "github.com/flywave/go3d/float64/vec3"
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec3"
+)
+
+func TestHorizonCulling(t *testing.T) {
+	camera := toScaledSpace(dvec3.T{WGS84_RADIUS_X + 1000, 0, 0})
+
+	positions := []dvec3.T{
+		{WGS84_RADIUS_X, 100, 100},
+		{WGS84_RADIUS_X, -100, -100},
+		{WGS84_RADIUS_X + 50, 0, 0},
+	}
+	front, ok := computeHorizonPoint(dvec3.T{WGS84_RADIUS_X, 0, 0}, positions)
+	if !ok || !isScaledSpacePointVisible(&front, &camera) {
+		t.FailNow()
+	}
+
+	for i := range positions {
+		positions[i][0] = -positions[i][0]
+	}
+	back, ok := computeHorizonPoint(dvec3.T{-WGS84_RADIUS_X, 0, 0}, positions)
+	if !ok || isScaledSpacePointVisible(&back, &camera) {
+		t.FailNow()
+	}
+
+	a := newTestArchive()
+	a.HorizonPoints = []dvec3.T{front, back, {}}
+	tr := NewTraversal(a, Camera{EyeECEF: dvec3.T{WGS84_RADIUS_X + 1000.25, 0.125, 0}}, 1, 1)
+	if !tr.isAboveHorizon(0) || tr.isAboveHorizon(1) || !tr.isAboveHorizon(2) {
+		t.FailNow()
+	}
+
+	a = newTestArchive()
+	a.Header.Matrix = mat4.Ident
+	a.Header.Matrix[3][0] = float32(WGS84_RADIUS_X)
+	a.Nodes[0].Sphere = Sphere{0, 0, 0, 10}
+	a.Nodes[1].Sphere = Sphere{-12543, 400000, 0, 10}
+	if a.BuildHorizonPoints() != nil || len(a.HorizonPoints) != 3 {
+		t.FailNow()
+	}
+	eye := dvec3.T{WGS84_RADIUS_X - 12543, 400000, 0}
+	eye.Normalize()
+	eye.Scale(WGS84_RADIUS_X + 1000)
+	tr = NewTraversal(a, Camera{EyeECEF: eye}, 1, 1)
+	if !tr.isAboveHorizon(0) || !tr.isAboveHorizon(1) {
+		t.FailNow()
+	}
+	tr = NewTraversal(a, Camera{EyeECEF: dvec3.T{-WGS84_RADIUS_X - 1000, 0, 0}}, 1, 1)
+	if tr.isAboveHorizon(0) || tr.isAboveHorizon(1) {
+		t.FailNow()
+	}
+}
+
+func TestOcclusionCulling(t *testing.T) {
+	sign := Signature{}
+	sign.Vertex.SetComponent(VERTEX_COORD, Attribute{Type: ATTR_FLOAT, Number: 3})
+	sign.Face.SetComponent(FACE_INDEX, Attribute{Type: ATTR_UNSIGNED_SHORT, Number: 3})
+
+	h := NewHeader(sign)
+	h.NNodes = 3
+	h.NPatches = 2
+
+	a := NewArchive(*h, nil)
+	a.initIndex()
+	a.Nodes[0] = Node{NVert: 4, NFace: 2, Error: 100, Sphere: Sphere{0, 0, -2, 12}, FirstPatch: 0}
+	a.Nodes[1] = Node{NVert: 4, NFace: 2, Error: 1, Sphere: Sphere{0, 0, -5, 1}, FirstPatch: 1}
+	a.Nodes[2] = Node{FirstPatch: 2}
+	a.Patchs[0] = Patch{Node: 1, FaceOffset: 2, TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID}
+	a.Patchs[1] = Patch{Node: 2, FaceOffset: 2, TexID: LM_INVALID_ID, MtlID: LM_INVALID_ID, FeatID: LM_INVALID_ID}
+	a.NodeMeshs[0] = NodeMesh{
+		Verts: []vec3.T{{-10, -10, 0}, {10, -10, 0}, {10, 10, 0}, {-10, 10, 0}},
+		Faces: [][3]uint16{{0, 1, 2}, {0, 2, 3}},
+	}
+
+	cam := Camera{Eye: vec3.T{0, 0, 10}, Center: vec3.T{0, 0, 0}, Up: vec3.T{0, 1, 0}, Fovy: math.Pi / 4, Near: 0.1, Far: 100}
+
+	tr := NewTraversal(a, cam, 256, 256)
+	tr.OcclusionCulling = true
+	if err := tr.Traverse(); err != nil {
+		t.FailNow()
+	}
+
+	if tr.Stats.Occluded != 1 || tr.Stats.Loaded != 0 || tr.Selected[1] {
+		t.FailNow()
+	}
+
+	tr.OcclusionCulling = false
+	if err := tr.Traverse(); err == nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,470 @@
+package lodm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec3"
+)
+
+const (
+	USD_ROOT       = "/Root"
+	USD_LOD_SET    = "lod"
+	USD_UV_PRIMVAR = "st"
+)
+
+type usdWriter struct {
+	buf   bytes.Buffer
+	depth int
+}
+
+func (w *usdWriter) line(format string, args ...interface{}) {
+	if format == "" {
+		w.buf.WriteByte('\n')
+		return
+	}
+	w.buf.WriteString(strings.Repeat("    ", w.depth))
+	fmt.Fprintf(&w.buf, format, args...)
+	w.buf.WriteByte('\n')
+}
+
+func (w *usdWriter) open(format string, args ...interface{}) {
+	w.line(format, args...)
+	w.line("{")
+	w.depth++
+}
+
+func (w *usdWriter) close() {
+	w.depth--
+	w.line("}")
+}
+
+func usdFloat(f float32) string {
+	return strconv.FormatFloat(float64(f), 'g', -1, 32)
+}
+
+func usdColor(c [3]byte) string {
+	return fmt.Sprintf("(%v, %v, %v)", usdFloat(float32(c[0])/255), usdFloat(float32(c[1])/255), usdFloat(float32(c[2])/255))
+}
+
+func usdMatrix(m *mat4.T) string {
+	rows := make([]string, 4)
+	for c := 0; c < 4; c++ {
+		rows[c] = fmt.Sprintf("(%v, %v, %v, %v)", usdFloat(m[c][0]), usdFloat(m[c][1]), usdFloat(m[c][2]), usdFloat(m[c][3]))
+	}
+	return "( " + strings.Join(rows, ", ") + " )"
+}
+
+func (w *usdWriter) array(typ, name string, n int, item func(i int) string, interpolation string) {
+	w.buf.WriteString(strings.Repeat("    ", w.depth))
+	fmt.Fprintf(&w.buf, "%v[] %v = [", typ, name)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			w.buf.WriteString(", ")
+		}
+		w.buf.WriteString(item(i))
+	}
+	w.buf.WriteString("]")
+	if interpolation != "" {
+		fmt.Fprintf(&w.buf, " (\n%v    interpolation = \"%v\"\n%v)", strings.Repeat("    ", w.depth), interpolation, strings.Repeat("    ", w.depth))
+	}
+	w.buf.WriteByte('\n')
+}
+
+func (w *usdWriter) transform(m *mat4.T) {
+	w.line("matrix4d xformOp:transform = %v", usdMatrix(m))
+	w.line("uniform token[] xformOpOrder = [\"xformOp:transform\"]")
+}
+
+type usdExporter struct {
+	archive   *Archive
+	files     *objExporter
+	materials map[materialKey]string
+	mtl       usdWriter
+	warnings  []string
+}
+
+func newUsdExporter(a *Archive, sink ExportSink) *usdExporter {
+	e := &usdExporter{archive: a, files: newObjExporter(a, sink), materials: make(map[materialKey]string)}
+	e.mtl.depth = 2
+	for d := 1; d < 4; d++ {
+		if a.Header.Sign.Vertex.HasData(d) {
+			e.warnings = append(e.warnings, fmt.Sprintf("dropped vertex data %v", d))
+		}
+	}
+	return e
+}
+
+func (e *usdExporter) material(mtl, tex uint32) (string, error) {
+	a := e.archive
+	if mtl != LM_INVALID_ID && int(mtl) >= len(a.Materials) {
+		mtl = LM_INVALID_ID
+	}
+	key := materialKey{MtlID: mtl, TexID: tex}
+	if path, ok := e.materials[key]; ok {
+		return path, nil
+	}
+	name := "material"
+	if mtl != LM_INVALID_ID {
+		name += fmt.Sprintf("_m%v", mtl)
+	}
+	if tex != LM_INVALID_ID {
+		name += fmt.Sprintf("_t%v", tex)
+	}
+	path := USD_ROOT + "/Materials/" + name
+
+	w := &e.mtl
+	w.open("def Material \"%v\"", name)
+	w.line("token outputs:surface.connect = <%v/Surface.outputs:surface>", path)
+	w.line("")
+	w.open("def Shader \"Surface\"")
+	w.line("uniform token info:id = \"UsdPreviewSurface\"")
+	if tex != LM_INVALID_ID {
+		w.line("color3f inputs:diffuseColor.connect = <%v/Texture.outputs:rgb>", path)
+	}
+	if mtl != LM_INVALID_ID {
+		m := &a.Materials[mtl]
+		if tex == LM_INVALID_ID {
+			w.line("color3f inputs:diffuseColor = %v", usdColor(m.Color))
+		}
+		if m.Emissive != [3]byte{} {
+			w.line("color3f inputs:emissiveColor = %v", usdColor(m.Emissive))
+		}
+		switch m.Type {
+		case MTL_PBR:
+			w.line("float inputs:metallic = %v", usdFloat(m.Metallic))
+			w.line("float inputs:roughness = %v", usdFloat(m.Roughness))
+		case MTL_PHONG:
+			w.line("int inputs:useSpecularWorkflow = 1")
+			w.line("color3f inputs:specularColor = %v", usdColor(m.Specular))
+			w.line("float inputs:roughness = %v", usdFloat(float32(math.Sqrt(2/(float64(m.Shininess)+2)))))
+		default:
+			w.line("float inputs:roughness = 1")
+		}
+		if m.Opacity > 0 && m.Opacity < 1 {
+			w.line("float inputs:opacity = %v", usdFloat(m.Opacity))
+		}
+		if m.ClearcoatThickness > 0 {
+			w.line("float inputs:clearcoat = %v", usdFloat(m.ClearcoatThickness))
+			w.line("float inputs:clearcoatRoughness = %v", usdFloat(m.ClearcoatRoughness))
+		}
+	} else if tex == LM_INVALID_ID {
+		w.line("color3f inputs:diffuseColor = (1, 1, 1)")
+	}
+	w.line("token outputs:surface")
+	w.close()
+	if tex != LM_INVALID_ID {
+		file, err := e.files.texture(tex)
+		if err != nil {
+			return "", err
+		}
+		w.line("")
+		w.open("def Shader \"PrimvarReader\"")
+		w.line("uniform token info:id = \"UsdPrimvarReader_float2\"")
+		w.line("string inputs:varname = \"%v\"", USD_UV_PRIMVAR)
+		w.line("float2 outputs:result")
+		w.close()
+		w.line("")
+		w.open("def Shader \"Texture\"")
+		w.line("uniform token info:id = \"UsdUVTexture\"")
+		w.line("asset inputs:file = @%v@", file)
+		w.line("float2 inputs:st.connect = <%v/PrimvarReader.outputs:result>", path)
+		w.line("token inputs:sourceColorSpace = \"sRGB\"")
+		w.line("token inputs:wrapS = \"repeat\"")
+		w.line("token inputs:wrapT = \"repeat\"")
+		w.line("float3 outputs:rgb")
+		w.close()
+	}
+	w.close()
+	e.materials[key] = path
+	return path, nil
+}
+
+func (e *usdExporter) writePatch(w *usdWriter, name string, mesh *NodeMesh, patch *Patch, start, end uint32) (bool, error) {
+	a := e.archive
+	remap := make(map[uint16]int)
+	var used []uint16
+	var indices []int
+	use := func(i uint16) int {
+		idx, ok := remap[i]
+		if !ok {
+			idx = len(used)
+			remap[i] = idx
+			used = append(used, i)
+		}
+		return idx
+	}
+	if mesh.HasFace() {
+		for f := start; f < end && int(f) < len(mesh.Faces); f++ {
+			for _, v := range mesh.Faces[f] {
+				indices = append(indices, use(v))
+			}
+		}
+	} else {
+		for i := start; i < end && int(i) < len(mesh.Verts); i++ {
+			use(uint16(i))
+		}
+	}
+	if len(used) == 0 {
+		return false, nil
+	}
+
+	tex := patch.TexID
+	if !mesh.HasTexcoord() {
+		tex = LM_INVALID_ID
+	}
+	path, err := e.material(patch.MtlID, tex)
+	if err != nil {
+		return false, err
+	}
+
+	min, max := mesh.Verts[used[0]], mesh.Verts[used[0]]
+	for _, i := range used {
+		min = vec3.Min(&min, &mesh.Verts[i])
+		max = vec3.Max(&max, &mesh.Verts[i])
+	}
+	if mesh.HasFace() {
+		w.open("def Mesh \"%v\" (\n%v    prepend apiSchemas = [\"MaterialBindingAPI\"]\n%v)", name, strings.Repeat("    ", w.depth), strings.Repeat("    ", w.depth))
+	} else {
+		w.open("def Points \"%v\" (\n%v    prepend apiSchemas = [\"MaterialBindingAPI\"]\n%v)", name, strings.Repeat("    ", w.depth), strings.Repeat("    ", w.depth))
+	}
+	w.line("float3[] extent = [(%v, %v, %v), (%v, %v, %v)]", usdFloat(min[0]), usdFloat(min[1]), usdFloat(min[2]), usdFloat(max[0]), usdFloat(max[1]), usdFloat(max[2]))
+	if mesh.HasFace() {
+		w.array("int", "faceVertexCounts", len(indices)/3, func(i int) string { return "3" }, "")
+		w.array("int", "faceVertexIndices", len(indices), func(i int) string { return strconv.Itoa(indices[i]) }, "")
+	}
+	w.line("rel material:binding = <%v>", path)
+	if mesh.HasNormal() {
+		normals := decodeNormals(mesh.Normals)
+		w.array("normal3f", "normals", len(used), func(i int) string {
+			n := normals[used[i]]
+			return fmt.Sprintf("(%v, %v, %v)", usdFloat(n[0]), usdFloat(n[1]), usdFloat(n[2]))
+		}, "vertex")
+	}
+	w.array("point3f", "points", len(used), func(i int) string {
+		v := mesh.Verts[used[i]]
+		return fmt.Sprintf("(%v, %v, %v)", usdFloat(v[0]), usdFloat(v[1]), usdFloat(v[2]))
+	}, "")
+	if mesh.HasColor() {
+		w.array("color3f", "primvars:displayColor", len(used), func(i int) string {
+			c := mesh.Colors[used[i]]
+			return usdColor([3]byte{c[0], c[1], c[2]})
+		}, "vertex")
+	}
+	if tex != LM_INVALID_ID {
+		w.array("texCoord2f", "primvars:"+USD_UV_PRIMVAR, len(used), func(i int) string {
+			uv := vec3.T{mesh.Texcoords[used[i]][0], mesh.Texcoords[used[i]][1], 1}
+			if int(tex) < len(a.Textures) && !a.Textures[tex].Mat.IsZero() {
+				uv = a.Textures[tex].Mat.MulVec3(&uv)
+			}
+			return fmt.Sprintf("(%v, %v)", usdFloat(uv[0]), usdFloat(uv[1]))
+		}, "vertex")
+	}
+	if mesh.HasFace() {
+		w.line("uniform token subdivisionScheme = \"none\"")
+	}
+	w.close()
+	return true, nil
+}
+
+func patchName(p uint32) string {
+	return fmt.Sprintf("patch_%v", p)
+}
+
+func (e *usdExporter) writeNode(w *usdWriter, name string, mesh *NodeMesh, first_patch, last_patch uint32, visible func(p uint32) bool) error {
+	w.open("def Xform \"%v\"", name)
+	start := uint32(0)
+	for p := first_patch; p < last_patch; p++ {
+		patch := &e.archive.Patchs[p]
+		if visible(p) {
+			if _, err := e.writePatch(w, patchName(p), mesh, patch, start, patch.FaceOffset); err != nil {
+				return err
+			}
+		}
+		start = patch.FaceOffset
+	}
+	w.close()
+	return nil
+}
+
+func (e *usdExporter) writeInstances(w *usdWriter) error {
+	a := e.archive
+	if len(a.Instances) == 0 {
+		return nil
+	}
+	used := make(map[uint32]bool)
+	w.line("")
+	w.open("class Scope \"Prototypes\"")
+	for i := range a.Instances {
+		n := a.Instances[i].Node
+		if used[n] {
+			continue
+		}
+		used[n] = true
+		if err := a.LoadInstance(n); err != nil {
+			return err
+		}
+		first_patch, last_patch := a.getInstanceNodePatchRange(n)
+		if err := e.writeNode(w, fmt.Sprintf("instance_node_%v", n), &a.InstanceMeshs[n], first_patch, last_patch, func(p uint32) bool { return true }); err != nil {
+			return err
+		}
+	}
+	w.close()
+	w.line("")
+	w.open("def Scope \"Instances\"")
+	for i := range a.Instances {
+		inst := &a.Instances[i]
+		w.open("def Xform \"%v_%v\" (\n%v    instanceable = true\n%v    prepend references = <%v/Prototypes/instance_node_%v>\n%v)", instanceName(inst.InstanceID), i, strings.Repeat("    ", w.depth), strings.Repeat("    ", w.depth), USD_ROOT, inst.Node, strings.Repeat("    ", w.depth))
+		if !inst.InstanceMat.IsZero() {
+			w.transform(&inst.InstanceMat)
+		}
+		w.close()
+	}
+	w.close()
+	return nil
+}
+
+func (e *usdExporter) writeCutRefs(w *usdWriter, selected []bool) {
+	a := e.archive
+	a.cutPatchs(selected, func(n, p uint32, start, end uint32) {
+		if start < end {
+			w.line("def \"%v_%v\" (\n%v    prepend references = <%v/Nodes/%v/%v>\n%v)", nodeName(n), patchName(p), strings.Repeat("    ", w.depth), USD_ROOT, nodeName(n), patchName(p), strings.Repeat("    ", w.depth))
+			w.line("{")
+			w.line("}")
+		}
+	})
+}
+
+func (e *usdExporter) nodeDepths() ([]int, int) {
+	a := e.archive
+	parent := a.firstParents()
+	depths := make([]int, len(parent))
+	max := 0
+	for n := range parent {
+		if parent[n] != LM_INVALID_ID {
+			depths[n] = depths[parent[n]] + 1
+		}
+		if depths[n] > max {
+			max = depths[n]
+		}
+	}
+	return depths, max
+}
+
+func (e *usdExporter) write(name string, body *usdWriter, metadata string) error {
+	a := e.archive
+	var out usdWriter
+	out.line("#usda 1.0")
+	out.line("(")
+	out.line("    defaultPrim = \"Root\"")
+	out.line("    metersPerUnit = 1")
+	out.line("    upAxis = \"Z\"")
+	out.line(")")
+	out.line("")
+	if metadata != "" {
+		out.line("def Xform \"Root\" (\n%v\n)", metadata)
+	} else {
+		out.line("def Xform \"Root\"")
+	}
+	out.line("{")
+	out.depth++
+	if m := a.Header.Matrix; !m.IsZero() && m != mat4.Ident {
+		out.transform(&m)
+		out.line("")
+	}
+	out.open("def Scope \"Materials\"")
+	out.buf.Write(e.mtl.buf.Bytes())
+	out.close()
+	out.buf.Write(body.buf.Bytes())
+	out.close()
+	return writeSinkFile(e.files.sink, name+".usda", out.buf.Bytes())
+}
+
+func (a *Archive) ExportCutUsda(sink ExportSink, name string, selected []bool) ([]string, error) {
+	if len(a.Nodes) < 2 {
+		return nil, errors.New("archive has no nodes")
+	}
+	e := newUsdExporter(a, sink)
+	body := &usdWriter{depth: 1}
+	body.line("")
+	body.open("def Scope \"Nodes\"")
+	for n := range selected {
+		if !selected[n] || uint32(n) >= a.sinkNode() {
+			continue
+		}
+		if err := a.LoadNode(uint32(n)); err != nil {
+			return nil, err
+		}
+		first_patch, last_patch := a.getNodePatchRange(uint32(n))
+		if err := e.writeNode(body, nodeName(uint32(n)), &a.NodeMeshs[n], first_patch, last_patch, func(p uint32) bool { return !selected[a.Patchs[p].Node] }); err != nil {
+			return nil, err
+		}
+	}
+	body.close()
+	if err := e.writeInstances(body); err != nil {
+		return nil, err
+	}
+	return e.warnings, e.write(name, body, "")
+}
+
+func (a *Archive) ExportNodeUsda(sink ExportSink, n uint32) ([]string, error) {
+	if n >= a.sinkNode() {
+		return nil, errors.New("node index error")
+	}
+	selected := make([]bool, len(a.Nodes))
+	selected[n] = true
+	return a.ExportCutUsda(sink, nodeName(n), selected)
+}
+
+func (a *Archive) ExportUsdaAtError(sink ExportSink, name string, maxError float32) ([]string, error) {
+	return a.ExportCutUsda(sink, name, a.SelectByError(maxError))
+}
+
+func (a *Archive) ExportUsda(sink ExportSink, name string) ([]string, error) {
+	if len(a.Nodes) < 2 {
+		return nil, errors.New("archive has no nodes")
+	}
+	e := newUsdExporter(a, sink)
+	body := &usdWriter{depth: 1}
+	body.line("")
+	body.open("class Scope \"Nodes\"")
+	for n := uint32(0); n < a.sinkNode(); n++ {
+		if err := a.LoadNode(n); err != nil {
+			return nil, err
+		}
+		first_patch, last_patch := a.getNodePatchRange(n)
+		if err := e.writeNode(body, nodeName(n), &a.NodeMeshs[n], first_patch, last_patch, func(p uint32) bool { return true }); err != nil {
+			return nil, err
+		}
+	}
+	body.close()
+
+	depths, max_depth := e.nodeDepths()
+	body.line("")
+	body.line("variantSet \"%v\" = {", USD_LOD_SET)
+	body.depth++
+	for d := 0; d <= max_depth; d++ {
+		selected := a.selectCut(func(n uint32) (bool, bool) {
+			return true, depths[n] < d
+		})
+		body.line("\"lod%v\" {", d)
+		body.depth++
+		body.open("def Scope \"Cut\"")
+		e.writeCutRefs(body, selected)
+		body.close()
+		body.depth--
+		body.line("}")
+	}
+	body.depth--
+	body.line("}")
+	if err := e.writeInstances(body); err != nil {
+		return nil, err
+	}
+	metadata := fmt.Sprintf("    variants = {\n        string %v = \"lod%v\"\n    }\n    prepend variantSets = \"%v\"", USD_LOD_SET, max_depth, USD_LOD_SET)
+	return e.warnings, e.write(name, body, metadata)
+}
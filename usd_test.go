@@ -0,0 +1,45 @@
+package lodm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flywave/go3d/mat4"
+	"github.com/flywave/go3d/vec2"
+)
+
+func TestExportUsda(t *testing.T) {
+	a := newTestTexturedArchive()
+	a.Patchs = append(a.Patchs, Patch{Node: LM_INVALID_ID, FaceOffset: 1, TexID: LM_INVALID_ID, MtlID: 0, FeatID: LM_INVALID_ID})
+	a.InstanceNodes = []Node{{NVert: 3, NFace: 1, FirstPatch: 2}, {FirstPatch: 3}}
+	a.InstanceMeshs = []NodeMesh{{Verts: testMesh.Verts[:3], Faces: testMesh.Faces[:1], Texcoords: make([]vec2.T, 3)}, {}}
+	a.Instances = []Instance{{Node: 0, InstanceID: 5, InstanceMat: mat4.T{{0, 1, 0, 0}, {-1, 0, 0, 0}, {0, 0, 1, 0}, {10, 0, 0, 1}}}, {Node: 0, InstanceID: 6}}
+
+	sink := NewMemorySink()
+	warnings, err := a.ExportUsda(sink, "scene")
+	if err != nil || len(warnings) != 0 || len(sink.Files) != 2 || sink.Files["texture_0.png"] == nil {
+		t.FailNow()
+	}
+	usda := string(sink.Files["scene.usda"])
+	if !strings.HasPrefix(usda, "#usda 1.0") || !strings.Contains(usda, `variantSet "lod" = {`) || !strings.Contains(usda, `string lod = "lod1"`) {
+		t.FailNow()
+	}
+	if !strings.Contains(usda, `"UsdPreviewSurface"`) || !strings.Contains(usda, `"UsdUVTexture"`) || !strings.Contains(usda, "@texture_0.png@") {
+		t.FailNow()
+	}
+	if strings.Count(usda, "instanceable = true") != 2 || strings.Count(usda, "xformOp:transform =") != 1 || !strings.Contains(usda, "prepend references = </Root/Prototypes/instance_node_0>") {
+		t.FailNow()
+	}
+	if !strings.Contains(usda, "prepend references = </Root/Nodes/node_0/patch_0>") || !strings.Contains(usda, "prepend references = </Root/Nodes/node_1/patch_1>") {
+		t.FailNow()
+	}
+
+	warnings, err = a.ExportNodeUsda(sink, 1)
+	if err != nil || len(warnings) != 0 {
+		t.FailNow()
+	}
+	usda = string(sink.Files["node_1.usda"])
+	if strings.Contains(usda, "variantSet") || strings.Count(usda, "def Mesh ") != 2 || !strings.Contains(usda, "texCoord2f[] primvars:st") {
+		t.FailNow()
+	}
+}
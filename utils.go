@@ -4,11 +4,7 @@ import (
 	"bytes"
 	"image/jpeg"
 	"image/png"
-	"reflect"
-	"unsafe"
-
-	"github.com/flywave/go-corto"
-	"github.com/flywave/go-draco"
+	"math"
 
 	"github.com/flywave/go3d/vec2"
 	"github.com/flywave/go3d/vec3"
@@ -91,333 +87,155 @@ const (
 )
 
 type CompressSetting struct {
-	CoordQ     float32
-	CoordBits  int
-	NormalBits int
-	ColorBits  [4]int
-	TexStep    float32
-	UvBits     int
+	CoordQ       float32
+	CoordBits    int
+	NormalBits   int
+	ColorBits    [4]int
+	TexStep      float32
+	UvBits       int
+	DeflateLevel int
 }
 
 var (
-	DEFAULE_COMPRESS_SETTING = CompressSetting{CoordQ: 0, CoordBits: 14, NormalBits: 10, ColorBits: [4]int{6, 6, 6, 5}, TexStep: 0.25, UvBits: 11}
+	DEFAULE_COMPRESS_SETTING = CompressSetting{CoordQ: 0, CoordBits: 14, NormalBits: 10, ColorBits: [4]int{6, 6, 6, 5}, TexStep: 0.25, UvBits: 11, DeflateLevel: 6}
 )
 
-func CompressNode(header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) NodeData {
-	buf := compressNodeMesh(header, node, mesh, patches, setting)
-	padding := calcPadding(uint32(len(buf)), LM_PADDING)
-	if padding == 0 {
-		return buf
+func (s *CompressSetting) coordStep(verts []vec3.T) float32 {
+	if q := float64(s.CoordQ); q != 0 && !math.IsInf(q, 0) && !math.IsNaN(q) {
+		return float32(math.Exp2(q))
 	}
-	for i := 0; i < int(padding); i++ {
-		buf = append(buf, byte(0))
+	if s.CoordBits > 0 {
+		if extent := maxExtent(vec3Floats(verts, len(verts)), 3); extent > 0 {
+			return extent / float32(math.Exp2(float64(s.CoordBits)))
+		}
 	}
-	return buf
+	return 0
 }
 
-func decompressNodeMesh(buf []byte, header Header, node *Node, mesh *NodeMesh) error {
-	sign := &header.Sign
-	if (sign.Flags & CORTO) > 0 {
-		ctx := &corto.DecoderContext{}
-		ctx.NFace = uint32(node.NFace)
-		ctx.NVert = uint32(node.NVert)
-		ctx.ColorsComponents = 4
-		ctx.Index16 = true
-		ctx.Normal16 = true
-		geom := corto.DecodeGeom(ctx, buf)
-		mesh.Verts = geom.Vertices[:]
-
-		mesh.Normals = make([][3]int16, len(geom.Normals16))
-		for i := range geom.Normals16 {
-			mesh.Normals[i] = [3]int16(geom.Normals16[i])
-		}
-		if len(geom.TexCoord) > 0 {
-			mesh.Texcoords = geom.TexCoord[:]
-		}
-		if len(geom.Indices16) > 0 {
-			mesh.Faces = make([][3]uint16, len(geom.Indices16))
-			for i := range geom.Indices16 {
-				mesh.Faces[i] = [3]uint16(geom.Indices16[i])
-			}
-		}
-		if len(geom.Colors) > 0 {
-			mesh.Colors = make([][4]byte, len(geom.Colors))
-			for i := range geom.Colors {
-				mesh.Colors[i] = [4]byte(geom.Colors[i])
-			}
-		}
-	} else {
-		if node.NFace == 0 {
-			m := draco.NewPointCloud()
-			denc := draco.NewDecoder()
-			err := denc.DecodePointCloud(m, buf)
-			if err != nil {
-				return err
-			}
-			{
-				posid := m.NamedAttributeID(draco.GAT_POSITION)
-
-				mesh.Verts = make([]vec3.T, node.NVert)
-
-				var vertsSlice []float32
-				vertsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&vertsSlice)))
-				vertsHeader.Cap = int(node.NVert * 3)
-				vertsHeader.Len = int(node.NVert * 3)
-				vertsHeader.Data = uintptr(unsafe.Pointer(&mesh.Verts[0]))
-
-				m.AttrData(m.Attr(posid), vertsSlice)
-			}
-
-			if header.Sign.Vertex.HasNormals() {
-				normid := m.NamedAttributeID(draco.GAT_NORMAL)
-
-				mesh.Normals = make([][3]int16, node.NVert)
-
-				var normsSlice []int16
-				normsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&normsSlice)))
-				normsHeader.Cap = int(node.NVert * 3)
-				normsHeader.Len = int(node.NVert * 3)
-				normsHeader.Data = uintptr(unsafe.Pointer(&mesh.Normals[0]))
-
-				m.AttrData(m.Attr(normid), normsSlice)
-			}
-
-			if header.Sign.Vertex.HasColors() {
-				colorid := m.NamedAttributeID(draco.GAT_COLOR)
-
-				mesh.Colors = make([][4]byte, node.NVert)
-
-				var colorsSlice []byte
-				colorsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&colorsSlice)))
-				colorsHeader.Cap = int(node.NVert * 4)
-				colorsHeader.Len = int(node.NVert * 4)
-				colorsHeader.Data = uintptr(unsafe.Pointer(&mesh.Colors[0]))
-
-				m.AttrData(m.Attr(colorid), colorsSlice)
-			}
-
-		} else {
-			m := draco.NewMesh()
-			d := draco.NewDecoder()
-			err := d.DecodeMesh(m, buf)
-			if err != nil {
-				return err
-			}
-			{
-				node.NFace = uint16(m.NumFaces())
-				mesh.Faces = make([][3]uint16, node.NFace)
-
-				faces := make([]uint32, node.NFace*3)
-				faces = m.Faces(faces)
-
-				for i := 0; i < int(node.NFace); i++ {
-					mesh.Faces[i] = [3]uint16{uint16(faces[i*3]), uint16(faces[i*3+1]), uint16(faces[i*3+2])}
-				}
-			}
-
-			{
-				posid := m.NamedAttributeID(draco.GAT_POSITION)
-
-				node.NVert = uint16(m.NumPoints())
-
-				mesh.Verts = make([]vec3.T, node.NVert)
-
-				var vertsSlice []float32
-				vertsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&vertsSlice)))
-				vertsHeader.Cap = int(node.NVert * 3)
-				vertsHeader.Len = int(node.NVert * 3)
-				vertsHeader.Data = uintptr(unsafe.Pointer(&mesh.Verts[0]))
-
-				m.AttrData(m.Attr(posid), vertsSlice)
-			}
-
-			if header.Sign.Vertex.HasNormals() {
-				normid := m.NamedAttributeID(draco.GAT_NORMAL)
-
-				mesh.Normals = make([][3]int16, node.NVert)
-
-				var normsSlice []int16
-				normsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&normsSlice)))
-				normsHeader.Cap = int(node.NVert * 3)
-				normsHeader.Len = int(node.NVert * 3)
-				normsHeader.Data = uintptr(unsafe.Pointer(&mesh.Normals[0]))
-
-				m.AttrData(m.Attr(normid), normsSlice)
-			}
-
-			if header.Sign.Vertex.HasColors() {
-				colorid := m.NamedAttributeID(draco.GAT_COLOR)
-
-				mesh.Colors = make([][4]byte, node.NVert)
-
-				var colorsSlice []byte
-				colorsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&colorsSlice)))
-				colorsHeader.Cap = int(node.NVert * 4)
-				colorsHeader.Len = int(node.NVert * 4)
-				colorsHeader.Data = uintptr(unsafe.Pointer(&mesh.Colors[0]))
-
-				m.AttrData(m.Attr(colorid), colorsSlice)
-			}
-
-			if header.Sign.Vertex.HasTextures() {
-				texcid := m.NamedAttributeID(draco.GAT_TEX_COORD)
-
-				mesh.Texcoords = make([]vec2.T, node.NVert)
-
-				var texsSlice []float32
-				texsHeader := (*reflect.SliceHeader)((unsafe.Pointer(&texsSlice)))
-				texsHeader.Cap = int(node.NVert * 2)
-				texsHeader.Len = int(node.NVert * 2)
-				texsHeader.Data = uintptr(unsafe.Pointer(&mesh.Texcoords[0]))
-
-				m.AttrData(m.Attr(texcid), texsSlice)
-			}
-		}
+func (s *CompressSetting) uvStep() float32 {
+	if s.UvBits > 0 {
+		return float32(math.Exp2(-float64(s.UvBits)))
 	}
-	return nil
+	if s.TexStep > 0 {
+		return s.TexStep / 512
+	}
+	return 0
 }
 
-func compressNodeMesh(header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) NodeData {
-	sig := header.Sign
-
-	if (sig.Flags & CORTO) > 0 {
-		ctx := corto.NewEncoderContext(setting.CoordQ)
-		if setting.CoordBits > 0 {
-			ctx.VertexBits = setting.CoordBits
-		}
-		ctx.NormBits = setting.NormalBits
-		ctx.UvBits = setting.TexStep / 512
-		ctx.ColorBits = setting.ColorBits
-
-		geom := &corto.Geom{}
-
-		for p := 0; p < len(patches); p++ {
-			geom.Groups = append(geom.Groups, int(patches[p].FaceOffset))
-		}
+func (s *CompressSetting) normalBits() int {
+	if s.NormalBits <= 1 || s.NormalBits > 16 {
+		return 16
+	}
+	return s.NormalBits
+}
 
-		geom.Vertices = mesh.Verts[:]
+func (s *CompressSetting) colorBits(k int) int {
+	if s.ColorBits[k] <= 0 || s.ColorBits[k] > 8 {
+		return 8
+	}
+	return s.ColorBits[k]
+}
 
-		if node.NFace != 0 {
-			geom.Indices16 = make([]corto.Face16, node.NFace)
-			for i := 0; i < int(node.NFace); i++ {
-				geom.Indices16[i] = corto.Face16{mesh.Faces[i][0], mesh.Faces[i][1], mesh.Faces[i][2]}
-			}
-		}
+func (s *CompressSetting) Quantization() Quantization {
+	q := Quantization{UvStep: s.uvStep(), NormalBits: uint8(s.normalBits())}
+	if cq := float64(s.CoordQ); cq != 0 && !math.IsInf(cq, 0) && !math.IsNaN(cq) {
+		q.CoordStep = float32(math.Exp2(cq))
+	}
+	for k := 0; k < 4; k++ {
+		q.ColorBits[k] = uint8(s.colorBits(k))
+	}
+	return q
+}
 
-		if sig.Vertex.HasNormals() {
-			geom.Normals16 = make([]corto.Normal16, node.NVert)
-			for i := 0; i < int(node.NVert); i++ {
-				geom.Normals16[i] = corto.Normal16{mesh.Normals[i][0], mesh.Normals[i][1], mesh.Normals[i][2]}
+func maxExtent(vals []float32, dims int) float32 {
+	if len(vals) < dims {
+		return 0
+	}
+	var extent float32
+	for k := 0; k < dims; k++ {
+		min, max := vals[k], vals[k]
+		for i := k; i < len(vals); i += dims {
+			if vals[i] < min {
+				min = vals[i]
 			}
-		}
-
-		if sig.Vertex.HasColors() {
-			geom.Colors = make([]corto.Color, node.NVert)
-			for i := 0; i < int(node.NVert); i++ {
-				geom.Colors[i] = corto.Color{mesh.Colors[i][0], mesh.Colors[i][1], mesh.Colors[i][2], mesh.Colors[i][3]}
+			if vals[i] > max {
+				max = vals[i]
 			}
 		}
-
-		if sig.Vertex.HasTextures() {
-			geom.TexCoord = mesh.Texcoords[:]
+		if max-min > extent {
+			extent = max - min
 		}
+	}
+	return extent
+}
 
-		buf := corto.EncodeGeom(ctx, geom)
-		return buf
-	} else if (sig.Flags & DRACO) > 0 {
-		enc := draco.NewEncoder()
-
-		if setting.CoordBits > 0 {
-			enc.SetAttributeQuantization(draco.GAT_POSITION, int32(setting.CoordBits))
-		}
-		if setting.NormalBits > 0 {
-			enc.SetAttributeQuantization(draco.GAT_NORMAL, int32(setting.NormalBits))
-		}
-		if setting.UvBits > 0 {
-			enc.SetAttributeQuantization(draco.GAT_TEX_COORD, int32(setting.UvBits))
-		}
-		if setting.ColorBits[0] > 0 {
-			enc.SetAttributeQuantization(draco.GAT_COLOR, int32(setting.ColorBits[0]))
-		}
-
-		if node.NFace == 0 {
-			builder := draco.NewPointCloudBuilder()
-			builder.Start(int(node.NVert))
-
-			builder.SetAttribute(int(node.NVert), mesh.Verts[:], draco.GAT_POSITION)
-
-			if sig.Vertex.HasNormals() {
-				builder.SetAttribute(int(node.NVert), mesh.Normals[:], draco.GAT_NORMAL)
-			}
+func quantizeNormal(n [3]int16, bits int) [3]int16 {
+	if bits >= 16 {
+		return n
+	}
+	v := vec3.T{float32(n[0]), float32(n[1]), float32(n[2])}
+	l := v.Length()
+	if l == 0 {
+		return n
+	}
+	v.Scale(float32(int32(1)<<uint(bits-1)-1) / l)
+	for k := 0; k < 3; k++ {
+		v[k] = float32(math.Round(float64(v[k])))
+	}
+	return encodeNormal(v)
+}
 
-			if sig.Vertex.HasColors() {
-				builder.SetAttribute(int(node.NVert), mesh.Colors[:], draco.GAT_COLOR)
-			}
-			pc := builder.GetPointCloud()
-			_, buf := enc.EncodePointCloud(pc)
-			return buf
-		} else {
-			builder := draco.NewMeshBuilder()
-			size := int(node.NFace)
+func encodeNormal(n vec3.T) [3]int16 {
+	if l := n.Length(); l > 0 {
+		n.Scale(math.MaxInt16 / l)
+	}
+	var ret [3]int16
+	for k := 0; k < 3; k++ {
+		ret[k] = int16(math.Max(-math.MaxInt16, math.Min(math.MaxInt16, math.Round(float64(n[k])))))
+	}
+	return ret
+}
 
-			builder.Start(size)
+func quantizeColor(c byte, bits int) byte {
+	if bits >= 8 {
+		return c
+	}
+	levels := float64(int(1)<<uint(bits) - 1)
+	return byte(math.Round(math.Round(float64(c)*levels/255) * 255 / levels))
+}
 
-			face_points := make([]vec3.T, size*3)
+func CompressNode(header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) (NodeData, error) {
+	return encodeNodeMesh(header.Sign.NodeCodec(), header, node, mesh, patches, setting)
+}
 
-			var face_normals [][3]int16
-			if sig.Vertex.HasNormals() {
-				face_normals = make([][3]int16, size*3)
-			}
-			var face_colors [][4]byte
-			if sig.Vertex.HasColors() {
-				face_colors = make([][4]byte, size*3)
-			}
-			var face_texcoords []vec2.T
-			if sig.Vertex.HasTextures() {
-				face_texcoords = make([]vec2.T, size*3)
-			}
+func encodeNodeMesh(codec NodeCodec, header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) (NodeData, error) {
+	buf, err := codec.Encode(header, node, mesh, patches, setting)
+	if err != nil {
+		return nil, err
+	}
+	return padNodeData(buf), nil
+}
 
-			for i := range mesh.Faces {
-				face_points[i*3] = mesh.Verts[int(mesh.Faces[i][0])]
-				face_points[i*3+1] = mesh.Verts[int(mesh.Faces[i][1])]
-				face_points[i*3+2] = mesh.Verts[int(mesh.Faces[i][2])]
-				if sig.Vertex.HasNormals() {
-					face_normals[i*3] = mesh.Normals[int(mesh.Faces[i][0])]
-					face_normals[i*3+1] = mesh.Normals[int(mesh.Faces[i][1])]
-					face_normals[i*3+2] = mesh.Normals[int(mesh.Faces[i][2])]
-				}
-				if sig.Vertex.HasColors() {
-					face_colors[i*3] = mesh.Colors[int(mesh.Faces[i][0])]
-					face_colors[i*3+1] = mesh.Colors[int(mesh.Faces[i][1])]
-					face_colors[i*3+2] = mesh.Colors[int(mesh.Faces[i][2])]
-				}
-				if sig.Vertex.HasTextures() {
-					face_texcoords[i*3] = mesh.Texcoords[int(mesh.Faces[i][0])]
-					face_texcoords[i*3+1] = mesh.Texcoords[int(mesh.Faces[i][1])]
-					face_texcoords[i*3+2] = mesh.Texcoords[int(mesh.Faces[i][2])]
-				}
-			}
+func padNodeData(buf NodeData) NodeData {
+	padding := calcPadding(uint32(len(buf)), LM_PADDING)
+	for i := 0; i < int(padding); i++ {
+		buf = append(buf, byte(0))
+	}
+	return buf
+}
 
-			builder.SetAttribute(size, face_points[:], draco.GAT_POSITION)
-			if sig.Vertex.HasNormals() {
-				builder.SetAttribute(size, face_normals[:], draco.GAT_NORMAL)
-			}
-			if sig.Vertex.HasColors() {
-				builder.SetAttribute(size, face_colors[:], draco.GAT_COLOR)
-			}
-			if sig.Vertex.HasTextures() {
-				builder.SetAttribute(size, face_texcoords[:], draco.GAT_TEX_COORD)
-			}
+func decompressNodeMesh(buf []byte, header Header, node *Node, mesh *NodeMesh) error {
+	return header.Sign.NodeCodec().Decode(buf, header, node, mesh)
+}
 
-			mesh := builder.GetMesh()
-			_, buf := enc.EncodeMesh(mesh)
-			return buf
-		}
-	}
-	return nil
+func compressNodeMesh(header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) (NodeData, error) {
+	return header.Sign.NodeCodec().Encode(header, node, mesh, patches, setting)
 }
 
 func compressTexture(header Header, img TextureImage) TextureData {
+	if img == nil {
+		return nil
+	}
 	sig := header.Sign
 	if (sig.Flags & PTPNG) > 0 {
 		writer := &bytes.Buffer{}
@@ -471,3 +289,166 @@ func decompressTexture(header Header, data TextureData) (TextureImage, error) {
 		return image, nil
 	}
 }
+
+func textureExt(header Header) string {
+	if (header.Sign.Flags & PTJPG) > 0 {
+		return "jpg"
+	}
+	return "png"
+}
+
+func textureMimeType(ext string) string {
+	if ext == "jpg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+func encodeTexture(header Header, img TextureImage) ([]byte, error) {
+	writer := &bytes.Buffer{}
+	if textureExt(header) == "jpg" {
+		if err := jpeg.Encode(writer, img, &jpeg.Options{Quality: LM_JPEG_QUALITY}); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := png.Encode(writer, img); err != nil {
+			return nil, err
+		}
+	}
+	return writer.Bytes(), nil
+}
+
+func pointsSphere(verts []vec3.T) Sphere {
+	if len(verts) == 0 {
+		return Sphere{}
+	}
+	min, max := verts[0], verts[0]
+	for _, v := range verts {
+		for i := 0; i < 3; i++ {
+			if v[i] < min[i] {
+				min[i] = v[i]
+			}
+			if v[i] > max[i] {
+				max[i] = v[i]
+			}
+		}
+	}
+	center := vec3.Interpolate(&min, &max, 0.5)
+	radius := float32(0)
+	for i := range verts {
+		if d := vec3.Distance(&verts[i], &center); d > radius {
+			radius = d
+		}
+	}
+	return Sphere{center[0], center[1], center[2], radius}
+}
+
+func unionSphere(a, b Sphere) Sphere {
+	if a.IsEmpty() {
+		return b
+	}
+	if b.IsEmpty() {
+		return a
+	}
+	ca, cb := a.Center(), b.Center()
+	d := vec3.Sub(&cb, &ca)
+	dist := d.Length()
+	if dist+b.Radius() <= a.Radius() {
+		return a
+	}
+	if dist+a.Radius() <= b.Radius() {
+		return b
+	}
+	radius := (dist + a.Radius() + b.Radius()) / 2
+	d.Scale((radius - a.Radius()) / dist)
+	return Sphere{ca[0] + d[0], ca[1] + d[1], ca[2] + d[2], radius}
+}
+
+func splitIndexedMesh(nverts int, faces [][3]uint32, copyVertex func(dst *NodeMesh, i uint32)) []NodeMesh {
+	var meshes []NodeMesh
+	if len(faces) == 0 {
+		for start := 0; start < nverts; start += OBJ_MAX_VERTS {
+			var mesh NodeMesh
+			for i := start; i < nverts && i < start+OBJ_MAX_VERTS; i++ {
+				copyVertex(&mesh, uint32(i))
+			}
+			meshes = append(meshes, mesh)
+		}
+		return meshes
+	}
+	var mesh NodeMesh
+	remap := make(map[uint32]uint16)
+	for _, face := range faces {
+		added := 0
+		for _, v := range face {
+			if _, ok := remap[v]; !ok {
+				added++
+			}
+		}
+		if len(mesh.Verts)+added > OBJ_MAX_VERTS {
+			meshes = append(meshes, mesh)
+			mesh = NodeMesh{}
+			remap = make(map[uint32]uint16)
+		}
+		var f [3]uint16
+		for k, v := range face {
+			idx, ok := remap[v]
+			if !ok {
+				idx = uint16(len(mesh.Verts))
+				remap[v] = idx
+				copyVertex(&mesh, v)
+			}
+			f[k] = idx
+		}
+		mesh.Faces = append(mesh.Faces, f)
+	}
+	if len(mesh.Faces) > 0 {
+		meshes = append(meshes, mesh)
+	}
+	return meshes
+}
+
+func appendNodeMesh(dst *NodeMesh, src *NodeMesh) {
+	base := uint16(len(dst.Verts))
+	n, m := len(dst.Verts), len(src.Verts)
+	normals, texcoords, colors := dst.HasNormal() || src.HasNormal(), dst.HasTexcoord() || src.HasTexcoord(), dst.HasColor() || src.HasColor()
+	if normals && !dst.HasNormal() {
+		dst.Normals = make([][3]int16, n)
+	}
+	if texcoords && !dst.HasTexcoord() {
+		dst.Texcoords = make([]vec2.T, n)
+	}
+	if colors && !dst.HasColor() {
+		dst.Colors = make([][4]byte, n)
+		for i := range dst.Colors {
+			dst.Colors[i] = [4]byte{255, 255, 255, 255}
+		}
+	}
+	dst.Verts = append(dst.Verts, src.Verts...)
+	if normals {
+		if src.HasNormal() {
+			dst.Normals = append(dst.Normals, src.Normals...)
+		} else {
+			dst.Normals = append(dst.Normals, make([][3]int16, m)...)
+		}
+	}
+	if texcoords {
+		if src.HasTexcoord() {
+			dst.Texcoords = append(dst.Texcoords, src.Texcoords...)
+		} else {
+			dst.Texcoords = append(dst.Texcoords, make([]vec2.T, m)...)
+		}
+	}
+	if colors {
+		if src.HasColor() {
+			dst.Colors = append(dst.Colors, src.Colors...)
+		} else {
+			for i := 0; i < m; i++ {
+				dst.Colors = append(dst.Colors, [4]byte{255, 255, 255, 255})
+			}
+		}
+	}
+	for _, f := range src.Faces {
+		dst.Faces = append(dst.Faces, [3]uint16{f[0] + base, f[1] + base, f[2] + base})
+	}
+}
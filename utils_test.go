@@ -1,10 +1,14 @@
 package lodm
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"math"
+	"sort"
 	"testing"
 
 	"github.com/flywave/go3d/vec2"
@@ -307,14 +311,17 @@ func TestDracoMesh(t *testing.T) {
 
 	node := &Node{NVert: uint16(len(testMesh2.Verts)), NFace: uint16(len(testMesh2.Faces))}
 
-	data := CompressNode(*h, node, &testMesh2, nil, &DEFAULE_COMPRESS_SETTING)
+	data, err := CompressNode(*h, node, &testMesh2, nil, &DEFAULE_COMPRESS_SETTING)
+	if err != nil {
+		t.FailNow()
+	}
 
 	if len(data) == 0 {
 		t.FailNow()
 	}
 
 	var mesh NodeMesh
-	err := decompressNodeMesh(data, *h, node, &mesh)
+	err = decompressNodeMesh(data, *h, node, &mesh)
 
 	if err != nil {
 		t.FailNow()
@@ -339,14 +346,17 @@ func TestCortoMesh(t *testing.T) {
 
 	node := &Node{NVert: uint16(len(testMesh2.Verts)), NFace: uint16(len(testMesh2.Faces))}
 
-	data := CompressNode(*h, node, &testMesh2, nil, &DEFAULE_COMPRESS_SETTING)
+	data, err := CompressNode(*h, node, &testMesh2, nil, &DEFAULE_COMPRESS_SETTING)
+	if err != nil {
+		t.FailNow()
+	}
 
 	if len(data) == 0 {
 		t.FailNow()
 	}
 
 	var mesh NodeMesh
-	err := decompressNodeMesh(data, *h, node, &mesh)
+	err = decompressNodeMesh(data, *h, node, &mesh)
 
 	if err != nil {
 		t.FailNow()
@@ -357,6 +367,107 @@ func TestCortoMesh(t *testing.T) {
 	}
 }
 
+type testNodeCodec struct {
+	encoded int
+	patches [][]Patch
+	err     error
+}
+
+func (c *testNodeCodec) Encode(header Header, node *Node, mesh *NodeMesh, patches []Patch, setting *CompressSetting) (NodeData, error) {
+	c.encoded++
+	c.patches = append(c.patches, patches)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return rawCodec.Encode(header, node, mesh, patches, setting)
+}
+
+func (c *testNodeCodec) Decode(buf []byte, header Header, node *Node, mesh *NodeMesh) error {
+	return rawCodec.Decode(buf, header, node, mesh)
+}
+
+func TestRegisterNodeCodec(t *testing.T) {
+	const flag FlagType = 0x40000000
+	codec := &testNodeCodec{}
+	if RegisterNodeCodec(flag, codec) != nil || RegisterNodeCodec(PTPNG, codec) == nil || RegisterNodeCodec(flag|CORTO, codec) == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() { UnregisterNodeCodec(flag) })
+	if _, ok := LookupNodeCodec(CORTO).(cortoNodeCodec); !ok || LookupNodeCodec(PTJPG) != rawCodec {
+		t.FailNow()
+	}
+
+	sign := Signature{}
+	sign.Vertex.SetComponent(VERTEX_COORD, Attribute{Type: ATTR_FLOAT, Number: 3})
+	sign.Vertex.SetComponent(VERTEX_TEX, Attribute{Type: ATTR_FLOAT, Number: 2})
+	sign.Face.SetComponent(FACE_INDEX, Attribute{Type: ATTR_UNSIGNED_SHORT, Number: 3})
+	sign.SetFlag(flag)
+	if !sign.IsCompressed() || sign.NodeCodec() != codec {
+		t.FailNow()
+	}
+
+	h := NewHeader(sign)
+	node := &Node{NVert: uint16(len(testMesh2.Verts)), NFace: uint16(len(testMesh2.Faces))}
+	data, err := CompressNode(*h, node, &testMesh2, nil, &DEFAULE_COMPRESS_SETTING)
+	if err != nil {
+		t.FailNow()
+	}
+	if codec.encoded != 1 || uint32(len(data))%LM_PADDING != 0 {
+		t.FailNow()
+	}
+	var mesh NodeMesh
+	if err := decompressNodeMesh(data, *h, node, &mesh); err != nil || len(mesh.Faces) != len(testMesh2.Faces) || mesh.Texcoords[3] != testMesh2.Texcoords[3] {
+		t.FailNow()
+	}
+
+	codec.err = errors.New("encode failed")
+	if data, err := CompressNode(*h, node, &testMesh2, nil, &DEFAULE_COMPRESS_SETTING); err == nil || data != nil {
+		t.FailNow()
+	}
+	a := newTestArchive()
+	a.Header.Sign.SetFlag(flag)
+	var file bytes.Buffer
+	offset := int64(0)
+	if a.saveNodes(&file, &offset) == nil || file.Len() != 0 {
+		t.FailNow()
+	}
+}
+
+func TestUnregisterNodeCodec(t *testing.T) {
+	const flag FlagType = 0x20000000
+	codec := &testNodeCodec{}
+	if RegisterNodeCodec(flag, codec) != nil || LookupNodeCodec(flag) != codec {
+		t.FailNow()
+	}
+	UnregisterNodeCodec(flag)
+	sign := Signature{Flags: flag}
+	if LookupNodeCodec(flag) != rawCodec || sign.IsCompressed() || isNodeCodecFlag(flag) {
+		t.FailNow()
+	}
+}
+
+func TestEncodeNodePatches(t *testing.T) {
+	const flag FlagType = 0x40000000
+	codec := &testNodeCodec{}
+	if RegisterNodeCodec(flag, codec) != nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() { UnregisterNodeCodec(flag) })
+
+	a := newTestArchive()
+	a.Header.Sign.SetFlag(flag)
+	a.SetSaveWorkers(1)
+	saveTestArchive(t, a)
+	if len(codec.patches) != 2 {
+		t.FailNow()
+	}
+	for n, patches := range codec.patches {
+		if len(patches) != 1 || patches[0].Node != uint32(n+1) {
+			t.FailNow()
+		}
+	}
+}
+
 func TestSize(t *testing.T) {
 	si := binary.Size(Patch{})
 	fmt.Printf("Patch-Size: %v", si)
@@ -371,3 +482,140 @@ func TestSize(t *testing.T) {
 	si = binary.Size(Feature{})
 	fmt.Printf("Feature-Size: %v", si)
 }
+
+func newQuantizationTestArchive(codec FlagType) *Archive {
+	sign, _ := newMeshoptTestMesh()
+	sign.Flags = codec
+	var mesh NodeMesh
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			i := y*8 + x
+			mesh.Verts = append(mesh.Verts, vec3.T{float32(x) + float32(i)*0.0137, float32(y) - float32(i)*0.0071, float32(i%5) * 0.31})
+			mesh.Normals = append(mesh.Normals, [3]int16{int16(i*431%2000 - 1000), int16(i*97%1500 - 700), 900})
+			mesh.Colors = append(mesh.Colors, [4]byte{byte(i * 37), byte(i * 101), byte(255 - i*13), byte(i * 7)})
+			mesh.Texcoords = append(mesh.Texcoords, vec2.T{float32(x)/7*0.9 + float32(i)*0.00031, float32(y)/7*0.8 - 0.2})
+			mesh.Data[1] = append(mesh.Data[1], float32(i))
+			mesh.Data[2] = append(mesh.Data[2], float32(x)*0.5, -float32(y))
+			if x < 7 && y < 7 {
+				mesh.Faces = append(mesh.Faces, [3]uint16{uint16(i), uint16(i + 1), uint16(i + 9)}, [3]uint16{uint16(i), uint16(i + 9), uint16(i + 8)})
+			}
+		}
+	}
+	a := newTestArchive()
+	a.Header.Sign = sign
+	a.Header.Sphere = pointsSphere(mesh.Verts)
+	for n := 0; n < 2; n++ {
+		a.Nodes[n].NVert, a.Nodes[n].NFace = uint16(len(mesh.Verts)), uint16(len(mesh.Faces))
+		a.Patchs[n].FaceOffset = uint32(len(mesh.Faces))
+		a.NodeMeshs[n] = mesh
+	}
+	return a
+}
+
+func TestQuantizationBounds(t *testing.T) {
+	for _, codec := range []FlagType{CORTO, DRACO, MESHOPT} {
+		for _, bits := range []int{6, 10} {
+			a := newQuantizationTestArchive(codec)
+			setting := CompressSetting{CoordQ: -7, NormalBits: bits, ColorBits: [4]int{3, 5, 6, 8}, UvBits: 9}
+			r, err := a.AnalyzeCompression(codec, &setting, 0)
+			if err != nil {
+				t.FailNow()
+			}
+			q := setting.Quantization()
+			if q.CoordStep != 1.0/128 || q.UvStep != 1.0/512 || q.NormalBits != uint8(bits) || q.ColorBits != [4]uint8{3, 5, 6, 8} {
+				t.FailNow()
+			}
+			if r.Position.Max > math.Sqrt(3)/2*float64(q.CoordStep)*1.001 || r.Texcoord.Max > math.Sqrt(2)/2*float64(q.UvStep)*1.001 {
+				t.FailNow()
+			}
+			if r.Normal.Max > math.Sqrt(3)/2/float64(int(1)<<uint(bits-1)-1)*180/math.Pi+0.05 {
+				t.FailNow()
+			}
+			if r.Color.Max > 255/float64(2*(int(1)<<3-1))+0.5 {
+				t.FailNow()
+			}
+		}
+	}
+
+	a := newQuantizationTestArchive(MESHOPT)
+	setting := DEFAULE_COMPRESS_SETTING
+	b := NewArchive(a.Header, &setting)
+	q := b.Header.Quantization
+	if math.Abs(float64(q.CoordStep-a.Header.Sphere.Radius()/(1<<14))) > 1e-9 || q.UvStep != 1.0/2048 || q.NormalBits != 10 || q.ColorBits != [4]uint8{6, 6, 6, 5} {
+		t.FailNow()
+	}
+	var buf bytes.Buffer
+	var h Header
+	if b.Header.Write(&buf) != nil || h.Read(&buf) != nil || h.Quantization != q {
+		t.FailNow()
+	}
+	if raw := NewArchive(*NewHeader(Signature{}), &setting); raw.Header.Quantization != (Quantization{}) {
+		t.FailNow()
+	}
+}
+
+func TestCortoDefaultCoordStep(t *testing.T) {
+	a := newQuantizationTestArchive(CORTO)
+	b := NewArchive(a.Header, nil)
+	step := b.Header.Quantization.CoordStep
+	if math.Abs(float64(step-a.Header.Sphere.Radius()/(1<<CoordBits))) > 1e-9 {
+		t.FailNow()
+	}
+	default_step := DEFAULE_COMPRESS_SETTING.coordStep(a.NodeMeshs[0].Verts)
+	if default_step <= 0 || default_step > 2*step {
+		t.FailNow()
+	}
+	for i, setting := range []*CompressSetting{b.setting, {}, nil} {
+		if i == 2 {
+			step = default_step
+		}
+		node := a.Nodes[0]
+		data, err := CompressNode(b.Header, &node, &a.NodeMeshs[0], a.Patchs[:1], setting)
+		if err != nil {
+			t.FailNow()
+		}
+		var mesh NodeMesh
+		if decompressNodeMesh(data, b.Header, &node, &mesh) != nil || len(mesh.Verts) != len(a.NodeMeshs[0].Verts) {
+			t.FailNow()
+		}
+		tolerance := float32(math.Sqrt(3)/2) * step * 1.001
+		if !withinTolerance(a.NodeMeshs[0].Verts, mesh.Verts, tolerance) || !withinTolerance(mesh.Verts, a.NodeMeshs[0].Verts, tolerance) {
+			t.FailNow()
+		}
+	}
+}
+
+func TestQuantizedNormalLength(t *testing.T) {
+	for _, codec := range []FlagType{CORTO, DRACO, MESHOPT} {
+		a := newQuantizationTestArchive(codec)
+		a.Header.Sign.Vertex.Attributes[int(VERTEX_DATA0)+1] = Attribute{}
+		for i, n := range a.NodeMeshs[0].Normals {
+			v := vec3.T{float32(n[0]), float32(n[1]), float32(n[2])}
+			v.Normalize()
+			a.NodeMeshs[0].Normals[i] = [3]int16{int16(math.Round(float64(v[0]) * 32767)), int16(math.Round(float64(v[1]) * 32767)), int16(math.Round(float64(v[2]) * 32767))}
+		}
+		node := a.Nodes[0]
+		data, err := CompressNode(a.Header, &node, &a.NodeMeshs[0], a.Patchs[:1], &CompressSetting{CoordQ: -7, NormalBits: 6})
+		if err != nil {
+			t.FailNow()
+		}
+		var mesh NodeMesh
+		if decompressNodeMesh(data, a.Header, &node, &mesh) != nil || len(mesh.Normals) != len(a.NodeMeshs[0].Normals) {
+			t.FailNow()
+		}
+		lengths := func(normals [][3]int16) []float64 {
+			ret := make([]float64, len(normals))
+			for i, n := range normals {
+				ret[i] = math.Sqrt(float64(n[0])*float64(n[0]) + float64(n[1])*float64(n[1]) + float64(n[2])*float64(n[2]))
+			}
+			sort.Float64s(ret)
+			return ret
+		}
+		src, dst := lengths(a.NodeMeshs[0].Normals), lengths(mesh.Normals)
+		for i := range src {
+			if math.Abs(dst[i]-src[i]) > src[i]*0.01+2 {
+				t.FailNow()
+			}
+		}
+	}
+}